@@ -0,0 +1,166 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// defaultAgeBuckets are the boundaries used by --age-histogram when
+// --age-bucket is not specified.
+var defaultAgeBuckets = []string{"1d", "7d", "30d", "1y"}
+
+// ageUnits are the suffixes, in addition to those supported by
+// time.ParseDuration, accepted by parseAge.
+var ageUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"d", 24 * time.Hour}, {"w", 7 * 24 * time.Hour}, {"y", 365 * 24 * time.Hour},
+}
+
+// parseAge parses an age specified either as a Go duration or as a number
+// of days (d), weeks (w) or years (y), eg. 36h, 7d or 1.5y.
+func parseAge(value string) (time.Duration, error) {
+	v := strings.TrimSpace(value)
+	for _, u := range ageUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(v, u.suffix), 64)
+			if err != nil || f < 0 {
+				return 0, fmt.Errorf("invalid age: %q", value)
+			}
+			return time.Duration(f * float64(u.unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %q", value)
+	}
+	return d, nil
+}
+
+// parseAgeBuckets parses the bucket boundaries for an age histogram, which
+// must be positive and strictly increasing.
+func parseAgeBuckets(values []string) ([]time.Duration, []string, error) {
+	if len(values) == 0 {
+		values = defaultAgeBuckets
+	}
+	var bounds []time.Duration
+	for _, v := range values {
+		age, err := parseAge(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		if age <= 0 || (len(bounds) > 0 && age <= bounds[len(bounds)-1]) {
+			return nil, nil, fmt.Errorf("age histogram buckets must be positive and increasing: %v", strings.Join(values, ", "))
+		}
+		bounds = append(bounds, age)
+	}
+	return bounds, values, nil
+}
+
+// ageBucket records the number and total size of files whose age is at
+// least that of the previous bucket and less than upper, upper is zero for
+// the last bucket. The labels are the boundaries as originally specified.
+type ageBucket struct {
+	upper                  time.Duration
+	lowerLabel, upperLabel string
+	files, bytes           int64
+}
+
+func (b ageBucket) label() string {
+	switch {
+	case len(b.upperLabel) == 0:
+		return ">= " + b.lowerLabel
+	case len(b.lowerLabel) == 0:
+		return "< " + b.upperLabel
+	}
+	return b.lowerLabel + " - " + b.upperLabel
+}
+
+// ageHistogram counts the files in each age bucket, where a file's age is
+// the time since it was last modified.
+type ageHistogram struct {
+	now          time.Time
+	buckets      []ageBucket
+	files, bytes int64
+}
+
+func newAgeHistogram(now time.Time, bounds []time.Duration, labels []string) *ageHistogram {
+	h := &ageHistogram{now: now, buckets: make([]ageBucket, len(bounds)+1)}
+	lower := ""
+	for i, b := range bounds {
+		h.buckets[i] = ageBucket{upper: b, lowerLabel: lower, upperLabel: labels[i]}
+		lower = labels[i]
+	}
+	h.buckets[len(bounds)] = ageBucket{lowerLabel: lower}
+	return h
+}
+
+func (h *ageHistogram) add(modTime time.Time, size int64) {
+	age := h.now.Sub(modTime)
+	i := sort.Search(len(h.buckets)-1, func(i int) bool {
+		return age < h.buckets[i].upper
+	})
+	h.buckets[i].files++
+	h.buckets[i].bytes += size
+	h.files++
+	h.bytes += size
+}
+
+func (h *ageHistogram) print(out io.Writer, root string) {
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Age histogram for %v: %v files, %v\n", root, h.files, fsize(h.bytes))
+	for _, b := range h.buckets {
+		ifmt.Fprintf(out, "%30v : %12v files (%6.2f%%) %20v (%6.2f%%)\n",
+			b.label(), b.files, percent(b.files, h.files), fsize(b.bytes), percent(b.bytes, h.bytes))
+	}
+}
+
+func (h *ageHistogram) writeTSV(out io.Writer) error {
+	wr := csv.NewWriter(out)
+	wr.Comma = '\t'
+	wr.Write([]string{"lower", "upper", "files", "files_pct", "bytes", "bytes_pct"})
+	for _, b := range h.buckets {
+		wr.Write([]string{
+			b.lowerLabel,
+			b.upperLabel,
+			strconv.FormatInt(b.files, 10),
+			strconv.FormatFloat(percent(b.files, h.files), 'f', 2, 64),
+			strconv.FormatInt(b.bytes, 10),
+			strconv.FormatFloat(percent(b.bytes, h.bytes), 'f', 2, 64),
+		})
+	}
+	wr.Flush()
+	return wr.Error()
+}
+
+// summaryAgeHistogram prints, and optionally writes as tsv, a histogram
+// of the ages of the files stored for root and its descendants.
+func summaryAgeHistogram(ctx context.Context, out io.Writer, root string, buckets []string, tsvOut string) error {
+	bounds, labels, err := parseAgeBuckets(buckets)
+	if err != nil {
+		return err
+	}
+	h := newAgeHistogram(time.Now(), bounds, labels)
+	if err := forEachFile(ctx, root, func(_ string, fi filewalk.Info) {
+		h.add(fi.ModTime, fi.Size)
+	}); err != nil {
+		return err
+	}
+	h.print(out, root)
+	return writeHistogramTSV(tsvOut, h.writeTSV)
+}
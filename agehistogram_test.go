@@ -0,0 +1,119 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	day := 24 * time.Hour
+	for i, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"0", 0},
+		{"0d", 0},
+		{"36h", 36 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"1d", day},
+		{" 7d ", 7 * day},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * day},
+		{"1y", 365 * day},
+		{"0.5y", 365 * day / 2},
+	} {
+		got, err := parseAge(tc.value)
+		if err != nil {
+			t.Errorf("%v: %q: %v", i, tc.value, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%v: %q: got %v, want %v", i, tc.value, got, tc.want)
+		}
+	}
+	for i, bad := range []string{"", "d", "-1d", "-1h", "1x", "1 d", "1D", "yesterday"} {
+		if _, err := parseAge(bad); err == nil || !strings.Contains(err.Error(), "invalid age") {
+			t.Errorf("%v: %q: missing or unexpected error: %v", i, bad, err)
+		}
+	}
+}
+
+func TestParseAgeBuckets(t *testing.T) {
+	day := 24 * time.Hour
+	for i, tc := range []struct {
+		values []string
+		bounds []time.Duration
+		labels []string
+	}{
+		{nil, []time.Duration{day, 7 * day, 30 * day, 365 * day}, defaultAgeBuckets},
+		{[]string{"1h"}, []time.Duration{time.Hour}, []string{"1h"}},
+		{[]string{"36h", "2d"}, []time.Duration{36 * time.Hour, 2 * day}, []string{"36h", "2d"}},
+	} {
+		bounds, labels, err := parseAgeBuckets(tc.values)
+		if err != nil {
+			t.Errorf("%v: %v: %v", i, tc.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(bounds, tc.bounds) || !reflect.DeepEqual(labels, tc.labels) {
+			t.Errorf("%v: got %v, %v, want %v, %v", i, bounds, labels, tc.bounds, tc.labels)
+		}
+	}
+	for i, tc := range []struct {
+		values []string
+		err    string
+	}{
+		{[]string{"x"}, "invalid age"},
+		{[]string{"1d", ""}, "invalid age"},
+		{[]string{"0d"}, "must be positive and increasing"},
+		{[]string{"7d", "1d"}, "must be positive and increasing"},
+		{[]string{"1d", "24h"}, "must be positive and increasing"},
+	} {
+		if _, _, err := parseAgeBuckets(tc.values); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: %v: missing or unexpected error: %v", i, tc.values, err)
+		}
+	}
+}
+
+func TestAgeHistogramBuckets(t *testing.T) {
+	now := time.Date(2021, 7, 4, 0, 0, 0, 0, time.UTC)
+	h := newAgeHistogram(now, []time.Duration{time.Hour, 24 * time.Hour}, []string{"1h", "1d"})
+	for _, tc := range []struct {
+		age  time.Duration
+		size int64
+	}{
+		{-time.Hour, 1}, // Modified in the future.
+		{0, 2},
+		{time.Hour - time.Nanosecond, 4},
+		{time.Hour, 8},
+		{24*time.Hour - time.Nanosecond, 16},
+		{24 * time.Hour, 32},
+		{1000 * time.Hour, 64},
+	} {
+		h.add(now.Add(-tc.age), tc.size)
+	}
+	want := []struct {
+		label        string
+		files, bytes int64
+	}{
+		{"< 1h", 3, 7},
+		{"1h - 1d", 2, 24},
+		{">= 1d", 2, 96},
+	}
+	if got, want := len(h.buckets), len(want); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, b := range h.buckets {
+		if b.label() != want[i].label || b.files != want[i].files || b.bytes != want[i].bytes {
+			t.Errorf("%v: got %v: %+v, want %+v", i, b.label(), b, want[i])
+		}
+	}
+	if got, want := []int64{h.files, h.bytes}, []int64{7, 127}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
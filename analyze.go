@@ -8,22 +8,54 @@ import (
 	"context"
 	"expvar"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/errorclass"
 	"cloudeng.io/cmd/idu/internal/exclusions"
-	"cloudeng.io/cmdutil"
+	"cloudeng.io/cmd/idu/internal/lastseen"
+	"cloudeng.io/cmd/idu/internal/otlp"
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/cmd/idu/internal/warnings"
+	"cloudeng.io/cmd/idu/internal/xattrs"
+	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/errors"
+	"cloudeng.io/file/diskusage"
 	"cloudeng.io/file/filewalk"
 	"cloudeng.io/path/cloudpath"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
 )
 
-type analyzeFlags struct {
-	Concurrency int  `subcmd:"concurrency,-1,number of threads to use for scanning"`
-	Incremental bool `subcmd:"incremental,true,incremental mode uses the existing database to avoid as much unnecssary work as possible"`
-	ScanSize    int  `subcmd:"scan-size,10000,control the number of items to fetch from the filesystem in a single operation"`
+type AnalyzeFlags struct {
+	PrefixFileFlags
+	Concurrency   int           `subcmd:"concurrency,-1,number of threads to use for scanning"`
+	Incremental   bool          `subcmd:"incremental,true,incremental mode uses the existing database to avoid as much unnecssary work as possible"`
+	ScanSize      int           `subcmd:"scan-size,10000,control the number of items to fetch from the filesystem in a single operation"`
+	Ramp          time.Duration `subcmd:"ramp,0s,'gradually increase the number of concurrent filesystem operations from one to --concurrency over the specified period at the start of the scan to avoid overwhelming cold caches, zero disables the ramp'"`
+	RampShape     string        `subcmd:"ramp-shape,linear,'the shape of the --ramp, linear or exponential, the latter increases concurrency slowly at first'"`
+	FilesOnly     bool          `subcmd:"files-only,false,'only record prefixes that contain files and omit their children, this disables incremental mode'"`
+	StatOnly      bool          `subcmd:"stat-only,false,'re-stat the files already stored in the database to update their sizes and modification times without listing any prefixes, new and deleted files will not be detected'"`
+	Symlinks      bool          `subcmd:"count-symlink-targets,false,'count symlinks to files outside of the tree being analyzed by the size of their targets rather than their own size, each target is counted for at most one symlink'"`
+	Exclusions    bool          `subcmd:"exclusion-hits,false,'display the number of paths matched by each configured exclusion once the scan is complete, exclusions with no matches may be obsolete or mistyped'"`
+	Emit          bool          `subcmd:"emit,false,'write a JSON object, with the prefix, its size, storage used and number of files and children, to stdout for every prefix as it is analyzed; progress updates are written to stderr instead'"`
+	WarnDepth     int           `subcmd:"warn-depth,64,'record a warning for prefixes nested more than this many levels below the prefix being analyzed, zero disables the warning'"`
+	WarnEntries   int           `subcmd:"warn-entries,100000,'record a warning for prefixes that contain more than this many files and children, zero disables the warning'"`
+	SkipPseudo    bool          `subcmd:"skip-pseudo-filesystems,false,'skip filesystems mounted beneath the prefix being analyzed whose type, as determined from /proc/self/mountinfo, is one of the pseudo_filesystems in the config file, eg. tmpfs, overlay, proc, sysfs or devpts; only supported on linux'"`
+	Trace         string        `subcmd:"trace,,'write a JSON Lines trace of every prefix entered, stat and listing performed, with their durations, and prefix exited to the specified file, for offline analysis of the scan'"`
+	MaxErrors     int           `subcmd:"max-errors,0,'abort the scan, recording the partial results obtained so far, once this many errors have been encountered, zero allows any number of errors'"`
+	DetectChanges bool          `subcmd:"detect-changes,false,'re-stat every file once its prefix has been listed and record a warning for any whose size or modification time changed, or that was removed, in the meantime; the new size and modification time are stored'"`
+	OnlyExt       flags.Commas  `subcmd:"only-ext,,'comma separated list of file extensions, eg. vmdk,qcow2, matched without regard to case; only files with one of these extensions are recorded, all others are ignored entirely so that totals reflect only those types, this disables incremental mode'"`
+	OneFS         bool          `subcmd:"one-file-system,false,'do not descend into directories on filesystems other than the one containing the prefix being analyzed, eg. network mounts, the directories skipped are noted in the run log; this may also be enabled for a layout in the config file'"`
+	MaxDepth      int           `subcmd:"max-depth,0,'do not record prefixes more than this many levels below the prefix being analyzed, the usage of those deeper prefixes is included in that of their ancestor at the limit, zero means no limit'"`
+	ExcludeFrom   string        `subcmd:"exclude-from,,'read gitignore style patterns, one per line, from the specified file and exclude the paths they match, relative to the prefix being analyzed, in addition to the exclusions in the config file and any .iduignore files; blank lines and lines starting with # are ignored'"`
+	Resume        bool          `subcmd:"resume,false,'resume an interrupted analyze run of the same prefix by skipping the prefixes that it had already scanned, as recorded in the database'"`
+	Note          string        `subcmd:"note,,'a free-form note to record with this run in the run log, eg. after storage migration'"`
 }
 
 // TODO(cnicolaou): determine a means of adding S3, GCP scanners etc without
@@ -32,11 +64,32 @@ type analyzeFlags struct {
 // same database (eg. go run cloudeng.io/aws/filewalk ...).
 
 type scanState struct {
-	fs          filewalk.Filesystem
-	exclusions  *exclusions.T
-	pt          *progressTracker
-	incremental bool
-	errorMap    map[string]struct{}
+	fs            filewalk.Filesystem
+	exclusions    *exclusions.T
+	devices       *deviceFilter
+	ignores       *exclusions.Ignores
+	symlinks      *symlinkTargets
+	emitter       *emitter
+	lastSeen      *lastseen.DB
+	xattrs        *xattrs.DB
+	warnings      *warnings.Log
+	tracer        *tracer
+	root          string
+	warnDepth     int
+	maxDepth      int
+	concurrency   int
+	warnEntries   int
+	maxErrors     int
+	detectChanges bool
+	onlyExt       extensionFilter
+	abort         func()
+	aborted       int32
+	pt            *progressTracker
+	incremental   bool
+	filesOnly     bool
+	errorMap      map[string]struct{}
+	changed       map[string]bool
+	resumeSince   time.Time
 }
 
 var activeMap = expvar.NewMap("cloudeng.io/idu.analyze-contents")
@@ -49,15 +102,18 @@ func (s stringer) String() string {
 }
 
 func timestampedError(err string) string {
-	ts := time.Now().Format(time.StampMilli)
+	ts := displayTime(time.Now()).Format(time.StampMilli)
 	return fmt.Sprintf("%v: %v", ts, err)
 }
 
 func formatVarUpdate(status string, nFiles, nChildren int) stringer {
-	return stringer(fmt.Sprintf("%v: %v: %v/%v", time.Now().Format(time.Stamp), status, nFiles, nChildren))
+	return stringer(fmt.Sprintf("%v: %v: %v/%v", displayTime(time.Now()).Format(time.Stamp), status, nFiles, nChildren))
 }
 
 func (sc *scanState) fileFn(ctx context.Context, prefix string, info *filewalk.Info, ch <-chan filewalk.Contents) ([]filewalk.Info, error) {
+	if err := globalPauser.wait(ctx); err != nil {
+		return nil, err
+	}
 	activeMap.Set(prefix, formatVarUpdate("start", 0, 0))
 	defer activeMap.Delete(prefix)
 	sc.pt.send(ctx, progressUpdate{prefixStart: 1})
@@ -68,9 +124,11 @@ func (sc *scanState) fileFn(ctx context.Context, prefix string, info *filewalk.I
 		Mode:    info.Mode,
 		Size:    info.Size,
 	}
+	defer sc.tracer.exit(prefix, time.Now(), &pi)
 	layout := globalConfig.LayoutFor(prefix)
 	debug(ctx, 1, "prefix: %v\n", prefix)
 	nerrors := 0
+	var listErr error
 	for results := range ch {
 		select {
 		case <-ctx.Done():
@@ -79,26 +137,60 @@ func (sc *scanState) fileFn(ctx context.Context, prefix string, info *filewalk.I
 		}
 		activeMap.Set(prefix, formatVarUpdate("results", len(results.Files), len(results.Children)))
 		if err := results.Err; err != nil {
-			if sc.fs.IsPermissionError(err) {
-				debug(ctx, 1, "permission denied: %v\n", prefix)
-			} else {
-				debug(ctx, 1, "error: %v: %v\n", prefix, err)
-			}
-			pi.Err = timestampedError(err.Error())
-			nerrors++
+			listErr = err
 			break
 		}
 		debug(ctx, 2, "prefix: %v # files: %v # children: %v\n", prefix, len(results.Files), len(results.Children))
-		for _, file := range results.Files {
-			debug(ctx, 3, "prefix/file: %v/%v\n", prefix, file.Name)
-			pi.DiskUsage += layout.Calculator.Calculate(file.Size)
-			pi.Files = append(pi.Files, file)
-		}
+		sc.addFiles(ctx, layout, prefix, &pi, results.Files)
 		pi.Children = append(pi.Children, results.Children...)
 		activeMap.Set(prefix, formatVarUpdate("listing", len(pi.Files), len(pi.Children)))
 	}
+	if listErr != nil {
+		category, action := globalConfig.ErrorActions.For(listErr)
+		if action == errorclass.Retry {
+			listErr = sc.retryListing(ctx, layout, prefix, &pi, listErr)
+		}
+		switch {
+		case listErr == nil:
+		case action == errorclass.Ignore:
+			debug(ctx, 1, "ignoring %v error: %v: %v\n", category, prefix, listErr)
+		default:
+			if sc.fs.IsPermissionError(listErr) {
+				debug(ctx, 1, "permission denied: %v\n", prefix)
+				sc.warn(ctx, prefix, warnings.Permission, "%v", listErr)
+			} else {
+				debug(ctx, 1, "error: %v: %v: %v\n", prefix, category, listErr)
+			}
+			pi.Err = timestampedError(fmt.Sprintf("%v: %v", category, listErr))
+			nerrors++
+		}
+	}
+	if sc.detectChanges && len(pi.Files) > 0 {
+		sc.restatFiles(ctx, layout, prefix, &pi)
+	}
+	if n := len(pi.Files) + len(pi.Children); sc.warnEntries > 0 && n > sc.warnEntries {
+		sc.warn(ctx, prefix, warnings.LargeDirectory, "%v files and %v children", len(pi.Files), len(pi.Children))
+	}
+	pi.DiskUsage += sc.xattrUsage(ctx, layout, prefix, pi.Files)
+	atLimit := sc.atMaxDepth(prefix)
+	if atLimit {
+		usage, listed := sc.subtreeUsage(ctx, prefix, pi.Children)
+		debug(ctx, 2, "max depth: %v: %v prefixes totaled\n", prefix, listed)
+		pi.DiskUsage += usage
+	}
 	activeMap.Set(prefix, formatVarUpdate("processing", len(pi.Files), len(pi.Children)))
-	_, deleted, err := handleDeletedChildren(ctx, layout, prefix, pi.Children)
+	if sc.filesOnly {
+		children, err := sc.filesOnlyUpdate(ctx, prefix, &pi, nerrors)
+		if atLimit {
+			return nil, err
+		}
+		return children, err
+	}
+	existing, err := existingPrefixInfo(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	remaining, deleted, err := handleDeletedChildren(ctx, layout, prefix, existing, pi.Children)
 	if err != nil {
 		debug(ctx, 1, "deletion error: %v: %v\n", prefix, err)
 		pi.Err = timestampedError(fmt.Sprintf("deletion: %v", err))
@@ -106,14 +198,142 @@ func (sc *scanState) fileFn(ctx context.Context, prefix string, info *filewalk.I
 		// they can be deleted in a subsequent invocation.
 		pi.Children = pi.Children[deleted+1:]
 	}
+	if atLimit {
+		if err := deleteDescendants(ctx, layout.Separator, prefix, remaining); err != nil {
+			debug(ctx, 1, "deletion error: %v: %v\n", prefix, err)
+		}
+	}
+	deletedFiles, err := removeStaleStats(ctx, layout, prefix, existing, &pi)
+	if err != nil {
+		return nil, err
+	}
 	// only update the database
 	if err := globalDatabaseManager.Set(ctx, prefix, &pi); err != nil {
 		return nil, err
 	}
-	sc.pt.send(ctx, progressUpdate{prefixDone: 1, deletions: deleted, errors: nerrors, files: len(pi.Files)})
+	sc.emitter.emit(prefix, &pi)
+	sc.markSeen(ctx, prefix, true)
+	sc.pt.send(ctx, progressUpdate{prefixDone: 1, deletions: deleted, fileDeletions: deletedFiles, errors: nerrors, files: len(pi.Files)})
+	if atLimit {
+		return nil, nil
+	}
 	return pi.Children, nil
 }
 
+// restatFiles re-stats the files listed for prefix to detect those that
+// changed, or were removed, since they were listed, which can happen when
+// scanning a live filesystem. Such files are recorded as warnings and their
+// new sizes and modification times are used.
+func (sc *scanState) restatFiles(ctx context.Context, layout config.Layout, prefix string, pi *filewalk.PrefixInfo) {
+	files := pi.Files[:0]
+	changed := 0
+	for _, file := range pi.Files {
+		// Symlinks may have been attributed the size of their targets.
+		if file.Mode&filewalk.ModeLink != 0 {
+			files = append(files, file)
+			continue
+		}
+		info, err := sc.fs.Stat(ctx, sc.fs.Join(prefix, file.Name))
+		if err != nil {
+			if sc.fs.IsNotExist(err) {
+				changed++
+				sc.warn(ctx, prefix, warnings.ChangedDuringScan, "%v: removed", file.Name)
+				pi.DiskUsage -= calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
+				continue
+			}
+			debug(ctx, 1, "stat error: %v/%v: %v\n", prefix, file.Name, err)
+			files = append(files, file)
+			continue
+		}
+		if diffs := fileDifferences(file, info); len(diffs) > 0 {
+			changed++
+			sc.warn(ctx, prefix, warnings.ChangedDuringScan, "%v: %v", file.Name, strings.Join(diffs, ", "))
+			calc := calculatorFor(layout, prefix, file.Name)
+			pi.DiskUsage += calc.Calculate(info.Size) - calc.Calculate(file.Size)
+			info.Name = file.Name
+			file = info
+		}
+		files = append(files, file)
+	}
+	pi.Files = files
+	if changed > 0 {
+		sc.pt.send(ctx, progressUpdate{changed: changed})
+	}
+}
+
+// listingRetries and listingRetryDelay control retries for errors whose
+// category is configured to be retried.
+const (
+	listingRetries    = 3
+	listingRetryDelay = time.Second
+)
+
+// retryListing re-lists prefix, replacing the contents of pi with the
+// new listing if it succeeds. It returns the last error encountered,
+// or nil if a listing succeeded.
+func (sc *scanState) retryListing(ctx context.Context, layout config.Layout, prefix string, pi *filewalk.PrefixInfo, err error) error {
+	for i := 0; i < listingRetries; i++ {
+		debug(ctx, 1, "retrying (%v/%v): %v: %v\n", i+1, listingRetries, prefix, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(listingRetryDelay * time.Duration(i+1)):
+		}
+		var files, children []filewalk.Info
+		files, children, err = listPrefix(ctx, sc.fs, prefix)
+		if err != nil {
+			continue
+		}
+		pi.Files, pi.Children, pi.DiskUsage = nil, children, 0
+		sc.addFiles(ctx, layout, prefix, pi, files)
+		return nil
+	}
+	return err
+}
+
+// addFiles adds those of files that are not excluded by --only-ext or by
+// an ignore file to pi, along with their disk usage.
+func (sc *scanState) addFiles(ctx context.Context, layout config.Layout, prefix string, pi *filewalk.PrefixInfo, files []filewalk.Info) {
+	for _, file := range files {
+		if !sc.onlyExt.include(file.Name) {
+			continue
+		}
+		if sc.ignores.Exclude(strings.TrimSuffix(prefix, layout.Separator)+layout.Separator+file.Name, false) {
+			debug(ctx, 2, "ignore: %v/%v\n", prefix, file.Name)
+			continue
+		}
+		debug(ctx, 3, "prefix/file: %v/%v\n", prefix, file.Name)
+		file = sc.symlinks.attribute(ctx, prefix, file)
+		pi.DiskUsage += calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
+		pi.Files = append(pi.Files, file)
+	}
+}
+
+// filesOnlyUpdate records only those prefixes that contain files, or
+// errors, and does so without recording their children.
+func (sc *scanState) filesOnlyUpdate(ctx context.Context, prefix string, pi *filewalk.PrefixInfo, nerrors int) ([]filewalk.Info, error) {
+	sc.emitter.emit(prefix, pi)
+	children := pi.Children
+	pi.Children = nil
+	if len(pi.Files) > 0 || len(pi.Err) > 0 {
+		if err := globalDatabaseManager.Set(ctx, prefix, pi); err != nil {
+			return nil, err
+		}
+	}
+	sc.pt.send(ctx, progressUpdate{prefixDone: 1, errors: nerrors, files: len(pi.Files)})
+	return children, nil
+}
+
+// calculatorFor returns the calculator to use for the named file within
+// prefix, taking care to avoid creating the file's path unless the layout
+// has overrides.
+func calculatorFor(layout config.Layout, prefix, name string) diskusage.Calculator {
+	if len(layout.Overrides) == 0 {
+		return layout.Calculator
+	}
+	return layout.CalculatorFor(strings.TrimSuffix(prefix, layout.Separator) + layout.Separator + name)
+}
+
 func findMissing(prefix string, previous, current []filewalk.Info) (remaining []filewalk.Info, deleted []string) {
 	cm := make(map[string]struct{}, len(previous))
 	for _, cur := range current {
@@ -129,12 +349,45 @@ func findMissing(prefix string, previous, current []filewalk.Info) (remaining []
 	return
 }
 
-func handleDeletedChildren(ctx context.Context, layout config.Layout, prefix string, children []filewalk.Info) ([]filewalk.Info, int, error) {
+// existingPrefixInfo returns the PrefixInfo currently stored for prefix,
+// or nil if there is none.
+func existingPrefixInfo(ctx context.Context, prefix string) (*filewalk.PrefixInfo, error) {
 	var existing filewalk.PrefixInfo
 	ok, err := globalDatabaseManager.Get(ctx, prefix, &existing)
 	if !ok || err != nil {
-		return nil, 0, err
+		return nil, err
 	}
+	return &existing, nil
+}
+
+// removeStaleStats removes the existing database entry for prefix if
+// storing current would leave stale statistics behind, since the database
+// only updates the statistics for non-zero values and for the current
+// user and group. It returns the number of files that have been deleted
+// since existing was stored.
+func removeStaleStats(ctx context.Context, layout config.Layout, prefix string, existing, current *filewalk.PrefixInfo) (int, error) {
+	if existing == nil {
+		return 0, nil
+	}
+	_, deletedFiles := findMissing("", existing.Files, current.Files)
+	if (existing.DiskUsage > 0 && current.DiskUsage == 0) ||
+		(len(existing.Files) > 0 && len(current.Files) == 0) ||
+		(len(existing.Children) > 0 && len(current.Children) == 0) ||
+		existing.UserID != current.UserID ||
+		existing.GroupID != current.GroupID {
+		debug(ctx, 2, "removing stale statistics for: %v\n", prefix)
+		if err := globalDatabaseManager.DeletePrefix(ctx, layout.Separator, prefix); err != nil {
+			return len(deletedFiles), err
+		}
+	}
+	return len(deletedFiles), nil
+}
+
+func handleDeletedChildren(ctx context.Context, layout config.Layout, prefix string, existing *filewalk.PrefixInfo, children []filewalk.Info) ([]filewalk.Info, int, error) {
+	if existing == nil {
+		return nil, 0, nil
+	}
+	var err error
 	if !strings.HasSuffix(prefix, layout.Separator) {
 		prefix += layout.Separator
 	}
@@ -152,22 +405,145 @@ func handleDeletedChildren(ctx context.Context, layout config.Layout, prefix str
 	return remaining, deleted, err
 }
 
+// addExcludeFrom adds the gitignore style patterns in filename as applying
+// to prefix. They are added before prefix's own ignore file, if any, is
+// read so that the latter takes precedence.
+func addExcludeFrom(ignores *exclusions.Ignores, prefix, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("--exclude-from: %v", err)
+	}
+	defer f.Close()
+	if err := ignores.Add(prefix, f); err != nil {
+		return fmt.Errorf("--exclude-from: %v: %v", filename, err)
+	}
+	return nil
+}
+
+// readIgnoreFile reads the ignore file, if any, in prefix. It is read
+// here, rather than when the contents of prefix are listed, so that it is
+// read for unchanged prefixes in incremental mode.
+func (sc *scanState) readIgnoreFile(ctx context.Context, prefix string) {
+	readIgnoreFile(ctx, sc.fs, sc.ignores, prefix)
+}
+
+// readIgnoreFile adds the patterns in the ignore file, if any, in prefix
+// to ignores.
+func readIgnoreFile(ctx context.Context, fs filewalk.Filesystem, ignores *exclusions.Ignores, prefix string) {
+	filename := fs.Join(prefix, exclusions.IgnoreFilename)
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debug(ctx, 1, "failed to open %v: %v\n", filename, err)
+		}
+		return
+	}
+	defer f.Close()
+	if err := ignores.Add(prefix, f); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring %v: %v\n", filename, err)
+	}
+}
+
+// warn records a warning for prefix, if warnings are being recorded.
+func (sc *scanState) warn(ctx context.Context, prefix, category, format string, args ...interface{}) {
+	sc.pt.send(ctx, progressUpdate{warnings: 1})
+	if sc.warnings == nil {
+		return
+	}
+	err := sc.warnings.Write(warnings.Warning{
+		Time:     time.Now(),
+		Prefix:   prefix,
+		Category: category,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if err != nil {
+		debug(ctx, 1, "failed to record warning: %v: %v\n", prefix, err)
+	}
+}
+
+// depth returns the number of levels that prefix is below the prefix
+// being analyzed.
+func (sc *scanState) depth(prefix string) int {
+	sep := globalConfig.LayoutFor(prefix).Separator
+	rel := strings.TrimPrefix(strings.TrimPrefix(prefix, sc.root), sep)
+	if len(rel) == 0 {
+		return 0
+	}
+	return strings.Count(rel, sep) + 1
+}
+
+// markSeen records that prefix was seen, and if scanned is true, that its
+// contents were listed by this run. Failures are not fatal since prefixes
+// with no record are never considered stale.
+func (sc *scanState) markSeen(ctx context.Context, prefix string, scanned bool) {
+	if sc.lastSeen == nil {
+		return
+	}
+	var err error
+	if scanned {
+		err = sc.lastSeen.Scanned(prefix, time.Now())
+	} else {
+		err = sc.lastSeen.Seen(prefix, time.Now())
+	}
+	if err != nil {
+		debug(ctx, 1, "failed to record last seen time: %v: %v\n", prefix, err)
+	}
+}
+
 func (sc *scanState) prefixFn(ctx context.Context, prefix string, info *filewalk.Info, err error) (bool, []filewalk.Info, error) {
-	prefixMap.Set(prefix, stringer(time.Now().Format(time.StampMilli)))
+	if err := globalPauser.wait(ctx); err != nil {
+		return true, nil, err
+	}
+	if sc.pt.tooManyErrors(sc.maxErrors) {
+		if atomic.CompareAndSwapInt32(&sc.aborted, 0, 1) {
+			sc.abort()
+		}
+		return true, nil, nil
+	}
+	prefixMap.Set(prefix, stringer(displayTime(time.Now()).Format(time.StampMilli)))
 	defer prefixMap.Delete(prefix)
 	if err != nil {
 		if sc.fs.IsPermissionError(err) {
 			debug(ctx, 1, "permission denied: %v\n", prefix)
+			sc.tracer.enter(prefix, "permission-denied", err)
+			sc.warn(ctx, prefix, warnings.Permission, "%v", err)
+			sc.markSeen(ctx, prefix, false)
 			return true, nil, nil
 		}
 		debug(ctx, 1, "error: %v\n", prefix)
+		sc.tracer.enter(prefix, "error", err)
 		return true, nil, err
 	}
 	if sc.exclusions.Exclude(prefix) {
 		debug(ctx, 1, "exclude: %v\n", prefix)
+		sc.tracer.enter(prefix, "excluded", nil)
+		return true, nil, nil
+	}
+	if sc.ignores.Exclude(prefix, true) {
+		debug(ctx, 1, "ignore: %v\n", prefix)
+		sc.tracer.enter(prefix, "ignored", nil)
 		return true, nil, nil
 	}
-	if !sc.incremental {
+	if sc.devices.skip(prefix, info) {
+		debug(ctx, 1, "other filesystem: %v\n", prefix)
+		sc.tracer.enter(prefix, "other-filesystem", nil)
+		return true, nil, nil
+	}
+	sc.readIgnoreFile(ctx, prefix)
+	sc.markSeen(ctx, prefix, false)
+	if depth := sc.depth(prefix); sc.warnDepth > 0 && depth > sc.warnDepth {
+		sc.warn(ctx, prefix, warnings.DeepNesting, "nested %v levels below %v", depth, sc.root)
+	}
+	if children, ok := sc.resumedChildren(ctx, prefix); ok {
+		sc.pt.send(ctx, progressUpdate{reused: len(children)})
+		debug(ctx, 2, "resumed: %v: #children: %v\n", prefix, len(children))
+		sc.tracer.enter(prefix, "resumed", nil)
+		return len(children) == 0, children, nil
+	}
+	// Prefixes at the --max-depth limit are always listed since changes
+	// beneath them would otherwise go unnoticed.
+	if !sc.incremental || sc.atMaxDepth(prefix) {
+		sc.tracer.enter(prefix, "list", nil)
 		return false, nil, nil
 	}
 
@@ -184,28 +560,107 @@ func (sc *scanState) prefixFn(ctx context.Context, prefix string, info *filewalk
 	if hasError {
 		debug(ctx, 2, "previous error existed for %v", prefix)
 	}
+	if sc.changed[prefix] {
+		debug(ctx, 2, "changed: %v\n", prefix)
+		unchanged = false
+	}
+	if unchanged && sc.rescanDue(ctx, prefix) {
+		debug(ctx, 2, "rescan due: %v\n", prefix)
+		unchanged = false
+	}
 	if unchanged && !hasError {
 		sc.pt.send(ctx, progressUpdate{reused: len(existing.Children)})
 		debug(ctx, 2, "unchanged: %v: #children: %v\n", prefix, len(existing.Children))
+		sc.tracer.enter(prefix, "unchanged", nil)
 		// safe to skip unchanged leaf directories.
 		return len(existing.Children) == 0, existing.Children, nil
 	}
+	sc.tracer.enter(prefix, "list", nil)
 	return false, nil, nil
 }
 
 func analyze(ctx context.Context, values interface{}, args []string) error {
-	flagValues := values.(*analyzeFlags)
+	flagValues := values.(*AnalyzeFlags)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	exclusions := exclusions.New(globalConfig.Exclusions)
-	prefix := args[0]
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	notifyInterrupts(cancel)
+	handlePauseSignals(ctx)
+	return analyzePrefix(ctx, flagValues, args[0], nil)
+}
+
+// analyzePrefix analyzes prefix. In incremental mode, the prefixes in
+// changed, if any, are re-listed even if their modification times are
+// unchanged, eg. because watch has been notified that files within them
+// have been modified.
+func analyzePrefix(ctx context.Context, flagValues *AnalyzeFlags, prefix string, changed map[string]bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := flags.OneOf(flagValues.RampShape).Validate("linear", "exponential"); err != nil {
+		return err
+	}
+	if flagValues.Resume && flagValues.FilesOnly {
+		return fmt.Errorf("--resume cannot be used with --files-only")
+	}
+	if flagValues.MaxDepth < 0 {
+		return fmt.Errorf("--max-depth must not be negative: %v", flagValues.MaxDepth)
+	}
+	ctx, span := globalTelemetry.Start(ctx, "analyze", otlp.String("prefix", prefix))
+	defer span.End()
+	ignores := exclusions.NewIgnores(globalConfig.LayoutFor(prefix).Separator)
+	if len(flagValues.ExcludeFrom) > 0 {
+		if err := addExcludeFrom(ignores, prefix, flagValues.ExcludeFrom); err != nil {
+			return err
+		}
+	}
 	if !cloudpath.IsLocal(prefix) {
 		return fmt.Errorf("currently only local filesystems are supported: %v", prefix)
 	}
-	cmdutil.HandleSignals(cancel, os.Interrupt, os.Kill)
+	excluded := append(globalConfig.InternalExclusions(), globalConfig.Exclusions...)
+	if flagValues.SkipPseudo {
+		excluded = append(excluded, pseudoFilesystemExclusions(ctx, os.Stderr, prefix)...)
+	}
+	exclusions := exclusions.New(excluded)
 	fs := filewalk.LocalFilesystem(flagValues.ScanSize)
-	pt := newProgressTracker(ctx, time.Second)
+	// Progress and other output is written to stderr when stdout is being
+	// used for --emit.
+	var out io.Writer = os.Stdout
+	if flagValues.Emit {
+		out = os.Stderr
+	}
+	pt := newProgressTracker(ctx, out, time.Second)
+	atomic.StoreInt64(&pt.estimatedPrefixes, previousRunPrefixes(prefix))
 	defer pt.summary()
+	start := time.Now()
+
+	if flagValues.StatOnly {
+		if flagValues.FilesOnly {
+			return fmt.Errorf("--stat-only and --files-only cannot be used together")
+		}
+		if flagValues.Symlinks || flagValues.Emit || len(flagValues.Trace) > 0 || len(flagValues.OnlyExt.Values) > 0 || len(flagValues.ExcludeFrom) > 0 || flagValues.MaxDepth > 0 || flagValues.OneFS || flagValues.Resume {
+			return fmt.Errorf("--stat-only cannot be used with --count-symlink-targets, --emit, --trace, --only-ext, --exclude-from, --max-depth, --one-file-system or --resume")
+		}
+		fmt.Fprintf(os.Stderr, "warning: --stat-only will not detect new or deleted files or prefixes\n")
+		errs := errors.M{}
+		_, scanSpan := globalTelemetry.Start(ctx, "scan", otlp.String("prefix", prefix), otlp.String("mode", "stat-only"))
+		errs.Append(statOnly(ctx, fs, pt, exclusions, prefix, flagValues.MaxErrors))
+		pt.endSpan(scanSpan, errs.Err())
+		_, flushSpan := globalTelemetry.Start(ctx, "database-flush", otlp.String("prefix", prefix))
+		errs.Append(globalDatabaseManager.CloseAll(ctx))
+		flushSpan.SetError(errs.Err())
+		flushSpan.End()
+		_, logSpan := globalTelemetry.Start(ctx, "log-and-close", otlp.String("prefix", prefix))
+		hits := exclusionHits(exclusions)
+		printExclusionHits(out, flagValues.Exclusions, hits)
+		errs.Append(recordRun(prefix, flagValues.Note, start, pt, hits, nil, nil, ctx.Err() != nil, errs.Err()))
+		logSpan.SetError(errs.Err())
+		logSpan.End()
+		span.SetError(errs.Err())
+		return errs.Err()
+	}
 
 	errs := errors.M{}
 	errorMap, err := deleteErrors(ctx, prefix)
@@ -213,19 +668,367 @@ func analyze(ctx context.Context, values interface{}, args []string) error {
 		return err
 	}
 	sc := scanState{
-		exclusions:  exclusions,
-		fs:          fs,
-		pt:          pt,
-		incremental: flagValues.Incremental,
-		errorMap:    errorMap,
-	}
-	walker := filewalk.New(sc.fs, filewalk.Concurrency(flagValues.Concurrency))
-	errs.Append(walker.Walk(ctx, sc.prefixFn, sc.fileFn, prefix))
+		exclusions:    exclusions,
+		ignores:       ignores,
+		fs:            fs,
+		pt:            pt,
+		incremental:   flagValues.Incremental && !flagValues.FilesOnly && len(flagValues.OnlyExt.Values) == 0,
+		filesOnly:     flagValues.FilesOnly,
+		errorMap:      errorMap,
+		root:          prefix,
+		warnDepth:     flagValues.WarnDepth,
+		maxDepth:      flagValues.MaxDepth,
+		concurrency:   flagValues.Concurrency,
+		warnEntries:   flagValues.WarnEntries,
+		maxErrors:     flagValues.MaxErrors,
+		detectChanges: flagValues.DetectChanges,
+		onlyExt:       newExtensionFilter(flagValues.OnlyExt.Values),
+		changed:       changed,
+	}
+	if flagValues.OneFS || globalConfig.LayoutFor(prefix).OneFileSystem {
+		if sc.devices, err = newDeviceFilter(ctx, fs, prefix); err != nil {
+			return err
+		}
+	}
+	if flagValues.Symlinks {
+		sc.symlinks = newSymlinkTargets(prefix)
+	}
+	if flagValues.Emit {
+		sc.emitter = newEmitter(ctx, os.Stdout)
+	}
+	if cfg, ok := globalConfig.DatabaseFor(prefix); ok && len(cfg.Location) > 0 {
+		if sc.lastSeen, err = lastseen.Open(cfg.Location); err != nil {
+			return sc.abandon(err)
+		}
+		if sc.warnings, err = warnings.Create(cfg.Location); err != nil {
+			return sc.abandon(err)
+		}
+		if sc.resumeSince, err = beginRun(cfg.Location, prefix, start, flagValues.Resume); err != nil {
+			return sc.abandon(err)
+		}
+	} else if flagValues.Resume {
+		return sc.abandon(fmt.Errorf("--resume requires a database with a local directory: %v", prefix))
+	}
+	if sc.xattrs, err = openXAttrs(out, prefix); err != nil {
+		return sc.abandon(err)
+	}
+	var walkFS filewalk.Filesystem = sc.fs
+	if len(flagValues.Trace) > 0 {
+		if sc.tracer, err = newTracer(flagValues.Trace); err != nil {
+			return sc.abandon(err)
+		}
+		// The ramp, if any, is applied outside of the trace so that the
+		// time spent waiting for it is not included in the trace.
+		walkFS = &tracedFilesystem{Filesystem: walkFS, tracer: sc.tracer}
+	}
+	if flagValues.Ramp > 0 {
+		// Only the walker's operations are subject to the ramp.
+		pt.ramp = newRamp(ctx, flagValues.Concurrency, flagValues.Ramp, flagValues.RampShape)
+		walkFS = &rampedFilesystem{Filesystem: walkFS, ramp: pt.ramp}
+	}
+	walker := filewalk.New(walkFS, filewalk.Concurrency(flagValues.Concurrency))
+	// The walk is cancelled separately from ctx when --max-errors is
+	// reached so that the partial results can still be recorded.
+	walkCtx, abort := context.WithCancel(ctx)
+	sc.abort = abort
+	_, scanSpan := globalTelemetry.Start(ctx, "scan", otlp.String("prefix", prefix))
+	err = walker.Walk(walkCtx, sc.prefixFn, sc.fileFn, prefix)
+	abort()
+	aborted := atomic.LoadInt32(&sc.aborted) != 0
+	switch {
+	case aborted:
+		err = maxErrorsReached(out, flagValues.MaxErrors)
+	case ctx.Err() != nil:
+		// The walker's errors are all due to the cancelation.
+		fmt.Fprintf(out, "analyze interrupted, partial results have been recorded, use --resume to continue\n")
+		err = fmt.Errorf("analyze interrupted: %v", ctx.Err())
+	}
+	errs.Append(err)
+	pt.endSpan(scanSpan, errs.Err())
+	if sc.lastSeen != nil {
+		errs.Append(sc.lastSeen.Close())
+	}
+	if sc.xattrs != nil {
+		errs.Append(sc.xattrs.Close())
+	}
+	errs.Append(sc.tracer.close())
+	if sc.warnings != nil {
+		if n := sc.warnings.Len(); n > 0 {
+			fmt.Fprintf(out, "%v warnings were recorded, use the warnings command to display them\n", n)
+		}
+		errs.Append(sc.warnings.Close())
+	}
+	if dropped := sc.emitter.close(); dropped > 0 {
+		fmt.Fprintf(out, "warning: --emit dropped %v records since they were not being consumed quickly enough\n", dropped)
+	}
+	sc.symlinks.summary(out)
+	_, flushSpan := globalTelemetry.Start(ctx, "database-flush", otlp.String("prefix", prefix))
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	flushSpan.SetError(errs.Err())
+	flushSpan.End()
+	_, logSpan := globalTelemetry.Start(ctx, "log-and-close", otlp.String("prefix", prefix))
+	if errs.Err() == nil && ctx.Err() == nil {
+		errs.Append(recordUsageHistory(ctx, prefix, flagValues.Note))
+		errs.Append(endRun(prefix))
+	}
+	hits := exclusionHits(exclusions)
+	printExclusionHits(out, flagValues.Exclusions, hits)
+	skipped := sc.devices.mounts()
+	if len(skipped) > 0 {
+		fmt.Fprintf(out, "%v directories on other filesystems were skipped, use database history to display them\n", len(skipped))
+	}
+	errs.Append(recordRun(prefix, flagValues.Note, start, pt, hits, skipped, scanOptions(flagValues), aborted || ctx.Err() != nil, errs.Err()))
+	logSpan.SetError(errs.Err())
+	logSpan.End()
+	span.SetError(errs.Err())
 	cancel()
 	return errs.Err()
 }
 
+// abandon closes the files and databases opened for a scan that fails
+// before it is started, and returns err.
+func (sc *scanState) abandon(err error) error {
+	if sc.lastSeen != nil {
+		sc.lastSeen.Close()
+	}
+	if sc.warnings != nil {
+		sc.warnings.Close()
+	}
+	if sc.xattrs != nil {
+		sc.xattrs.Close()
+	}
+	sc.emitter.close()
+	return err
+}
+
+// maxErrorsReached reports that a scan was aborted because --max-errors
+// was reached and returns an error to that effect.
+func maxErrorsReached(out io.Writer, maxErrors int) error {
+	fmt.Fprintf(out, "scan aborted after encountering %v or more errors, partial results have been recorded\n", maxErrors)
+	return fmt.Errorf("scan aborted: --max-errors=%v reached", maxErrors)
+}
+
+// scanOptions returns the options, as recorded in the run log, that
+// determine which files and children are recorded for each prefix.
+func scanOptions(flagValues *AnalyzeFlags) *runlog.ScanOptions {
+	opts := &runlog.ScanOptions{
+		OnlyExt:   flagValues.OnlyExt.Values,
+		FilesOnly: flagValues.FilesOnly,
+		Symlinks:  flagValues.Symlinks,
+	}
+	if len(flagValues.ExcludeFrom) > 0 {
+		opts.ExcludeFrom = flagValues.ExcludeFrom
+		if abs, err := filepath.Abs(flagValues.ExcludeFrom); err == nil {
+			opts.ExcludeFrom = abs
+		}
+	}
+	return opts
+}
+
+// recordRun appends an entry for an analyze run to the run log of the
+// database for prefix, if it has a local directory. Partial is set for
+// runs that were interrupted or aborted before scanning every prefix.
+func recordRun(prefix, note string, start time.Time, pt *progressTracker, hits []runlog.ExclusionHits, skipped []string, opts *runlog.ScanOptions, partial bool, runErr error) error {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return nil
+	}
+	entry := runlog.Entry{
+		Prefix:        prefix,
+		Start:         start,
+		Stop:          time.Now(),
+		Note:          note,
+		Prefixes:      atomic.LoadInt64(&pt.numPrefixesFinished),
+		Files:         atomic.LoadInt64(&pt.numFiles),
+		Errors:        atomic.LoadInt64(&pt.numErrors),
+		Exclusions:    hits,
+		SkippedMounts: skipped,
+		Partial:       partial,
+		Options:       opts,
+	}
+	if runErr != nil {
+		entry.Err = runErr.Error()
+	}
+	return runlog.Append(cfg.Location, entry)
+}
+
+// beginRun records that an analyze run of prefix, that started at start,
+// is in progress so that it may be resumed if it is interrupted. When
+// resuming, the start of the interrupted run is returned, and is retained,
+// so that the resumed run may itself be resumed.
+func beginRun(dir, prefix string, start time.Time, resume bool) (time.Time, error) {
+	if !resume {
+		return time.Time{}, runlog.Begin(dir, runlog.Entry{Prefix: prefix, Start: start})
+	}
+	entry, ok, err := runlog.InProgress(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok || entry.Prefix != prefix {
+		return time.Time{}, fmt.Errorf("--resume: there is no interrupted analyze run of %v", prefix)
+	}
+	return entry.Start, nil
+}
+
+// endRun records that the analyze run of prefix completed successfully
+// and hence need not be resumed.
+func endRun(prefix string) error {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return nil
+	}
+	return runlog.End(cfg.Location)
+}
+
+// rescanDue returns true if the layout for prefix specifies
+// force_rescan_after and prefix has not been listed within that period,
+// including when it is not known to have ever been listed.
+func (sc *scanState) rescanDue(ctx context.Context, prefix string) bool {
+	after := globalConfig.LayoutFor(prefix).ForceRescanAfter
+	if after <= 0 || sc.lastSeen == nil {
+		return false
+	}
+	rec, ok, err := sc.lastSeen.Get(prefix)
+	if err != nil {
+		debug(ctx, 1, "failed to read last seen time: %v: %v\n", prefix, err)
+		return true
+	}
+	return !ok || rec.Scanned.IsZero() || time.Since(rec.Scanned) > after
+}
+
+// resumedChildren returns the children of prefix, as stored in the
+// database, if prefix was scanned by the interrupted run being resumed.
+func (sc *scanState) resumedChildren(ctx context.Context, prefix string) ([]filewalk.Info, bool) {
+	if sc.resumeSince.IsZero() || sc.lastSeen == nil {
+		return nil, false
+	}
+	rec, ok, err := sc.lastSeen.Get(prefix)
+	if err != nil || !ok || rec.Scanned.Before(sc.resumeSince) {
+		return nil, false
+	}
+	existing, err := existingPrefixInfo(ctx, prefix)
+	if err != nil || existing == nil {
+		return nil, false
+	}
+	return existing.Children, true
+}
+
+// previousRunPrefixes returns the number of prefixes scanned by the most
+// recent successful analyze run of prefix, or zero if there is none.
+func previousRunPrefixes(prefix string) int64 {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return 0
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil {
+		return 0
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if e := entries[i]; e.Prefix == prefix && len(e.Err) == 0 {
+			return e.Prefixes
+		}
+	}
+	return 0
+}
+
+// exclusionHits returns the number of paths matched by each of the
+// exclusions in the configuration file, ignoring those for idu's own
+// directories.
+func exclusionHits(ex *exclusions.T) []runlog.ExclusionHits {
+	configured := map[string]bool{}
+	for _, e := range globalConfig.Exclusions {
+		for _, re := range e.Regexps {
+			configured[e.Prefix+"\x00"+re.String()] = true
+		}
+		for _, g := range e.Globs {
+			configured[e.Prefix+"\x00"+g.Pattern] = true
+		}
+	}
+	var hits []runlog.ExclusionHits
+	for _, h := range ex.Hits() {
+		if configured[h.Prefix+"\x00"+h.Pattern] {
+			hits = append(hits, runlog.ExclusionHits{Prefix: h.Prefix, Pattern: h.Pattern, Hits: h.Count})
+		}
+	}
+	return hits
+}
+
+func printExclusionHits(out io.Writer, enabled bool, hits []runlog.ExclusionHits) {
+	if !enabled {
+		return
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "\nexclusion hits:\n")
+	for _, h := range hits {
+		unused := ""
+		if h.Hits == 0 {
+			unused = " (no matches, obsolete or mistyped?)"
+		}
+		ifmt.Fprintf(out, "% 12v : %v: %q%v\n", h.Hits, h.Prefix, h.Pattern, unused)
+	}
+}
+
+// statOnly re-stats the files stored in the database for prefix to update
+// their sizes, modification times etc. Files that no longer exist are
+// removed, but no prefixes are listed and hence new files are not found.
+func statOnly(ctx context.Context, fs filewalk.Filesystem, pt *progressTracker, exclusions *exclusions.T, prefix string, maxErrors int) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	sc := db.NewScanner(prefix, 0, filewalk.ScanLimit(1000))
+	within := withinPrefix(prefix, globalConfig.LayoutFor(prefix).Separator)
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		if exclusions.Exclude(prefix) {
+			continue
+		}
+		if pt.tooManyErrors(maxErrors) {
+			return maxErrorsReached(pt.out, maxErrors)
+		}
+		pt.send(ctx, progressUpdate{prefixStart: 1})
+		layout := globalConfig.LayoutFor(prefix)
+		existing := *pi
+		files := make([]filewalk.Info, 0, len(pi.Files))
+		nerrors, restats := 0, 0
+		pi.DiskUsage = 0
+		for _, file := range pi.Files {
+			info, err := fs.Stat(ctx, fs.Join(prefix, file.Name))
+			if err != nil {
+				if fs.IsNotExist(err) {
+					debug(ctx, 1, "file no longer exists: %v/%v\n", prefix, file.Name)
+					continue
+				}
+				debug(ctx, 1, "stat error: %v/%v: %v\n", prefix, file.Name, err)
+				nerrors++
+			} else {
+				info.Name = file.Name
+				file = info
+				restats++
+			}
+			pi.DiskUsage += calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
+			files = append(files, file)
+		}
+		pi.Files = files
+		deletedFiles, err := removeStaleStats(ctx, layout, prefix, &existing, pi)
+		if err != nil {
+			return err
+		}
+		if err := db.Set(ctx, prefix, pi); err != nil {
+			return err
+		}
+		pt.send(ctx, progressUpdate{prefixDone: 1, files: len(pi.Files), restats: restats, fileDeletions: deletedFiles, errors: nerrors})
+	}
+	return sc.Err()
+}
+
 func deleteErrors(ctx context.Context, prefix string) (map[string]struct{}, error) {
 	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix)
 	if err != nil {
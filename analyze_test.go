@@ -0,0 +1,161 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/exclusions"
+	"cloudeng.io/file/diskusage"
+	"cloudeng.io/file/filewalk"
+)
+
+func TestRetryListingFilters(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, name := range []string{"a.vmdk", "b.txt", "c.vmdk", "d.log.vmdk"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignores := exclusions.NewIgnores("/")
+	if err := ignores.Add(tmpDir, strings.NewReader("c.vmdk\n")); err != nil {
+		t.Fatal(err)
+	}
+	sc := &scanState{
+		fs:      filewalk.LocalFilesystem(100),
+		ignores: ignores,
+		onlyExt: newExtensionFilter([]string{"vmdk"}),
+	}
+	layout := config.Layout{Prefix: tmpDir, Separator: "/", Calculator: diskusage.NewIdentity()}
+	pi := &filewalk.PrefixInfo{}
+	if err := sc.retryListing(ctx, layout, tmpDir, pi, fmt.Errorf("oops")); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range pi.Files {
+		names = append(names, fi.Name)
+	}
+	sort.Strings(names)
+	if got, want := names, []string{"a.vmdk", "d.log.vmdk"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRestatFiles(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu-restat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fs := filewalk.LocalFilesystem(100)
+	var listed []filewalk.Info
+	for _, name := range []string{"unchanged", "modified", "removed"} {
+		filename := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(filename, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		info, err := fs.Stat(ctx, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, info)
+	}
+	// Symlinks are not re-stat'ed since they may have been attributed the
+	// size of their targets.
+	listed = append(listed, filewalk.Info{Name: "link", Size: 100, Mode: filewalk.ModeLink})
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "modified"), []byte("modified during the scan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tmpDir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	sc := &scanState{fs: fs}
+	layout := config.Layout{Prefix: tmpDir, Separator: "/", Calculator: diskusage.NewIdentity()}
+	pi := &filewalk.PrefixInfo{Files: listed}
+	for _, fi := range listed {
+		pi.DiskUsage += fi.Size
+	}
+	sc.restatFiles(ctx, layout, tmpDir, pi)
+	sizes := map[string]int64{}
+	for _, fi := range pi.Files {
+		sizes[fi.Name] = fi.Size
+	}
+	want := map[string]int64{
+		"unchanged": int64(len("unchanged")),
+		"modified":  int64(len("modified during the scan")),
+		"link":      100,
+	}
+	if got := sizes; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := pi.DiskUsage, int64(len("unchanged")+len("modified during the scan")+100); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	for i, tc := range []struct {
+		max, errors int
+		want        bool
+	}{
+		{0, 0, false},
+		{0, 100, false},
+		{-1, 100, false},
+		{1, 0, false},
+		{1, 1, true},
+		{3, 2, false},
+		{3, 3, true},
+		{3, 4, true},
+	} {
+		pt := &progressTracker{numErrors: int64(tc.errors)}
+		if got, want := pt.tooManyErrors(tc.max), tc.want; got != want {
+			t.Errorf("%v: max %v, errors %v: got %v, want %v", i, tc.max, tc.errors, got, want)
+		}
+	}
+
+	// Once the limit is reached, all prefixes are skipped and the scan is
+	// aborted exactly once.
+	ctx := context.Background()
+	aborts := 0
+	sc := &scanState{
+		fs:        filewalk.LocalFilesystem(100),
+		pt:        &progressTracker{numErrors: 2},
+		maxErrors: 2,
+		abort:     func() { aborts++ },
+	}
+	for _, prefix := range []string{"/a", "/b"} {
+		skip, children, err := sc.prefixFn(ctx, prefix, &filewalk.Info{}, nil)
+		if !skip || children != nil || err != nil {
+			t.Errorf("%v: got %v, %v, %v, want the prefix to be skipped", prefix, skip, children, err)
+		}
+	}
+	if got, want := aborts, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	out := &strings.Builder{}
+	err := maxErrorsReached(out, 2)
+	if err == nil || err.Error() != "scan aborted: --max-errors=2 reached" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if got, want := out.String(), "scan aborted after encountering 2 or more errors, partial results have been recorded\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
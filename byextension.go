@@ -0,0 +1,95 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// noExtension is the name used for files that have no extension.
+const noExtension = "(none)"
+
+// extensionUsage is the number and total size of the files with a given
+// extension.
+type extensionUsage struct {
+	Extension string `json:"extension"`
+	Files     int64  `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// extensionSummary is the JSON representation of summary --by-extension.
+type extensionSummary struct {
+	Prefix     string           `json:"prefix"`
+	Files      int64            `json:"files"`
+	Bytes      int64            `json:"bytes"`
+	Extensions []extensionUsage `json:"extensions"`
+}
+
+// usageByExtension returns the usage of the files stored for root and its
+// descendants grouped by extension and sorted by total size.
+func usageByExtension(ctx context.Context, root string) (extensionSummary, error) {
+	byExt := map[string]*extensionUsage{}
+	summary := extensionSummary{Prefix: root}
+	err := forEachFile(ctx, root, func(_ string, fi filewalk.Info) {
+		ext := fileExtension(fi.Name)
+		if len(ext) == 0 {
+			ext = noExtension
+		}
+		u := byExt[ext]
+		if u == nil {
+			u = &extensionUsage{Extension: ext}
+			byExt[ext] = u
+		}
+		u.Files++
+		u.Bytes += fi.Size
+		summary.Files++
+		summary.Bytes += fi.Size
+	})
+	if err != nil {
+		return extensionSummary{}, err
+	}
+	summary.Extensions = make([]extensionUsage, 0, len(byExt))
+	for _, u := range byExt {
+		summary.Extensions = append(summary.Extensions, *u)
+	}
+	sort.Slice(summary.Extensions, func(i, j int) bool {
+		a, b := summary.Extensions[i], summary.Extensions[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Extension < b.Extension
+	})
+	return summary, nil
+}
+
+// summaryByExtension prints the top extensions by total size beneath root,
+// or writes all of them as JSON.
+func summaryByExtension(ctx context.Context, out io.Writer, root string, topN int, asJSON bool) error {
+	summary, err := usageByExtension(ctx, root)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return json.NewEncoder(out).Encode(summary)
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Usage by extension for %v: %v files, %v\n", root, summary.Files, fsize(summary.Bytes))
+	for i, u := range summary.Extensions {
+		if i >= topN {
+			ifmt.Fprintf(out, "... %v more\n", len(summary.Extensions)-topN)
+			break
+		}
+		ifmt.Fprintf(out, "%20v : %12v files (%6.2f%%) %20v (%6.2f%%)\n",
+			u.Extension, u.Files, percent(u.Files, summary.Files), fsize(u.Bytes), percent(u.Bytes, summary.Bytes))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+// changeRecord is the JSON representation of a file reported by
+// find --changed-since.
+type changeRecord struct {
+	Path    string    `json:"path"`
+	Change  string    `json:"change"`
+	Details []string  `json:"details,omitempty"`
+	Bytes   int64     `json:"bytes"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// changeWriter writes the changes found by find --changed-since as they
+// are found, either as text or JSON.
+type changeWriter struct {
+	out    io.Writer
+	enc    *json.Encoder
+	fileRE []*regexp.Regexp
+	counts map[string]int
+}
+
+func newChangeWriter(out io.Writer, asJSON bool, fileRE []*regexp.Regexp) *changeWriter {
+	cw := &changeWriter{out: out, fileRE: fileRE, counts: map[string]int{}}
+	if asJSON {
+		cw.enc = json.NewEncoder(out)
+	}
+	return cw
+}
+
+func (cw *changeWriter) write(prefix, sep, change string, fi filewalk.Info, details ...string) error {
+	if cw.fileRE != nil && !match(cw.fileRE, fi.Name) {
+		return nil
+	}
+	cw.counts[change]++
+	path := strings.TrimSuffix(prefix, sep) + sep + fi.Name
+	if cw.enc != nil {
+		return cw.enc.Encode(changeRecord{
+			Path:    path,
+			Change:  change,
+			Details: details,
+			Bytes:   fi.Size,
+			ModTime: displayTime(fi.ModTime),
+		})
+	}
+	if len(details) > 0 {
+		_, err := fmt.Fprintf(cw.out, "%-9v %v (%v)\n", change, path, strings.Join(details, ", "))
+		return err
+	}
+	_, err := fmt.Fprintf(cw.out, "%-9v %v\n", change, path)
+	return err
+}
+
+// fileDifferences returns the ways in which a file has changed.
+func fileDifferences(before, after filewalk.Info) []string {
+	var diffs []string
+	if before.Size != after.Size {
+		diffs = append(diffs, "size")
+	}
+	if !before.ModTime.Equal(after.ModTime) {
+		diffs = append(diffs, "modification time")
+	}
+	return diffs
+}
+
+// diffFiles reports the files in prefix that were added, removed or
+// modified between two records of it, either of which may be nil.
+func (cw *changeWriter) diffFiles(prefix, sep string, before, after *filewalk.PrefixInfo) error {
+	previous := map[string]filewalk.Info{}
+	if before != nil {
+		for _, fi := range before.Files {
+			previous[fi.Name] = fi
+		}
+	}
+	if after != nil {
+		for _, fi := range after.Files {
+			prev, ok := previous[fi.Name]
+			delete(previous, fi.Name)
+			if !ok {
+				if err := cw.write(prefix, sep, "added", fi); err != nil {
+					return err
+				}
+				continue
+			}
+			if diffs := fileDifferences(prev, fi); len(diffs) > 0 {
+				if err := cw.write(prefix, sep, "modified", fi, diffs...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if before == nil {
+		return nil
+	}
+	// Report removals in the order in which they were stored.
+	for _, fi := range before.Files {
+		if _, ok := previous[fi.Name]; ok {
+			if err := cw.write(prefix, sep, "removed", fi); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// changedSinceSnapshot compares the files stored for root and its
+// descendants in the live database against those in a snapshot.
+func (cw *changeWriter) changedSinceSnapshot(ctx context.Context, snapshot filewalk.Database, root string) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	sep := globalConfig.LayoutFor(root).Separator
+	before := &compareScanner{sc: snapshot.NewScanner(root, 0, filewalk.ScanLimit(10000))}
+	after := &compareScanner{sc: db.NewScanner(root, 0, filewalk.ScanLimit(10000))}
+	before.next(ctx)
+	after.next(ctx)
+	for !before.done || !after.done {
+		switch {
+		case after.done || (!before.done && before.prefix < after.prefix):
+			err = cw.diffFiles(before.prefix, sep, before.info, nil)
+			before.next(ctx)
+		case before.done || after.prefix < before.prefix:
+			err = cw.diffFiles(after.prefix, sep, nil, after.info)
+			after.next(ctx)
+		default:
+			err = cw.diffFiles(after.prefix, sep, before.info, after.info)
+			before.next(ctx)
+			after.next(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	errs := errors.M{}
+	errs.Append(before.sc.Err())
+	errs.Append(after.sc.Err())
+	return errs.Err()
+}
+
+// changedSinceTime reports the files stored for root and its descendants
+// whose modification time is after since. Files that have since been
+// removed cannot be detected.
+func (cw *changeWriter) changedSinceTime(ctx context.Context, root string, since time.Time) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	sep := globalConfig.LayoutFor(root).Separator
+	within := withinPrefix(root, sep)
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		for _, fi := range pi.Files {
+			if fi.ModTime.After(since) {
+				if err := cw.write(prefix, sep, "changed", fi); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// runAtOrBefore returns the most recent of entries, which are ordered by
+// time, that analyzed root, or one of its ancestors, and completed at or
+// before when.
+func runAtOrBefore(entries []runlog.Entry, root, sep string, when time.Time) (runlog.Entry, error) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Prefix != root && !strings.HasPrefix(root, strings.TrimSuffix(e.Prefix, sep)+sep) {
+			continue
+		}
+		if !e.Stop.After(when) {
+			return e, nil
+		}
+	}
+	return runlog.Entry{}, fmt.Errorf("no analyze run of %v completed at or before %v", root, displayTime(when).Format(time.RFC3339))
+}
+
+// changedSinceRun reports the files stored for root and its descendants
+// that were modified after the start of the analyze run, as recorded in
+// the run log, that was the most recent at when. Measuring from the
+// start of the run ensures that files modified whilst it was running are
+// reported.
+func (cw *changeWriter) changedSinceRun(ctx context.Context, out io.Writer, root string, when time.Time) error {
+	cfg, ok := globalConfig.DatabaseFor(root)
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", root)
+	}
+	if len(cfg.Location) == 0 {
+		return fmt.Errorf("database location is unknown, hence its run log cannot be read: %v", cfg.Description)
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil {
+		return err
+	}
+	run, err := runAtOrBefore(entries, root, globalConfig.LayoutFor(root).Separator, when)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v: reporting files modified since the analyze run of %v that started at %v\n", root, run.Prefix, displayTime(run.Start).Format(time.RFC3339))
+	return cw.changedSinceTime(ctx, root, run.Start)
+}
+
+// isDatabaseDir returns true if dir is a local database directory, such
+// as a snapshot.
+func isDatabaseDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, localDBLockFilename))
+	return err == nil
+}
+
+// findChangedSince reports the files that have been added, removed or
+// modified since either a snapshot, when since is a database directory,
+// or the analyze run that was the most recent at a point in time, in which
+// case only files modified since that run can be reported.
+func findChangedSince(ctx context.Context, flagValues *findFlags, args []string, fileRE []*regexp.Regexp) error {
+	since := flagValues.ChangedSince
+	cw := newChangeWriter(os.Stdout, flagValues.JSON, fileRE)
+	errs := errors.M{}
+	if isDatabaseDir(since) {
+		snapshot, _, err := openForCompare(ctx, since)
+		if err != nil {
+			return err
+		}
+		for _, root := range args {
+			errs.Append(cw.changedSinceSnapshot(ctx, snapshot, root))
+		}
+		errs.Append(snapshot.Close(ctx))
+	} else {
+		when, err := parseTimeFlag("changed-since", since)
+		if err != nil {
+			return fmt.Errorf("%v, or a database snapshot directory", err)
+		}
+		fmt.Fprintf(os.Stderr, "warning: files removed since %v cannot be detected without a snapshot\n", displayTime(when).Format(time.RFC3339))
+		for _, root := range args {
+			errs.Append(cw.changedSinceRun(ctx, os.Stderr, root, when))
+		}
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if !flagValues.JSON {
+		fmt.Fprintf(os.Stderr, "added: %v, removed: %v, modified: %v, changed: %v\n",
+			cw.counts["added"], cw.counts["removed"], cw.counts["modified"], cw.counts["changed"])
+	}
+	return errs.Err()
+}
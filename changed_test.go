@@ -0,0 +1,60 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+)
+
+func TestRunAtOrBefore(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2021, 7, 4, hour, 0, 0, 0, time.UTC)
+	}
+	entries := []runlog.Entry{
+		{Prefix: "/a", Start: at(1), Stop: at(2)},
+		{Prefix: "/a/b", Start: at(3), Stop: at(4)},
+		{Prefix: "/ab", Start: at(5), Stop: at(6)},
+		{Prefix: "/a", Start: at(7), Stop: at(8)},
+	}
+	for i, tc := range []struct {
+		root  string
+		when  time.Time
+		start time.Time
+	}{
+		{"/a", at(2), at(1)},
+		{"/a", at(6), at(1)},
+		{"/a/b", at(6), at(3)},
+		{"/a/b/c", at(5), at(3)},
+		{"/a/c", at(5), at(1)},
+		{"/a/b", at(9), at(7)},
+		{"/ab", at(7), at(5)},
+	} {
+		run, err := runAtOrBefore(entries, tc.root, "/", tc.when)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got, want := run.Start, tc.start; !got.Equal(want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	for i, tc := range []struct {
+		root string
+		when time.Time
+	}{
+		{"/a", at(1)},
+		{"/ab", at(4)},
+		{"/b", at(9)},
+	} {
+		_, err := runAtOrBefore(entries, tc.root, "/", tc.when)
+		if err == nil || !strings.Contains(err.Error(), "no analyze run of "+tc.root+" completed at or before") {
+			t.Errorf("%v: missing or wrong error: %v", i, err)
+		}
+	}
+}
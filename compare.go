@@ -0,0 +1,199 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type compareFlags struct {
+	MaxDivergences int `subcmd:"max-divergences,20,the maximum number of divergent prefixes to display"`
+}
+
+// openForCompare opens the database specified by arg read-only. arg may be
+// a local database directory, such as a snapshot, or a prefix for which a
+// database is configured.
+func openForCompare(ctx context.Context, arg string) (filewalk.Database, string, error) {
+	if _, err := os.Stat(filepath.Join(arg, localDBLockFilename)); err == nil {
+		cfg := config.Database{
+			Prefix:   arg,
+			Location: arg,
+			Open: func(ctx context.Context, opts ...filewalk.DatabaseOption) (filewalk.Database, error) {
+				return localdb.Open(ctx, arg, opts)
+			},
+		}
+		db, err := openDatabase(ctx, cfg, filewalk.ReadOnly())
+		return db, fmt.Sprintf("local database in %v", arg), err
+	}
+	cfg, ok := globalConfig.DatabaseFor(arg)
+	if !ok {
+		return nil, "", fmt.Errorf("%v is neither a local database directory nor a prefix with a configured database", arg)
+	}
+	db, err := openDatabase(ctx, cfg, filewalk.ReadOnly())
+	if err != nil {
+		if _, ok := err.(*lockTimeoutError); ok {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("failed to open database for %v: %v", arg, err)
+	}
+	return db, cfg.Description, nil
+}
+
+// prefixInfoDifferences returns the names of the fields that differ
+// between a and b.
+func prefixInfoDifferences(a, b *filewalk.PrefixInfo) []string {
+	var diffs []string
+	if a.UserID != b.UserID {
+		diffs = append(diffs, "user")
+	}
+	if a.GroupID != b.GroupID {
+		diffs = append(diffs, "group")
+	}
+	if a.Size != b.Size {
+		diffs = append(diffs, "size")
+	}
+	if a.DiskUsage != b.DiskUsage {
+		diffs = append(diffs, "disk usage")
+	}
+	if a.Mode != b.Mode {
+		diffs = append(diffs, "mode")
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		diffs = append(diffs, "modification time")
+	}
+	if !bytes.Equal(prefixChecksum(a.Files, nil), prefixChecksum(b.Files, nil)) {
+		diffs = append(diffs, "files")
+	}
+	if !bytes.Equal(prefixChecksum(nil, a.Children), prefixChecksum(nil, b.Children)) {
+		diffs = append(diffs, "children")
+	}
+	if a.Err != b.Err {
+		diffs = append(diffs, "error")
+	}
+	return diffs
+}
+
+// compareScanner wraps a DatabaseScanner to allow its current entry to be
+// examined before it is consumed.
+type compareScanner struct {
+	sc     filewalk.DatabaseScanner
+	prefix string
+	info   *filewalk.PrefixInfo
+	done   bool
+}
+
+func (cs *compareScanner) next(ctx context.Context) {
+	if cs.done {
+		return
+	}
+	if !cs.sc.Scan(ctx) {
+		cs.done = true
+		return
+	}
+	cs.prefix, cs.info = cs.sc.PrefixInfo()
+}
+
+// err returns the scanner's error, if any, and is safe to call on a
+// compareScanner that has no underlying scanner.
+func (cs *compareScanner) err() error {
+	if cs.sc == nil {
+		return nil
+	}
+	return cs.sc.Err()
+}
+
+var compareTotals = []struct {
+	name   string
+	metric filewalk.MetricName
+}{
+	{"files", filewalk.TotalFileCount},
+	{"prefixes", filewalk.TotalPrefixCount},
+	{"disk usage", filewalk.TotalDiskUsage},
+	{"errors", filewalk.TotalErrorCount},
+}
+
+// dbCompare compares the prefix records and totals of two databases by
+// scanning both, in order, in lockstep.
+func dbCompare(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*compareFlags)
+	errs := errors.M{}
+	dba, descA, err := openForCompare(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	dbb, descB, err := openForCompare(ctx, args[1])
+	if err != nil {
+		dba.Close(ctx)
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Printf("a: %v\nb: %v\n", descA, descB)
+
+	var nSame, nDiverged int
+	report := func(format string, args ...interface{}) {
+		nDiverged++
+		if nDiverged <= flagValues.MaxDivergences {
+			ifmt.Printf(format, args...)
+		}
+	}
+	a := &compareScanner{sc: dba.NewScanner("", 0, filewalk.ScanLimit(10000))}
+	b := &compareScanner{sc: dbb.NewScanner("", 0, filewalk.ScanLimit(10000))}
+	a.next(ctx)
+	b.next(ctx)
+	for !a.done || !b.done {
+		switch {
+		case b.done || (!a.done && a.prefix < b.prefix):
+			report("only in a: %v\n", a.prefix)
+			a.next(ctx)
+		case a.done || b.prefix < a.prefix:
+			report("only in b: %v\n", b.prefix)
+			b.next(ctx)
+		default:
+			if diffs := prefixInfoDifferences(a.info, b.info); len(diffs) > 0 {
+				report("differs: %v: %v\n", a.prefix, strings.Join(diffs, ", "))
+			} else {
+				nSame++
+			}
+			a.next(ctx)
+			b.next(ctx)
+		}
+	}
+	errs.Append(a.err())
+	errs.Append(b.err())
+	for _, t := range compareTotals {
+		ta, err := dba.Total(ctx, t.metric, filewalk.Global())
+		errs.Append(err)
+		tb, err := dbb.Total(ctx, t.metric, filewalk.Global())
+		errs.Append(err)
+		if ta != tb {
+			report("total %v differs: a: %v, b: %v\n", t.name, ta, tb)
+		}
+	}
+	errs.Append(dba.Close(ctx))
+	errs.Append(dbb.Close(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	if nDiverged > flagValues.MaxDivergences {
+		ifmt.Printf("... %v more\n", nDiverged-flagValues.MaxDivergences)
+	}
+	ifmt.Printf("identical prefixes: %v, divergences: %v\n", nSame, nDiverged)
+	if nDiverged > 0 {
+		return fmt.Errorf("the databases have diverged")
+	}
+	return nil
+}
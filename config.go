@@ -8,8 +8,10 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 
 	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/exclusions"
 )
 
 type configFlags struct {
@@ -30,3 +32,20 @@ func configManager(ctx context.Context, values interface{}, args []string) error
 	fmt.Println(string(buf))
 	return err
 }
+
+func testExclusions(ctx context.Context, values interface{}, args []string) error {
+	prefix, paths := args[0], args[1:]
+	ex := exclusions.New(append(globalConfig.InternalExclusions(), globalConfig.Exclusions...))
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(prefix, path)
+		}
+		match, ok := ex.Match(path)
+		if !ok {
+			fmt.Printf("%v: not excluded\n", path)
+			continue
+		}
+		fmt.Printf("%v: excluded by exclusion %v for prefix %q: %q\n", path, match.Index, match.Prefix, match.Pattern)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// contentTypes are the broad categories of content type that can be
+// detected by sampling a file's header.
+var contentTypes = []string{"archive", "audio", "document", "image", "text", "video", "other"}
+
+// contentSampleSize is the number of bytes read from the start of a file
+// to determine its content type.
+const contentSampleSize = 512
+
+// archiveMagic are the magic numbers for archive formats that are not
+// recognised by http.DetectContentType.
+var archiveMagic = [][]byte{
+	[]byte("7z\xBC\xAF\x27\x1C"),
+	[]byte("\xFD7zXZ\x00"),
+	[]byte("BZh"),
+	[]byte("\x28\xB5\x2F\xFD"), // zstd
+}
+
+func validateContentType(typ string) error {
+	for _, t := range contentTypes {
+		if t == typ {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported content type: %v, must be one of %v", typ, strings.Join(contentTypes, ", "))
+}
+
+// classifyContent returns the broad category of content for the supplied
+// header.
+func classifyContent(header []byte) string {
+	for _, magic := range archiveMagic {
+		if bytes.HasPrefix(header, magic) {
+			return "archive"
+		}
+	}
+	if len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")) {
+		return "archive"
+	}
+	if len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp")) {
+		return "video"
+	}
+	mime := http.DetectContentType(header)
+	if idx := strings.Index(mime, ";"); idx > 0 {
+		mime = mime[:idx]
+	}
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		return "image"
+	case strings.HasPrefix(mime, "video/"):
+		return "video"
+	case strings.HasPrefix(mime, "audio/"), mime == "application/ogg":
+		return "audio"
+	case strings.HasPrefix(mime, "text/"):
+		return "text"
+	case mime == "application/pdf", mime == "application/postscript":
+		return "document"
+	case mime == "application/zip", mime == "application/x-gzip",
+		mime == "application/x-rar-compressed", mime == "application/wasm":
+		return "archive"
+	}
+	return "other"
+}
+
+// detectContentType determines the content type of the named file by
+// reading at most contentSampleSize bytes from its start.
+func detectContentType(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, contentSampleSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if n == 0 {
+		return "other", nil
+	}
+	return classifyContent(buf[:n]), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClassifyContent(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+	for i, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image"},
+		{"GIF89a", "image"},
+		{"\x00\x00\x00\x18ftypmp42", "video"},
+		{"ID3\x03\x00", "audio"},
+		{"OggS\x00\x02", "audio"},
+		{"%PDF-1.4\n", "document"},
+		{"%!PS-Adobe-3.0", "document"},
+		{"PK\x03\x04", "archive"},
+		{"\x1f\x8b\x08", "archive"},
+		{"7z\xBC\xAF\x27\x1C", "archive"},
+		{"\xFD7zXZ\x00", "archive"},
+		{"BZh91AY", "archive"},
+		{"\x28\xB5\x2F\xFD", "archive"},
+		{string(tar), "archive"},
+		{"hello world\n", "text"},
+		{"<html><body>", "text"},
+		{"\x00\x01\x02\x03\xff", "other"},
+	} {
+		if got, want := classifyContent([]byte(tc.header)), tc.want; got != want {
+			t.Errorf("%v: %q: got %v, want %v", i, tc.header, got, want)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Only the start of the file is sampled.
+	long := "%PDF-1.4\n" + strings.Repeat("\x00", 2*contentSampleSize)
+	for i, tc := range []struct {
+		contents string
+		want     string
+	}{
+		{"", "other"},
+		{"text", "text"},
+		{long, "document"},
+	} {
+		filename := filepath.Join(tmpDir, "f")
+		if err := ioutil.WriteFile(filename, []byte(tc.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		typ, err := detectContentType(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := typ, tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	if _, err := detectContentType(filepath.Join(tmpDir, "missing")); err == nil {
+		t.Errorf("expected an error")
+	}
+	for _, typ := range contentTypes {
+		if err := validateContentType(typ); err != nil {
+			t.Errorf("%v: %v", typ, err)
+		}
+	}
+	if err := validateContentType("spreadsheet"); err == nil || !strings.Contains(err.Error(), "unsupported content type: spreadsheet") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
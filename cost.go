@@ -0,0 +1,123 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// tierCost is the number, total size and estimated monthly cost of the
+// files assigned to a storage tier.
+type tierCost struct {
+	tier         config.StorageTier
+	files, bytes int64
+	cost         float64
+}
+
+// costEstimate records the estimated monthly cost of storing files in
+// cloud storage, as determined by the cost estimators, if any, of their
+// layouts. Files whose layouts do not estimate costs are counted as
+// unpriced.
+type costEstimate struct {
+	now                          time.Time
+	tiers                        []tierCost
+	unpricedFiles, unpricedBytes int64
+	files, bytes                 int64
+	cost                         float64
+}
+
+func newCostEstimate(now time.Time) *costEstimate {
+	return &costEstimate{
+		now: now,
+		tiers: []tierCost{
+			{tier: config.StandardTier},
+			{tier: config.InfrequentTier},
+			{tier: config.ArchiveTier},
+		},
+	}
+}
+
+func (ce *costEstimate) add(calc interface{}, modTime time.Time, size int64) {
+	ce.files++
+	ce.bytes += size
+	est, ok := calc.(config.CostEstimator)
+	if !ok {
+		ce.unpricedFiles++
+		ce.unpricedBytes += size
+		return
+	}
+	age := ce.now.Sub(modTime)
+	if age < 0 {
+		age = 0
+	}
+	cost := est.MonthlyCost(size, age)
+	tc := &ce.tiers[est.Tier(age)]
+	tc.files++
+	tc.bytes += size
+	tc.cost += cost
+	ce.cost += cost
+}
+
+func (ce *costEstimate) print(out io.Writer, root string) {
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Estimated monthly storage cost for %v: %.2f for %v files, %v\n", root, ce.cost, ce.files, fsize(ce.bytes))
+	for _, tc := range ce.tiers {
+		ifmt.Fprintf(out, "%12v : %12v files %20v %14.2f (%6.2f%%)\n",
+			tc.tier, tc.files, fsize(tc.bytes), tc.cost, 100*safeRatio(tc.cost, ce.cost))
+	}
+	if ce.unpricedFiles > 0 {
+		ifmt.Fprintf(out, "%12v : %12v files %20v (no cloud layout)\n", "unpriced", ce.unpricedFiles, fsize(ce.unpricedBytes))
+	}
+}
+
+func safeRatio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+func (ce *costEstimate) writeTSV(out io.Writer) error {
+	wr := csv.NewWriter(out)
+	wr.Comma = '\t'
+	wr.Write([]string{"tier", "files", "bytes", "monthly_cost"})
+	for _, tc := range ce.tiers {
+		wr.Write([]string{
+			tc.tier.String(),
+			strconv.FormatInt(tc.files, 10),
+			strconv.FormatInt(tc.bytes, 10),
+			strconv.FormatFloat(tc.cost, 'f', 2, 64),
+		})
+	}
+	wr.Flush()
+	return wr.Error()
+}
+
+// summaryCost prints, and optionally writes as tsv, the estimated monthly
+// cost of storing the files stored for root and its descendants in cloud
+// storage, as per the cloud layouts configured for them.
+func summaryCost(ctx context.Context, out io.Writer, root, tsvOut string) error {
+	ce := newCostEstimate(time.Now())
+	if err := forEachFile(ctx, root, func(prefix string, fi filewalk.Info) {
+		ce.add(calculatorFor(globalConfig.LayoutFor(prefix), prefix, fi.Name), fi.ModTime, fi.Size)
+	}); err != nil {
+		return err
+	}
+	if ce.unpricedFiles == ce.files && ce.files > 0 {
+		return fmt.Errorf("no cloud layout is configured for %v", root)
+	}
+	ce.print(out, root)
+	return writeHistogramTSV(tsvOut, ce.writeTSV)
+}
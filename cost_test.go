@@ -0,0 +1,53 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/file/diskusage"
+)
+
+type flatRate struct{}
+
+func (flatRate) Tier(age time.Duration) config.StorageTier {
+	if age > time.Hour {
+		return config.ArchiveTier
+	}
+	return config.StandardTier
+}
+
+func (fr flatRate) MonthlyCost(size int64, age time.Duration) float64 {
+	if fr.Tier(age) == config.ArchiveTier {
+		return float64(size) / 10
+	}
+	return float64(size)
+}
+
+func TestCostEstimate(t *testing.T) {
+	now := time.Now()
+	ce := newCostEstimate(now)
+	ce.add(flatRate{}, now, 10)
+	ce.add(flatRate{}, now.Add(time.Minute), 5)
+	ce.add(flatRate{}, now.Add(-2*time.Hour), 100)
+	ce.add(diskusage.NewIdentity(), now, 1000)
+	if got, want := ce.cost, 25.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ce.tiers[config.StandardTier].files, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ce.tiers[config.ArchiveTier].bytes, int64(100); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ce.unpricedBytes, int64(1000); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ce.files, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -6,22 +6,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/runlog"
 	"cloudeng.io/errors"
 	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 )
 
 type eraseFlags struct {
 	ReallyDelete bool `subcmd:"really,false,must be set to erase the database"`
+	DryRun       bool `subcmd:"dry-run,false,display the database that would be erased and its contents without deleting anything"`
 }
 
 func dbErase(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*eraseFlags)
+	if flagValues.DryRun {
+		return dbEraseDryRun(ctx, args[0])
+	}
 	if !flagValues.ReallyDelete {
 		fmt.Printf("use --really to erase/delete the database\n")
 		return nil
@@ -34,6 +46,59 @@ func dbErase(ctx context.Context, values interface{}, args []string) error {
 	return dbCfg.Delete(ctx)
 }
 
+// dbEraseDryRun displays the database that would be erased for prefix
+// along with a summary of its contents.
+func dbEraseDryRun(ctx context.Context, prefix string) error {
+	dbCfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok {
+		return fmt.Errorf("no database found for %v", prefix)
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Printf("would delete: %s\n", dbCfg.Description)
+	st, err := statDatabase(dbCfg)
+	if err != nil {
+		return err
+	}
+	if !st.exists {
+		ifmt.Printf("     Status: does not exist\n")
+		return nil
+	}
+	ifmt.Printf("       Size: %v\n", fsize(st.size))
+	ifmt.Printf("Last Update: %v (%v ago)\n", displayTime(st.updated).Format(time.RFC3339), time.Since(st.updated).Truncate(time.Second))
+	if st.locked {
+		// Opening the database would block until the writer is done.
+		ifmt.Printf("     Status: locked (in use by a writer)\n")
+		return nil
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		ifmt.Printf("% 11v: % 10v entries\n", s.Name, s.NumEntries)
+	}
+	nPrefixes, err := db.Total(ctx, filewalk.TotalPrefixCount, filewalk.Global())
+	if err != nil {
+		return err
+	}
+	nFiles, err := db.Total(ctx, filewalk.TotalFileCount, filewalk.Global())
+	if err != nil {
+		return err
+	}
+	nErrors, err := db.Total(ctx, filewalk.TotalErrorCount, filewalk.Global())
+	if err != nil {
+		return err
+	}
+	ifmt.Printf("   Prefixes: % 10v\n", nPrefixes)
+	ifmt.Printf("      Files: % 10v\n", nFiles)
+	ifmt.Printf("     Errors: % 10v\n", nErrors)
+	return globalDatabaseManager.CloseAll(ctx)
+}
+
 func dbRefreshStats(ctx context.Context, values interface{}, args []string) error {
 	db, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ResetStats())
 	if err != nil {
@@ -47,7 +112,7 @@ func dbRefreshStats(ctx context.Context, values interface{}, args []string) erro
 		layout := globalConfig.LayoutFor(prefix)
 		info.DiskUsage = 0
 		for _, file := range info.Files {
-			info.DiskUsage += layout.Calculator.Calculate(file.Size)
+			info.DiskUsage += calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
 		}
 		if err := db.Set(ctx, prefix, info); err != nil {
 			return fmt.Errorf("failed to set: %v: %v", prefix, err)
@@ -113,10 +178,80 @@ func dbTotalSizeAndKeys(ctx context.Context, prefix string) (size, entries int64
 	return
 }
 
+type compactFlags struct {
+	DryRun bool `subcmd:"dry-run,false,'compact a temporary copy of the database to report the space that compaction would reclaim without modifying the database itself'"`
+}
+
+// localDBSize returns the total size of the files of the local database
+// in dir, as reported by its Stats method.
+func localDBSize(ctx context.Context, dir string) (int64, error) {
+	db, err := localdb.Open(ctx, dir, []filewalk.DatabaseOption{filewalk.ReadOnly()})
+	if err != nil {
+		return 0, err
+	}
+	stats, err := db.Stats()
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(db.Close(ctx))
+	var size int64
+	for _, stat := range stats {
+		size += stat.Size
+	}
+	return size, errs.Err()
+}
+
+// projectedCompaction compacts a copy of the database for prefix, made
+// whilst holding its lock, and returns its size before and after
+// compaction. The database itself is not modified.
+func projectedCompaction(ctx context.Context, prefix string) (before, after int64, err error) {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return 0, 0, fmt.Errorf("--dry-run is only supported for local databases: %v", prefix)
+	}
+	tmpDir, err := ioutil.TempDir("", "idu-compact-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+	copyDir := filepath.Join(tmpDir, "db")
+	if _, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly()); err != nil {
+		return 0, 0, err
+	}
+	errs := errors.M{}
+	errs.Append(writeSnapshot(copyDir, cfg.Prefix, cfg.Description, cfg.Location))
+	errs.Append(globalDatabaseManager.Close(ctx, prefix))
+	if err := errs.Err(); err != nil {
+		return 0, 0, err
+	}
+	if before, err = localDBSize(ctx, copyDir); err != nil {
+		return 0, 0, err
+	}
+	db, err := localdb.Open(ctx, copyDir, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := db.CompactAndClose(ctx); err != nil {
+		return 0, 0, err
+	}
+	after, err = localDBSize(ctx, copyDir)
+	return before, after, err
+}
+
 func dbCompact(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*compactFlags)
 	var errs errors.M
 	ifmt := message.NewPrinter(language.English)
 	for _, prefix := range args {
+		if flagValues.DryRun {
+			before, after, err := projectedCompaction(ctx, prefix)
+			if err != nil {
+				errs.Append(err)
+				continue
+			}
+			ifmt.Printf("compaction of the database for: %v: would reduce its size from %v to %v, saving %v\n",
+				prefix, fsize(before), fsize(after), fsize(before-after))
+			continue
+		}
 		beforeSize, beforeEntries, _ := dbTotalSizeAndKeys(ctx, prefix)
 		if err := globalDatabaseManager.Compact(ctx, prefix); err != nil {
 			errs.Append(err)
@@ -162,3 +297,161 @@ func dbRmPrefixes(ctx context.Context, values interface{}, args []string) error
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	return errs.Err()
 }
+
+// localDBLockInfoFilename is the file written by cloudeng.io/file/filewalk/localdb
+// whilst a database is locked for writing.
+const localDBLockInfoFilename = "db.info"
+
+type dbStatus struct {
+	exists, locked bool
+	size           int64
+	updated        time.Time
+}
+
+// statDatabase determines the status of a database without opening it,
+// since opening it may block on a lock held by another process.
+func statDatabase(cfg config.Database) (dbStatus, error) {
+	var st dbStatus
+	if len(cfg.Location) == 0 {
+		return st, fmt.Errorf("database location is unknown")
+	}
+	entries, err := ioutil.ReadDir(cfg.Location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		st.exists = true
+		if entry.Name() == localDBLockInfoFilename {
+			st.locked = true
+		}
+		st.size += entry.Size()
+		if entry.ModTime().After(st.updated) {
+			st.updated = entry.ModTime()
+		}
+	}
+	return st, nil
+}
+
+func dbList(ctx context.Context, values interface{}, args []string) error {
+	dbs := make([]config.Database, len(globalConfig.Databases))
+	copy(dbs, globalConfig.Databases)
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].Prefix < dbs[j].Prefix
+	})
+	ifmt := message.NewPrinter(language.English)
+	for i, cfg := range dbs {
+		ifmt.Printf("%v\n", cfg.Prefix)
+		ifmt.Printf("%s\n", strings.Repeat("=", len(cfg.Prefix)))
+		ifmt.Printf("     Database: %v\n", cfg.Description)
+		st, err := statDatabase(cfg)
+		switch {
+		case err != nil:
+			ifmt.Printf("       Status: unknown: %v\n", err)
+		case !st.exists:
+			ifmt.Printf("       Status: does not exist\n")
+		default:
+			status := "ok"
+			if st.locked {
+				status = "locked (in use by a writer)"
+			}
+			ifmt.Printf("       Status: %v\n", status)
+			ifmt.Printf("         Size: %v\n", fsize(st.size))
+			ifmt.Printf(" Last Updated: %v (%v ago)\n", displayTime(st.updated).Format(time.RFC3339), time.Since(st.updated).Truncate(time.Second))
+		}
+		if i < len(dbs)-1 {
+			ifmt.Printf("\n")
+		}
+	}
+	return nil
+}
+
+type historyFlags struct {
+	Limit      int  `subcmd:"limit,0,'display only the most recent runs, zero displays all runs'"`
+	Exclusions bool `subcmd:"exclusion-hits,false,'display the number of paths matched by each configured exclusion for each run'"`
+	JSON       bool `subcmd:"json,false,'write each run as a JSON object, one per line, as it is recorded in the run log'"`
+}
+
+// relativeTime returns a human readable description of how long before
+// now t occurred, eg. 3 days ago.
+func relativeTime(now, t time.Time) string {
+	d := now.Sub(t)
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %v ago", unit)
+		}
+		return fmt.Sprintf("%v %vs ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int64(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour")
+	case d < 365*24*time.Hour:
+		return plural(int64(d/(24*time.Hour)), "day")
+	}
+	return plural(int64(d/(365*24*time.Hour)), "year")
+}
+
+// dbHistory displays the run log for the database for a prefix.
+func dbHistory(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*historyFlags)
+	cfg, ok := globalConfig.DatabaseFor(args[0])
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", args[0])
+	}
+	if len(cfg.Location) == 0 {
+		return fmt.Errorf("database location is unknown: %v", cfg.Description)
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil {
+		return err
+	}
+	if n := flagValues.Limit; n > 0 && n < len(entries) {
+		entries = entries[len(entries)-n:]
+	}
+	if flagValues.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	now := time.Now()
+	ifmt := message.NewPrinter(language.English)
+	for _, e := range entries {
+		ifmt.Printf("%v %-15v %10v % 10v prefixes % 12v files % 8v errors %v",
+			displayTime(e.Start).Format(time.RFC3339),
+			"("+relativeTime(now, e.Start)+")",
+			e.Stop.Sub(e.Start).Truncate(time.Second),
+			e.Prefixes, e.Files, e.Errors, e.Prefix)
+		if len(e.Note) > 0 {
+			ifmt.Printf(": %v", e.Note)
+		}
+		if e.Partial {
+			ifmt.Printf(" (partial)")
+		}
+		if len(e.Err) > 0 {
+			ifmt.Printf(" (failed: %v)", e.Err)
+		}
+		ifmt.Printf("\n")
+		if flagValues.Exclusions {
+			for _, h := range e.Exclusions {
+				ifmt.Printf("    % 12v : %v: %q\n", h.Hits, h.Prefix, h.Pattern)
+			}
+		}
+		for _, m := range e.SkippedMounts {
+			ifmt.Printf("    skipped other filesystem: %v\n", m)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Now()
+	for i, tc := range []struct {
+		ago  time.Duration
+		want string
+	}{
+		{10 * time.Second, "just now"},
+		{time.Minute, "1 minute ago"},
+		{45 * time.Minute, "45 minutes ago"},
+		{5 * time.Hour, "5 hours ago"},
+		{3*24*time.Hour + time.Hour, "3 days ago"},
+		{800 * 24 * time.Hour, "2 years ago"},
+	} {
+		if got, want := relativeTime(now, now.Add(-tc.ago)), tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// probeLock returns true if the database lock file could be locked, for
+// reading if readOnly is set, without blocking; the lock is released
+// immediately. A lock file that does not exist is unlocked.
+func probeLock(filename string, readOnly bool) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	how := syscall.LOCK_EX
+	if readOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -7,7 +7,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"cloudeng.io/cmd/idu/internal/config"
 	"cloudeng.io/errors"
@@ -17,11 +22,14 @@ import (
 
 type databaseManager struct {
 	sync.Mutex
-	dbs map[string]filewalk.Database
+	dbs map[string]*managedDatabase
+	// lru lists the prefixes of the open databases, least recently
+	// used first.
+	lru []string
 }
 
 var globalDatabaseManager = databaseManager{
-	dbs: map[string]filewalk.Database{},
+	dbs: map[string]*managedDatabase{},
 }
 
 func (dbm *databaseManager) DatabaseFor(ctx context.Context, prefix string, opts ...filewalk.DatabaseOption) (filewalk.Database, error) {
@@ -31,7 +39,7 @@ func (dbm *databaseManager) DatabaseFor(ctx context.Context, prefix string, opts
 	return db, err
 }
 
-func (dbm *databaseManager) databaseForLocked(ctx context.Context, prefix string, opts ...filewalk.DatabaseOption) (filewalk.Database, config.Database, error) {
+func (dbm *databaseManager) databaseForLocked(ctx context.Context, prefix string, opts ...filewalk.DatabaseOption) (*managedDatabase, config.Database, error) {
 	cfg, ok := globalConfig.DatabaseFor(prefix)
 	if !ok {
 		return nil, cfg, fmt.Errorf("no database is configured for %v", prefix)
@@ -39,15 +47,389 @@ func (dbm *databaseManager) databaseForLocked(ctx context.Context, prefix string
 	if db, ok := dbm.dbs[cfg.Prefix]; ok {
 		return db, cfg, nil
 	}
-	db, err := cfg.Open(ctx, opts...)
-	if err != nil {
-		return nil, cfg, fmt.Errorf("failed to open database for %v: %v", prefix, err)
+	db := &managedDatabase{dbm: dbm, cfg: cfg, opts: opts}
+	if err := db.openLocked(ctx); err != nil {
+		return nil, cfg, err
 	}
 	dbm.dbs[cfg.Prefix] = db
 	debug(ctx, 1, "prefix: %v: using database %v\n", prefix, cfg.Description)
 	return db, cfg, nil
 }
 
+// touchLocked marks the database for prefix as the most recently used.
+func (dbm *databaseManager) touchLocked(prefix string) {
+	for i, p := range dbm.lru {
+		if p == prefix {
+			dbm.lru = append(dbm.lru[:i], dbm.lru[i+1:]...)
+			break
+		}
+	}
+	dbm.lru = append(dbm.lru, prefix)
+}
+
+func (dbm *databaseManager) forgetLocked(prefix string) {
+	for i, p := range dbm.lru {
+		if p == prefix {
+			dbm.lru = append(dbm.lru[:i], dbm.lru[i+1:]...)
+			return
+		}
+	}
+}
+
+// evictLocked closes least recently used databases that are not
+// currently in use until there is room to open another one.
+func (dbm *databaseManager) evictLocked(ctx context.Context) error {
+	max := globalConfig.MaxOpenDatabases
+	if max <= 0 {
+		return nil
+	}
+	errs := errors.M{}
+	for i := 0; len(dbm.lru) >= max && i < len(dbm.lru); {
+		db := dbm.dbs[dbm.lru[i]]
+		if db.inUse > 0 {
+			i++
+			continue
+		}
+		debug(ctx, 1, "closing least recently used database: %v\n", db.cfg.Description)
+		errs.Append(db.db.Close(ctx))
+		db.db = nil
+		dbm.lru = append(dbm.lru[:i], dbm.lru[i+1:]...)
+	}
+	if len(dbm.lru) >= max {
+		debug(ctx, 1, "all %v open databases are in use, opening another\n", len(dbm.lru))
+	}
+	return errs.Err()
+}
+
+// lockTimeoutError is returned when a database cannot be opened because
+// it remains locked, eg. by a running analyze, beyond the timeout
+// specified via --db-lock-timeout or the number of attempts specified
+// via --db-lock-retries.
+type lockTimeoutError struct {
+	prefix   string
+	waited   time.Duration
+	attempts int
+}
+
+func (e *lockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v (%v attempts) waiting to lock the database for %v, it is in use by another idu command", e.waited.Round(time.Millisecond), e.attempts, e.prefix)
+}
+
+// maxLockBackoff is the longest delay between attempts to lock a database.
+const maxLockBackoff = time.Minute
+
+// waitForLock waits for the lock file of the local database described by
+// cfg to become available by attempting to lock it without blocking,
+// waiting for exponentially increasing intervals, starting at
+// --db-lock-backoff, between attempts. It gives up once --db-lock-retries
+// attempts have been made or --db-lock-timeout has elapsed, whichever
+// comes first.
+func waitForLock(ctx context.Context, cfg config.Database, readOnly bool) error {
+	timeout, retries, delay := globalFlags.DBLockTimeout, globalFlags.DBLockRetries, globalFlags.DBLockBackoff
+	if delay <= 0 {
+		delay = time.Second
+	}
+	filename := filepath.Join(cfg.Location, localDBLockFilename)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		available, err := probeLock(filename, readOnly)
+		if err != nil || available {
+			return err
+		}
+		waited := time.Since(start)
+		if remaining := timeout - waited; timeout > 0 && delay > remaining {
+			delay = remaining
+		}
+		if (retries > 0 && attempt >= retries) || (timeout > 0 && delay <= 0) {
+			return &lockTimeoutError{prefix: cfg.Prefix, waited: waited, attempts: attempt}
+		}
+		debug(ctx, 1, "database for %v is locked, retrying in %v\n", cfg.Prefix, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxLockBackoff {
+			delay = maxLockBackoff
+		}
+	}
+}
+
+// openDatabase opens the database described by cfg. The local database
+// waits for the database lock to be released indefinitely unless either
+// --db-lock-timeout or --db-lock-retries is set, in which case the lock
+// is retried as per waitForLock before the database is opened. Testing
+// the lock, rather than abandoning a blocked open, ensures that the lock
+// is never acquired after the open has been given up on.
+func openDatabase(ctx context.Context, cfg config.Database, opts ...filewalk.DatabaseOption) (filewalk.Database, error) {
+	if len(cfg.Location) == 0 || (globalFlags.DBLockTimeout <= 0 && globalFlags.DBLockRetries <= 0) {
+		return cfg.Open(ctx, opts...)
+	}
+	var dbOpts filewalk.DatabaseOptions
+	for _, fn := range opts {
+		fn(&dbOpts)
+	}
+	if err := waitForLock(ctx, cfg, dbOpts.ReadOnly); err != nil {
+		return nil, err
+	}
+	return cfg.Open(ctx, opts...)
+}
+
+// managedDatabase is a filewalk.Database that is transparently closed when
+// the maximum number of open databases is reached and it is the least
+// recently used, and then reopened, using the same options, when next
+// used. Statistics are only reset, as per filewalk.ResetStats, when the
+// database is first opened and not when it is reopened. It is never closed whilst any of its methods are being called or
+// any of its scanners are active.
+type managedDatabase struct {
+	dbm   *databaseManager
+	cfg   config.Database
+	opts  []filewalk.DatabaseOption
+	db    filewalk.Database // nil when closed, guarded by dbm.
+	inUse int               // guarded by dbm.
+}
+
+func (md *managedDatabase) openLocked(ctx context.Context) error {
+	if err := md.dbm.evictLocked(ctx); err != nil {
+		return err
+	}
+	db, err := openDatabase(ctx, md.cfg, md.opts...)
+	if err != nil {
+		if _, ok := err.(*lockTimeoutError); ok {
+			return err
+		}
+		return fmt.Errorf("failed to open database for %v: %v", md.cfg.Prefix, err)
+	}
+	md.db = db
+	md.opts = withoutResetStats(md.opts)
+	md.dbm.touchLocked(md.cfg.Prefix)
+	return nil
+}
+
+// withoutResetStats returns opts with any request to reset the database's
+// statistics removed.
+func withoutResetStats(opts []filewalk.DatabaseOption) []filewalk.DatabaseOption {
+	var dbOpts filewalk.DatabaseOptions
+	for _, fn := range opts {
+		fn(&dbOpts)
+	}
+	if !dbOpts.ResetStats {
+		return opts
+	}
+	dbOpts.ResetStats = false
+	return []filewalk.DatabaseOption{func(o *filewalk.DatabaseOptions) {
+		*o = dbOpts
+	}}
+}
+
+func (md *managedDatabase) acquire(ctx context.Context) (filewalk.Database, error) {
+	md.dbm.Lock()
+	defer md.dbm.Unlock()
+	if md.db == nil {
+		if err := md.openLocked(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		md.dbm.touchLocked(md.cfg.Prefix)
+	}
+	md.inUse++
+	return md.db, nil
+}
+
+func (md *managedDatabase) release() {
+	md.dbm.Lock()
+	defer md.dbm.Unlock()
+	md.inUse--
+}
+
+// closeLocked closes the database, if open, and removes it from the
+// manager.
+func (md *managedDatabase) closeLocked(ctx context.Context, compact bool) error {
+	delete(md.dbm.dbs, md.cfg.Prefix)
+	md.dbm.forgetLocked(md.cfg.Prefix)
+	db := md.db
+	md.db = nil
+	switch {
+	case db != nil && compact:
+		return db.CompactAndClose(ctx)
+	case db != nil:
+		return db.Close(ctx)
+	case compact:
+		db, err := openDatabase(ctx, md.cfg, md.opts...)
+		if err != nil {
+			return err
+		}
+		return db.CompactAndClose(ctx)
+	}
+	return nil
+}
+
+func (md *managedDatabase) Set(ctx context.Context, prefix string, info *filewalk.PrefixInfo) error {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer md.release()
+	return db.Set(ctx, prefix, info)
+}
+
+func (md *managedDatabase) Get(ctx context.Context, prefix string, info *filewalk.PrefixInfo) (bool, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer md.release()
+	return db.Get(ctx, prefix, info)
+}
+
+func (md *managedDatabase) Delete(ctx context.Context, separator string, prefixes []string, recurse bool) (int, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer md.release()
+	return db.Delete(ctx, separator, prefixes, recurse)
+}
+
+func (md *managedDatabase) DeleteErrors(ctx context.Context, prefixes []string) (int, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer md.release()
+	return db.DeleteErrors(ctx, prefixes)
+}
+
+func (md *managedDatabase) Save(ctx context.Context) error {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer md.release()
+	return db.Save(ctx)
+}
+
+func (md *managedDatabase) Close(ctx context.Context) error {
+	md.dbm.Lock()
+	defer md.dbm.Unlock()
+	return md.closeLocked(ctx, false)
+}
+
+func (md *managedDatabase) CompactAndClose(ctx context.Context) error {
+	md.dbm.Lock()
+	defer md.dbm.Unlock()
+	return md.closeLocked(ctx, true)
+}
+
+func (md *managedDatabase) UserIDs(ctx context.Context) ([]string, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer md.release()
+	return db.UserIDs(ctx)
+}
+
+func (md *managedDatabase) GroupIDs(ctx context.Context) ([]string, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer md.release()
+	return db.GroupIDs(ctx)
+}
+
+func (md *managedDatabase) Metrics() []filewalk.MetricName {
+	db, err := md.acquire(context.Background())
+	if err != nil {
+		return nil
+	}
+	defer md.release()
+	return db.Metrics()
+}
+
+func (md *managedDatabase) Stats() ([]filewalk.DatabaseStats, error) {
+	db, err := md.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer md.release()
+	return db.Stats()
+}
+
+func (md *managedDatabase) Total(ctx context.Context, name filewalk.MetricName, opts ...filewalk.MetricOption) (int64, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer md.release()
+	return db.Total(ctx, name, opts...)
+}
+
+func (md *managedDatabase) TopN(ctx context.Context, name filewalk.MetricName, n int, opts ...filewalk.MetricOption) ([]filewalk.Metric, error) {
+	db, err := md.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer md.release()
+	return db.TopN(ctx, name, n, opts...)
+}
+
+func (md *managedDatabase) NewScanner(prefix string, limit int, opts ...filewalk.ScannerOption) filewalk.DatabaseScanner {
+	return &managedScanner{md: md, prefix: prefix, limit: limit, opts: opts}
+}
+
+// managedScanner keeps its database open from the first call to Scan
+// until Scan returns false or, for scans that are stopped early, until Err
+// is called. No further results are returned once Err has been called.
+type managedScanner struct {
+	md     *managedDatabase
+	prefix string
+	limit  int
+	opts   []filewalk.ScannerOption
+	sc     filewalk.DatabaseScanner
+	done   bool
+	err    error
+}
+
+func (ms *managedScanner) Scan(ctx context.Context) bool {
+	if ms.done {
+		return false
+	}
+	if ms.sc == nil {
+		db, err := ms.md.acquire(ctx)
+		if err != nil {
+			ms.err, ms.done = err, true
+			return false
+		}
+		ms.sc = db.NewScanner(ms.prefix, ms.limit, ms.opts...)
+	}
+	if ms.sc.Scan(ctx) {
+		return true
+	}
+	ms.done = true
+	ms.md.release()
+	return false
+}
+
+func (ms *managedScanner) PrefixInfo() (string, *filewalk.PrefixInfo) {
+	return ms.sc.PrefixInfo()
+}
+
+func (ms *managedScanner) Err() error {
+	if !ms.done && ms.sc != nil {
+		ms.done = true
+		ms.md.release()
+	}
+	if ms.err != nil {
+		return ms.err
+	}
+	if ms.sc == nil {
+		return nil
+	}
+	return ms.sc.Err()
+}
+
 func (dbm *databaseManager) Set(ctx context.Context, prefix string, info *filewalk.PrefixInfo, opts ...filewalk.DatabaseOption) error {
 	db, err := dbm.DatabaseFor(ctx, prefix, opts...)
 	if err != nil {
@@ -72,26 +454,34 @@ func (dbm *databaseManager) Delete(ctx context.Context, separator, prefix string
 	return db.Delete(ctx, separator, prefixes, true)
 }
 
+// DeletePrefix deletes prefix, but not its children.
+func (dbm *databaseManager) DeletePrefix(ctx context.Context, separator, prefix string, opts ...filewalk.DatabaseOption) error {
+	db, err := dbm.DatabaseFor(ctx, prefix, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = db.Delete(ctx, separator, []string{prefix}, false)
+	return err
+}
+
 func (dbm *databaseManager) Compact(ctx context.Context, prefix string) error {
 	dbm.Lock()
 	defer dbm.Unlock()
-	db, cfg, err := dbm.databaseForLocked(ctx, prefix)
+	db, _, err := dbm.databaseForLocked(ctx, prefix)
 	if err != nil {
 		return err
 	}
-	delete(dbm.dbs, cfg.Prefix)
-	return db.CompactAndClose(ctx)
+	return db.closeLocked(ctx, true)
 }
 
 func (dbm *databaseManager) Close(ctx context.Context, prefix string) error {
 	dbm.Lock()
 	defer dbm.Unlock()
-	db, cfg, err := dbm.databaseForLocked(ctx, prefix)
+	db, _, err := dbm.databaseForLocked(ctx, prefix)
 	if err != nil {
 		return err
 	}
-	delete(dbm.dbs, cfg.Prefix)
-	return db.Close(ctx)
+	return db.closeLocked(ctx, false)
 }
 
 func (dbm *databaseManager) CloseAll(ctx context.Context) error {
@@ -99,12 +489,81 @@ func (dbm *databaseManager) CloseAll(ctx context.Context) error {
 	defer dbm.Unlock()
 	errs := errors.M{}
 	for _, db := range dbm.dbs {
-		errs.Append(db.Close(ctx))
+		errs.Append(db.closeLocked(ctx, false))
 	}
-	dbm.dbs = map[string]filewalk.Database{}
+	dbm.dbs = map[string]*managedDatabase{}
+	dbm.lru = nil
 	return errs.Err()
 }
 
+// isNestedPrefix returns true if prefix is the same as, or lies within, parent
+// and both are stored in the same database.
+func isNestedPrefix(parent, prefix string) bool {
+	sep := globalConfig.LayoutFor(parent).Separator
+	if prefix != parent && !strings.HasPrefix(prefix, strings.TrimSuffix(parent, sep)+sep) {
+		return false
+	}
+	pdb, pok := globalConfig.DatabaseFor(parent)
+	db, ok := globalConfig.DatabaseFor(prefix)
+	return pok && ok && pdb.Prefix == db.Prefix
+}
+
+// overlappingPrefixes returns the supplied prefixes with any that are
+// nested within another (see isNestedPrefix) removed, as well as the
+// nested prefixes that were removed. Identical prefixes are reduced to one.
+func overlappingPrefixes(prefixes []string) (merged, nested []string) {
+	for i, prefix := range prefixes {
+		overlaps := false
+		for j, parent := range prefixes {
+			if i == j || !isNestedPrefix(parent, prefix) {
+				continue
+			}
+			// For identical prefixes, keep only the first.
+			if parent != prefix || j < i {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			nested = append(nested, prefix)
+			continue
+		}
+		merged = append(merged, prefix)
+	}
+	return
+}
+
+// mergePrefixes warns about overlapping prefixes and, if merge is set,
+// removes the nested ones.
+func mergePrefixes(prefixes []string, merge bool) []string {
+	merged, nested := overlappingPrefixes(prefixes)
+	if len(nested) == 0 {
+		return prefixes
+	}
+	if !merge {
+		fmt.Fprintf(os.Stderr, "warning: the following prefixes overlap with others and may be counted more than once, consider using --merge-identical-prefixes: %v\n", strings.Join(nested, ", "))
+		return prefixes
+	}
+	fmt.Fprintf(os.Stderr, "warning: ignoring the following overlapping prefixes: %v\n", strings.Join(nested, ", "))
+	return merged
+}
+
+// warnNestedDatabases warns that the usage of any prefixes within prefix
+// that have their own databases configured is stored in those databases
+// and hence is not included in summaries of prefix.
+func warnNestedDatabases(prefix string) {
+	nested := globalConfig.NestedDatabases(prefix)
+	if len(nested) == 0 {
+		return
+	}
+	prefixes := make([]string, len(nested))
+	for i, d := range nested {
+		prefixes[i] = d.Prefix
+	}
+	sort.Strings(prefixes)
+	fmt.Fprintf(os.Stderr, "warning: the following prefixes within %v have their own databases and are not included: %v\n", prefix, strings.Join(prefixes, ", "))
+}
+
 type userManager struct {
 	idmanager *userid.IDManager
 }
@@ -0,0 +1,255 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/file/filewalk"
+)
+
+func TestDatabaseManagerLRU(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cfg := "max_open_databases: 2\ndatabases:\n"
+	for _, p := range []string{"/a", "/b", "/c"} {
+		cfg += fmt.Sprintf("  - prefix: %v\n    type: local\n    directory: %v\n", p, filepath.Join(tmpDir, p))
+	}
+	globalConfig, err = config.ParseConfig([]byte(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm := &databaseManager{dbs: map[string]*managedDatabase{}}
+	defer dbm.CloseAll(ctx)
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if err := dbm.Set(ctx, p+"/x", &filewalk.PrefixInfo{Size: int64(len(p))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := dbm.lru, []string{"/b", "/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if dbm.dbs["/a"].db != nil {
+		t.Errorf("/a should have been closed")
+	}
+
+	// A scanner in progress prevents its database from being closed.
+	db, err := dbm.DatabaseFor(ctx, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := db.NewScanner("/b/x", 0)
+	if !sc.Scan(ctx) {
+		t.Fatalf("scan failed: %v", sc.Err())
+	}
+	var pi filewalk.PrefixInfo
+	if ok, err := dbm.Get(ctx, "/a/x", &pi); !ok || err != nil || pi.Size != 2 {
+		t.Fatalf("get: %v %v %v", ok, err, pi.Size)
+	}
+	if got, want := dbm.lru, []string{"/b", "/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for sc.Scan(ctx) {
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dbm.Get(ctx, "/c/x", &pi); !ok || err != nil || pi.Size != 2 {
+		t.Fatalf("get: %v %v %v", ok, err, pi.Size)
+	}
+	if got, want := dbm.lru, []string{"/a", "/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A scan that is stopped early releases its database once Err is called.
+	if err := dbm.Set(ctx, "/c/y", &filewalk.PrefixInfo{Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = dbm.DatabaseFor(ctx, "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc = db.NewScanner("/c/x", 0)
+	if !sc.Scan(ctx) {
+		t.Fatalf("scan failed: %v", sc.Err())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.Scan(ctx) {
+		t.Errorf("scan should have stopped")
+	}
+	if got, want := dbm.dbs["/c"].inUse, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ok, err := dbm.Get(ctx, "/b/x", &pi); !ok || err != nil || pi.Size != 2 {
+		t.Fatalf("get: %v %v %v", ok, err, pi.Size)
+	}
+	if ok, err := dbm.Get(ctx, "/a/x", &pi); !ok || err != nil || pi.Size != 2 {
+		t.Fatalf("get: %v %v %v", ok, err, pi.Size)
+	}
+	if got, want := dbm.lru, []string{"/b", "/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWithoutResetStats(t *testing.T) {
+	options := func(opts []filewalk.DatabaseOption) filewalk.DatabaseOptions {
+		var o filewalk.DatabaseOptions
+		for _, fn := range opts {
+			fn(&o)
+		}
+		return o
+	}
+	for _, tc := range []struct {
+		opts []filewalk.DatabaseOption
+		want filewalk.DatabaseOptions
+	}{
+		{nil, filewalk.DatabaseOptions{}},
+		{[]filewalk.DatabaseOption{filewalk.ResetStats()}, filewalk.DatabaseOptions{}},
+		{[]filewalk.DatabaseOption{filewalk.ReadOnly()}, filewalk.DatabaseOptions{ReadOnly: true}},
+		{[]filewalk.DatabaseOption{filewalk.ResetStats(), filewalk.ErrorsOnly()}, filewalk.DatabaseOptions{ErrorsOnly: true}},
+	} {
+		if got, want := options(withoutResetStats(tc.opts)), tc.want; got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestDatabaseLockTimeout(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cfg, err := config.ParseConfig([]byte(fmt.Sprintf("databases:\n  - prefix: /a\n    type: local\n    directory: %v\n", tmpDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabase(ctx, cfg.Databases[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(timeout, backoff time.Duration, retries int) {
+		globalFlags.DBLockTimeout, globalFlags.DBLockBackoff, globalFlags.DBLockRetries = timeout, backoff, retries
+	}(globalFlags.DBLockTimeout, globalFlags.DBLockBackoff, globalFlags.DBLockRetries)
+	globalFlags.DBLockBackoff = 10 * time.Millisecond
+
+	// Bounded by time.
+	globalFlags.DBLockTimeout, globalFlags.DBLockRetries = 100*time.Millisecond, 0
+	start := time.Now()
+	_, err = openDatabase(ctx, cfg.Databases[0])
+	if _, ok := err.(*lockTimeoutError); !ok {
+		t.Fatalf("unexpected or missing error: %v", err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > 5*time.Second {
+		t.Errorf("took %v", took)
+	}
+	if got, want := err.Error(), "waiting to lock the database for /a"; !strings.Contains(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Bounded by the number of attempts: 10, 20 and 40ms between them.
+	globalFlags.DBLockTimeout, globalFlags.DBLockRetries = 0, 4
+	_, err = openDatabase(ctx, cfg.Databases[0], filewalk.ReadOnly())
+	lerr, ok := err.(*lockTimeoutError)
+	if !ok {
+		t.Fatalf("unexpected or missing error: %v", err)
+	}
+	if got, want := lerr.attempts, 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := lerr.waited, 70*time.Millisecond; got < want {
+		t.Errorf("got %v, want at least %v", got, want)
+	}
+
+	// Cancelation stops the retries.
+	globalFlags.DBLockTimeout, globalFlags.DBLockRetries = time.Hour, 0
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = openDatabase(cctx, cfg.Databases[0])
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected or missing error: %v", err)
+	}
+
+	// None of the abandoned attempts hold the lock once it is released and
+	// the next attempt succeeds.
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	globalFlags.DBLockTimeout, globalFlags.DBLockRetries = time.Second, 0
+	db, err = openDatabase(ctx, cfg.Databases[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openDatabase(ctx, cfg.Databases[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	defer func(cfg *config.Config) { globalConfig = cfg }(globalConfig)
+	var err error
+	globalConfig, err = config.ParseConfig([]byte("databases:\n  - prefix: /data\n    type: local\n    directory: ./db\n  - prefix: /data/other\n    type: local\n    directory: ./db-other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		parent, prefix string
+		nested         bool
+	}{
+		{"/data/a", "/data/a/b", true},
+		{"/data/a/", "/data/a/b", true},
+		{"/data/a", "/data/a", true},
+		{"/data/a", "/data/ab", false},
+		{"/data/a", "/data/b", false},
+		{"/data/a/b", "/data/a", false},
+		// Prefixes stored in different databases do not overlap.
+		{"/data", "/data/other/a", false},
+	} {
+		if got, want := isNestedPrefix(tc.parent, tc.prefix), tc.nested; got != want {
+			t.Errorf("%v, %v: got %v, want %v", tc.parent, tc.prefix, got, want)
+		}
+	}
+	for _, tc := range []struct {
+		prefixes, merged, nested []string
+	}{
+		{[]string{"/data/a", "/data/a/b"}, []string{"/data/a"}, []string{"/data/a/b"}},
+		{[]string{"/data/a/b", "/data/a"}, []string{"/data/a"}, []string{"/data/a/b"}},
+		{[]string{"/data/a", "/data/a"}, []string{"/data/a"}, []string{"/data/a"}},
+		{[]string{"/data/a", "/data/ab"}, []string{"/data/a", "/data/ab"}, nil},
+		{[]string{"/data/a", "/data/b"}, []string{"/data/a", "/data/b"}, nil},
+	} {
+		merged, nested := overlappingPrefixes(tc.prefixes)
+		if got, want := merged, tc.merged; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.prefixes, got, want)
+		}
+		if got, want := nested, tc.nested; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.prefixes, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"github.com/cosnicolaou/pudge"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type dbVerifyFlags struct {
+	List   bool `subcmd:"list,false,'display each unreadable or inconsistent prefix and the reason it failed verification'"`
+	Repair bool `subcmd:"repair,false,'delete the prefixes that cannot be read from the database, they will be recreated by the next analyze run'"`
+}
+
+// localDBPrefixFilename is the file used by cloudeng.io/file/filewalk/localdb
+// to store the per-prefix information.
+const localDBPrefixFilename = "prefix.pudge"
+
+// inconsistentPrefixInfo returns a description of the first internal
+// inconsistency found in pi, or the empty string if there are none.
+func inconsistentPrefixInfo(sep string, pi *filewalk.PrefixInfo) string {
+	if pi.Size < 0 {
+		return fmt.Sprintf("negative size: %v", pi.Size)
+	}
+	if pi.DiskUsage < 0 {
+		return fmt.Sprintf("negative disk usage: %v", pi.DiskUsage)
+	}
+	seen := make(map[string]bool, len(pi.Files)+len(pi.Children))
+	for _, entries := range [][]filewalk.Info{pi.Files, pi.Children} {
+		for _, fi := range entries {
+			switch {
+			case len(fi.Name) == 0:
+				return "empty file or child name"
+			case strings.Contains(fi.Name, sep):
+				return fmt.Sprintf("name contains the separator: %q", fi.Name)
+			case fi.Size < 0:
+				return fmt.Sprintf("negative size for %q: %v", fi.Name, fi.Size)
+			case seen[fi.Name]:
+				return fmt.Sprintf("duplicate file or child name: %q", fi.Name)
+			}
+			seen[fi.Name] = true
+		}
+	}
+	return ""
+}
+
+// dbVerifyResult records the outcome of verifying the prefixes in a
+// database.
+type dbVerifyResult struct {
+	healthy      int
+	unreadable   []string
+	inconsistent []string
+	reasons      map[string]string
+}
+
+// verifyPrefixes reads every prefix beneath root individually, rather than
+// via a scanner, so that a single unreadable prefix does not prevent the
+// remainder from being verified.
+func verifyPrefixes(ctx context.Context, db filewalk.Database, root, sep string) (dbVerifyResult, error) {
+	res := dbVerifyResult{reasons: map[string]string{}}
+	parent := strings.TrimSuffix(root, sep) + sep
+	sc := db.NewScanner("", 0, filewalk.KeysOnly(), filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, _ := sc.PrefixInfo()
+		if prefix != root && !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		var pi filewalk.PrefixInfo
+		ok, err := db.Get(ctx, prefix, &pi)
+		switch {
+		case err != nil:
+			res.unreadable = append(res.unreadable, prefix)
+			res.reasons[prefix] = err.Error()
+			continue
+		case !ok:
+			continue
+		}
+		if reason := inconsistentPrefixInfo(sep, &pi); len(reason) > 0 {
+			res.inconsistent = append(res.inconsistent, prefix)
+			res.reasons[prefix] = reason
+			continue
+		}
+		res.healthy++
+	}
+	return res, sc.Err()
+}
+
+// deleteUnreadable deletes the specified prefixes from the local database
+// in location. The database's Delete method cannot be used since it
+// must read each prefix in order to update the per-user and per-group
+// statistics. The database must already be open for writing, in which case
+// pudge returns the instance it is using.
+func deleteUnreadable(location string, prefixes []string) (int, error) {
+	pdb, err := pudge.Open(filepath.Join(location, localDBPrefixFilename), nil)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, prefix := range prefixes {
+		if err := pdb.Delete(prefix); err != nil && err != pudge.ErrKeyNotFound {
+			return deleted, fmt.Errorf("failed to delete: %v: %v", prefix, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// dbVerify checks that every prefix beneath the specified prefix can be
+// read from the database and is internally consistent.
+func dbVerify(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*dbVerifyFlags)
+	prefix := args[0]
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", prefix)
+	}
+	var opts []filewalk.DatabaseOption
+	if flagValues.Repair {
+		if len(cfg.Location) == 0 {
+			return fmt.Errorf("--repair is only supported for local databases: %v", prefix)
+		}
+	} else {
+		opts = append(opts, filewalk.ReadOnly())
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, opts...)
+	if err != nil {
+		return err
+	}
+	res, err := verifyPrefixes(ctx, db, prefix, globalConfig.LayoutFor(prefix).Separator)
+	errs := errors.M{}
+	errs.Append(err)
+	deleted := 0
+	if err == nil && flagValues.Repair && len(res.unreadable) > 0 {
+		deleted, err = deleteUnreadable(cfg.Location, res.unreadable)
+		errs.Append(err)
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	ifmt := message.NewPrinter(language.English)
+	if flagValues.List {
+		for _, p := range res.unreadable {
+			ifmt.Printf("unreadable: %v: %v\n", p, res.reasons[p])
+		}
+		for _, p := range res.inconsistent {
+			ifmt.Printf("inconsistent: %v: %v\n", p, res.reasons[p])
+		}
+	}
+	ifmt.Printf("%v healthy, %v unreadable, %v inconsistent prefixes\n", res.healthy, len(res.unreadable), len(res.inconsistent))
+	if flagValues.Repair {
+		ifmt.Printf("deleted %v unreadable prefixes, use refresh-stats to recalculate the database statistics\n", deleted)
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	if !flagValues.Repair && len(res.unreadable)+len(res.inconsistent) > 0 {
+		return fmt.Errorf("database for %v failed verification", prefix)
+	}
+	return nil
+}
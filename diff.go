@@ -0,0 +1,197 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type diffFlags struct {
+	TopN int  `subcmd:"top,20,'the number of changes to display, ordered by the absolute change in bytes, zero displays all changes'"`
+	JSON bool `subcmd:"json,false,'write each change as a JSON object, one per line'"`
+}
+
+// prefixChange is the change in the files and bytes stored directly within
+// a prefix between two scans. It is also the JSON representation of such a
+// change.
+type prefixChange struct {
+	Prefix      string `json:"prefix"`
+	Change      string `json:"change"` // One of added, removed, grew, shrank or changed.
+	FilesBefore int64  `json:"files_before"`
+	FilesAfter  int64  `json:"files_after"`
+	BytesBefore int64  `json:"bytes_before"`
+	BytesAfter  int64  `json:"bytes_after"`
+}
+
+func (pc prefixChange) bytesDelta() int64 {
+	return pc.BytesAfter - pc.BytesBefore
+}
+
+func (pc prefixChange) filesDelta() int64 {
+	return pc.FilesAfter - pc.FilesBefore
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// signedSize formats a change in size with an explicit sign.
+func signedSize(v int64) string {
+	if v < 0 {
+		return "-" + fsize(-v)
+	}
+	return "+" + fsize(v)
+}
+
+// newPrefixChange returns the change between before and after, either of
+// which may be nil, and false if there is none.
+func newPrefixChange(prefix string, before, after *filewalk.PrefixInfo) (prefixChange, bool) {
+	pc := prefixChange{Prefix: prefix}
+	if before != nil {
+		pc.FilesBefore, pc.BytesBefore = int64(len(before.Files)), before.DiskUsage
+	}
+	if after != nil {
+		pc.FilesAfter, pc.BytesAfter = int64(len(after.Files)), after.DiskUsage
+	}
+	switch {
+	case before == nil:
+		pc.Change = "added"
+	case after == nil:
+		pc.Change = "removed"
+	case pc.bytesDelta() > 0:
+		pc.Change = "grew"
+	case pc.bytesDelta() < 0:
+		pc.Change = "shrank"
+	case pc.filesDelta() != 0:
+		pc.Change = "changed"
+	default:
+		return pc, false
+	}
+	return pc, true
+}
+
+// diffScans returns the changes to root and its descendants between two
+// databases, ordered by the absolute change in bytes.
+func diffScans(ctx context.Context, dbBefore, dbAfter filewalk.Database, root, sep string) ([]prefixChange, error) {
+	parent := strings.TrimSuffix(root, sep) + sep
+	inTree := func(prefix string) bool {
+		return prefix == root || strings.HasPrefix(prefix, parent)
+	}
+	var changes []prefixChange
+	record := func(prefix string, before, after *filewalk.PrefixInfo) {
+		if !inTree(prefix) {
+			return
+		}
+		if pc, ok := newPrefixChange(prefix, before, after); ok {
+			changes = append(changes, pc)
+		}
+	}
+	// A scan cannot start at a prefix that is not in the database, as is
+	// the case for prefixes that were added or removed between the scans.
+	scanner := func(db filewalk.Database) (*compareScanner, error) {
+		var pi filewalk.PrefixInfo
+		ok, err := db.Get(ctx, root, &pi)
+		if err != nil || !ok {
+			return &compareScanner{done: true}, err
+		}
+		cs := &compareScanner{sc: db.NewScanner(root, 0, filewalk.ScanLimit(10000))}
+		cs.next(ctx)
+		return cs, nil
+	}
+	before, err := scanner(dbBefore)
+	if err != nil {
+		return nil, err
+	}
+	after, err := scanner(dbAfter)
+	if err != nil {
+		return nil, err
+	}
+	for !before.done || !after.done {
+		switch {
+		case after.done || (!before.done && before.prefix < after.prefix):
+			record(before.prefix, before.info, nil)
+			before.next(ctx)
+		case before.done || after.prefix < before.prefix:
+			record(after.prefix, nil, after.info)
+			after.next(ctx)
+		default:
+			record(after.prefix, before.info, after.info)
+			before.next(ctx)
+			after.next(ctx)
+		}
+	}
+	errs := errors.M{}
+	errs.Append(before.err())
+	errs.Append(after.err())
+	sort.SliceStable(changes, func(i, j int) bool {
+		di, dj := abs(changes[i].bytesDelta()), abs(changes[j].bytesDelta())
+		if di != dj {
+			return di > dj
+		}
+		return changes[i].Prefix < changes[j].Prefix
+	})
+	return changes, errs.Err()
+}
+
+// dbDiff reports the prefixes beneath a prefix that were added, removed,
+// grew or shrank between two scans, each specified as a database snapshot
+// directory or a prefix with a configured database.
+func dbDiff(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*diffFlags)
+	root := args[0]
+	dbBefore, descBefore, err := openForCompare(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	dbAfter, descAfter, err := openForCompare(ctx, args[2])
+	if err != nil {
+		dbBefore.Close(ctx)
+		return err
+	}
+	changes, err := diffScans(ctx, dbBefore, dbAfter, root, globalConfig.LayoutFor(root).Separator)
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(dbBefore.Close(ctx))
+	errs.Append(dbAfter.Close(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	var filesDelta, bytesDelta int64
+	for _, pc := range changes {
+		filesDelta += pc.filesDelta()
+		bytesDelta += pc.bytesDelta()
+	}
+	if n := flagValues.TopN; n > 0 && n < len(changes) {
+		changes = changes[:n]
+	}
+	if flagValues.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, pc := range changes {
+			if err := enc.Encode(pc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Printf("before: %v\nafter: %v\n", descBefore, descAfter)
+	for _, pc := range changes {
+		ifmt.Printf("%-8v % 16v % 12v files : %v\n", pc.Change, signedSize(pc.bytesDelta()), pc.filesDelta(), pc.Prefix)
+	}
+	ifmt.Printf("total change for %v: %v, %v files\n", root, signedSize(bytesDelta), filesDelta)
+	return nil
+}
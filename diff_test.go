@@ -0,0 +1,133 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestNewPrefixChange(t *testing.T) {
+	pi := func(files int, bytes int64) *filewalk.PrefixInfo {
+		return &filewalk.PrefixInfo{Files: make([]filewalk.Info, files), DiskUsage: bytes}
+	}
+	for i, tc := range []struct {
+		before, after *filewalk.PrefixInfo
+		change        string
+	}{
+		{nil, pi(1, 10), "added"},
+		{pi(1, 10), nil, "removed"},
+		{pi(1, 10), pi(1, 11), "grew"},
+		{pi(2, 10), pi(1, 9), "shrank"},
+		{pi(1, 10), pi(2, 10), "changed"},
+		{pi(1, 10), pi(1, 10), ""},
+		{pi(0, 0), pi(0, 0), ""},
+	} {
+		pc, ok := newPrefixChange("/a", tc.before, tc.after)
+		if got, want := ok, len(tc.change) > 0; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := pc.Change, tc.change; ok && got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDiffScans(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	open := func(name string, prefixes map[string]*filewalk.PrefixInfo) filewalk.Database {
+		db, err := localdb.Open(ctx, filepath.Join(tmpDir, name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for prefix, pi := range prefixes {
+			if err := db.Set(ctx, prefix, pi); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	pi := func(files int, bytes int64) *filewalk.PrefixInfo {
+		return &filewalk.PrefixInfo{Files: make([]filewalk.Info, files), DiskUsage: bytes}
+	}
+	before := open("before", map[string]*filewalk.PrefixInfo{
+		"/r":         pi(1, 10),
+		"/r/a":       pi(1, 10),
+		"/r/a/gone":  pi(2, 30),
+		"/r/a/same":  pi(1, 5),
+		"/r/a/small": pi(3, 300),
+		"/r/ab":      pi(1, 1),
+		"/r/b":       pi(1, 1),
+	})
+	defer before.Close(ctx)
+	after := open("after", map[string]*filewalk.PrefixInfo{
+		"/r":         pi(1, 10),
+		"/r/a":       pi(2, 10),
+		"/r/a/new":   pi(1, 1000),
+		"/r/a/same":  pi(1, 5),
+		"/r/a/small": pi(3, 100),
+		"/r/ab":      pi(1, 1000000),
+		"/r/b":       pi(1, 2),
+	})
+	defer after.Close(ctx)
+
+	type change struct {
+		prefix, change string
+		delta          int64
+	}
+	diff := func(root string) []change {
+		changes, err := diffScans(ctx, before, after, root, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []change
+		for _, pc := range changes {
+			got = append(got, change{pc.Prefix, pc.Change, pc.bytesDelta()})
+		}
+		return got
+	}
+	// /r/ab shares a string prefix with /r/a but is not beneath it.
+	if got, want := diff("/r/a"), []change{
+		{"/r/a/new", "added", 1000},
+		{"/r/a/small", "shrank", -200},
+		{"/r/a/gone", "removed", -30},
+		{"/r/a", "changed", 0},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := diff("/r"), []change{
+		{"/r/ab", "grew", 999999},
+		{"/r/a/new", "added", 1000},
+		{"/r/a/small", "shrank", -200},
+		{"/r/a/gone", "removed", -30},
+		{"/r/b", "grew", 1},
+		{"/r/a", "changed", 0},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := diff("/r/a/same"); len(got) != 0 {
+		t.Errorf("unexpected changes: %v", got)
+	}
+	// Prefixes that exist in only one of the scans are reported as wholly
+	// added or removed.
+	if got, want := diff("/r/a/new"), []change{{"/r/a/new", "added", 1000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := diff("/r/a/gone"), []change{{"/r/a/gone", "removed", -30}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/path/cloudpath"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type duFlags struct {
+	ScanSize int  `subcmd:"scan-size,10000,control the number of items to fetch from the filesystem in a single operation"`
+	Update   bool `subcmd:"update,false,'update the database with the contents of the prefix, its children are not re-analyzed'"`
+}
+
+// du displays the sizes of the immediate contents of a prefix without
+// descending into its children.
+func du(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*duFlags)
+	prefix := args[0]
+	if !cloudpath.IsLocal(prefix) {
+		return fmt.Errorf("currently only local filesystems are supported: %v", prefix)
+	}
+	fs := filewalk.LocalFilesystem(flagValues.ScanSize)
+	info, err := fs.Stat(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	files, children, err := listPrefix(ctx, fs, prefix)
+	if err != nil {
+		return err
+	}
+	layout := globalConfig.LayoutFor(prefix)
+	pi := filewalk.PrefixInfo{
+		ModTime:  info.ModTime,
+		UserID:   info.UserID,
+		GroupID:  info.GroupID,
+		Mode:     info.Mode,
+		Size:     info.Size,
+		Files:    files,
+		Children: children,
+	}
+	type entry struct {
+		name          string
+		size, storage int64
+		prefix        bool
+	}
+	entries := make([]entry, 0, len(files)+len(children))
+	var size int64
+	for _, file := range files {
+		storage := calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
+		pi.DiskUsage += storage
+		size += file.Size
+		entries = append(entries, entry{name: file.Name, size: file.Size, storage: storage})
+	}
+	for _, child := range children {
+		entries = append(entries, entry{name: child.Name + layout.Separator, size: child.Size, prefix: true})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].storage == entries[j].storage {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].storage > entries[j].storage
+	})
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Printf("     disk usage :            size : file/prefix\n")
+	for _, e := range entries {
+		storage := fsize(e.storage)
+		if e.prefix {
+			storage = "-"
+		}
+		ifmt.Printf("% 15v : % 15v : %v\n", storage, fsize(e.size), e.name)
+	}
+	ifmt.Printf("% 15v : % 15v : %v (%v files, %v prefixes)\n", fsize(pi.DiskUsage), fsize(size), prefix, len(files), len(children))
+	if !flagValues.Update {
+		return nil
+	}
+	errs := errors.M{}
+	existing, err := existingPrefixInfo(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	_, _, err = handleDeletedChildren(ctx, layout, prefix, existing, pi.Children)
+	errs.Append(err)
+	_, err = removeStaleStats(ctx, layout, prefix, existing, &pi)
+	errs.Append(err)
+	errs.Append(globalDatabaseManager.Set(ctx, prefix, &pi))
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type dupDirsFlags struct {
+	TopN    int `subcmd:"top,20,the number of groups of duplicate trees to display"`
+	MinSize int `subcmd:"min-size,1,'ignore trees whose disk usage, in bytes, is less than this'"`
+}
+
+// dupDirNode holds the stored metadata for a single prefix.
+type dupDirNode struct {
+	files    []filewalk.Info
+	children []string
+	usage    int64
+}
+
+// dupDirTree is the structural hash and total disk usage of a subtree.
+type dupDirTree struct {
+	hash    string
+	storage int64
+	nFiles  int
+}
+
+// treeHasher computes structural hashes for subtrees. The hash of a
+// prefix covers the names and sizes of its files and the names and hashes
+// of its children, but not modification times, modes or owners so that
+// copies made at different times are considered identical.
+type treeHasher struct {
+	sep   string
+	nodes map[string]*dupDirNode
+	trees map[string]dupDirTree
+}
+
+func (th *treeHasher) childPrefix(prefix, name string) string {
+	return strings.TrimSuffix(prefix, th.sep) + th.sep + name
+}
+
+func (th *treeHasher) hash(prefix string) dupDirTree {
+	if t, ok := th.trees[prefix]; ok {
+		return t
+	}
+	h := sha256.New()
+	buf := make([]byte, 8)
+	node := th.nodes[prefix]
+	if node == nil {
+		// The prefix is not in the database, eg. because it was excluded,
+		// so make sure that its hash is unique.
+		h.Write([]byte(prefix))
+		t := dupDirTree{hash: string(h.Sum(nil))}
+		th.trees[prefix] = t
+		return t
+	}
+	t := dupDirTree{storage: node.usage, nFiles: len(node.files)}
+	files := make([]filewalk.Info, len(node.files))
+	copy(files, node.files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	for _, file := range files {
+		h.Write([]byte(file.Name))
+		binary.LittleEndian.PutUint64(buf, uint64(file.Size))
+		h.Write(buf)
+	}
+	// Separate files from children.
+	h.Write([]byte{0})
+	children := make([]string, len(node.children))
+	copy(children, node.children)
+	sort.Strings(children)
+	for _, child := range children {
+		ct := th.hash(th.childPrefix(prefix, child))
+		h.Write([]byte(child))
+		h.Write([]byte(ct.hash))
+		t.storage += ct.storage
+		t.nFiles += ct.nFiles
+	}
+	t.hash = string(h.Sum(nil))
+	th.trees[prefix] = t
+	return t
+}
+
+// dupDirGroup is a set of identical subtrees.
+type dupDirGroup struct {
+	prefixes []string
+	storage  int64
+	nFiles   int
+}
+
+func (g dupDirGroup) wasted() int64 {
+	return g.storage * int64(len(g.prefixes)-1)
+}
+
+// duplicateTrees returns the groups of identical subtrees beneath root,
+// ordered by the amount of disk space that could be reclaimed by removing
+// all but one copy. Subtrees whose parents are themselves duplicates
+// are not reported.
+func (th *treeHasher) duplicateTrees(root string, minSize int64) []dupDirGroup {
+	th.hash(root)
+	byHash := map[string][]string{}
+	for prefix, t := range th.trees {
+		if t.nFiles == 0 || t.storage < minSize || th.nodes[prefix] == nil {
+			continue
+		}
+		byHash[t.hash] = append(byHash[t.hash], prefix)
+	}
+	parents := map[string]string{}
+	for prefix, node := range th.nodes {
+		for _, child := range node.children {
+			parents[th.childPrefix(prefix, child)] = prefix
+		}
+	}
+	isDuplicate := func(prefix string) bool {
+		return len(byHash[th.trees[prefix].hash]) > 1
+	}
+	var groups []dupDirGroup
+	for _, prefixes := range byHash {
+		if len(prefixes) < 2 {
+			continue
+		}
+		nested := true
+		for _, prefix := range prefixes {
+			if parent, ok := parents[prefix]; !ok || !isDuplicate(parent) {
+				nested = false
+				break
+			}
+		}
+		if nested {
+			continue
+		}
+		sort.Strings(prefixes)
+		t := th.trees[prefixes[0]]
+		groups = append(groups, dupDirGroup{prefixes: prefixes, storage: t.storage, nFiles: t.nFiles})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if wi, wj := groups[i].wasted(), groups[j].wasted(); wi != wj {
+			return wi > wj
+		}
+		return groups[i].prefixes[0] < groups[j].prefixes[0]
+	})
+	return groups
+}
+
+// load reads the metadata for root and its descendants from db.
+func (th *treeHasher) load(ctx context.Context, db filewalk.Database, root string) error {
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	within := withinPrefix(root, th.sep)
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		node := &dupDirNode{files: pi.Files, usage: pi.DiskUsage}
+		for _, child := range pi.Children {
+			node.children = append(node.children, child.Name)
+		}
+		th.nodes[prefix] = node
+	}
+	return sc.Err()
+}
+
+// dupDirs reports groups of identical directory trees using only the
+// metadata stored in the database.
+func dupDirs(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*dupDirsFlags)
+	root := args[0]
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	th := &treeHasher{
+		sep:   globalConfig.LayoutFor(root).Separator,
+		nodes: map[string]*dupDirNode{},
+		trees: map[string]dupDirTree{},
+	}
+	errs := errors.M{}
+	errs.Append(th.load(ctx, db, root))
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	groups := th.duplicateTrees(root, int64(flagValues.MinSize))
+	var total int64
+	for _, g := range groups {
+		total += g.wasted()
+	}
+	ifmt := message.NewPrinter(language.English)
+	for i, g := range groups {
+		if i >= flagValues.TopN {
+			break
+		}
+		ifmt.Printf("%v reclaimable: %v copies of %v (%v files)\n", fsize(g.wasted()), len(g.prefixes), fsize(g.storage), g.nFiles)
+		for _, prefix := range g.prefixes {
+			ifmt.Printf("    %v\n", prefix)
+		}
+	}
+	ifmt.Printf("%v groups of duplicate trees, %v reclaimable\n", len(groups), fsize(total))
+	return nil
+}
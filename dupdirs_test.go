@@ -0,0 +1,49 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestTreeHasherLoad(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	for _, prefix := range []string{"/r/a", "/r/a/b", "/r/ab", "/r/ab/b", "/r/b"} {
+		pi := &filewalk.PrefixInfo{Files: []filewalk.Info{{Name: "f", Size: 1}}, DiskUsage: 1}
+		if err := db.Set(ctx, prefix, pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	th := &treeHasher{sep: "/", nodes: map[string]*dupDirNode{}, trees: map[string]dupDirTree{}}
+	if err := th.load(ctx, db, "/r/a"); err != nil {
+		t.Fatal(err)
+	}
+	var loaded []string
+	for prefix := range th.nodes {
+		loaded = append(loaded, prefix)
+	}
+	sort.Strings(loaded)
+	if got, want := loaded, []string{"/r/a", "/r/a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
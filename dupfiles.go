@@ -0,0 +1,313 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type duplicatesFlags struct {
+	Hash    bool `subcmd:"hash,false,'confirm that files are identical by reading them from the filesystem and comparing checksums of their contents, otherwise files with the same name and size are assumed to be identical'"`
+	TopN    int  `subcmd:"top,20,the number of groups of duplicate files to display"`
+	MinSize int  `subcmd:"min-size,1,'ignore files whose size, in bytes, is less than this'"`
+}
+
+// dupFileKey identifies files that may be identical, name is empty when
+// their contents are to be compared.
+type dupFileKey struct {
+	name string
+	size int64
+}
+
+// dupFileGroup is a set of, likely, identical files.
+type dupFileGroup struct {
+	size    int64
+	storage int64
+	paths   []string
+}
+
+func (g dupFileGroup) wasted() int64 {
+	return g.storage * int64(len(g.paths)-1)
+}
+
+func sortDupFileGroups(groups []dupFileGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		if wi, wj := groups[i].wasted(), groups[j].wasted(); wi != wj {
+			return wi > wj
+		}
+		return groups[i].paths[0] < groups[j].paths[0]
+	})
+}
+
+// readableFilesystem is a filewalk.Filesystem whose files can be read.
+type readableFilesystem interface {
+	filewalk.Filesystem
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+}
+
+// localReadableFilesystem implements readableFilesystem for the local
+// filesystem.
+type localReadableFilesystem struct {
+	filewalk.Filesystem
+}
+
+func (localReadableFilesystem) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// dupFilter excludes the prefixes and files that analyze would exclude, via
+// the configured exclusions and ignore files, so that files recorded
+// before an exclusion was added are not reported.
+type dupFilter struct {
+	fs         filewalk.Filesystem
+	root, sep  string
+	exclusions *exclusions.T
+	ignores    *exclusions.Ignores
+	excluded   map[string]bool
+}
+
+func newDupFilter(ctx context.Context, fs filewalk.Filesystem, root, sep string) (*dupFilter, error) {
+	opts, analyzed := analyzeOptions(root, sep)
+	ignores, err := analyzeIgnores(ctx, fs, root, sep, opts, analyzed)
+	if err != nil {
+		return nil, err
+	}
+	return &dupFilter{
+		fs:         fs,
+		root:       root,
+		sep:        sep,
+		exclusions: exclusions.New(append(globalConfig.InternalExclusions(), globalConfig.Exclusions...)),
+		ignores:    ignores,
+		excluded:   map[string]bool{},
+	}, nil
+}
+
+// excludePrefix returns true if prefix, or any of its ancestors, is
+// excluded. It reads prefix's ignore file, if any, if it is not.
+func (df *dupFilter) excludePrefix(ctx context.Context, prefix string) bool {
+	if df.exclusions.Exclude(prefix) || df.ignores.Exclude(prefix, true) {
+		df.excluded[prefix] = true
+	}
+	excluded := false
+	prefixAndAncestors(df.root, prefix, df.sep, func(p string) {
+		excluded = excluded || df.excluded[p]
+	})
+	if !excluded {
+		readIgnoreFile(ctx, df.fs, df.ignores, prefix)
+	}
+	return excluded
+}
+
+func (df *dupFilter) excludeFile(path string) bool {
+	return df.exclusions.Exclude(path) || df.ignores.Exclude(path, false)
+}
+
+// scanDuplicates calls fn for each file beneath root, as stored in the
+// database, that may have a duplicate. Symlinks and excluded files are
+// ignored.
+func scanDuplicates(ctx context.Context, db filewalk.Database, fs filewalk.Filesystem, root string, minSize int64, fn func(prefix string, fi filewalk.Info, path string)) error {
+	sep := globalConfig.LayoutFor(root).Separator
+	filter, err := newDupFilter(ctx, fs, root, sep)
+	if err != nil {
+		return err
+	}
+	within := withinPrefix(root, sep)
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		if filter.excludePrefix(ctx, prefix) {
+			continue
+		}
+		for _, fi := range pi.Files {
+			if fi.Size < minSize || fi.Mode&filewalk.ModeLink != 0 {
+				continue
+			}
+			path := strings.TrimSuffix(prefix, sep) + sep + fi.Name
+			if filter.excludeFile(path) {
+				continue
+			}
+			fn(prefix, fi, path)
+		}
+	}
+	return sc.Err()
+}
+
+// candidateDuplicates calls emit with each group of files beneath root,
+// as stored in the database, that share the same size and, unless
+// byContent is set, the same name. The database is scanned twice, first to
+// count the files with each size, and name, and then to collect the paths
+// of those that have duplicates, so that only the paths of candidates are
+// retained and each group is emitted, and released, as soon as all of its
+// files have been seen.
+func candidateDuplicates(ctx context.Context, db filewalk.Database, fs filewalk.Filesystem, root string, minSize int64, byContent bool, emit func(dupFileGroup) error) error {
+	layout := globalConfig.LayoutFor(root)
+	keyFor := func(fi filewalk.Info) dupFileKey {
+		key := dupFileKey{size: fi.Size}
+		if !byContent {
+			key.name = fi.Name
+		}
+		return key
+	}
+	counts := map[dupFileKey]int{}
+	if err := scanDuplicates(ctx, db, fs, root, minSize, func(_ string, fi filewalk.Info, _ string) {
+		counts[keyFor(fi)]++
+	}); err != nil {
+		return err
+	}
+	var emitErr error
+	candidates := map[dupFileKey]*dupFileGroup{}
+	err := scanDuplicates(ctx, db, fs, root, minSize, func(prefix string, fi filewalk.Info, path string) {
+		key := keyFor(fi)
+		if counts[key] < 2 || emitErr != nil {
+			return
+		}
+		g := candidates[key]
+		if g == nil {
+			g = &dupFileGroup{
+				size:    fi.Size,
+				storage: calculatorFor(layout, prefix, fi.Name).Calculate(fi.Size),
+			}
+			candidates[key] = g
+		}
+		g.paths = append(g.paths, path)
+		if len(g.paths) == counts[key] {
+			delete(candidates, key)
+			sort.Strings(g.paths)
+			emitErr = emit(*g)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if emitErr != nil {
+		return emitErr
+	}
+	// Files deleted between the two scans may leave incomplete groups.
+	var remaining []dupFileGroup
+	for _, g := range candidates {
+		if len(g.paths) > 1 {
+			sort.Strings(g.paths)
+			remaining = append(remaining, *g)
+		}
+	}
+	sortDupFileGroups(remaining)
+	for _, g := range remaining {
+		if err := emit(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checksum(ctx context.Context, fs readableFilesystem, filename string) (string, error) {
+	f, err := fs.Open(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// confirmDuplicates splits a group of files of the same size into groups
+// of files with identical contents. Files that cannot be read are
+// reported to out and ignored.
+func confirmDuplicates(ctx context.Context, fs readableFilesystem, out io.Writer, candidate dupFileGroup) ([]dupFileGroup, error) {
+	byHash := map[string][]string{}
+	for _, path := range candidate.paths {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		sum, err := checksum(ctx, fs, path)
+		if err != nil {
+			fmt.Fprintf(out, "warning: failed to read: %v\n", err)
+			continue
+		}
+		byHash[sum] = append(byHash[sum], path)
+	}
+	var groups []dupFileGroup
+	for _, paths := range byHash {
+		if len(paths) > 1 {
+			groups = append(groups, dupFileGroup{size: candidate.size, storage: candidate.storage, paths: paths})
+		}
+	}
+	sortDupFileGroups(groups)
+	return groups, nil
+}
+
+// duplicates reports groups of duplicate files, ordered by reclaimable
+// disk usage. Groups are displayed as they are confirmed when --hash is
+// used, in which case they are ordered only approximately.
+func duplicates(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*duplicatesFlags)
+	root := args[0]
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	var total int64
+	displayed, found := 0, 0
+	display := func(g dupFileGroup) {
+		total += g.wasted()
+		found++
+		if displayed >= flagValues.TopN {
+			return
+		}
+		displayed++
+		ifmt.Printf("%v reclaimable: %v copies of %v\n", fsize(g.wasted()), len(g.paths), fsize(g.size))
+		for _, path := range g.paths {
+			ifmt.Printf("    %v\n", path)
+		}
+	}
+	fs := localReadableFilesystem{filewalk.LocalFilesystem(1000)}
+	var groups []dupFileGroup
+	err = candidateDuplicates(ctx, db, fs, root, int64(flagValues.MinSize), flagValues.Hash, func(candidate dupFileGroup) error {
+		if !flagValues.Hash {
+			groups = append(groups, candidate)
+			return nil
+		}
+		confirmed, err := confirmDuplicates(ctx, fs, os.Stderr, candidate)
+		for _, g := range confirmed {
+			display(g)
+		}
+		return err
+	})
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	sortDupFileGroups(groups)
+	for _, g := range groups {
+		display(g)
+	}
+	ifmt.Printf("%v groups of duplicate files, %v reclaimable\n", found, fsize(total))
+	return nil
+}
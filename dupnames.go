@@ -0,0 +1,133 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// maxDuplicateNamePaths is the maximum number of paths recorded, and
+// displayed, for each duplicated filename.
+const maxDuplicateNamePaths = 20
+
+// duplicateName records the occurrences of a single filename.
+type duplicateName struct {
+	name  string
+	count int
+	bytes int64
+	paths []string
+}
+
+// duplicateNames aggregates files by their filename, ie. the last
+// component of their path.
+type duplicateNames struct {
+	names map[string]*duplicateName
+}
+
+func (dn *duplicateNames) add(prefix, sep string, fi filewalk.Info) {
+	d := dn.names[fi.Name]
+	if d == nil {
+		d = &duplicateName{name: fi.Name}
+		dn.names[fi.Name] = d
+	}
+	d.count++
+	d.bytes += fi.Size
+	if len(d.paths) < maxDuplicateNamePaths {
+		d.paths = append(d.paths, strings.TrimSuffix(prefix, sep)+sep+fi.Name)
+	}
+}
+
+// duplicated returns the filenames that occur at least minCount times,
+// sorted by count or by total size in bytes.
+func (dn *duplicateNames) duplicated(minCount int, byBytes bool) []*duplicateName {
+	var dups []*duplicateName
+	for _, d := range dn.names {
+		if d.count >= minCount {
+			dups = append(dups, d)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		a, b := dups[i], dups[j]
+		if byBytes && a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		return a.name < b.name
+	})
+	return dups
+}
+
+// findDuplicateNames reports filenames that occur repeatedly beneath the
+// specified prefixes. Files may be restricted to those owned by a user or
+// group, or to those that match the --file regular expressions.
+func findDuplicateNames(ctx context.Context, flagValues *findFlags, args []string, userKey, groupKey string, fileRE []*regexp.Regexp) error {
+	dn := &duplicateNames{names: map[string]*duplicateName{}}
+	errs := errors.M{}
+	for _, root := range args {
+		db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+		if err != nil {
+			errs.Append(err)
+			break
+		}
+		sep := globalConfig.LayoutFor(root).Separator
+		sc := db.NewScanner(root, 0, filewalk.ScanLimit(100000))
+		within := withinPrefix(root, sep)
+		for sc.Scan(ctx) {
+			prefix, pi := sc.PrefixInfo()
+			if ok, done := within(prefix); !ok {
+				if done {
+					break
+				}
+				continue
+			}
+			for _, fi := range pi.Files {
+				if len(userKey) > 0 && fi.UserID != userKey {
+					continue
+				}
+				if len(groupKey) > 0 && fi.GroupID != groupKey {
+					continue
+				}
+				if fileRE != nil && !match(fileRE, fi.Name) {
+					continue
+				}
+				dn.add(prefix, sep, fi)
+			}
+		}
+		errs.Append(sc.Err())
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	dups := dn.duplicated(flagValues.MinCount, flagValues.DuplicateSort == "bytes")
+	for i, d := range dups {
+		if i >= flagValues.TopN {
+			ifmt.Printf("... %v more\n", len(dups)-flagValues.TopN)
+			break
+		}
+		ifmt.Printf("%v: %v occurrences, %v\n", d.name, d.count, fsize(d.bytes))
+		for _, path := range d.paths {
+			ifmt.Printf("    %v\n", path)
+		}
+		if n := d.count - len(d.paths); n > 0 {
+			ifmt.Printf("    ... %v more\n", n)
+		}
+	}
+	return nil
+}
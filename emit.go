@@ -0,0 +1,87 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// emitBufferSize is the number of records that may be queued for output
+// by analyze --emit before further records are dropped.
+const emitBufferSize = 10000
+
+// emitRecord is the JSON representation of a prefix written by
+// analyze --emit once it has been analyzed.
+type emitRecord struct {
+	Prefix   string `json:"prefix"`
+	Bytes    int64  `json:"bytes"`
+	Storage  int64  `json:"storage"`
+	Files    int    `json:"files"`
+	Children int    `json:"children"`
+	Err      string `json:"error,omitempty"`
+}
+
+// emitter streams a record for each prefix as it is analyzed. Records are
+// queued and written by a separate goroutine so that a slow consumer does
+// not block scanning; records are dropped, and counted, if the queue is
+// full.
+type emitter struct {
+	ch      chan emitRecord
+	dropped int64
+	wg      sync.WaitGroup
+}
+
+func newEmitter(ctx context.Context, out io.Writer) *emitter {
+	em := &emitter{ch: make(chan emitRecord, emitBufferSize)}
+	em.wg.Add(1)
+	go func() {
+		defer em.wg.Done()
+		enc := json.NewEncoder(out)
+		for rec := range em.ch {
+			if err := enc.Encode(rec); err != nil {
+				debug(ctx, 1, "failed to emit %v: %v\n", rec.Prefix, err)
+			}
+		}
+	}()
+	return em
+}
+
+func (em *emitter) emit(prefix string, pi *filewalk.PrefixInfo) {
+	if em == nil {
+		return
+	}
+	rec := emitRecord{
+		Prefix:   prefix,
+		Storage:  pi.DiskUsage,
+		Files:    len(pi.Files),
+		Children: len(pi.Children),
+		Err:      pi.Err,
+	}
+	for _, fi := range pi.Files {
+		rec.Bytes += fi.Size
+	}
+	select {
+	case em.ch <- rec:
+	default:
+		atomic.AddInt64(&em.dropped, 1)
+	}
+}
+
+// close waits for all queued records to be written and returns the number
+// of records that were dropped.
+func (em *emitter) close() int64 {
+	if em == nil {
+		return 0
+	}
+	close(em.ch)
+	em.wg.Wait()
+	return atomic.LoadInt64(&em.dropped)
+}
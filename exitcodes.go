@@ -0,0 +1,64 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"cloudeng.io/errors"
+)
+
+// The exit codes used by idu. These are part of its documented interface,
+// see README.md, and must not be changed.
+const (
+	exitOK          = 0 // Success.
+	exitOperational = 1 // An operational error, eg. invalid flags or an I/O error.
+	exitThreshold   = 2 // A quota or threshold has been breached.
+	exitStale       = 3 // The database is out of date with respect to the filesystem.
+)
+
+// exitError associates an exit code with an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns an error that will cause idu to exit with the
+// specified code. It returns nil if err is nil.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCodeFor returns the exit code to use for err.
+func exitCodeFor(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return exitOperational
+}
+
+// exit prints err, if any, and exits with the appropriate code.
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	os.Exit(exitCodeFor(err))
+}
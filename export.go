@@ -0,0 +1,274 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cloudeng.io/cmdutil/flags"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+type exportFlags struct {
+	Format    string `subcmd:"format,treemap,'the format to export, treemap for a nested JSON treemap, manifest for a list of files suitable for use with rsync --files-from or tar, or csv for a row per prefix and file with its path, uid, gid, size, modification time and whether it is a prefix'"`
+	Output    string `subcmd:"output,,'the file to write the export to, stdout is used if not specified'"`
+	MaxDepth  int    `subcmd:"max-depth,8,'the maximum depth of prefixes to include, deeper prefixes are included in the totals of their ancestors'"`
+	MaxNodes  int    `subcmd:"max-nodes,10000,'the maximum number of prefixes to include, the smallest prefixes are included in the totals of their parents'"`
+	Relative  bool   `subcmd:"relative,false,'write manifest paths relative to the exported prefix rather than as absolute paths'"`
+	PathsOnly bool   `subcmd:"paths-only,false,'write only the path of each file to the manifest, omitting its size and modification time, as required by rsync --files-from'"`
+	Null      bool   `subcmd:"null,false,'terminate each manifest entry with a NUL rather than a newline, for use with rsync --from0 or tar --null'"`
+}
+
+// treemapNode represents a prefix in the nested JSON format used by
+// treemap, sunburst and flamegraph visualizations (eg. d3.hierarchy).
+// Value is the disk usage of the files within the prefix itself, including
+// any prefixes that were folded into it, whereas Size also includes the
+// disk usage of all of its children.
+type treemapNode struct {
+	Name     string         `json:"name"`
+	Path     string         `json:"path"`
+	Value    int64          `json:"value"`
+	Size     int64          `json:"size"`
+	Children []*treemapNode `json:"children,omitempty"`
+
+	parent *treemapNode
+	depth  int
+}
+
+// parentPrefix returns the parent of prefix, using sep as the separator.
+func parentPrefix(prefix, sep string) string {
+	idx := strings.LastIndex(prefix, sep)
+	if idx <= 0 {
+		return prefix[:idx+1]
+	}
+	return prefix[:idx]
+}
+
+func buildTreemap(ctx context.Context, db filewalk.Database, root, sep string, maxDepth int) (*treemapNode, int, error) {
+	root = strings.TrimSuffix(root, sep)
+	if len(root) == 0 {
+		root = sep
+	}
+	nodes := map[string]*treemapNode{
+		root: {Name: root, Path: root},
+	}
+	folded := map[string]int64{}
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if prefix == root {
+			nodes[root].Value += pi.DiskUsage
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(prefix, root), sep)
+		if depth := strings.Count(rel, sep) + 1; depth > maxDepth {
+			// Fold into the ancestor at maxDepth.
+			parts := strings.SplitN(rel, sep, maxDepth+1)
+			ancestor := strings.TrimSuffix(root, sep) + sep + strings.Join(parts[:maxDepth], sep)
+			folded[ancestor] += pi.DiskUsage
+			continue
+		}
+		node := nodes[prefix]
+		if node == nil {
+			node = &treemapNode{Path: prefix}
+			nodes[prefix] = node
+		}
+		node.Name = prefix[strings.LastIndex(prefix, sep)+1:]
+		node.Value += pi.DiskUsage
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	for ancestor, usage := range folded {
+		if node := nodes[ancestor]; node != nil {
+			node.Value += usage
+			continue
+		}
+		nodes[ancestor] = &treemapNode{
+			Name:  ancestor[strings.LastIndex(ancestor, sep)+1:],
+			Path:  ancestor,
+			Value: usage,
+		}
+	}
+	// Link each node to its parent, the scan order is not sufficient since
+	// some prefixes may be missing, eg. due to errors.
+	paths := make([]string, 0, len(nodes))
+	for path := range nodes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if path == root {
+			continue
+		}
+		node := nodes[path]
+		parent := nodes[parentPrefix(path, sep)]
+		if parent == nil || !strings.HasPrefix(path, root) {
+			parent = nodes[root]
+		}
+		node.parent = parent
+		parent.Children = append(parent.Children, node)
+	}
+	setTreemapSizes(nodes[root], 0)
+	return nodes[root], len(nodes), nil
+}
+
+func setTreemapSizes(node *treemapNode, depth int) int64 {
+	node.depth = depth
+	node.Size = node.Value
+	for _, child := range node.Children {
+		node.Size += setTreemapSizes(child, depth+1)
+	}
+	sort.Slice(node.Children, func(i, j int) bool {
+		return node.Children[i].Size > node.Children[j].Size
+	})
+	return node.Size
+}
+
+// pruneTreemap folds the smallest nodes into their parents until at most
+// maxNodes remain.
+func pruneTreemap(root *treemapNode, total, maxNodes int) {
+	if total <= maxNodes {
+		return
+	}
+	all := make([]*treemapNode, 0, total)
+	var collect func(n *treemapNode)
+	collect = func(n *treemapNode) {
+		all = append(all, n)
+		for _, c := range n.Children {
+			collect(c)
+		}
+	}
+	collect(root)
+	// Prune the deepest of the smallest nodes first so that a node's
+	// children are always folded into it before it is itself folded.
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Size == all[j].Size {
+			return all[i].depth > all[j].depth
+		}
+		return all[i].Size < all[j].Size
+	})
+	pruned := map[*treemapNode]bool{}
+	for _, n := range all[:total-maxNodes] {
+		if n == root {
+			continue
+		}
+		pruned[n] = true
+	}
+	var fold func(n *treemapNode)
+	fold = func(n *treemapNode) {
+		remaining := n.Children[:0]
+		for _, c := range n.Children {
+			fold(c)
+			if pruned[c] {
+				n.Value += c.Value
+				remaining = append(remaining, c.Children...)
+				continue
+			}
+			remaining = append(remaining, c)
+		}
+		n.Children = remaining
+	}
+	fold(root)
+	setTreemapSizes(root, 0)
+}
+
+func dbExport(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*exportFlags)
+	if err := flags.OneOf(flagValues.Format).Validate("treemap", "treemap", "manifest", "csv"); err != nil {
+		return err
+	}
+	switch flagValues.Format {
+	case "manifest":
+		return dbExportManifest(ctx, flagValues, args[0])
+	case "csv":
+		return dbExportCSV(ctx, flagValues, args[0])
+	}
+	if flagValues.MaxDepth < 1 || flagValues.MaxNodes < 1 {
+		return fmt.Errorf("--max-depth and --max-nodes must be greater than zero")
+	}
+	prefix := args[0]
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	layout := globalConfig.LayoutFor(prefix)
+	root, nNodes, err := buildTreemap(ctx, db, prefix, layout.Separator, flagValues.MaxDepth)
+	if err != nil {
+		return err
+	}
+	pruneTreemap(root, nNodes, flagValues.MaxNodes)
+	errs := errors.M{}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	var out io.WriteCloser = os.Stdout
+	if len(flagValues.Output) > 0 {
+		out, err = createOutput(flagValues.Output)
+		if err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	errs.Append(enc.Encode(root))
+	if out != os.Stdout {
+		errs.Append(out.Close())
+	}
+	return errs.Err()
+}
+
+// dbExportManifest streams the manifest for prefix to the requested output.
+func dbExportManifest(ctx context.Context, flagValues *exportFlags, prefix string) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	var out io.WriteCloser = os.Stdout
+	if len(flagValues.Output) > 0 {
+		out, err = createOutput(flagValues.Output)
+		if err != nil {
+			globalDatabaseManager.CloseAll(ctx)
+			return err
+		}
+	}
+	errs := errors.M{}
+	layout := globalConfig.LayoutFor(prefix)
+	errs.Append(writeManifest(ctx, out, db, prefix, layout.Separator, flagValues.Relative, flagValues.PathsOnly, flagValues.Null))
+	if out != os.Stdout {
+		errs.Append(out.Close())
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
+
+// dbExportCSV streams the prefixes and files stored for prefix to the
+// requested output as CSV.
+func dbExportCSV(ctx context.Context, flagValues *exportFlags, prefix string) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	var out io.WriteCloser = os.Stdout
+	if len(flagValues.Output) > 0 {
+		out, err = createOutput(flagValues.Output)
+		if err != nil {
+			globalDatabaseManager.CloseAll(ctx)
+			return err
+		}
+	}
+	errs := errors.M{}
+	errs.Append(writeCSVExport(ctx, out, db, prefix, globalConfig.LayoutFor(prefix).Separator))
+	if out != os.Stdout {
+		errs.Append(out.Close())
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
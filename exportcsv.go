@@ -0,0 +1,61 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// csvExportHeader is the header row for database export --format=csv.
+var csvExportHeader = []string{"path", "uid", "gid", "size", "mtime", "is_dir"}
+
+// writeCSVExport streams a row for every prefix stored beneath root, and
+// for every file within those prefixes, to out as CSV. Rows are written as
+// they are read from the database so that memory usage is bounded.
+func writeCSVExport(ctx context.Context, out io.Writer, db filewalk.Database, root, sep string) error {
+	wr := csv.NewWriter(out)
+	row := func(path, uid, gid string, size int64, mtime time.Time, isDir bool) {
+		wr.Write([]string{
+			path,
+			uid,
+			gid,
+			strconv.FormatInt(size, 10),
+			displayTime(mtime).Format(time.RFC3339),
+			strconv.FormatBool(isDir),
+		})
+	}
+	wr.Write(csvExportHeader)
+	parent := strings.TrimSuffix(root, sep) + sep
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if prefix != root && !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		row(prefix, pi.UserID, pi.GroupID, pi.Size, pi.ModTime, true)
+		dir := strings.TrimSuffix(prefix, sep) + sep
+		for _, fi := range pi.Files {
+			row(dir+fi.Name, fi.UserID, fi.GroupID, fi.Size, fi.ModTime, false)
+		}
+		if err := wr.Error(); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	wr.Flush()
+	return wr.Error()
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// extensionFilter is the set of file extensions, in lower case and without
+// a leading dot, that analyze --only-ext will record. A nil filter
+// includes all files.
+type extensionFilter map[string]bool
+
+func newExtensionFilter(extensions []string) extensionFilter {
+	if len(extensions) == 0 {
+		return nil
+	}
+	ef := extensionFilter{}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if len(ext) > 0 {
+			ef[ext] = true
+		}
+	}
+	return ef
+}
+
+// include returns true if the named file has one of the filter's
+// extensions, ignoring case.
+func (ef extensionFilter) include(name string) bool {
+	if ef == nil {
+		return true
+	}
+	return ef[fileExtension(name)]
+}
+
+// fileExtension returns the extension of the named file, in lower case and
+// without a leading dot, ie. everything after the last dot. Files with no
+// extension, and hidden files with no other dot, eg. .profile, have an
+// empty extension.
+func fileExtension(name string) string {
+	ext := filepath.Ext(name)
+	if len(ext) == len(name) {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
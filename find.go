@@ -6,13 +6,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
-	"cloudeng.io/algo/container/heap"
 	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/errors"
 	"cloudeng.io/file/filewalk"
@@ -22,13 +22,82 @@ import (
 )
 
 type findFlags struct {
+	PrefixFileFlags
+	OtherFlags
 	User        string          `subcmd:"user,,restrict output to the specified user"`
 	Group       string          `subcmd:"group,,restrict output to the specified group"`
 	PrefixMatch flags.Repeating `subcmd:"prefix,,a regular expression to match against prefix/directory names against"`
 	FileMatch   flags.Repeating `subcmd:"file,,a regular expression to match against filenames against"`
+	PathMatch   flags.Repeating `subcmd:"regexp,,a regular expression to match against the full path of every prefix and file"`
+	FilesOnly   bool            `subcmd:"files-only,false,only report matching files and not prefixes"`
+	PrefixOnly  bool            `subcmd:"prefixes-only,false,only report matching prefixes and not files"`
+	MinSize     string          `subcmd:"min-size,,'only match files whose size is at least this value, with an optional decimal (KB, MB, ...) or binary (KiB, MiB, ...) unit suffix, eg. 10MB'"`
+	MaxSize     string          `subcmd:"max-size,,'only match files whose size is at most this value, with an optional unit suffix as for --min-size, eg. 1GiB'"`
+	NewerThan   string          `subcmd:"newer-than,,'only match files modified more recently than this, specified as an age, ie. a duration or number of days (d), weeks (w) or years (y) such as 36h or 30d, or as a time in RFC3339 or YYYY-MM-DD format'"`
+	OlderThan   string          `subcmd:"older-than,,'only match files modified before this, specified as an age or time as for --newer-than'"`
+	Types       flags.Commas    `subcmd:"type,,'comma separated list of content types (archive, audio, document, image, text, video or other) to match files against, the type is determined by reading the start of each candidate file from the filesystem'"`
 	ShowSizes   bool            `subcmd:"sizes,true,'show usage, number of files, children etc'"`
 	Sort        bool            `subcmd:"sort,false,'sort found files by diskusage, file and child count'"`
 	TopN        int             `subcmd:"top,100,'show the top prefixes by file/prefix counts and disk usage'"`
+	JSON        bool            `subcmd:"json,false,'write each match as a JSON object, one per line'"`
+	OwnerNames  bool            `subcmd:"owner-names,false,'include user and group names in JSON output'"`
+	Merge       bool            `subcmd:"merge-identical-prefixes,false,'ignore prefixes that are identical to, or contained within, other prefixes on the command line'"`
+
+	DuplicateNames bool   `subcmd:"duplicate-names,false,'report filenames that occur repeatedly, with their paths and total size, rather than individual matches'"`
+	MinCount       int    `subcmd:"min-count,2,'the minimum number of occurrences of a filename for it to be reported by --duplicate-names'"`
+	DuplicateSort  string `subcmd:"duplicate-sort,count,'sort the filenames reported by --duplicate-names by count or bytes'"`
+
+	ChangedSince string `subcmd:"changed-since,,'report files that were added, removed or modified since the specified database snapshot, or files modified since the most recent analyze run, as recorded in the run log, that completed at or before the specified time, in RFC3339 or YYYY-MM-DD format'"`
+}
+
+// findRecord is the JSON representation of a prefix or file found by find.
+type findRecord struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Bytes   int64     `json:"bytes"`
+	Storage int64     `json:"storage"`
+	UserID  string    `json:"uid"`
+	GroupID string    `json:"gid"`
+	User    string    `json:"user,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modtime"`
+}
+
+func newFindRecord(path, typ string, size, storage int64, uid, gid string, mode filewalk.FileMode, modTime time.Time, names bool) findRecord {
+	rec := findRecord{
+		Path:    path,
+		Type:    typ,
+		Bytes:   size,
+		Storage: storage,
+		UserID:  uid,
+		GroupID: gid,
+		Mode:    mode.String(),
+		ModTime: displayTime(modTime),
+	}
+	if names {
+		rec.User = globalUserManager.nameForUID(uid)
+		rec.Group = globalUserManager.nameForGID(gid)
+	}
+	return rec
+}
+
+// writeJSONResult writes the prefix and any files contained in result as
+// JSON objects, one per line.
+func writeJSONResult(enc *json.Encoder, result results, names bool) error {
+	pi := result.prefixInfo
+	if len(pi.Files) == 0 {
+		return enc.Encode(newFindRecord(result.prefix, "prefix", pi.Size, pi.DiskUsage, pi.UserID, pi.GroupID, pi.Mode, pi.ModTime, names))
+	}
+	layout := globalConfig.LayoutFor(result.prefix)
+	prefix := strings.TrimSuffix(result.prefix, result.sep)
+	for _, fi := range pi.Files {
+		path := prefix + result.sep + fi.Name
+		if err := enc.Encode(newFindRecord(path, "file", fi.Size, calculatorFor(layout, result.prefix, fi.Name).Calculate(fi.Size), fi.UserID, fi.GroupID, fi.Mode, fi.ModTime, names)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type finder struct {
@@ -37,6 +106,93 @@ type finder struct {
 	sep              string
 	user, group      string
 	prefixRE, fileRE []*regexp.Regexp
+	pathRE           []*regexp.Regexp
+	filesOnly        bool
+	prefixesOnly     bool
+	types            map[string]bool
+	sizes            *sizeRange
+	modTimes         *modTimeRange
+}
+
+// sizeRange is an inclusive range of file sizes, max is negative when
+// there is no upper bound.
+type sizeRange struct {
+	min, max int64
+}
+
+// parseSizeRange parses the --min-size and --max-size flags, either or
+// both of which may be empty. It returns nil if neither is specified.
+func parseSizeRange(min, max string) (*sizeRange, error) {
+	if len(min) == 0 && len(max) == 0 {
+		return nil, nil
+	}
+	sr := &sizeRange{max: -1}
+	var err error
+	if len(min) > 0 {
+		if sr.min, err = parseSize(min); err != nil {
+			return nil, fmt.Errorf("--min-size: %v", err)
+		}
+	}
+	if len(max) > 0 {
+		if sr.max, err = parseSize(max); err != nil {
+			return nil, fmt.Errorf("--max-size: %v", err)
+		}
+		if sr.max < sr.min {
+			return nil, fmt.Errorf("--max-size %v is less than --min-size %v", max, min)
+		}
+	}
+	return sr, nil
+}
+
+func (sr *sizeRange) contains(size int64) bool {
+	return size >= sr.min && (sr.max < 0 || size <= sr.max)
+}
+
+// modTimeRange is an exclusive range of modification times, either bound
+// may be zero to indicate that there is no such bound.
+type modTimeRange struct {
+	after, before time.Time
+}
+
+// parseAgeOrTime parses a time specified either as an age, relative to
+// now, or as an absolute time.
+func parseAgeOrTime(flag, value string, now time.Time) (time.Time, error) {
+	if age, err := parseAge(value); err == nil {
+		return now.Add(-age), nil
+	}
+	t, err := parseTimeFlag(flag, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid age or time for --%v: %q, use a duration, eg. 30d, RFC3339 or YYYY-MM-DD", flag, value)
+	}
+	return t, nil
+}
+
+// parseModTimeRange parses the --newer-than and --older-than flags, either
+// or both of which may be empty. It returns nil if neither is specified.
+func parseModTimeRange(newer, older string, now time.Time) (*modTimeRange, error) {
+	if len(newer) == 0 && len(older) == 0 {
+		return nil, nil
+	}
+	mr := &modTimeRange{}
+	var err error
+	if len(newer) > 0 {
+		if mr.after, err = parseAgeOrTime("newer-than", newer, now); err != nil {
+			return nil, err
+		}
+	}
+	if len(older) > 0 {
+		if mr.before, err = parseAgeOrTime("older-than", older, now); err != nil {
+			return nil, err
+		}
+	}
+	if !mr.after.IsZero() && !mr.before.IsZero() && !mr.before.After(mr.after) {
+		return nil, fmt.Errorf("--newer-than %v and --older-than %v do not overlap", newer, older)
+	}
+	return mr, nil
+}
+
+func (mr *modTimeRange) contains(t time.Time) bool {
+	return (mr.after.IsZero() || t.After(mr.after)) && (mr.before.IsZero() || t.Before(mr.before))
 }
 
 type results struct {
@@ -59,8 +215,15 @@ func (fr *finder) find(ctx context.Context, resultsCh chan results, root string)
 	sc := fr.db.NewScanner(root, 0, filewalk.ScanLimit(100000))
 	user, group := fr.user, fr.group
 	prefixRE, fileRE := fr.prefixRE, fr.fileRE
+	within := withinPrefix(root, fr.sep)
 	for sc.Scan(ctx) {
 		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
 		found := *pi
 		found.Children = nil
 		found.Files = nil
@@ -71,34 +234,72 @@ func (fr *finder) find(ctx context.Context, resultsCh chan results, root string)
 			nFiles:     len(pi.Files),
 			nChildren:  len(pi.Children),
 		}
-		if len(user) > 0 && pi.UserID == user {
-			resultsCh <- result
-			continue
-		}
-		if len(group) > 0 && pi.GroupID == group {
-			resultsCh <- result
-			continue
-		}
-		if prefixRE != nil {
-			if match(prefixRE, prefix) {
+		if !fr.filesOnly {
+			if len(user) > 0 && pi.UserID == user {
+				resultsCh <- result
+				continue
+			}
+			if len(group) > 0 && pi.GroupID == group {
+				resultsCh <- result
+				continue
+			}
+			if (prefixRE != nil && match(prefixRE, prefix)) || (fr.pathRE != nil && match(fr.pathRE, prefix)) {
 				resultsCh <- result
 			}
 		}
-		if fileRE == nil {
+		if fr.prefixesOnly || (fileRE == nil && fr.pathRE == nil && fr.types == nil && fr.sizes == nil && fr.modTimes == nil) {
 			continue
 		}
 		for _, fi := range pi.Files {
-			if match(fileRE, fi.Name) {
-				found.Files = append(found.Files, fi)
+			if fileRE != nil && !match(fileRE, fi.Name) {
+				continue
+			}
+			if fr.pathRE != nil && !match(fr.pathRE, strings.TrimSuffix(prefix, fr.sep)+fr.sep+fi.Name) {
+				continue
+			}
+			if fr.sizes != nil && !fr.sizes.contains(fi.Size) {
+				continue
+			}
+			if fr.modTimes != nil && !fr.modTimes.contains(fi.ModTime) {
+				continue
+			}
+			if fr.types != nil && !fr.matchType(ctx, prefix, fi.Name) {
+				continue
 			}
+			found.Files = append(found.Files, fi)
 		}
 		if len(found.Files) > 0 {
-			resultsCh <- results{prefix: prefix, prefixInfo: found}
+			resultsCh <- results{prefix: prefix, sep: fr.sep, prefixInfo: found}
 		}
 	}
 	return sc.Err()
 }
 
+// matchType returns true if the named file's content type is one of
+// those requested.
+func (fr *finder) matchType(ctx context.Context, prefix, name string) bool {
+	filename := strings.TrimSuffix(prefix, fr.sep) + fr.sep + name
+	typ, err := detectContentType(filename)
+	if err != nil {
+		debug(ctx, 1, "failed to determine content type: %v: %v\n", filename, err)
+		return false
+	}
+	return fr.types[typ]
+}
+
+// printFiles prints the path, and optionally the size, of every file
+// contained in result.
+func printFiles(ifmt *message.Printer, result results, sizes bool) {
+	prefix := strings.TrimSuffix(result.prefix, result.sep)
+	for _, fi := range result.prefixInfo.Files {
+		if sizes {
+			ifmt.Printf("%v%s%v: %v\n", prefix, result.sep, fi.Name, fsize(fi.Size))
+		} else {
+			ifmt.Printf("%v%s%v\n", prefix, result.sep, fi.Name)
+		}
+	}
+}
+
 func compileRE(arg string, expressions flags.Repeating) ([]*regexp.Regexp, error) {
 	if len(expressions.Values) == 0 {
 		return nil, nil
@@ -116,6 +317,11 @@ func compileRE(arg string, expressions flags.Repeating) ([]*regexp.Regexp, error
 
 func find(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*findFlags)
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	args = mergePrefixes(args, flagValues.Merge)
 
 	userKey := ""
 	if usr := flagValues.User; len(usr) > 0 {
@@ -130,12 +336,52 @@ func find(ctx context.Context, values interface{}, args []string) error {
 	errs.Append(err)
 	fileRE, err := compileRE("file", flagValues.FileMatch)
 	errs.Append(err)
+	pathRE, err := compileRE("regexp", flagValues.PathMatch)
+	errs.Append(err)
+	if flagValues.FilesOnly && flagValues.PrefixOnly {
+		errs.Append(fmt.Errorf("--files-only and --prefixes-only cannot be used together"))
+	}
+	sizes, err := parseSizeRange(flagValues.MinSize, flagValues.MaxSize)
+	errs.Append(err)
+	modTimes, err := parseModTimeRange(flagValues.NewerThan, flagValues.OlderThan, time.Now())
+	errs.Append(err)
+	var types map[string]bool
+	for _, typ := range flagValues.Types.Values {
+		if err := validateContentType(typ); err != nil {
+			errs.Append(err)
+			continue
+		}
+		if types == nil {
+			types = map[string]bool{}
+		}
+		types[typ] = true
+	}
+	if flagValues.JSON && flagValues.Sort {
+		errs.Append(fmt.Errorf("--json and --sort cannot be used together"))
+	}
+	if flagValues.DuplicateNames {
+		errs.Append(flags.OneOf(flagValues.DuplicateSort).Validate("count", "bytes"))
+		if flagValues.JSON || flagValues.Sort || prefixRE != nil || pathRE != nil || types != nil || sizes != nil || modTimes != nil {
+			errs.Append(fmt.Errorf("--duplicate-names cannot be used with --json, --sort, --prefix, --regexp, --type, --min-size, --max-size, --newer-than or --older-than"))
+		}
+	}
+	if len(flagValues.ChangedSince) > 0 {
+		if flagValues.DuplicateNames || flagValues.Sort || prefixRE != nil || pathRE != nil || types != nil || sizes != nil || modTimes != nil || len(userKey) > 0 || len(groupKey) > 0 {
+			errs.Append(fmt.Errorf("--changed-since cannot be used with --duplicate-names, --sort, --prefix, --regexp, --type, --min-size, --max-size, --newer-than, --older-than, --user or --group"))
+		}
+	}
 	if err := errs.Err(); err != nil {
 		return err
 	}
+	if len(flagValues.ChangedSince) > 0 {
+		return findChangedSince(ctx, flagValues, args, fileRE)
+	}
+	if flagValues.DuplicateNames {
+		return findDuplicateNames(ctx, flagValues, args, userKey, groupKey, fileRE)
+	}
 
 	resultsCh := make(chan results, 1000)
-	pt := newProgressTracker(ctx, time.Second)
+	pt := newProgressTracker(ctx, os.Stdout, time.Second)
 	finders := &errgroup.T{}
 	finders = errgroup.WithConcurrency(finders, len(args))
 	for _, root := range args {
@@ -146,13 +392,19 @@ func find(ctx context.Context, values interface{}, args []string) error {
 		}
 		layout := globalConfig.LayoutFor(root)
 		f := &finder{
-			pt:       pt,
-			db:       db,
-			sep:      layout.Separator,
-			user:     userKey,
-			group:    groupKey,
-			prefixRE: prefixRE,
-			fileRE:   fileRE,
+			pt:           pt,
+			db:           db,
+			sep:          layout.Separator,
+			user:         userKey,
+			group:        groupKey,
+			prefixRE:     prefixRE,
+			fileRE:       fileRE,
+			pathRE:       pathRE,
+			filesOnly:    flagValues.FilesOnly,
+			prefixesOnly: flagValues.PrefixOnly,
+			types:        types,
+			sizes:        sizes,
+			modTimes:     modTimes,
 		}
 		finders.Go(func() error {
 			return f.find(ctx, resultsCh, root)
@@ -164,14 +416,26 @@ func find(ctx context.Context, values interface{}, args []string) error {
 		close(resultsCh)
 	}()
 
-	files, children, disk := heap.NewKeyedInt64(heap.Descending), heap.NewKeyedInt64(heap.Descending), heap.NewKeyedInt64(heap.Descending)
+	files, children, disk := newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak)
 	ifmt := message.NewPrinter(language.English)
+	enc := json.NewEncoder(os.Stdout)
 	for result := range resultsCh {
 		pi := result.prefixInfo
+		if flagValues.JSON {
+			if err := writeJSONResult(enc, result, flagValues.OwnerNames); err != nil {
+				errs.Append(err)
+				break
+			}
+			continue
+		}
 		if flagValues.Sort {
-			files.Update(result.prefix, int64(result.nFiles))
-			children.Update(result.prefix, int64(result.nChildren))
-			disk.Update(result.prefix, pi.DiskUsage)
+			files.add(result.prefix, int64(result.nFiles), &pi)
+			children.add(result.prefix, int64(result.nChildren), &pi)
+			disk.add(result.prefix, pi.DiskUsage, &pi)
+			continue
+		}
+		if flagValues.FilesOnly && len(pi.Files) > 0 {
+			printFiles(ifmt, result, flagValues.ShowSizes)
 			continue
 		}
 		ifmt.Printf("%v", result.prefix)
@@ -183,26 +447,16 @@ func find(ctx context.Context, values interface{}, args []string) error {
 			}
 		}
 		ifmt.Printf("\n")
-		if len(pi.Files) == 0 {
-			continue
-		}
-		prefix := strings.TrimSuffix(result.prefix, result.sep)
-		for _, fi := range pi.Files {
-			if flagValues.ShowSizes {
-				ifmt.Printf("%v%s%v: %v\n", prefix, result.sep, fi.Name, fsize(pi.Size))
-			} else {
-				ifmt.Printf("%v%s%v\n", prefix, result.sep, fi.Name)
-			}
-		}
+		printFiles(ifmt, result, flagValues.ShowSizes)
 	}
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	if flagValues.Sort {
 		nFiles, nChildren, nBytes := files.Sum(), children.Sum(), disk.Sum()
-		topFiles, topChildren, topBytes := topNMetrics(files.TopN(flagValues.TopN)),
-			topNMetrics(children.TopN(flagValues.TopN)),
-			topNMetrics(disk.TopN(flagValues.TopN))
+		topFiles, topChildren, topBytes := files.TopN(flagValues.TopN),
+			children.TopN(flagValues.TopN),
+			disk.TopN(flagValues.TopN)
 
-		printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, 0, flagValues.TopN, topFiles, topChildren, topBytes)
+		printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, 0, flagValues.TopN, flagValues.Other, nil, topFiles, topChildren, topBytes)
 	}
 	return errs.Err()
 }
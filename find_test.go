@@ -0,0 +1,185 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestModTimeRange(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	mr, err := parseModTimeRange("7d", "1d", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		ago  time.Duration
+		want bool
+	}{
+		{time.Hour, false},
+		{2 * 24 * time.Hour, true},
+		{6 * 24 * time.Hour, true},
+		{8 * 24 * time.Hour, false},
+	} {
+		if got, want := mr.contains(now.Add(-tc.ago)), tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	mr, err = parseModTimeRange("2021-06-01T00:00:00Z", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mr.contains(now) || mr.contains(now.AddDate(0, -2, 0)) {
+		t.Errorf("wrong result for an absolute --newer-than: %v", mr)
+	}
+
+	if mr, err := parseModTimeRange("", "", now); mr != nil || err != nil {
+		t.Errorf("unexpected range or error: %v, %v", mr, err)
+	}
+	for _, tc := range [][2]string{
+		{"1d", "7d"},
+		{"yesterday", ""},
+	} {
+		_, err := parseModTimeRange(tc[0], tc[1], now)
+		if err == nil || !(strings.Contains(err.Error(), "do not overlap") || strings.Contains(err.Error(), "invalid age or time")) {
+			t.Errorf("%v: missing or wrong error: %v", tc, err)
+		}
+	}
+}
+
+func TestSizeRange(t *testing.T) {
+	for i, tc := range []struct {
+		min, max string
+		in, out  []int64
+	}{
+		{"10", "", []int64{10, 11, 1 << 40}, []int64{0, 9}},
+		{"", "10", []int64{0, 9, 10}, []int64{11}},
+		{"1KB", "1KiB", []int64{1000, 1024}, []int64{999, 1025}},
+		{"1.5M", "2MB", []int64{1500000, 2000000}, []int64{1499999, 2000001}},
+		{"0", "0", []int64{0}, []int64{1}},
+		{" 2 kb ", "", []int64{2000}, []int64{1999}},
+	} {
+		sr, err := parseSizeRange(tc.min, tc.max)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		for _, size := range tc.in {
+			if !sr.contains(size) {
+				t.Errorf("%v: %v should be within %+v", i, size, sr)
+			}
+		}
+		for _, size := range tc.out {
+			if sr.contains(size) {
+				t.Errorf("%v: %v should not be within %+v", i, size, sr)
+			}
+		}
+	}
+
+	if sr, err := parseSizeRange("", ""); sr != nil || err != nil {
+		t.Errorf("unexpected range or error: %v, %v", sr, err)
+	}
+	for i, tc := range []struct {
+		min, max, err string
+	}{
+		{"x", "", "--min-size: invalid size"},
+		{"", "10XB", "--max-size: invalid size"},
+		{"-1", "", "--min-size: invalid size"},
+		{"KB", "", "--min-size: invalid size"},
+		{"2MB", "1MB", "--max-size 1MB is less than --min-size 2MB"},
+	} {
+		_, err := parseSizeRange(tc.min, tc.max)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: missing or wrong error: %v", i, err)
+		}
+	}
+}
+
+func TestFindPathMatches(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	files := func(names ...string) []filewalk.Info {
+		var fi []filewalk.Info
+		for _, n := range names {
+			fi = append(fi, filewalk.Info{Name: n})
+		}
+		return fi
+	}
+	for prefix, fi := range map[string][]filewalk.Info{
+		"/r":           files("a.log", "b.txt"),
+		"/r/logs":      files("c.log", "d.txt"),
+		"/r/logs/2021": files("e.log"),
+		// /r/logs2 shares a string prefix with /r/logs but is not beneath it.
+		"/r/logs2": files("f.log"),
+		"/r/src":   files("g.go"),
+	} {
+		if err := db.Set(ctx, prefix, &filewalk.PrefixInfo{Files: fi}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(root string, filesOnly, prefixesOnly bool, expressions ...string) []string {
+		fr := &finder{db: db, sep: "/", filesOnly: filesOnly, prefixesOnly: prefixesOnly}
+		for _, e := range expressions {
+			fr.pathRE = append(fr.pathRE, regexp.MustCompile(e))
+		}
+		ch := make(chan results, 100)
+		if err := fr.find(ctx, ch, root); err != nil {
+			t.Fatal(err)
+		}
+		close(ch)
+		var found []string
+		for r := range ch {
+			if len(r.prefixInfo.Files) == 0 {
+				found = append(found, r.prefix+"/")
+			}
+			for _, fi := range r.prefixInfo.Files {
+				found = append(found, r.prefix+"/"+fi.Name)
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+	for i, tc := range []struct {
+		root                    string
+		filesOnly, prefixesOnly bool
+		expressions             []string
+		want                    []string
+	}{
+		{"/r", false, false, []string{`\.log$`}, []string{"/r/a.log", "/r/logs/2021/e.log", "/r/logs/c.log", "/r/logs2/f.log"}},
+		// The expression is matched against the full path of prefixes
+		// as well as files.
+		{"/r", false, false, []string{`/logs`}, []string{"/r/logs/", "/r/logs/2021/", "/r/logs/2021/e.log", "/r/logs/c.log", "/r/logs/d.txt", "/r/logs2/", "/r/logs2/f.log"}},
+		{"/r", true, false, []string{`/logs`}, []string{"/r/logs/2021/e.log", "/r/logs/c.log", "/r/logs/d.txt", "/r/logs2/f.log"}},
+		{"/r", false, true, []string{`/logs`}, []string{"/r/logs/", "/r/logs/2021/", "/r/logs2/"}},
+		{"/r", true, false, []string{`\.go$`, `^/r/b`}, []string{"/r/b.txt", "/r/src/g.go"}},
+		{"/r/logs", true, false, []string{`\.log$`}, []string{"/r/logs/2021/e.log", "/r/logs/c.log"}},
+		{"/r/logs", false, false, []string{`nomatch`}, nil},
+	} {
+		if got, want := find(tc.root, tc.filesOnly, tc.prefixesOnly, tc.expressions...), tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v %v: got %v, want %v", i, tc.root, tc.expressions, got, want)
+		}
+	}
+}
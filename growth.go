@@ -0,0 +1,301 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// usageHistoryFilename is the file, within a database's local directory,
+// that records per-prefix disk usage at the end of each analyze run.
+const usageHistoryFilename = "usage-history.json"
+
+const (
+	// usageHistoryTopN is the number of prefixes, by disk usage, whose
+	// usage is recorded for each run.
+	usageHistoryTopN = 1000
+	// maxUsageHistory is the number of runs retained in the history.
+	maxUsageHistory = 10
+)
+
+// usageSnapshot records the disk usage of the largest prefixes at the end
+// of an analyze run.
+type usageSnapshot struct {
+	Time   time.Time        `json:"time"`
+	Note   string           `json:"note,omitempty"`
+	Usage  map[string]int64 `json:"usage"`
+	Totals *usageTotals     `json:"totals,omitempty"`
+}
+
+// usageTotals records the database-wide totals at the end of an analyze
+// run. It is not present for runs recorded before totals were.
+type usageTotals struct {
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"`
+	Children int64 `json:"children"`
+	Errors   int64 `json:"errors"`
+}
+
+func readUsageHistory(dir string) ([]usageSnapshot, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, usageHistoryFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var history []usageSnapshot
+	if err := json.Unmarshal(buf, &history); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", usageHistoryFilename, err)
+	}
+	return history, nil
+}
+
+func writeUsageHistory(dir string, history []usageSnapshot) error {
+	if len(history) > maxUsageHistory {
+		history = history[len(history)-maxUsageHistory:]
+	}
+	buf, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, usageHistoryFilename+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, usageHistoryFilename))
+}
+
+// recordUsageHistory appends the current disk usage of the largest prefixes
+// in the database for prefix to its usage history. It must be called once
+// the database has been closed by the analyze run. The note, if any, is
+// that supplied via analyze --note.
+func recordUsageHistory(ctx context.Context, prefix, note string) error {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return nil
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	errs := errors.M{}
+	var totals usageTotals
+	for _, t := range []struct {
+		metric filewalk.MetricName
+		value  *int64
+	}{
+		{filewalk.TotalDiskUsage, &totals.Bytes},
+		{filewalk.TotalFileCount, &totals.Files},
+		{filewalk.TotalPrefixCount, &totals.Children},
+		{filewalk.TotalErrorCount, &totals.Errors},
+	} {
+		var err error
+		*t.value, err = db.Total(ctx, t.metric, filewalk.Global())
+		errs.Append(err)
+	}
+	top, err := db.TopN(ctx, filewalk.TotalDiskUsage, usageHistoryTopN, filewalk.Global())
+	errs.Append(err)
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	snapshot := usageSnapshot{
+		Time:   time.Now(),
+		Note:   note,
+		Usage:  make(map[string]int64, len(top)+1),
+		Totals: &totals,
+	}
+	for _, m := range top {
+		snapshot.Usage[m.Prefix] = m.Value
+	}
+	snapshot.Usage[cfg.Prefix] = totals.Bytes
+	history, err := readUsageHistory(cfg.Location)
+	if err != nil {
+		return err
+	}
+	return writeUsageHistory(cfg.Location, append(history, snapshot))
+}
+
+// growthRates returns the growth, in bytes per day, of every prefix that
+// appears in both of the two most recent runs in history.
+func growthRates(history []usageSnapshot) map[string]float64 {
+	if len(history) < 2 {
+		return nil
+	}
+	prev, cur := history[len(history)-2], history[len(history)-1]
+	days := cur.Time.Sub(prev.Time).Hours() / 24
+	if days <= 0 {
+		return nil
+	}
+	rates := make(map[string]float64, len(cur.Usage))
+	for prefix, usage := range cur.Usage {
+		if before, ok := prev.Usage[prefix]; ok {
+			rates[prefix] = float64(usage-before) / days
+		}
+	}
+	return rates
+}
+
+// growthRatesFor returns the growth rates recorded for the database that
+// stores prefix as well as the two runs that they were computed from.
+func growthRatesFor(prefix string) (rates map[string]float64, from, to usageSnapshot, err error) {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		err = fmt.Errorf("growth rates are only available for local databases: %v", prefix)
+		return
+	}
+	history, err := readUsageHistory(cfg.Location)
+	if err != nil {
+		return
+	}
+	rates = growthRates(history)
+	if rates == nil {
+		err = fmt.Errorf("growth rates require at least two analyze runs for %v", prefix)
+		return
+	}
+	from, to = history[len(history)-2], history[len(history)-1]
+	return
+}
+
+// describeRun returns the time of the run and its note, if any.
+func describeRun(run usageSnapshot) string {
+	ts := displayTime(run.Time).Format(time.RFC3339)
+	if len(run.Note) == 0 {
+		return ts
+	}
+	return fmt.Sprintf("%v (%v)", ts, run.Note)
+}
+
+// fgrowth formats a growth rate in bytes per day.
+func fgrowth(rate float64) string {
+	if rate < 0 {
+		return "-" + fsize(int64(-rate)) + "/day"
+	}
+	return "+" + fsize(int64(rate)) + "/day"
+}
+
+// printGrowthRates prints the growth rates of the supplied prefixes,
+// fastest growing first. Prefixes with no recorded growth rate are
+// printed last.
+func printGrowthRates(out io.Writer, topN int, topBytes []filewalk.Metric, rates map[string]float64, from, to usageSnapshot) {
+	ifmt := message.NewPrinter(language.English)
+	sorted := make([]filewalk.Metric, len(topBytes))
+	copy(sorted, topBytes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, iok := rates[sorted[i].Prefix]
+		rj, jok := rates[sorted[j].Prefix]
+		if iok != jok {
+			return iok
+		}
+		return ri > rj
+	})
+	fmt.Fprintf(out, "Top %v prefixes by disk usage, ordered by growth rate between runs at %v and %v\n", topN, describeRun(from), describeRun(to))
+	for _, m := range sorted {
+		growth := "(unknown)"
+		if rate, ok := rates[m.Prefix]; ok {
+			growth = fgrowth(rate)
+		}
+		ifmt.Fprintf(out, "%20v: %v (%v)\n", growth, m.Prefix, fsize(m.Value))
+	}
+}
+
+// timeFlagLayouts are the formats accepted by flags such as summary --as-of,
+// times without a time zone are interpreted in the --timezone time zone.
+var timeFlagLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseTimeFlag(flag, value string) (time.Time, error) {
+	for _, layout := range timeFlagLayouts {
+		if t, err := time.ParseInLocation(layout, value, displayZone); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time for --%v: %q, use RFC3339 or YYYY-MM-DD", flag, value)
+}
+
+// usageAsOf returns the most recent run in history that completed at or
+// before asOf.
+func usageAsOf(history []usageSnapshot, asOf time.Time) (usageSnapshot, error) {
+	if len(history) == 0 {
+		return usageSnapshot{}, fmt.Errorf("no usage history has been recorded")
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Time.After(asOf) {
+			return history[i], nil
+		}
+	}
+	return usageSnapshot{}, fmt.Errorf("%v predates the earliest recorded run at %v", displayTime(asOf).Format(time.RFC3339), describeRun(history[0]))
+}
+
+// printUsageAsOf prints the totals and the top prefixes by disk usage
+// recorded for a past run.
+func printUsageAsOf(out io.Writer, topN int, run usageSnapshot) {
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Usage as of the run at %v\n", describeRun(run))
+	if t := run.Totals; t != nil {
+		ifmt.Fprintf(out, "% 20v : total disk usage\n", fsize(t.Bytes))
+		ifmt.Fprintf(out, "% 20v : total files\n", t.Files)
+		ifmt.Fprintf(out, "% 20v : total children\n", t.Children)
+		ifmt.Fprintf(out, "% 20v : total errors\n", t.Errors)
+	} else {
+		ifmt.Fprintf(out, "totals were not recorded for this run\n")
+	}
+	top := make([]filewalk.Metric, 0, len(run.Usage))
+	for prefix, usage := range run.Usage {
+		top = append(top, filewalk.Metric{Prefix: prefix, Value: usage})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Value != top[j].Value {
+			return top[i].Value > top[j].Value
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+	top = firstNMetrics(top, topN)
+	fmt.Fprintf(out, "Top %v prefixes by disk usage\n", topN)
+	for _, m := range top {
+		ifmt.Fprintf(out, "%20v: %v\n", fsize(m.Value), m.Prefix)
+	}
+}
+
+// summaryAsOf reports the usage recorded for the database that stores
+// prefix by the most recent run at or before asOf.
+func summaryAsOf(out io.Writer, prefix, asOf string, topN int) error {
+	when, err := parseTimeFlag("as-of", asOf)
+	if err != nil {
+		return err
+	}
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return fmt.Errorf("usage history is only available for local databases: %v", prefix)
+	}
+	history, err := readUsageHistory(cfg.Location)
+	if err != nil {
+		return err
+	}
+	run, err := usageAsOf(history, when)
+	if err != nil {
+		return fmt.Errorf("%v: %v", prefix, err)
+	}
+	printUsageAsOf(out, topN, run)
+	return nil
+}
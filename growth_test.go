@@ -0,0 +1,142 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrowthRates(t *testing.T) {
+	now := time.Now()
+	run := func(days int, usage map[string]int64) usageSnapshot {
+		return usageSnapshot{Time: now.Add(time.Duration(days) * 24 * time.Hour), Usage: usage}
+	}
+	first := run(0, map[string]int64{"/a": 100, "/a/b": 50, "/a/gone": 10})
+	for i, tc := range []struct {
+		history []usageSnapshot
+		want    map[string]float64
+	}{
+		{nil, nil},
+		{[]usageSnapshot{first}, nil},
+		// Runs at the same time have no growth rate.
+		{[]usageSnapshot{first, run(0, map[string]int64{"/a": 200})}, nil},
+		{[]usageSnapshot{first, run(2, map[string]int64{"/a": 300, "/a/b": 40, "/a/new": 10})},
+			map[string]float64{"/a": 100, "/a/b": -5}},
+		// Only the two most recent runs are used.
+		{[]usageSnapshot{first, run(1, map[string]int64{"/a": 0}), run(3, map[string]int64{"/a": 100})},
+			map[string]float64{"/a": 50}},
+	} {
+		if got, want := growthRates(tc.history), tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestUsageHistory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	history, err := readUsageHistory(tmpDir)
+	if err != nil || history != nil {
+		t.Fatalf("got %v, %v, want no history and no error", history, err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < maxUsageHistory+2; i++ {
+		history = append(history, usageSnapshot{
+			Time:  now.Add(time.Duration(i) * time.Hour),
+			Usage: map[string]int64{"/a": int64(i)},
+		})
+		if err := writeUsageHistory(tmpDir, history); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := readUsageHistory(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the most recent runs are retained.
+	if want := history[len(history)-maxUsageHistory:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if rates := growthRates(got); !reflect.DeepEqual(rates, map[string]float64{"/a": 24}) {
+		t.Errorf("got %v", rates)
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	defer func(zone *time.Location) { displayZone = zone }(displayZone)
+	var err error
+	displayZone, err = time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err)
+	}
+	for i, tc := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"2021-07-04T10:11:12Z", time.Date(2021, 7, 4, 10, 11, 12, 0, time.UTC)},
+		{"2021-07-04T10:11:12+02:00", time.Date(2021, 7, 4, 8, 11, 12, 0, time.UTC)},
+		// Times without a time zone are in the --timezone time zone.
+		{"2021-07-04T10:11:12", time.Date(2021, 7, 4, 10, 11, 12, 0, displayZone)},
+		{"2021-07-04 10:11:12", time.Date(2021, 7, 4, 10, 11, 12, 0, displayZone)},
+		{"2021-07-04", time.Date(2021, 7, 4, 0, 0, 0, 0, displayZone)},
+	} {
+		got, err := parseTimeFlag("as-of", tc.value)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.value, got, tc.want)
+		}
+	}
+	for i, bad := range []string{"", "yesterday", "2021-13-01", "2021-07-04T25:00:00", "07/04/2021"} {
+		_, err := parseTimeFlag("as-of", bad)
+		if err == nil || !strings.Contains(err.Error(), "invalid time for --as-of") {
+			t.Errorf("%v: %q: missing or unexpected error: %v", i, bad, err)
+		}
+	}
+}
+
+func TestUsageAsOf(t *testing.T) {
+	start := time.Date(2021, 7, 4, 0, 0, 0, 0, time.UTC)
+	var history []usageSnapshot
+	for i := 0; i < 3; i++ {
+		history = append(history, usageSnapshot{Time: start.Add(time.Duration(i) * time.Hour), Note: string(rune('a' + i))})
+	}
+	for i, tc := range []struct {
+		asOf time.Time
+		want string
+	}{
+		{start, "a"},
+		{start.Add(time.Minute), "a"},
+		{start.Add(time.Hour - time.Nanosecond), "a"},
+		{start.Add(time.Hour), "b"},
+		{start.Add(2 * time.Hour), "c"},
+		{start.Add(48 * time.Hour), "c"},
+	} {
+		run, err := usageAsOf(history, tc.asOf)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got, want := run.Note, tc.want; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.asOf, got, want)
+		}
+	}
+	if _, err := usageAsOf(history, start.Add(-time.Nanosecond)); err == nil || !strings.Contains(err.Error(), "predates the earliest recorded run") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if _, err := usageAsOf(nil, start); err == nil || !strings.Contains(err.Error(), "no usage history has been recorded") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
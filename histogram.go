@@ -0,0 +1,203 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloudeng.io/cmd/idu/query"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// sizeUnits are the suffixes accepted by parseSize, longest first so that
+// eg. KiB is not mistaken for B.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40}, {"PIB", 1 << 50},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"PB", 1e15},
+	{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"P", 1e15},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes with an optional decimal (KB, MB, ...)
+// or binary (KiB, MiB, ...) unit suffix, eg. 1.5GB or 512KiB.
+func parseSize(value string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			multiplier = u.multiplier
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return int64(f * float64(multiplier)), nil
+}
+
+// parseSizeBuckets parses a comma separated list of bucket boundaries,
+// which must be positive and strictly increasing.
+func parseSizeBuckets(value string) ([]int64, error) {
+	var bounds []int64
+	for _, b := range strings.Split(value, ",") {
+		size, err := parseSize(b)
+		if err != nil {
+			return nil, err
+		}
+		if size <= 0 || (len(bounds) > 0 && size <= bounds[len(bounds)-1]) {
+			return nil, fmt.Errorf("size histogram buckets must be positive and increasing: %v", value)
+		}
+		bounds = append(bounds, size)
+	}
+	return bounds, nil
+}
+
+// sizeBucket records the number and total size of files whose size is at
+// least lower and less than upper, upper is zero for the last bucket.
+type sizeBucket struct {
+	lower, upper int64
+	files, bytes int64
+}
+
+// sizeHistogram counts the files in each size bucket.
+type sizeHistogram struct {
+	buckets      []sizeBucket
+	files, bytes int64
+}
+
+func newSizeHistogram(bounds []int64) *sizeHistogram {
+	h := &sizeHistogram{buckets: make([]sizeBucket, len(bounds)+1)}
+	var lower int64
+	for i, b := range bounds {
+		h.buckets[i] = sizeBucket{lower: lower, upper: b}
+		lower = b
+	}
+	h.buckets[len(bounds)] = sizeBucket{lower: lower}
+	return h
+}
+
+func (h *sizeHistogram) add(size int64) {
+	i := sort.Search(len(h.buckets)-1, func(i int) bool {
+		return size < h.buckets[i].upper
+	})
+	h.buckets[i].files++
+	h.buckets[i].bytes += size
+	h.files++
+	h.bytes += size
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func (b sizeBucket) label() string {
+	if b.upper == 0 {
+		return ">= " + fsize(b.lower)
+	}
+	return fsize(b.lower) + " - " + fsize(b.upper)
+}
+
+func (h *sizeHistogram) print(out io.Writer, root string) {
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Size histogram for %v: %v files, %v\n", root, h.files, fsize(h.bytes))
+	for _, b := range h.buckets {
+		ifmt.Fprintf(out, "%30v : %12v files (%6.2f%%) %20v (%6.2f%%)\n",
+			b.label(), b.files, percent(b.files, h.files), fsize(b.bytes), percent(b.bytes, h.bytes))
+	}
+}
+
+func (h *sizeHistogram) writeTSV(out io.Writer) error {
+	wr := csv.NewWriter(out)
+	wr.Comma = '\t'
+	wr.Write([]string{"lower", "upper", "files", "files_pct", "bytes", "bytes_pct"})
+	for _, b := range h.buckets {
+		upper := ""
+		if b.upper != 0 {
+			upper = strconv.FormatInt(b.upper, 10)
+		}
+		wr.Write([]string{
+			strconv.FormatInt(b.lower, 10),
+			upper,
+			strconv.FormatInt(b.files, 10),
+			strconv.FormatFloat(percent(b.files, h.files), 'f', 2, 64),
+			strconv.FormatInt(b.bytes, 10),
+			strconv.FormatFloat(percent(b.bytes, h.bytes), 'f', 2, 64),
+		})
+	}
+	wr.Flush()
+	return wr.Error()
+}
+
+// forEachFile calls fn for every file stored for root and its
+// descendants.
+func forEachFile(ctx context.Context, root string, fn func(prefix string, fi filewalk.Info)) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	q := query.New(db, globalConfig.LayoutFor(root).Separator)
+	err = q.Walk(ctx, root, func(prefix string, pi *filewalk.PrefixInfo) error {
+		for _, fi := range pi.Files {
+			fn(prefix, fi)
+		}
+		return nil
+	})
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
+
+// summarySizeHistogram prints, and optionally writes as tsv, a histogram
+// of the sizes of the files stored for root and its descendants.
+func summarySizeHistogram(ctx context.Context, out io.Writer, root, buckets, tsvOut string) error {
+	bounds, err := parseSizeBuckets(buckets)
+	if err != nil {
+		return err
+	}
+	h := newSizeHistogram(bounds)
+	if err := forEachFile(ctx, root, func(_ string, fi filewalk.Info) {
+		h.add(fi.Size)
+	}); err != nil {
+		return err
+	}
+	h.print(out, root)
+	return writeHistogramTSV(tsvOut, h.writeTSV)
+}
+
+// writeHistogramTSV writes a histogram, as tsv, to the named file or object
+// store URL, if any.
+func writeHistogramTSV(tsvOut string, write func(io.Writer) error) error {
+	if len(tsvOut) == 0 {
+		return nil
+	}
+	tfile, err := createOutput(tsvOut)
+	if err != nil {
+		return err
+	}
+	if err := write(tfile); err != nil {
+		tfile.Close()
+		return err
+	}
+	return tfile.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for i, tc := range []struct {
+		value string
+		want  int64
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"10B", 10},
+		{"1K", 1000},
+		{"1kb", 1000},
+		{"1KiB", 1024},
+		{"1kib", 1024},
+		{"1.5MB", 1500000},
+		{"2MiB", 2 << 20},
+		{"1G", 1e9},
+		{"1GiB", 1 << 30},
+		{"3TB", 3e12},
+		{"1TiB", 1 << 40},
+		{"1PB", 1e15},
+		{"1PiB", 1 << 50},
+		{" 4 KB ", 4000},
+		{"0.5", 0},
+	} {
+		got, err := parseSize(tc.value)
+		if err != nil {
+			t.Errorf("%v: %q: %v", i, tc.value, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%v: %q: got %v, want %v", i, tc.value, got, tc.want)
+		}
+	}
+	for i, bad := range []string{"", "KB", "-1", "-1KB", "1XB", "1 2", "Inf", "NaN", "1e400"} {
+		if _, err := parseSize(bad); err == nil || !strings.Contains(err.Error(), "invalid size") {
+			t.Errorf("%v: %q: missing or unexpected error: %v", i, bad, err)
+		}
+	}
+}
+
+func TestParseSizeBuckets(t *testing.T) {
+	for i, tc := range []struct {
+		value string
+		want  []int64
+	}{
+		{"1", []int64{1}},
+		{"1KB,1MB,1GB", []int64{1e3, 1e6, 1e9}},
+		{"1000,1KiB", []int64{1000, 1024}},
+		{" 1KB , 2KB ", []int64{1000, 2000}},
+	} {
+		got, err := parseSizeBuckets(tc.value)
+		if err != nil {
+			t.Errorf("%v: %q: %v", i, tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: %q: got %v, want %v", i, tc.value, got, tc.want)
+		}
+	}
+	for i, tc := range []struct {
+		value, err string
+	}{
+		{"", "invalid size"},
+		{"1KB,,1MB", "invalid size"},
+		{"1KB,x", "invalid size"},
+		{"0", "must be positive and increasing"},
+		{"1MB,1KB", "must be positive and increasing"},
+		{"1KB,1000", "must be positive and increasing"},
+	} {
+		if _, err := parseSizeBuckets(tc.value); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: %q: missing or unexpected error: %v", i, tc.value, err)
+		}
+	}
+}
+
+func TestSizeHistogramBuckets(t *testing.T) {
+	h := newSizeHistogram([]int64{10, 100})
+	for _, size := range []int64{0, 9, 10, 99, 100, 1000} {
+		h.add(size)
+	}
+	want := []sizeBucket{
+		{lower: 0, upper: 10, files: 2, bytes: 9},
+		{lower: 10, upper: 100, files: 2, bytes: 109},
+		{lower: 100, files: 2, bytes: 1100},
+	}
+	if got := h.buckets; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := []int64{h.files, h.bytes}, []int64{6, 1218}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -9,14 +9,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
+	"cloudeng.io/cmd/idu/internal/errorclass"
+	"cloudeng.io/cmd/idu/internal/mounts"
 	"cloudeng.io/cmdutil/structdoc"
 	"cloudeng.io/errors"
 	"cloudeng.io/file/diskusage"
 	"cloudeng.io/file/filewalk"
+	"cloudeng.io/path/cloudpath"
 	"gopkg.in/yaml.v2"
 )
 
@@ -26,6 +31,36 @@ type Layout struct {
 	Prefix     string
 	Separator  string
 	Calculator diskusage.Calculator
+	Overrides  []LayoutOverride
+	// XAttrs is true if the size of the extended attributes of files
+	// is to be included in their storage usage.
+	XAttrs bool
+	// OneFileSystem is true if analyze is to skip directories on
+	// filesystems other than the one containing the prefix being analyzed.
+	OneFileSystem bool
+	// ForceRescanAfter, if non-zero, is the period after which an
+	// incremental analyze lists the contents of a prefix even if its
+	// modification time is unchanged.
+	ForceRescanAfter time.Duration
+}
+
+// LayoutOverride represents a calculator to be used instead of the
+// Layout's own calculator for files whose path matches Regexp.
+type LayoutOverride struct {
+	Regexp     *regexp.Regexp
+	Calculator diskusage.Calculator
+}
+
+// CalculatorFor returns the calculator to use for the file with the
+// specified path; it is the calculator for the first override that
+// matches the path, or the Layout's calculator if there are no matches.
+func (l Layout) CalculatorFor(path string) diskusage.Calculator {
+	for _, o := range l.Overrides {
+		if o.Regexp.MatchString(path) {
+			return o.Calculator
+		}
+	}
+	return l.Calculator
 }
 
 // DatabaseOpenFunc is called to open a filewalk.Database instance in
@@ -44,13 +79,15 @@ type Database struct {
 	Open        DatabaseOpenFunc
 	Delete      DatabaseDeleteFunc
 	Description string
+	Location    string // Location is the local directory used by the database, if any.
 }
 
-// Exclusions represents a set of exclusion regular expressions to
-// apply to a prefix.
+// Exclusions represents a set of exclusion regular expressions and
+// gitignore style glob patterns to apply to a prefix.
 type Exclusions struct {
 	Prefix  string
 	Regexps []*regexp.Regexp
+	Globs   []Glob
 }
 
 // Config represents a complete configuration.
@@ -58,6 +95,21 @@ type Config struct {
 	Databases  []Database   // Per-prefix databases.
 	Layouts    []Layout     // Per-prefix layouts.
 	Exclusions []Exclusions // Per-prefix exclusions.
+	ReportsDir string       // Default directory for per-user/group reports.
+	// ErrorActions determines how each category of error encountered
+	// when scanning is to be handled.
+	ErrorActions errorclass.Actions
+	// ReportProfiles are named, predefined, reports.
+	ReportProfiles []ReportProfile
+	// MaxOpenDatabases is the maximum number of databases that may be
+	// open concurrently, zero means that there is no limit.
+	MaxOpenDatabases int
+	// Tenants are the prefixes whose children are reported on, with
+	// quotas, by summary --tenants.
+	Tenants []Tenants
+	// PseudoFilesystems are the types of filesystem that are skipped by
+	// analyze --skip-pseudo-filesystems.
+	PseudoFilesystems []string
 }
 
 func (cfg *Config) DatabaseFor(prefix string) (Database, bool) {
@@ -93,15 +145,52 @@ func (cfg *Config) ExclusionsFor(prefix string) (Exclusions, bool) {
 	return Exclusions{}, false
 }
 
+// InternalExclusions returns exclusions for the directories used by idu
+// itself, ie. local database directories and the reports directory, so
+// that they are not included in the very statistics that they record.
+// Relative directories are interpreted relative to the current directory.
+func (cfg *Config) InternalExclusions() []Exclusions {
+	dirs := make([]string, 0, len(cfg.Databases)+1)
+	for _, db := range cfg.Databases {
+		if len(db.Location) > 0 {
+			dirs = append(dirs, db.Location)
+		}
+	}
+	if len(cfg.ReportsDir) > 0 {
+		switch cloudpath.Scheme(cfg.ReportsDir) {
+		case cloudpath.AWSS3, cloudpath.GoogleCloudStorage:
+		default:
+			dirs = append(dirs, cfg.ReportsDir)
+		}
+	}
+	excl := make([]Exclusions, 0, len(dirs))
+	for _, dir := range dirs {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		dir = strings.TrimSuffix(dir, string(filepath.Separator))
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(dir) + "(" + regexp.QuoteMeta(string(filepath.Separator)) + "|$)")
+		excl = append(excl, Exclusions{Prefix: dir, Regexps: []*regexp.Regexp{re}})
+	}
+	return excl
+}
+
 type exclusions struct {
 	Prefix  string   `yaml:"prefix" cmd:"prefix that these exclusions apply to"`
 	Regexps []string `yaml:"regexps" cmd:"prefixes and files matching these regular expressions will be ignored when building a datagase"`
+	Globs   []string `yaml:"exclude_globs" cmd:"prefixes and files matching these gitignore style glob patterns, eg. **/node_modules or *.tmp, will be ignored when building a database; patterns containing a / are relative to the prefix, others match at any depth beneath it; / is translated to the separator of the layout for the prefix"`
 }
 
 type yamlConfig struct {
-	Databases  []database   `yaml:"databases" cmd:"per-prefix database configurations"`
-	Layouts    []layout     `yaml:"layouts" cmd:"per-prefix filesystem layouts"`
-	Exclusions []exclusions `yaml:"exclusions" cmd:"per-prefix exclusions"`
+	Databases      []database        `yaml:"databases" cmd:"per-prefix database configurations"`
+	Layouts        []layout          `yaml:"layouts" cmd:"per-prefix filesystem layouts"`
+	Exclusions     []exclusions      `yaml:"exclusions" cmd:"per-prefix exclusions"`
+	ReportsDir     string            `yaml:"reports_dir" cmd:"default directory for per-user and per-group reports, it is automatically excluded from analysis"`
+	ReportProfiles []reportProfile   `yaml:"reports" cmd:"named report profiles, as used with summary --profile"`
+	ErrorActions   map[string]string `yaml:"error_actions" cmd:"per-category actions for errors encountered when scanning; the categories are transient-network, permission, not-found and other and the actions are record (the default), ignore or retry"`
+	MaxOpenDBs     int               `yaml:"max_open_databases" cmd:"the maximum number of databases that may be open at any one time, the least recently used database is closed when this limit is reached; zero, the default, means no limit"`
+	Tenants        []tenants         `yaml:"tenants" cmd:"prefixes whose immediate children are tenants with quotas, as used with summary --tenants"`
+	PseudoFS       []string          `yaml:"pseudo_filesystems" cmd:"the types of filesystem, as listed in /proc/self/mountinfo, that are skipped by analyze --skip-pseudo-filesystems; defaults to tmpfs, overlay, proc, sysfs, devpts and similar filesystems that do not contain real data"`
 }
 
 // ReadConfig will read a yaml config from the specified file.
@@ -118,7 +207,7 @@ func ReadConfig(filename string) (*Config, error) {
 		cfg.Layouts = []Layout{
 			{Prefix: "", Separator: "/", Calculator: diskusage.NewSimple(4096)},
 		}
-		fmt.Printf("warning: config %v does not contain a layout. assuming a simple layout with 4K block size\n", filename)
+		fmt.Fprintf(os.Stderr, "warning: config %v does not contain a layout. assuming a simple layout with 4K block size\n", filename)
 	}
 	return cfg, nil
 }
@@ -129,7 +218,73 @@ func ParseConfig(buf []byte) (*Config, error) {
 	if err := yaml.Unmarshal(buf, ymlcfg); err != nil {
 		return nil, err
 	}
-	cfg := &Config{}
+	if ymlcfg.MaxOpenDBs < 0 {
+		return nil, fmt.Errorf("max_open_databases must not be negative: %v", ymlcfg.MaxOpenDBs)
+	}
+	cfg := &Config{
+		ReportsDir:        os.ExpandEnv(ymlcfg.ReportsDir),
+		MaxOpenDatabases:  ymlcfg.MaxOpenDBs,
+		PseudoFilesystems: ymlcfg.PseudoFS,
+	}
+	if len(cfg.PseudoFilesystems) == 0 {
+		cfg.PseudoFilesystems = mounts.DefaultPseudoFilesystems
+	}
+	cfg.ErrorActions = errorclass.Actions{}
+	for category, action := range ymlcfg.ErrorActions {
+		c, err := errorclass.ParseCategory(category)
+		if err != nil {
+			return nil, err
+		}
+		a, err := errorclass.ParseAction(action)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ErrorActions[c] = a
+	}
+	names := map[string]bool{}
+	for _, rp := range ymlcfg.ReportProfiles {
+		p, err := rp.profile()
+		if err != nil {
+			return nil, err
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate report profile: %v", p.Name)
+		}
+		names[p.Name] = true
+		cfg.ReportProfiles = append(cfg.ReportProfiles, p)
+	}
+	for _, yt := range ymlcfg.Tenants {
+		t, err := yt.tenants()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Tenants = append(cfg.Tenants, t)
+	}
+	cfg.Layouts = make([]Layout, len(ymlcfg.Layouts))
+	for i, l := range ymlcfg.Layouts {
+		sep := "/"
+		if len(l.Spec.Separator) > 0 {
+			sep = l.Spec.Separator
+		}
+		cfg.Layouts[i] = Layout{
+			Prefix:           os.ExpandEnv(l.Spec.Prefix),
+			Separator:        sep,
+			Calculator:       l.instance,
+			XAttrs:           l.Spec.XAttrs,
+			OneFileSystem:    l.Spec.OneFS,
+			ForceRescanAfter: l.Spec.Rescan,
+		}
+		for _, o := range l.Spec.Overrides {
+			cfg.Layouts[i].Overrides = append(cfg.Layouts[i].Overrides,
+				LayoutOverride{Regexp: o.re, Calculator: o.instance})
+		}
+	}
+
+	// Sort by longest, ie most specific, prefix first so that the layout,
+	// and hence separator, for each exclusion can be determined.
+	sort.Slice(cfg.Layouts, func(i, j int) bool {
+		return len(cfg.Layouts[i].Prefix) > len(cfg.Layouts[j].Prefix)
+	})
 	cfg.Exclusions = make([]Exclusions, len(ymlcfg.Exclusions))
 	for i, e := range ymlcfg.Exclusions {
 		regexps := make([]*regexp.Regexp, len(e.Regexps))
@@ -141,22 +296,17 @@ func ParseConfig(buf []byte) (*Config, error) {
 			}
 			regexps[i] = re
 		}
+		globs := make([]Glob, len(e.Globs))
+		sep := cfg.LayoutFor(e.Prefix).Separator
+		for i, pattern := range e.Globs {
+			g, err := compileGlob(e.Prefix, sep, pattern)
+			errs.Append(err)
+			globs[i] = g
+		}
 		if err := errs.Err(); err != nil {
 			return nil, err
 		}
-		cfg.Exclusions[i] = Exclusions{e.Prefix, regexps}
-	}
-	cfg.Layouts = make([]Layout, len(ymlcfg.Layouts))
-	for i, l := range ymlcfg.Layouts {
-		sep := "/"
-		if len(l.Spec.Separator) > 0 {
-			sep = l.Spec.Separator
-		}
-		cfg.Layouts[i] = Layout{
-			Prefix:     os.ExpandEnv(l.Spec.Prefix),
-			Separator:  sep,
-			Calculator: l.instance,
-		}
+		cfg.Exclusions[i] = Exclusions{Prefix: e.Prefix, Regexps: regexps, Globs: globs}
 	}
 
 	cfg.Databases = make([]Database, len(ymlcfg.Databases))
@@ -167,6 +317,7 @@ func ParseConfig(buf []byte) (*Config, error) {
 			Open:        db.open,
 			Description: db.description,
 			Delete:      db.delete,
+			Location:    db.location,
 		}
 	}
 	if len(cfg.Databases) == 0 || cfg.Databases[0].Open == nil {
@@ -176,15 +327,57 @@ func ParseConfig(buf []byte) (*Config, error) {
 	sort.Slice(cfg.Exclusions, func(i, j int) bool {
 		return len(cfg.Exclusions[i].Prefix) > len(cfg.Exclusions[j].Prefix)
 	})
-	sort.Slice(cfg.Layouts, func(i, j int) bool {
-		return len(cfg.Layouts[i].Prefix) > len(cfg.Layouts[j].Prefix)
-	})
 	sort.Slice(cfg.Databases, func(i, j int) bool {
 		return len(cfg.Databases[i].Prefix) > len(cfg.Databases[j].Prefix)
 	})
+	if err := cfg.validateOverlaps(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// validateOverlaps returns an error if more than one database, or
+// layout, is configured for the same prefix, since all but one of them
+// would be silently ignored. Prefixes that differ only by a trailing
+// separator are considered the same.
+func (cfg *Config) validateOverlaps() error {
+	errs := errors.M{}
+	dbs := map[string]string{}
+	for _, d := range cfg.Databases {
+		p := strings.TrimSuffix(d.Prefix, cfg.LayoutFor(d.Prefix).Separator)
+		if other, ok := dbs[p]; ok {
+			errs.Append(fmt.Errorf("more than one database is configured for the same prefix: %v and %v", other, d.Prefix))
+			continue
+		}
+		dbs[p] = d.Prefix
+	}
+	layouts := map[string]string{}
+	for _, l := range cfg.Layouts {
+		p := strings.TrimSuffix(l.Prefix, l.Separator)
+		if other, ok := layouts[p]; ok {
+			errs.Append(fmt.Errorf("more than one layout is configured for the same prefix: %v and %v", other, l.Prefix))
+			continue
+		}
+		layouts[p] = l.Prefix
+	}
+	return errs.Err()
+}
+
+// NestedDatabases returns the databases configured for prefixes strictly
+// within prefix, the usage of those prefixes is stored in those databases
+// rather than in the database for prefix itself.
+func (cfg *Config) NestedDatabases(prefix string) []Database {
+	sep := cfg.LayoutFor(prefix).Separator
+	parent := strings.TrimSuffix(prefix, sep) + sep
+	var nested []Database
+	for _, d := range cfg.Databases {
+		if strings.HasPrefix(strings.TrimSuffix(d.Prefix, sep), parent) {
+			nested = append(nested, d)
+		}
+	}
+	return nested
+}
+
 func describe(name string, cfg interface{}) string {
 	out := &strings.Builder{}
 	desc, err := structdoc.Describe(cfg, "cmd", name+":\n")
@@ -205,16 +398,18 @@ func Documentation() string {
 		panic(err)
 	}
 	out.WriteString(structdoc.FormatFields(0, 2, desc.Fields))
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
 	if len(supportedLayouts) == 0 {
 		return out.String()
 	}
 	out.WriteString("\nSupported Databases:\n")
 	for name, cfg := range supportedDatabases {
-		out.WriteString(describe(name, cfg.config))
+		out.WriteString(describe(name, cfg.config()))
 	}
 	out.WriteString("\nSupported Layouts:\n")
 	for name, cfg := range supportedLayouts {
-		out.WriteString(describe(name, cfg.config))
+		out.WriteString(describe(name, cfg.config()))
 	}
 	return out.String()
 }
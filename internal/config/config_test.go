@@ -5,10 +5,15 @@
 package config_test
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/errorclass"
+	"cloudeng.io/file/diskusage"
 )
 
 const simple = `
@@ -75,6 +80,79 @@ func TestSimple(t *testing.T) {
 	if got, want := cfg.Exclusions[1].Regexps[1].String(), "something"; got != want {
 		t.Errorf("got %v, want %v", got, want)
 	}
+	if got, want := strings.Join(cfg.PseudoFilesystems, ","), "tmpfs"; !strings.Contains(got, want) {
+		t.Errorf("got %v, does not contain %v", got, want)
+	}
+}
+
+func TestExcludeGlobs(t *testing.T) {
+	base := `databases:
+  - prefix: /
+    type: local
+    directory: ./db
+exclusions:
+  - prefix: /tmp/
+    exclude_globs:
+`
+	cfg, err := config.ParseConfig([]byte(base + "      - \"**/node_modules\"\n      - \"/a/*.o\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	globs := cfg.Exclusions[0].Globs
+	if got, want := len(globs), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := globs[0].Pattern, "**/node_modules"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := globs[1].Regexp.String(), `^/tmp/a/[^/]*\.o(/.*)?$`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"!keep", "/", "[z-a]"} {
+		if _, err := config.ParseConfig([]byte(base + "      - \"" + bad + "\"\n")); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+
+	// Patterns are translated to use the separator of the layout for the
+	// exclusion's prefix.
+	cfg, err = config.ParseConfig([]byte(`databases:
+  - prefix: "C:"
+    type: local
+    directory: ./db
+layouts:
+  - type: identity
+    prefix: "C:"
+    separator: "\\"
+exclusions:
+  - prefix: 'C:\tmp'
+    exclude_globs:
+      - "**/node_modules"
+      - "a/*.o"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	globs = cfg.Exclusions[0].Globs
+	if got, want := globs[0].Regexp.String(), `^C:\\tmp\\(.*\\)?node_modules(\\.*)?$`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := globs[1].Regexp.String(), `^C:\\tmp\\a\\[^\\]*\.o(\\.*)?$`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		path  string
+		match bool
+	}{
+		{`C:\tmp\x\node_modules\y`, true},
+		{`C:\tmp\a\b.o`, true},
+		{`C:\tmp\a\b\c.o`, false},
+		{`C:\tmp/a/b.o`, false},
+	} {
+		if got, want := globs[0].Regexp.MatchString(tc.path) || globs[1].Regexp.MatchString(tc.path), tc.match; got != want {
+			t.Errorf("%v: got %v, want %v", tc.path, got, want)
+		}
+	}
 }
 
 func TestDocumentation(t *testing.T) {
@@ -90,3 +168,499 @@ func TestDocumentation(t *testing.T) {
 		}
 	}
 }
+
+type minimumSize struct {
+	MinSize int64 `yaml:"min_size" cmd:"the minimum storage used by any file"`
+}
+
+type minimumCalculator struct {
+	min int64
+}
+
+func (c *minimumCalculator) Calculate(size int64) int64 {
+	if size < c.min {
+		return c.min
+	}
+	return size
+}
+
+func (c *minimumCalculator) String() string {
+	return fmt.Sprintf("minimum: %v", c.min)
+}
+
+const custom = `
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: minimum
+    prefix: "/archive"
+    min_size: 65536
+`
+
+func TestRegisterLayout(t *testing.T) {
+	newFn := func(cfg interface{}) (diskusage.Calculator, error) {
+		return &minimumCalculator{min: cfg.(*minimumSize).MinSize}, nil
+	}
+	descFn := func() interface{} { return &minimumSize{} }
+	if err := config.RegisterLayout("minimum", newFn, descFn, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.RegisterLayout("minimum", newFn, descFn, false); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := config.RegisterLayout("block", newFn, descFn, false); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := config.RegisterLayout("minimum", newFn, descFn, true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg, err := config.ParseConfig([]byte(custom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := cfg.LayoutFor("/archive/a")
+	if got, want := layout.Calculator.String(), "minimum: 65536"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		size, storage int64
+	}{
+		{10, 65536},
+		{100000, 100000},
+	} {
+		if got, want := layout.Calculator.Calculate(tc.size), tc.storage; got != want {
+			t.Errorf("%v: got %v, want %v", tc.size, got, want)
+		}
+	}
+	if got := config.Documentation(); !strings.Contains(got, "min_size") {
+		t.Errorf("documentation does not contain the custom layout's fields: %v", got)
+	}
+}
+
+const overrides = `
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: block
+    prefix: "/data"
+    block_size: 4096
+    xattrs: true
+    one_file_system: true
+    force_rescan_after: 24h
+    overrides:
+      - regexp: "^/data/ssd/"
+        type: block
+        block_size: 512
+      - regexp: "\\.raw$"
+        type: identity
+`
+
+func TestLayoutOverrides(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(overrides))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := cfg.LayoutFor("/data")
+	if got, want := len(layout.Overrides), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if !layout.XAttrs {
+		t.Errorf("xattrs not set for %v", layout.Prefix)
+	}
+	if cfg.LayoutFor("/other").XAttrs {
+		t.Errorf("xattrs unexpectedly set for /other")
+	}
+	if !layout.OneFileSystem || cfg.LayoutFor("/other").OneFileSystem {
+		t.Errorf("one_file_system not set for only %v", layout.Prefix)
+	}
+	if got, want := layout.ForceRescanAfter, 24*time.Hour; got != want || cfg.LayoutFor("/other").ForceRescanAfter != 0 {
+		t.Errorf("got %v, want %v for only %v", got, want, layout.Prefix)
+	}
+	for i, tc := range []struct {
+		path    string
+		storage int64
+	}{
+		{"/data/a", 4096},
+		{"/data/hdd/a", 4096},
+		{"/data/ssd/a", 512},
+		{"/data/ssd/b/c", 512},
+		{"/data/image.raw", 10},
+		{"/data/ssd/image.raw", 512},
+	} {
+		if got, want := layout.CalculatorFor(tc.path).Calculate(10), tc.storage; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.path, got, want)
+		}
+	}
+}
+
+func TestErrorActions(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+error_actions:
+  transient-network: retry
+  not-found: ignore
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.ErrorActions, (errorclass.Actions{
+		errorclass.TransientNetwork: errorclass.Retry,
+		errorclass.NotFound:         errorclass.Ignore,
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"nfs: retry", "permission: panic"} {
+		_, err := config.ParseConfig([]byte(`
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+error_actions:
+  ` + bad + "\n"))
+		if err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestMaxOpenDatabases(t *testing.T) {
+	const dbs = `
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+`
+	cfg, err := config.ParseConfig([]byte(dbs + "max_open_databases: 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.MaxOpenDatabases, 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := config.ParseConfig([]byte(dbs + "max_open_databases: -1\n")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	db := func(prefix string) string {
+		return fmt.Sprintf("  - prefix: %v\n    type: local\n    directory: ./db\n", prefix)
+	}
+	layout := func(prefix string) string {
+		return fmt.Sprintf("  - type: identity\n    prefix: %v\n", prefix)
+	}
+	for i, tc := range []struct {
+		databases, layouts []string
+		err                string
+	}{
+		{[]string{"/a", "/b"}, []string{"/a", "/b"}, ""},
+		{[]string{"/a", "/a/b", "/ab"}, []string{"/a", "/a/b", "/ab"}, ""},
+		{[]string{"/a", "/a"}, nil, "more than one database is configured for the same prefix: /a and /a"},
+		{[]string{"/a", "/a/"}, nil, "more than one database is configured for the same prefix"},
+		{[]string{"/a"}, []string{"/a/b", "/a/b"}, "more than one layout is configured for the same prefix: /a/b and /a/b"},
+		{[]string{"/a"}, []string{"/a/b/", "/a/b"}, "more than one layout is configured for the same prefix"},
+	} {
+		cfg := "databases:\n"
+		for _, p := range tc.databases {
+			cfg += db(p)
+		}
+		if len(tc.layouts) > 0 {
+			cfg += "layouts:\n"
+		}
+		for _, p := range tc.layouts {
+			cfg += layout(p)
+		}
+		_, err := config.ParseConfig([]byte(cfg))
+		if len(tc.err) == 0 {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: missing or wrong error: %v", i, err)
+		}
+	}
+
+	cfg, err := config.ParseConfig([]byte("databases:\n" + db("/a") + db("/a/b") + db("/a/b/c") + db("/ab") + db("/b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		prefix string
+		nested []string
+	}{
+		{"/a", []string{"/a/b/c", "/a/b"}},
+		{"/a/", []string{"/a/b/c", "/a/b"}},
+		{"/a/b", []string{"/a/b/c"}},
+		{"/a/b/c", nil},
+		{"/ab", nil},
+		{"/c", nil},
+	} {
+		var nested []string
+		for _, d := range cfg.NestedDatabases(tc.prefix) {
+			nested = append(nested, d.Prefix)
+		}
+		if got, want := nested, tc.nested; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.prefix, got, want)
+		}
+	}
+}
+
+func TestReportProfiles(t *testing.T) {
+	const base = `
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+reports:
+`
+	cfg, err := config.ParseConfig([]byte(base + `
+  - name: finance
+    format: tsv
+    group_by: user
+    fields: [owner, bytes]
+    output: /tmp/finance.tsv
+  - name: ops
+    top: 5
+    omit_other: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []config.ReportProfile{
+		{Name: "finance", Format: "tsv", Fields: []string{"owner", "bytes"}, TopN: 20, GroupBy: "user", Output: "/tmp/finance.tsv"},
+		{Name: "ops", Format: "text", TopN: 5, GroupBy: "global", OmitOther: true},
+	} {
+		p, ok := cfg.ReportProfileFor(tc.Name)
+		if !ok {
+			t.Errorf("%v: %v: not found", i, tc.Name)
+			continue
+		}
+		if got, want := p, tc; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %#v, want %#v", i, got, want)
+		}
+	}
+	if _, ok := cfg.ReportProfileFor("none"); ok {
+		t.Errorf("unexpected profile")
+	}
+	for i, bad := range []string{
+		"  - format: text\n",
+		"  - name: a\n    format: csv\n",
+		"  - name: a\n    group_by: tenant\n",
+		"  - name: a\n    fields: [bytes]\n",
+		"  - name: a\n    format: tsv\n    fields: [size]\n",
+		"  - name: a\n  - name: a\n",
+	} {
+		if _, err := config.ParseConfig([]byte(base + bad)); err == nil {
+			t.Errorf("%v: %q: expected an error", i, bad)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	const base = `
+databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+tenants:
+`
+	cfg, err := config.ParseConfig([]byte(base + `
+  - prefix: /home/
+    quota: 1000
+    quotas:
+      alice: 2000
+      bob: 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, ok := cfg.TenantsFor("/home")
+	if !ok {
+		t.Fatalf("no tenants for /home")
+	}
+	for _, tc := range []struct {
+		name  string
+		quota int64
+	}{
+		{"alice", 2000}, {"bob", 0}, {"carol", 1000},
+	} {
+		if got, want := tenants.QuotaFor(tc.name), tc.quota; got != want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+	if _, ok := cfg.TenantsFor("/projects"); ok {
+		t.Errorf("unexpected tenants for /projects")
+	}
+	for i, bad := range []string{
+		"  - quota: 10\n",
+		"  - prefix: /home\n    quota: -1\n",
+		"  - prefix: /home\n    quotas:\n      alice: -1\n",
+	} {
+		if _, err := config.ParseConfig([]byte(base + bad)); err == nil {
+			t.Errorf("%v: %q: expected an error", i, bad)
+		}
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`databases:
+  - prefix: /tmp
+    type: local
+    directory: ./db-tmp
+    sync_interval: 30s
+  - prefix: /
+    type: local
+    directory: ./db-local
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cfg.Databases), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+    sync_interval: -1s
+`))
+	if err == nil || !strings.Contains(err.Error(), "sync_interval must not be negative") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+}
+
+func TestForceRescanAfter(t *testing.T) {
+	_, err := config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: block
+    prefix: /
+    block_size: 4096
+    force_rescan_after: -1h
+`))
+	if err == nil || !strings.Contains(err.Error(), "force_rescan_after must not be negative") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+}
+
+func TestCloudLayout(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: cloud
+    prefix: /
+    standard_price: 0.023
+    infrequent_price: 0.0125
+    archive_price: 0.004
+    infrequent_after: 720h
+    archive_after: 4320h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calc := cfg.LayoutFor("/a").Calculator
+	if got, want := calc.Calculate(1000), int64(1000); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	est, ok := calc.(config.CostEstimator)
+	if !ok {
+		t.Fatalf("%T does not implement config.CostEstimator", calc)
+	}
+	day := 24 * time.Hour
+	for i, tc := range []struct {
+		age  time.Duration
+		tier config.StorageTier
+		cost float64
+	}{
+		{day, config.StandardTier, 0.023},
+		{60 * day, config.InfrequentTier, 0.0125},
+		{365 * day, config.ArchiveTier, 0.004},
+	} {
+		if got, want := est.Tier(tc.age), tc.tier; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := est.MonthlyCost(2<<30, tc.age), 2*tc.cost; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	_, err = config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: cloud
+    prefix: /
+    infrequent_after: 720h
+    archive_after: 24h
+`))
+	if err == nil || !strings.Contains(err.Error(), "must be greater than infrequent_after") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+}
+
+func TestCompressedLayout(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: compressed
+    prefix: /zfs
+    ratio: 0.5
+    block_size: 512
+    overrides:
+      - regexp: "\\.gz$"
+        type: compressed
+        ratio: 1.5
+  - type: compressed
+    prefix: /
+    ratio: 0.25
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zfs := cfg.LayoutFor("/zfs/a")
+	for i, tc := range []struct {
+		path string
+		size int64
+		want int64
+	}{
+		{"/zfs/a", 0, 0},
+		{"/zfs/a", 1000, 512},
+		{"/zfs/a", 1100, 1024},
+		{"/zfs/a.gz", 1000, 1000},
+	} {
+		if got, want := zfs.CalculatorFor(tc.path).Calculate(tc.size), tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	if got, want := cfg.LayoutFor("/other").Calculator.Calculate(1001), int64(251); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = config.ParseConfig([]byte(`databases:
+  - prefix: /
+    type: local
+    directory: ./db-local
+layouts:
+  - type: compressed
+    prefix: /
+`))
+	if err == nil || !strings.Contains(err.Error(), "invalid compression ratio") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"cloudeng.io/file/diskusage"
+)
+
+// StorageTier is a storage class offered by a cloud storage service.
+type StorageTier int
+
+// The storage tiers supported by the cloud layout.
+const (
+	StandardTier StorageTier = iota
+	InfrequentTier
+	ArchiveTier
+)
+
+func (t StorageTier) String() string {
+	switch t {
+	case StandardTier:
+		return "standard"
+	case InfrequentTier:
+		return "infrequent"
+	case ArchiveTier:
+		return "archive"
+	}
+	return "unknown"
+}
+
+// CostEstimator is implemented by calculators that can estimate the
+// monthly cost of storing a file. It is intended for estimating the cost of
+// storing the contents of a filesystem in cloud storage, where a file's
+// storage tier is assumed to be determined by its age since the cost is
+// not a function of its size alone and hence cannot be reported via
+// diskusage.Calculator.
+type CostEstimator interface {
+	// Tier returns the storage tier that a file of the specified age would
+	// be stored in.
+	Tier(age time.Duration) StorageTier
+	// MonthlyCost returns the estimated monthly cost of storing a file of
+	// the specified size and age.
+	MonthlyCost(size int64, age time.Duration) float64
+}
+
+// gib is the unit in which cloud storage prices are typically quoted.
+const gib = 1 << 30
+
+type cloud struct {
+	StandardPrice   float64       `yaml:"standard_price" cmd:"the monthly price per GiB of the standard storage tier"`
+	InfrequentPrice float64       `yaml:"infrequent_price" cmd:"the monthly price per GiB of the infrequent access tier"`
+	ArchivePrice    float64       `yaml:"archive_price" cmd:"the monthly price per GiB of the archive tier"`
+	InfrequentAfter time.Duration `yaml:"infrequent_after" cmd:"files that have not been modified for at least this long are assumed to be stored in the infrequent access tier, zero to not use this tier"`
+	ArchiveAfter    time.Duration `yaml:"archive_after" cmd:"files that have not been modified for at least this long are assumed to be stored in the archive tier, zero to not use this tier"`
+}
+
+type cloudCalculator struct {
+	diskusage.Calculator
+	cloud
+}
+
+func newCloud(cfg interface{}) (diskusage.Calculator, error) {
+	c := cfg.(*cloud)
+	if c.StandardPrice < 0 || c.InfrequentPrice < 0 || c.ArchivePrice < 0 {
+		return nil, fmt.Errorf("prices must not be negative")
+	}
+	if c.InfrequentAfter < 0 || c.ArchiveAfter < 0 {
+		return nil, fmt.Errorf("tier ages must not be negative")
+	}
+	if c.InfrequentAfter > 0 && c.ArchiveAfter > 0 && c.ArchiveAfter <= c.InfrequentAfter {
+		return nil, fmt.Errorf("archive_after (%v) must be greater than infrequent_after (%v)", c.ArchiveAfter, c.InfrequentAfter)
+	}
+	// Cloud storage is billed for the logical size of each file.
+	return &cloudCalculator{Calculator: diskusage.NewIdentity(), cloud: *c}, nil
+}
+
+// Tier implements CostEstimator.
+func (c *cloudCalculator) Tier(age time.Duration) StorageTier {
+	switch {
+	case c.ArchiveAfter > 0 && age >= c.ArchiveAfter:
+		return ArchiveTier
+	case c.InfrequentAfter > 0 && age >= c.InfrequentAfter:
+		return InfrequentTier
+	}
+	return StandardTier
+}
+
+// MonthlyCost implements CostEstimator.
+func (c *cloudCalculator) MonthlyCost(size int64, age time.Duration) float64 {
+	price := c.StandardPrice
+	switch c.Tier(age) {
+	case InfrequentTier:
+		price = c.InfrequentPrice
+	case ArchiveTier:
+		price = c.ArchivePrice
+	}
+	return float64(size) / gib * price
+}
+
+func (c *cloudCalculator) String() string {
+	return fmt.Sprintf("cloud: %v/%v/%v per GiB-month, infrequent after %v, archive after %v",
+		c.StandardPrice, c.InfrequentPrice, c.ArchivePrice, c.InfrequentAfter, c.ArchiveAfter)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"cloudeng.io/file/filewalk"
 	"cloudeng.io/file/filewalk/localdb"
@@ -24,21 +25,36 @@ type database struct {
 	open        DatabaseOpenFunc
 	delete      DatabaseDeleteFunc
 	description string
+	location    string
 }
 
-type databaseFactory func(spec interface{}) (DatabaseOpenFunc, DatabaseDeleteFunc, string)
+type databaseFactory func(spec interface{}) (open DatabaseOpenFunc, delete DatabaseDeleteFunc, description, location string)
 
 type databaseConfig struct {
-	config  interface{}
+	config  func() interface{}
 	factory databaseFactory
 }
 
 var supportedDatabases = map[string]databaseConfig{
-	"local": {&localDatabaseSpec{}, localOpen},
+	"local": {func() interface{} { return &localDatabaseSpec{} }, localOpen},
 }
 
 type localDatabaseSpec struct {
-	Directory string `yaml:"directory" cmd:"local directory containing the database"`
+	Directory    string        `yaml:"directory" cmd:"local directory containing the database"`
+	SyncInterval time.Duration `yaml:"sync_interval" cmd:"the interval at which the database is periodically persisted to disk while it is being written, eg. 10s; longer intervals reduce the write load on busy filesystems whereas shorter ones lose less work if idu is killed; the default is to persist it only when it is closed"`
+}
+
+// databaseValidator is implemented by database specific configurations
+// that need to be validated once they have been unmarshaled.
+type databaseValidator interface {
+	validate() error
+}
+
+func (s *localDatabaseSpec) validate() error {
+	if s.SyncInterval < 0 {
+		return fmt.Errorf("sync_interval must not be negative: %v", s.SyncInterval)
+	}
+	return nil
 }
 
 func (d *database) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -49,20 +65,52 @@ func (d *database) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if !ok {
 		return fmt.Errorf("unsupported database: %q", d.Spec.Type)
 	}
-	if err := unmarshal(cfg.config); err != nil {
+	spec := cfg.config()
+	if err := unmarshal(spec); err != nil {
 		return err
 	}
-	d.open, d.delete, d.description = cfg.factory(cfg.config)
+	if v, ok := spec.(databaseValidator); ok {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("database for %v: %v", d.Spec.Prefix, err)
+		}
+	}
+	d.open, d.delete, d.description, d.location = cfg.factory(spec)
 	return nil
 }
 
-func localOpen(spec interface{}) (DatabaseOpenFunc, DatabaseDeleteFunc, string) {
-	dir := os.ExpandEnv(spec.(*localDatabaseSpec).Directory)
+func localOpen(spec interface{}) (DatabaseOpenFunc, DatabaseDeleteFunc, string, string) {
+	local := spec.(*localDatabaseSpec)
+	dir := os.ExpandEnv(local.Directory)
+	var localOpts []localdb.DatabaseOption
+	if local.SyncInterval > 0 {
+		localOpts = append(localOpts, localdb.SyncInterval(local.SyncInterval))
+	}
 	open := func(ctx context.Context, opts ...filewalk.DatabaseOption) (filewalk.Database, error) {
-		return localdb.Open(ctx, dir, opts)
+		return localdb.Open(ctx, dir, opts, localOpts...)
 	}
 	delete := func(ctx context.Context) error {
 		return os.RemoveAll(dir)
 	}
-	return open, delete, fmt.Sprintf("local database in %s", dir)
+	return open, delete, fmt.Sprintf("local database in %s", dir), dir
+}
+
+// UseSnapshot replaces the database configured for prefix with the
+// local database snapshot in dir. The snapshot is always opened read-only
+// and cannot be deleted.
+func (cfg *Config) UseSnapshot(prefix, dir string) error {
+	for i, db := range cfg.Databases {
+		if db.Prefix != prefix {
+			continue
+		}
+		cfg.Databases[i].Open = func(ctx context.Context, opts ...filewalk.DatabaseOption) (filewalk.Database, error) {
+			return localdb.Open(ctx, dir, append(opts, filewalk.ReadOnly()))
+		}
+		cfg.Databases[i].Delete = func(ctx context.Context) error {
+			return fmt.Errorf("snapshots cannot be deleted: %v", dir)
+		}
+		cfg.Databases[i].Description = fmt.Sprintf("snapshot of %s in %s", db.Description, dir)
+		cfg.Databases[i].Location = dir
+		return nil
+	}
+	return fmt.Errorf("no database is configured for the snapshot's prefix: %v", prefix)
 }
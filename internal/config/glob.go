@@ -0,0 +1,108 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Glob represents a gitignore style glob pattern, as specified in the
+// exclude_globs field of an exclusion, and the regular expression that it
+// is compiled to. The regular expression matches full paths.
+type Glob struct {
+	Pattern string
+	Regexp  *regexp.Regexp
+}
+
+// GlobRegexp returns the regular expression equivalent to a gitignore
+// style glob pattern, where ** matches any number of directories, * and
+// ? do not match a /, and [...] are character classes. The returned
+// expression is not anchored.
+func GlobRegexp(glob string) string {
+	return globRegexp(glob, "/")
+}
+
+// globRegexp is like GlobRegexp except that the / in glob, and hence the
+// directories matched by ** and the names matched by * and ?, are delimited
+// by sep in the returned expression.
+func globRegexp(glob, sep string) string {
+	qsep := regexp.QuoteMeta(sep)
+	notSep := "[^" + qsep + "]"
+	var out strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				out.WriteString("(.*" + qsep + ")?")
+				i += 2
+				continue
+			}
+			if strings.HasPrefix(glob[i:], "**") {
+				out.WriteString(".*")
+				i++
+				continue
+			}
+			out.WriteString(notSep + "*")
+		case '?':
+			out.WriteString(notSep)
+		case '/':
+			out.WriteString(qsep)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				out.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			out.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				out.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			out.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return out.String()
+}
+
+// compileGlob compiles a glob for the exclusions for prefix, whose
+// layout uses sep as its separator. Patterns are always written using /,
+// which is translated to sep. As for gitignore, patterns that contain a /
+// other than a trailing one are relative to prefix, others may match at any
+// depth beneath it. Anything beneath a matching path is also matched. A
+// trailing / is accepted but has no effect since exclusions are applied to
+// directories.
+func compileGlob(prefix, sep, glob string) (Glob, error) {
+	pattern := strings.TrimSpace(glob)
+	if strings.HasPrefix(pattern, "!") {
+		return Glob{}, fmt.Errorf("negated patterns are not supported in exclude_globs: %q", glob)
+	}
+	pattern = strings.TrimRight(pattern, "/")
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if len(pattern) == 0 {
+		return Glob{}, fmt.Errorf("empty pattern in exclude_globs: %q", glob)
+	}
+	qsep := regexp.QuoteMeta(sep)
+	expr := "^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, sep)) + qsep
+	if !anchored {
+		expr += "(.*" + qsep + ")?"
+	}
+	expr += globRegexp(pattern, sep) + "(" + qsep + ".*)?$"
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Glob{}, fmt.Errorf("failed to compile %v: %v", glob, err)
+	}
+	return Glob{Pattern: glob, Regexp: re}, nil
+}
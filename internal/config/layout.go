@@ -6,15 +6,31 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
 
 	"cloudeng.io/file/diskusage"
 )
 
 type layoutSpec struct {
-	Type      string      `yaml:"type" cmd:"type of this layout"`
-	Prefix    string      `yaml:"prefix" cmd:"prefix that this layout applies to"`
-	Separator string      `yaml:"separator" cmd:"filename separator to use, defaults tp /"`
-	config    interface{} `yaml:"custom fields" cmd:"layout specific configuration fields"` //nolint:structcheck
+	Type      string           `yaml:"type" cmd:"type of this layout"`
+	Prefix    string           `yaml:"prefix" cmd:"prefix that this layout applies to"`
+	Separator string           `yaml:"separator" cmd:"filename separator to use, defaults tp /"`
+	XAttrs    bool             `yaml:"xattrs" cmd:"include the size of the extended attributes of files in their storage usage, this requires an additional system call per file and is only supported on linux"`
+	OneFS     bool             `yaml:"one_file_system" cmd:"do not descend into directories on filesystems other than the one containing the prefix being analyzed, eg. network mounts, as per analyze --one-file-system"`
+	Rescan    time.Duration    `yaml:"force_rescan_after" cmd:"in incremental mode, list the contents of any prefix that has not been listed for longer than this even if its modification time is unchanged, for filesystems whose modification times are unreliable; disabled by default"`
+	Overrides []layoutOverride `yaml:"overrides" cmd:"layouts to use instead of this one for files whose paths match the specified regular expressions, the first matching override is used"`
+	config    interface{}      `yaml:"custom fields" cmd:"layout specific configuration fields"` //nolint:structcheck
+}
+
+type layoutOverride struct {
+	Regexp   string      `yaml:"regexp" cmd:"regular expression to match against the full path of each file"`
+	Type     string      `yaml:"type" cmd:"type of the layout to use for matching files"`
+	config   interface{} `yaml:"custom fields" cmd:"layout specific configuration fields"` //nolint:structcheck
+	re       *regexp.Regexp
+	instance diskusage.Calculator
 }
 
 type layout struct {
@@ -22,34 +38,112 @@ type layout struct {
 	instance diskusage.Calculator
 }
 
+// LayoutFactory is called to create a diskusage.Calculator from the
+// configuration returned by the corresponding LayoutConfigFunc once it has
+// been populated from the yaml configuration file.
+type LayoutFactory func(cfg interface{}) (diskusage.Calculator, error)
+
+// LayoutConfigFunc is called to obtain a new instance of a pointer to the
+// struct into which a layout's custom fields are to be unmarshaled. The
+// struct's cmd tags are used to document the layout.
+type LayoutConfigFunc func() interface{}
+
 type layoutConfig struct {
-	config  interface{}
-	factory func(cfg interface{}) (diskusage.Calculator, error)
+	config  LayoutConfigFunc
+	factory LayoutFactory
 }
 
-var supportedLayouts = map[string]layoutConfig{
-	"block":    {&simple{}, newSimpleLayout},
-	"identity": {&identity{}, newIdentity},
-	"raid0":    {&raid0{}, newRaid0},
+var (
+	layoutsMu        sync.Mutex
+	supportedLayouts = map[string]layoutConfig{
+		"block":      {func() interface{} { return &simple{} }, newSimpleLayout},
+		"cloud":      {func() interface{} { return &cloud{} }, newCloud},
+		"compressed": {func() interface{} { return &compressed{} }, newCompressed},
+		"identity":   {func() interface{} { return &identity{} }, newIdentity},
+		"raid0":      {func() interface{} { return &raid0{} }, newRaid0},
+	}
+)
+
+// RegisterLayout registers a new layout type, so that it may be referred
+// to by name in the layouts section of a configuration file. It must be
+// called before the configuration file is parsed. An error is returned
+// if the name is already registered, including for the built-in layouts,
+// unless force is true. descFn may be nil for layouts that have no custom
+// fields.
+func RegisterLayout(name string, newFn LayoutFactory, descFn LayoutConfigFunc, force bool) error {
+	if len(name) == 0 || newFn == nil {
+		return fmt.Errorf("a layout must have a name and a factory function")
+	}
+	if descFn == nil {
+		descFn = func() interface{} { return &struct{}{} }
+	}
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
+	if _, ok := supportedLayouts[name]; ok && !force {
+		return fmt.Errorf("layout is already registered: %v", name)
+	}
+	supportedLayouts[name] = layoutConfig{config: descFn, factory: newFn}
+	return nil
+}
+
+func layoutFor(typ string) (layoutConfig, bool) {
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
+	cfg, ok := supportedLayouts[typ]
+	return cfg, ok
+}
+
+func newCalculator(typ, prefix string, unmarshal func(interface{}) error) (diskusage.Calculator, error) {
+	cfg, ok := layoutFor(typ)
+	if !ok {
+		return nil, fmt.Errorf("unsupported layout: %v %v", typ, prefix)
+	}
+	spec := cfg.config()
+	if err := unmarshal(spec); err != nil {
+		return nil, err
+	}
+	instance, err := cfg.factory(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure %v for prefix %v: %v", typ, prefix, err)
+	}
+	return instance, nil
 }
 
 func (l *layout) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&l.Spec); err != nil {
 		return err
 	}
-	cfg, ok := supportedLayouts[l.Spec.Type]
-	if !ok {
-		return fmt.Errorf("unsupported layout: %v %v", l.Spec.Type, l.Spec.Prefix)
+	if l.Spec.Rescan < 0 {
+		return fmt.Errorf("force_rescan_after must not be negative for prefix %v: %v", l.Spec.Prefix, l.Spec.Rescan)
 	}
-	if err := unmarshal(cfg.config); err != nil {
+	instance, err := newCalculator(l.Spec.Type, l.Spec.Prefix, unmarshal)
+	if err != nil {
 		return err
 	}
-	instance, err := cfg.factory(cfg.config)
+	l.instance = instance
+	return nil
+}
+
+func (o *layoutOverride) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	spec := struct {
+		Regexp string `yaml:"regexp"`
+		Type   string `yaml:"type"`
+	}{}
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+	o.Regexp, o.Type = spec.Regexp, spec.Type
+	re, err := regexp.Compile(o.Regexp)
 	if err != nil {
-		return fmt.Errorf("failed to configure %v for prefix %v: %v", l.Spec.Type, l.Spec.Prefix, err)
+		return fmt.Errorf("failed to compile %v: %v", o.Regexp, err)
 	}
-	l.instance = instance
-	return err
+	o.re = re
+	instance, err := newCalculator(o.Type, o.Regexp, unmarshal)
+	if err != nil {
+		return err
+	}
+	o.instance = instance
+	return nil
 }
 
 type simple struct {
@@ -63,6 +157,11 @@ type raid0 struct {
 	NumStripes int   `yaml:"num_stripes" cmd:"the number of stripes used"`
 }
 
+type compressed struct {
+	Ratio     float64 `yaml:"ratio" cmd:"the assumed ratio of compressed to logical size, eg. 0.5 for data that compresses by half, ratios greater than 1 are treated as 1 since such filesystems store incompressible data as is"`
+	BlockSize int64   `yaml:"block_size" cmd:"block size used by this filesystem, the compressed size is rounded up to a multiple of it, zero for no rounding"`
+}
+
 func newSimpleLayout(cfg interface{}) (diskusage.Calculator, error) {
 	c := cfg.(*simple)
 	if s := c.BlockSize; s == 0 {
@@ -75,6 +174,40 @@ func newIdentity(cfg interface{}) (diskusage.Calculator, error) {
 	return diskusage.NewIdentity(), nil
 }
 
+func newCompressed(cfg interface{}) (diskusage.Calculator, error) {
+	c := cfg.(*compressed)
+	if c.Ratio <= 0 {
+		return nil, fmt.Errorf("invalid compression ratio: %v, must be in the range (0, 1]", c.Ratio)
+	}
+	if c.BlockSize < 0 {
+		return nil, fmt.Errorf("invalid block size: %v", c.BlockSize)
+	}
+	ratio := c.Ratio
+	if ratio > 1 {
+		ratio = 1
+	}
+	return &compressedCalculator{ratio: ratio, blockSize: c.BlockSize}, nil
+}
+
+// compressedCalculator estimates the storage used by files on filesystems,
+// such as ZFS and btrfs, that transparently compress their contents.
+type compressedCalculator struct {
+	ratio     float64
+	blockSize int64
+}
+
+func (c *compressedCalculator) Calculate(size int64) int64 {
+	n := int64(math.Ceil(float64(size) * c.ratio))
+	if c.blockSize == 0 || n%c.blockSize == 0 {
+		return n
+	}
+	return (n/c.blockSize + 1) * c.blockSize
+}
+
+func (c *compressedCalculator) String() string {
+	return fmt.Sprintf("compressed: ratio %v, block size %v", c.ratio, c.blockSize)
+}
+
 func newRaid0(cfg interface{}) (diskusage.Calculator, error) {
 	c := cfg.(*raid0)
 	if s := c.StripeSize; s == 0 {
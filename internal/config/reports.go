@@ -0,0 +1,105 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// ReportFields are the fields that may be included in a tsv report.
+var ReportFields = []string{
+	"owner", "prefix", "user", "bytes", "files", "directories", "errors", "avg_file_size",
+	"distinct_users", "distinct_groups",
+}
+
+// ReportProfile represents a named, predefined, report.
+type ReportProfile struct {
+	Name    string
+	Format  string   // Format is either text or tsv.
+	Fields  []string // Fields to include in a tsv report, all if empty.
+	TopN    int      // TopN is the number of prefixes to include.
+	GroupBy string   // GroupBy is one of global, user or group.
+	// Output is the file or directory that the report is to be written to,
+	// stdout is used if empty.
+	Output string
+	// OmitOther omits the (other) row that otherwise follows each top-N
+	// listing in text reports.
+	OmitOther bool
+}
+
+type reportProfile struct {
+	Name      string   `yaml:"name" cmd:"name of the report, as used with summary --profile"`
+	Format    string   `yaml:"format" cmd:"format of the report, text (the default) or tsv"`
+	Fields    []string `yaml:"fields" cmd:"fields to include in tsv reports: owner, prefix, user, bytes, files, directories, errors, avg_file_size, distinct_users and distinct_groups, all fields are included by default"`
+	TopN      int      `yaml:"top" cmd:"number of prefixes to include in the report, defaults to 20"`
+	GroupBy   string   `yaml:"group_by" cmd:"global (the default), user or group; the latter two generate a report for every user or group, in a separate file per user/group for text reports"`
+	Output    string   `yaml:"output" cmd:"file or directory (for per user/group text reports) to write the report to, stdout is used by default"`
+	OmitOther bool     `yaml:"omit_other" cmd:"omit the (other) row that otherwise follows each top-N listing in text reports"`
+}
+
+func oneOf(field, val string, allowed ...string) error {
+	for _, a := range allowed {
+		if val == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: %q is not one of %v", field, val, allowed)
+}
+
+func (rp reportProfile) profile() (ReportProfile, error) {
+	p := ReportProfile{
+		Name:      rp.Name,
+		Format:    rp.Format,
+		Fields:    rp.Fields,
+		TopN:      rp.TopN,
+		GroupBy:   rp.GroupBy,
+		Output:    os.ExpandEnv(rp.Output),
+		OmitOther: rp.OmitOther,
+	}
+	if len(p.Name) == 0 {
+		return p, fmt.Errorf("report profile has no name")
+	}
+	if len(p.Format) == 0 {
+		p.Format = "text"
+	}
+	if len(p.GroupBy) == 0 {
+		p.GroupBy = "global"
+	}
+	if p.TopN == 0 {
+		p.TopN = 20
+	}
+	if err := oneOf("format", p.Format, "text", "tsv"); err != nil {
+		return p, fmt.Errorf("report profile %v: %v", p.Name, err)
+	}
+	if err := oneOf("group_by", p.GroupBy, "global", "user", "group"); err != nil {
+		return p, fmt.Errorf("report profile %v: %v", p.Name, err)
+	}
+	if p.TopN < 0 {
+		return p, fmt.Errorf("report profile %v: top must be positive: %v", p.Name, p.TopN)
+	}
+	if len(p.Fields) > 0 && p.Format != "tsv" {
+		return p, fmt.Errorf("report profile %v: fields can only be specified for tsv reports", p.Name)
+	}
+	for _, f := range p.Fields {
+		if err := oneOf("fields", f, ReportFields...); err != nil {
+			return p, fmt.Errorf("report profile %v: %v", p.Name, err)
+		}
+	}
+	if len(p.Fields) == 0 && p.Format == "tsv" {
+		p.Fields = ReportFields
+	}
+	return p, nil
+}
+
+// ReportProfileFor returns the named report profile.
+func (cfg *Config) ReportProfileFor(name string) (ReportProfile, bool) {
+	for _, p := range cfg.ReportProfiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ReportProfile{}, false
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Tenants represents a prefix, such as /home, whose immediate children
+// are each considered to be a separate tenant with a quota.
+type Tenants struct {
+	Prefix string
+	// Quota is the default quota, in bytes, for each tenant, zero means
+	// that there is no quota.
+	Quota int64
+	// Quotas are per-tenant quotas, in bytes, that override Quota.
+	Quotas map[string]int64
+}
+
+// QuotaFor returns the quota for the named tenant, zero means that it has
+// no quota.
+func (t Tenants) QuotaFor(name string) int64 {
+	if q, ok := t.Quotas[name]; ok {
+		return q
+	}
+	return t.Quota
+}
+
+type tenants struct {
+	Prefix string           `yaml:"prefix" cmd:"prefix whose immediate children are tenants, eg. /home"`
+	Quota  int64            `yaml:"quota" cmd:"default quota, in bytes, for each tenant, zero means no quota"`
+	Quotas map[string]int64 `yaml:"quotas" cmd:"per-tenant quotas, in bytes, keyed by the tenant's name, ie. the name of the child directory"`
+}
+
+func (t tenants) tenants() (Tenants, error) {
+	tc := Tenants{
+		Prefix: os.ExpandEnv(t.Prefix),
+		Quota:  t.Quota,
+		Quotas: t.Quotas,
+	}
+	if len(tc.Prefix) == 0 {
+		return tc, fmt.Errorf("tenants has no prefix")
+	}
+	if tc.Quota < 0 {
+		return tc, fmt.Errorf("tenants %v: quota must not be negative: %v", tc.Prefix, tc.Quota)
+	}
+	for name, q := range tc.Quotas {
+		if q < 0 {
+			return tc, fmt.Errorf("tenants %v: quota for %v must not be negative: %v", tc.Prefix, name, q)
+		}
+	}
+	return tc, nil
+}
+
+// TenantsFor returns the tenant configuration for prefix, if any.
+func (cfg *Config) TenantsFor(prefix string) (Tenants, bool) {
+	for _, t := range cfg.Tenants {
+		if strings.TrimSuffix(t.Prefix, "/") == strings.TrimSuffix(prefix, "/") {
+			return t, true
+		}
+	}
+	return Tenants{}, false
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package errorclass provides support for classifying the errors
+// encountered when scanning a filesystem, in particular, distinguishing
+// the transient errors commonly seen on network filesystems (eg. NFS, SMB)
+// from those that are not.
+package errorclass
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Category represents a class of error.
+type Category int
+
+const (
+	Other            Category = iota // Any error not in another category.
+	TransientNetwork                 // Timeouts, stale handles, connection resets etc.
+	Permission                       // Permission denied errors.
+	NotFound                         // The file or prefix no longer exists.
+)
+
+var categoryNames = map[Category]string{
+	Other:            "other",
+	TransientNetwork: "transient-network",
+	Permission:       "permission",
+	NotFound:         "not-found",
+}
+
+// String implements fmt.Stringer.
+func (c Category) String() string {
+	if n, ok := categoryNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("category(%d)", int(c))
+}
+
+// ParseCategory returns the Category with the specified name.
+func ParseCategory(name string) (Category, error) {
+	for c, n := range categoryNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return Other, fmt.Errorf("unrecognised error category: %v", name)
+}
+
+var transientErrnos = map[syscall.Errno]bool{
+	syscall.ESTALE:       true,
+	syscall.ETIMEDOUT:    true,
+	syscall.ECONNRESET:   true,
+	syscall.ECONNREFUSED: true,
+	syscall.ECONNABORTED: true,
+	syscall.EHOSTUNREACH: true,
+	syscall.ENETUNREACH:  true,
+	syscall.ENETDOWN:     true,
+	syscall.ENETRESET:    true,
+	syscall.EIO:          true,
+	syscall.EAGAIN:       true,
+	syscall.EINTR:        true,
+}
+
+// Classify returns the Category for the supplied error.
+func Classify(err error) Category {
+	if err == nil {
+		return Other
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if transientErrnos[errno] {
+			return TransientNetwork
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TransientNetwork
+	}
+	switch {
+	case os.IsPermission(err):
+		return Permission
+	case os.IsNotExist(err):
+		return NotFound
+	}
+	return Other
+}
+
+// Action represents the action to be taken for a given category of error.
+type Action int
+
+const (
+	Record Action = iota // Record the error in the database.
+	Ignore               // Ignore the error, it is not recorded.
+	Retry                // Retry the operation before recording the error.
+)
+
+var actionNames = map[Action]string{
+	Record: "record",
+	Ignore: "ignore",
+	Retry:  "retry",
+}
+
+// String implements fmt.Stringer.
+func (a Action) String() string {
+	if n, ok := actionNames[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// ParseAction returns the Action with the specified name.
+func ParseAction(name string) (Action, error) {
+	for a, n := range actionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return Record, fmt.Errorf("unrecognised error action: %v", name)
+}
+
+// Actions maps error categories to the action to be taken for them,
+// categories that are not present default to Record.
+type Actions map[Category]Action
+
+// For returns the Category and Action for the supplied error.
+func (a Actions) For(err error) (Category, Action) {
+	c := Classify(err)
+	return c, a[c]
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package errorclass_test
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/errorclass"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	for i, tc := range []struct {
+		err      error
+		category errorclass.Category
+	}{
+		{syscall.ESTALE, errorclass.TransientNetwork},
+		{syscall.ETIMEDOUT, errorclass.TransientNetwork},
+		{syscall.ECONNRESET, errorclass.TransientNetwork},
+		{syscall.EHOSTUNREACH, errorclass.TransientNetwork},
+		{syscall.EIO, errorclass.TransientNetwork},
+		{&os.PathError{Op: "open", Path: "/a", Err: syscall.ESTALE}, errorclass.TransientNetwork},
+		{fmt.Errorf("wrapped: %w", &os.PathError{Op: "lstat", Path: "/a", Err: syscall.ETIMEDOUT}), errorclass.TransientNetwork},
+		{timeoutError{}, errorclass.TransientNetwork},
+		{syscall.EACCES, errorclass.Permission},
+		{syscall.EPERM, errorclass.Permission},
+		{&os.PathError{Op: "open", Path: "/a", Err: syscall.EACCES}, errorclass.Permission},
+		{os.ErrPermission, errorclass.Permission},
+		{syscall.ENOENT, errorclass.NotFound},
+		{&os.PathError{Op: "lstat", Path: "/a", Err: syscall.ENOENT}, errorclass.NotFound},
+		{os.ErrNotExist, errorclass.NotFound},
+		{syscall.EINVAL, errorclass.Other},
+		{fmt.Errorf("oops"), errorclass.Other},
+		{nil, errorclass.Other},
+	} {
+		if got, want := errorclass.Classify(tc.err), tc.category; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.err, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []errorclass.Category{errorclass.Other, errorclass.TransientNetwork, errorclass.Permission, errorclass.NotFound} {
+		p, err := errorclass.ParseCategory(c.String())
+		if err != nil || p != c {
+			t.Errorf("%v: got %v, %v", c, p, err)
+		}
+	}
+	for _, a := range []errorclass.Action{errorclass.Record, errorclass.Ignore, errorclass.Retry} {
+		p, err := errorclass.ParseAction(a.String())
+		if err != nil || p != a {
+			t.Errorf("%v: got %v, %v", a, p, err)
+		}
+	}
+	if _, err := errorclass.ParseCategory("nfs"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := errorclass.ParseAction("panic"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestActions(t *testing.T) {
+	actions := errorclass.Actions{
+		errorclass.TransientNetwork: errorclass.Retry,
+		errorclass.NotFound:         errorclass.Ignore,
+	}
+	for i, tc := range []struct {
+		err      error
+		category errorclass.Category
+		action   errorclass.Action
+	}{
+		{syscall.ESTALE, errorclass.TransientNetwork, errorclass.Retry},
+		{syscall.ENOENT, errorclass.NotFound, errorclass.Ignore},
+		{syscall.EACCES, errorclass.Permission, errorclass.Record},
+		{fmt.Errorf("oops"), errorclass.Other, errorclass.Record},
+	} {
+		c, a := actions.For(tc.err)
+		if got, want := c, tc.category; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := a, tc.action; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
@@ -8,14 +8,24 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"cloudeng.io/cmd/idu/internal/config"
 )
 
-// T represents a set of exclusions as regular expressions.
+// T represents a set of exclusions as regular expressions. T records
+// the number of paths matched by each exclusion, see Hits.
 type T struct {
 	prefixes   []string
-	exclusions [][]*regexp.Regexp
+	exclusions [][]pattern
+	hits       [][]int64
+}
+
+// pattern is a compiled exclusion and its source, which is the glob
+// for exclusions specified as globs.
+type pattern struct {
+	re     *regexp.Regexp
+	source string
 }
 
 // New creates a new instance of exclusions.
@@ -28,23 +38,68 @@ func New(exclusions []config.Exclusions) *T {
 	ex := &T{}
 	for _, e := range cpy {
 		ex.prefixes = append(ex.prefixes, e.Prefix)
-		re := make([]*regexp.Regexp, len(e.Regexps))
-		copy(re, e.Regexps)
-		ex.exclusions = append(ex.exclusions, re)
+		patterns := make([]pattern, 0, len(e.Regexps)+len(e.Globs))
+		for _, re := range e.Regexps {
+			patterns = append(patterns, pattern{re: re, source: re.String()})
+		}
+		for _, g := range e.Globs {
+			patterns = append(patterns, pattern{re: g.Regexp, source: g.Pattern})
+		}
+		ex.exclusions = append(ex.exclusions, patterns)
+		ex.hits = append(ex.hits, make([]int64, len(patterns)))
 	}
 	return ex
 }
 
+// Match describes the exclusion that matched a given path.
+type Match struct {
+	Prefix  string // Prefix is the prefix that the exclusion applies to.
+	Index   int    // Index is the index of the pattern within those for Prefix.
+	Pattern string // Pattern is the source of the matching pattern.
+}
+
 // Exclude returns true if the supplied path matches any of the exclusions.
 func (e T) Exclude(path string) bool {
+	_, ok := e.Match(path)
+	return ok
+}
+
+// Match returns the first exclusion, if any, that matches the supplied path.
+// Exclusions for longer, ie. more specific, prefixes are tried first.
+func (e T) Match(path string) (Match, bool) {
 	for i, p := range e.prefixes {
 		if strings.HasPrefix(path, p) {
-			for _, re := range e.exclusions[i] {
-				if re.MatchString(path) {
-					return true
+			for j, pat := range e.exclusions[i] {
+				if pat.re.MatchString(path) {
+					atomic.AddInt64(&e.hits[i][j], 1)
+					return Match{Prefix: p, Index: j, Pattern: pat.source}, true
 				}
 			}
 		}
 	}
-	return false
+	return Match{}, false
+}
+
+// Hit records the number of paths matched by a single exclusion.
+type Hit struct {
+	Prefix  string // Prefix is the prefix that the exclusion applies to.
+	Pattern string // Pattern is the source of the exclusion's pattern.
+	Count   int64  // Count is the number of paths that it matched.
+}
+
+// Hits returns the number of paths matched by each exclusion, in the
+// order that they are tried by Match. A path is counted only for the
+// exclusion that it is excluded by.
+func (e T) Hits() []Hit {
+	var hits []Hit
+	for i, p := range e.prefixes {
+		for j, pat := range e.exclusions[i] {
+			hits = append(hits, Hit{
+				Prefix:  p,
+				Pattern: pat.source,
+				Count:   atomic.LoadInt64(&e.hits[i][j]),
+			})
+		}
+	}
+	return hits
 }
@@ -54,3 +54,94 @@ func TestExclusions(t *testing.T) {
 		}
 	}
 }
+
+func TestMatch(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exclusions.New(cfg.Exclusions)
+	for i, tc := range []struct {
+		path    string
+		matched bool
+		match   exclusions.Match
+	}{
+		{"/a/b/c", true, exclusions.Match{Prefix: "/", Index: 0, Pattern: "^/a/b/c$"}},
+		{"/tmp/a/z/", true, exclusions.Match{Prefix: "/tmp", Index: 0, Pattern: "/z/"}},
+		{"/tmp/a", false, exclusions.Match{}},
+	} {
+		match, ok := ex.Match(tc.path)
+		if got, want := ok, tc.matched; got != want {
+			t.Errorf("%v; %v: got %v, want %v", i, tc.path, got, want)
+		}
+		if got, want := match, tc.match; got != want {
+			t.Errorf("%v; %v: got %v, want %v", i, tc.path, got, want)
+		}
+	}
+}
+
+func TestHits(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exclusions.New(cfg.Exclusions)
+	for _, path := range []string{"/a/b/c", "/tmp/a/z/", "/tmp//z/b", "/tmp/a", "/a/b/c"} {
+		ex.Exclude(path)
+	}
+	hits := ex.Hits()
+	if got, want := fmt.Sprintf("%v", hits), "[{/tmp /z/ 2} {/ ^/a/b/c$ 2}]"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+const globsCfg = `databases:
+  - prefix: /
+    type: local
+    directory: /dev/null
+exclusions:
+  - prefix: /home
+    regexps:
+      - "/cache$"
+    exclude_globs:
+      - "**/node_modules"
+      - "*.tmp"
+      - "/u/build/"
+      - "src/**/gen"
+`
+
+func TestGlobs(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(globsCfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := exclusions.New(cfg.Exclusions)
+	for i, tc := range []struct {
+		path    string
+		matched bool
+	}{
+		{"/home/u/cache", true},
+		{"/home/node_modules", true},
+		{"/home/u/p/node_modules", true},
+		{"/home/u/p/node_modules/x", true},
+		{"/home/u/p/node_modules2", false},
+		{"/other/node_modules", false},
+		{"/home/a.tmp", true},
+		{"/home/u/b.tmp", true},
+		{"/home/u/b.tmpx", false},
+		{"/home/u/build", true},
+		{"/home/u/build/x", true},
+		{"/home/v/u/build", false},
+		{"/home/src/gen", true},
+		{"/home/src/a/b/gen", true},
+		{"/home/u/src/gen", false},
+	} {
+		if got, want := ex.Exclude(tc.path), tc.matched; got != want {
+			t.Errorf("%v; %v: got %v, want %v", i, tc.path, got, want)
+		}
+	}
+	hits := ex.Hits()
+	if got, want := fmt.Sprintf("%v", hits[:3]), "[{/home /cache$ 1} {/home **/node_modules 3} {/home *.tmp 2}]"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
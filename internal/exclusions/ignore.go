@@ -0,0 +1,155 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package exclusions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cloudeng.io/cmd/idu/internal/config"
+)
+
+// IgnoreFilename is the name of the per-directory files that contain
+// gitignore style patterns.
+const IgnoreFilename = ".iduignore"
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Ignores represents the patterns read from the ignore files found in
+// a directory hierarchy. The patterns in an ignore file apply to the
+// directory containing it and all of its descendants and, as for
+// .gitignore files, the last matching pattern determines whether a path
+// is excluded, with patterns in a subdirectory taking precedence over
+// those in its parents. Negated patterns (ie. those starting with !) can
+// therefore be used to re-include paths excluded by a parent directory.
+// Ignores is safe for concurrent use.
+type Ignores struct {
+	sep  string
+	mu   sync.RWMutex
+	dirs map[string][]ignorePattern
+}
+
+// NewIgnores returns a new instance of Ignores for a filesystem that uses
+// the specified separator.
+func NewIgnores(separator string) *Ignores {
+	return &Ignores{
+		sep:  separator,
+		dirs: map[string][]ignorePattern{},
+	}
+}
+
+// Add parses the gitignore style patterns read from rd and records them
+// as applying to dir. Patterns that have already been recorded for dir
+// are retained, but the new patterns take precedence over them.
+func (ig *Ignores) Add(dir string, rd io.Reader) error {
+	var patterns []ignorePattern
+	sc := bufio.NewScanner(rd)
+	for line := 1; sc.Scan(); line++ {
+		p, ok, err := parseIgnorePattern(sc.Text())
+		if err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	dir = strings.TrimSuffix(dir, ig.sep)
+	ig.dirs[dir] = append(ig.dirs[dir], patterns...)
+	return nil
+}
+
+// Exclude returns true if path, which is a directory if isDir is true,
+// is excluded by the patterns in the ignore files of any of its parent
+// directories.
+func (ig *Ignores) Exclude(path string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	ig.mu.RLock()
+	defer ig.mu.RUnlock()
+	if len(ig.dirs) == 0 {
+		return false
+	}
+	excluded := false
+	for i := 0; i < len(path); {
+		idx := strings.Index(path[i:], ig.sep)
+		if idx < 0 {
+			break
+		}
+		i += idx
+		patterns := ig.dirs[path[:i]]
+		i += len(ig.sep)
+		if len(patterns) == 0 || i >= len(path) {
+			continue
+		}
+		rel := path[i:]
+		if ig.sep != "/" {
+			rel = strings.ReplaceAll(rel, ig.sep, "/")
+		}
+		for _, p := range patterns {
+			if p.dirOnly && !isDir {
+				continue
+			}
+			if p.re.MatchString(rel) {
+				excluded = !p.negate
+			}
+		}
+	}
+	return excluded
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool, error) {
+	var p ignorePattern
+	line = strings.TrimRight(line, " \t")
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return p, false, nil
+	}
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// Patterns containing a separator are relative to the directory
+	// containing the ignore file, others may match at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if len(line) == 0 {
+		return p, false, nil
+	}
+	expr := config.GlobRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return p, false, fmt.Errorf("invalid pattern: %q: %v", line, err)
+	}
+	p.re = re
+	return p, true, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package exclusions_test
+
+import (
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+)
+
+func TestIgnores(t *testing.T) {
+	ig := exclusions.NewIgnores("/")
+	for _, tc := range []struct {
+		dir, patterns string
+	}{
+		{"/", "# comment\n\n*.log\n/top-only\nbuild/\ntmp*\n"},
+		{"/a", "!keep.log\n/b/*.dat\n**/cache\n"},
+		{"/a/b", "*.dat\n!important.dat\n"},
+		{"/a/b/c", "!tmpfile\n"},
+	} {
+		if err := ig.Add(tc.dir, strings.NewReader(tc.patterns)); err != nil {
+			t.Fatalf("%v: %v", tc.dir, err)
+		}
+	}
+	for i, tc := range []struct {
+		path    string
+		isDir   bool
+		matched bool
+	}{
+		{"/x.log", false, true},
+		{"/z/x.log", false, true},
+		{"/a/keep.log", false, false},
+		{"/a/d/keep.log", false, false},
+		{"/z/keep.log", false, true},
+		{"/top-only", false, true},
+		{"/a/top-only", false, false},
+		{"/build", true, true},
+		{"/a/build", true, true},
+		{"/a/build", false, false},
+		{"/tmpdir", true, true},
+		{"/a/b/c/tmpfile", false, false},
+		{"/a/b/c/tmpother", false, true},
+		{"/a/b/x.dat", false, true},
+		{"/a/b/important.dat", false, false},
+		{"/a/b/c/y.dat", false, true},
+		{"/a/x.dat", false, false},
+		{"/a/cache", true, true},
+		{"/a/d/e/cache", true, true},
+		{"/cache", true, false},
+		{"/", true, false},
+		{"/a", true, false},
+	} {
+		if got, want := ig.Exclude(tc.path, tc.isDir), tc.matched; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.path, got, want)
+		}
+	}
+}
+
+func TestIgnoresSeparator(t *testing.T) {
+	ig := exclusions.NewIgnores(`\`)
+	if err := ig.Add(`C:\data`, strings.NewReader("logs/*.txt\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !ig.Exclude(`C:\data\logs\a.txt`, false) {
+		t.Errorf("expected a match")
+	}
+	if ig.Exclude(`C:\data\other\a.txt`, false) {
+		t.Errorf("unexpected match")
+	}
+	var nilIgnores *exclusions.Ignores
+	if nilIgnores.Exclude("/a", false) {
+		t.Errorf("unexpected match")
+	}
+}
+
+func TestIgnoresMerged(t *testing.T) {
+	ig := exclusions.NewIgnores("/")
+	for _, patterns := range []string{"*.tmp\nscratch/\n", "!keep.tmp\n"} {
+		if err := ig.Add("/data/", strings.NewReader(patterns)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tc := range []struct {
+		path    string
+		isDir   bool
+		matched bool
+	}{
+		{"/data/a.tmp", false, true},
+		{"/data/x/keep.tmp", false, false},
+		{"/data/x/scratch", true, true},
+		{"/data/a.txt", false, false},
+	} {
+		if got, want := ig.Exclude(tc.path, tc.isDir), tc.matched; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.path, got, want)
+		}
+	}
+}
+
+func TestIgnoresErrors(t *testing.T) {
+	ig := exclusions.NewIgnores("/")
+	err := ig.Add("/", strings.NewReader("ok\n[z-a]\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
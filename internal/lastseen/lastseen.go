@@ -0,0 +1,113 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package lastseen provides support for recording when each prefix was
+// last seen, and last scanned, by analyze. It is stored alongside, rather
+// than within, the database since the format of the database's per-prefix
+// information is fixed.
+package lastseen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cosnicolaou/pudge"
+)
+
+// Filename is the name of the file, within a database's directory, that
+// records when each prefix was last seen.
+const Filename = "lastseen.pudge"
+
+// Record records when a prefix was last seen and last scanned.
+type Record struct {
+	// Seen is the time of the most recent analyze run that found the
+	// prefix, whether or not it was re-scanned.
+	Seen time.Time
+	// Scanned is the time at which the prefix's contents were last listed.
+	Scanned time.Time
+}
+
+// DB represents the last seen times for the prefixes in a database.
+type DB struct {
+	db *pudge.Db
+}
+
+// Open opens the last seen times stored in dir, creating them if they do
+// not exist.
+func Open(dir string) (*DB, error) {
+	db, err := pudge.Open(filepath.Join(dir, Filename), &pudge.Config{
+		FileMode:     0666,
+		DirMode:      0777,
+		SyncInterval: 60,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", filepath.Join(dir, Filename), err)
+	}
+	return &DB{db: db}, nil
+}
+
+func encodeTime(buf []byte, t time.Time) {
+	if !t.IsZero() {
+		binary.LittleEndian.PutUint64(buf, uint64(t.UnixNano()))
+	}
+}
+
+func encode(r Record) []byte {
+	buf := make([]byte, 16)
+	encodeTime(buf, r.Seen)
+	encodeTime(buf[8:], r.Scanned)
+	return buf
+}
+
+func decodeTime(buf []byte) time.Time {
+	if ns := int64(binary.LittleEndian.Uint64(buf)); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Get returns the record for prefix, if there is one.
+func (db *DB) Get(prefix string) (Record, bool, error) {
+	var buf []byte
+	if err := db.db.Get(prefix, &buf); err != nil {
+		if err == pudge.ErrKeyNotFound {
+			return Record{}, false, nil
+		}
+		return Record{}, false, err
+	}
+	if len(buf) != 16 {
+		return Record{}, false, fmt.Errorf("corrupt last seen record for %v", prefix)
+	}
+	return Record{Seen: decodeTime(buf), Scanned: decodeTime(buf[8:])}, true, nil
+}
+
+// Seen records that prefix was seen, but not scanned, at time t.
+func (db *DB) Seen(prefix string, t time.Time) error {
+	r, _, err := db.Get(prefix)
+	if err != nil {
+		return err
+	}
+	r.Seen = t
+	return db.db.Set(prefix, encode(r))
+}
+
+// Scanned records that prefix was seen and scanned at time t.
+func (db *DB) Scanned(prefix string, t time.Time) error {
+	return db.db.Set(prefix, encode(Record{Seen: t, Scanned: t}))
+}
+
+// Delete deletes the record for prefix.
+func (db *DB) Delete(prefix string) error {
+	if err := db.db.Delete(prefix); err != nil && err != pudge.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Close persists the last seen times and closes the underlying file.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package lastseen_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/lastseen"
+)
+
+func TestLastSeen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "lastseen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := lastseen.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := db.Get("/a"); ok || err != nil {
+		t.Fatalf("unexpected record or error: %v, %v", ok, err)
+	}
+	scanned := time.Now().Add(-time.Hour)
+	seen := time.Now()
+	if err := db.Scanned("/a", scanned); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Seen("/a", seen); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Seen("/b", seen); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = lastseen.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, ok, err := db.Get("/a")
+	if !ok || err != nil {
+		t.Fatalf("missing record or error: %v, %v", ok, err)
+	}
+	if !r.Seen.Equal(seen) || !r.Scanned.Equal(scanned) {
+		t.Errorf("got %v, want seen %v, scanned %v", r, seen, scanned)
+	}
+	r, _, _ = db.Get("/b")
+	if !r.Seen.Equal(seen) || !r.Scanned.IsZero() {
+		t.Errorf("got %v, want seen %v, never scanned", r, seen)
+	}
+	if err := db.Delete("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := db.Get("/b"); ok {
+		t.Errorf("record was not deleted")
+	}
+}
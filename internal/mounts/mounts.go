@@ -0,0 +1,97 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package mounts provides support for determining the filesystems that are
+// currently mounted and their types, so that pseudo filesystems such as
+// tmpfs, overlay and proc may be skipped when scanning.
+package mounts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNotSupported is returned on systems for which the mounted filesystems
+// cannot be determined.
+var ErrNotSupported = errors.New("determining mounted filesystems is not supported on this system")
+
+// DefaultPseudoFilesystems are the filesystem types that are considered to
+// not contain real data by default.
+var DefaultPseudoFilesystems = []string{
+	"autofs", "bpf", "cgroup", "cgroup2", "configfs", "debugfs", "devpts",
+	"devtmpfs", "fusectl", "mqueue", "overlay", "proc", "pstore",
+	"securityfs", "sysfs", "tmpfs", "tracefs",
+}
+
+// Mount represents a single mounted filesystem.
+type Mount struct {
+	Point string // Point is the directory that the filesystem is mounted on.
+	Type  string // Type is the filesystem type, eg. ext4 or tmpfs.
+}
+
+// unescape reverses the octal escaping, eg. \040 for a space, used for
+// mount points in /proc/self/mountinfo.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// ParseMountInfo parses the format used by /proc/self/mountinfo on linux.
+func ParseMountInfo(rd io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		// The optional fields are terminated by a single hyphen that
+		// is followed by the filesystem type.
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+		mounts = append(mounts, Mount{Point: unescape(fields[4]), Type: fields[sep+1]})
+	}
+	return mounts, sc.Err()
+}
+
+// Filter returns the mounts whose type is one of types.
+func Filter(mounts []Mount, types []string) []Mount {
+	want := map[string]bool{}
+	for _, t := range types {
+		want[t] = true
+	}
+	var filtered []Mount
+	for _, m := range mounts {
+		if want[m.Type] {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,20 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package mounts
+
+import "os"
+
+// List returns the filesystems mounted in the current process's mount
+// namespace, as per /proc/self/mountinfo.
+func List() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
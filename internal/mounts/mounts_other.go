@@ -0,0 +1,12 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package mounts
+
+// List returns ErrNotSupported.
+func List() ([]Mount, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package mounts_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/mounts"
+)
+
+const mountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:22 / /proc rw,relatime - proc proc rw
+24 22 0:23 / /sys rw,relatime shared:7 master:1 - sysfs sysfs rw
+26 22 0:24 / /dev/shm rw,relatime - tmpfs tmpfs rw,size=6158152k
+27 22 0:25 / /var/lib/docker/overlay2/abc/merged rw,relatime - overlay overlay rw,lowerdir=/a
+28 22 8:2 / /mnt/my\040data rw,relatime - xfs /dev/sdb1 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	all, err := mounts.ParseMountInfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := all, []mounts.Mount{
+		{"/", "ext4"},
+		{"/proc", "proc"},
+		{"/sys", "sysfs"},
+		{"/dev/shm", "tmpfs"},
+		{"/var/lib/docker/overlay2/abc/merged", "overlay"},
+		{"/mnt/my data", "xfs"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	pseudo := mounts.Filter(all, mounts.DefaultPseudoFilesystems)
+	if got, want := len(pseudo), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := mounts.Filter(all, []string{"xfs"}), []mounts.Mount{{"/mnt/my data", "xfs"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := mounts.ParseMountInfo(strings.NewReader("22 1 8:1 / /\n")); err == nil {
+		t.Errorf("expected an error for a malformed line")
+	}
+}
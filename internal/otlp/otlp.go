@@ -0,0 +1,286 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package otlp provides minimal support for recording trace spans and
+// exporting them to an OpenTelemetry collector using the OTLP/HTTP
+// protocol with JSON encoding. It is intended for recording a small number
+// of spans around the major phases of a command rather than for
+// fine-grained tracing. All methods may be called on a nil Exporter or Span,
+// in which case they do nothing, so that tracing has no overhead when it
+// is disabled.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attribute represents a single span attribute.
+type Attribute struct {
+	Key   string
+	Value interface{} // Value is either a string or an int64.
+}
+
+// String returns a string valued attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer valued attribute.
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span represents a single, timed, operation.
+type Span struct {
+	exporter *Exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	mu       sync.Mutex
+	attrs    []Attribute
+	err      string
+	ended    bool
+}
+
+// Exporter records spans and exports them to a collector.
+type Exporter struct {
+	url     string
+	service string
+	client  *http.Client
+	root    *Span
+	mu      sync.Mutex
+	spans   []exportedSpan
+}
+
+// New returns an Exporter that will export spans to the OTLP/HTTP collector
+// at endpoint, eg. http://localhost:4318, on behalf of the named service.
+// The spans will belong to the trace, and have the parent, specified by
+// traceparent, in the W3C trace context format, if it is valid, eg. as
+// supplied by an orchestrating pipeline via the TRACEPARENT environment
+// variable, or otherwise to a new trace.
+func New(endpoint, service, traceparent string) *Exporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	e := &Exporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	e.root = &Span{exporter: e}
+	if !parseTraceparent(traceparent, e.root) {
+		rand.Read(e.root.traceID[:])
+	}
+	return e
+}
+
+// parseTraceparent parses a W3C traceparent header value of the form
+// 00-<trace-id>-<parent-id>-<flags> into s.
+func parseTraceparent(tp string, s *Span) bool {
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return false
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	copy(s.traceID[:], tid)
+	copy(s.spanID[:], sid)
+	return true
+}
+
+type spanKey struct{}
+
+// Start starts a new span that is a child of the span in ctx, if any, or of
+// the trace's parent as specified to New otherwise. The returned context
+// contains the new span.
+func (e *Exporter) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if e == nil {
+		return ctx, nil
+	}
+	parent, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok {
+		parent = e.root
+	}
+	s := &Span{
+		exporter: e,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// SetError records that the operation represented by the span failed
+// if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span, only the first call to End has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	es := exportedSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        exportAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		es.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if len(s.err) > 0 {
+		es.Status = &exportedStatus{Code: 2, Message: s.err} // STATUS_CODE_ERROR
+	}
+	s.mu.Unlock()
+	s.exporter.mu.Lock()
+	s.exporter.spans = append(s.exporter.spans, es)
+	s.exporter.mu.Unlock()
+}
+
+type exportedValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type exportedAttribute struct {
+	Key   string        `json:"key"`
+	Value exportedValue `json:"value"`
+}
+
+type exportedStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type exportedSpan struct {
+	TraceID           string              `json:"traceId"`
+	SpanID            string              `json:"spanId"`
+	ParentSpanID      string              `json:"parentSpanId,omitempty"`
+	Name              string              `json:"name"`
+	Kind              int                 `json:"kind"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string              `json:"endTimeUnixNano"`
+	Attributes        []exportedAttribute `json:"attributes,omitempty"`
+	Status            *exportedStatus     `json:"status,omitempty"`
+}
+
+func exportAttributes(attrs []Attribute) []exportedAttribute {
+	out := make([]exportedAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v exportedValue
+		switch val := a.Value.(type) {
+		case string:
+			v.StringValue = &val
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprintf("%v", val)
+			v.StringValue = &s
+		}
+		out = append(out, exportedAttribute{Key: a.Key, Value: v})
+	}
+	return out
+}
+
+// Flush exports all of the spans that have ended since the last call to
+// Flush.
+func (e *Exporter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": exportAttributes([]Attribute{String("service.name", e.service)}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": e.service},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", e.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("failed to export spans to %v: %v", e.url, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export spans to %v: %v", e.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package otlp_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/otlp"
+)
+
+type span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type request struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []span `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestExport(t *testing.T) {
+	var received []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		var req request
+		if err := json.Unmarshal(buf, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, req)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	exp := otlp.New(srv.URL, "idu", "00-"+traceID+"-"+parentID+"-01")
+	ctx, outer := exp.Start(ctx, "analyze", otlp.String("prefix", "/a"))
+	_, inner := exp.Start(ctx, "scan")
+	inner.SetAttributes(otlp.Int("files", 10))
+	inner.SetError(fmt.Errorf("oops"))
+	inner.End()
+	outer.End()
+	outer.End()
+	if err := exp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(received), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	spans := received[0].ResourceSpans[0].ScopeSpans[0].Spans
+	if got, want := len(spans), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	scan, analyze := spans[0], spans[1]
+	if got, want := analyze.ParentSpanID, parentID; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan.ParentSpanID, analyze.SpanID; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, s := range spans {
+		if got, want := s.TraceID, traceID; got != want {
+			t.Errorf("%v: got %v, want %v", s.Name, got, want)
+		}
+	}
+	if got, want := analyze.Attributes[0].Value.StringValue, "/a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan.Attributes[0].Value.IntValue, "10"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := scan.Status.Code, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A nil exporter does nothing.
+	var disabled *otlp.Exporter
+	nctx, s := disabled.Start(ctx, "nothing")
+	if s != nil || nctx != ctx {
+		t.Errorf("unexpected span or context from a nil exporter")
+	}
+	s.SetAttributes(otlp.Int("files", 1))
+	s.End()
+	if err := disabled.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
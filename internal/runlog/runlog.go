@@ -0,0 +1,153 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package runlog provides support for recording a log of analyze runs,
+// one JSON object per line, within a database's local directory.
+package runlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Filename is the name of the run log within a database's directory.
+const Filename = "runlog.json"
+
+// InProgressFilename is the name of the file, within a database's
+// directory, that records the analyze run currently in progress, or one
+// that was interrupted.
+const InProgressFilename = "runlog-inprogress.json"
+
+// Entry represents a single analyze run.
+type Entry struct {
+	Prefix   string    `json:"prefix"`
+	Start    time.Time `json:"start"`
+	Stop     time.Time `json:"stop"`
+	Note     string    `json:"note,omitempty"`
+	Prefixes int64     `json:"prefixes"`
+	Files    int64     `json:"files"`
+	Errors   int64     `json:"errors"`
+	Err      string    `json:"error,omitempty"`
+	// Exclusions records the number of paths matched by each of the
+	// configured exclusions during the run.
+	Exclusions []ExclusionHits `json:"exclusions,omitempty"`
+	// SkippedMounts records the directories that were not analyzed
+	// because they are on a different filesystem, as per
+	// --one-file-system.
+	SkippedMounts []string `json:"skipped_mounts,omitempty"`
+	// Partial is set for runs that were interrupted, or aborted by
+	// --max-errors, and hence recorded the results for only some of
+	// the prefixes.
+	Partial bool `json:"partial,omitempty"`
+	// Options records the options that determined which files and
+	// children were recorded for each prefix, it is not set for runs,
+	// such as analyze --stat-only, that do not list prefixes.
+	Options *ScanOptions `json:"options,omitempty"`
+}
+
+// ScanOptions records the analyze options that filter or modify the
+// files and children recorded for each prefix.
+type ScanOptions struct {
+	OnlyExt     []string `json:"only_ext,omitempty"`
+	ExcludeFrom string   `json:"exclude_from,omitempty"`
+	FilesOnly   bool     `json:"files_only,omitempty"`
+	Symlinks    bool     `json:"count_symlink_targets,omitempty"`
+}
+
+// ExclusionHits records the number of paths matched by an exclusion.
+type ExclusionHits struct {
+	Prefix  string `json:"prefix"`
+	Pattern string `json:"pattern"`
+	Hits    int64  `json:"hits"`
+}
+
+// Append appends entry to the run log in dir.
+func Append(dir string, entry Entry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, Filename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns all of the entries in the run log in dir, oldest first.
+// It returns no entries, and no error, if there is no run log.
+func Read(dir string) ([]Entry, error) {
+	f, err := os.Open(filepath.Join(dir, Filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%v: line %v: %v", Filename, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, sc.Err()
+}
+
+// Begin records that the analyze run described by entry, typically with
+// only its Prefix and Start set, is in progress.
+func Begin(dir string, entry Entry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, InProgressFilename)
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// InProgress returns the run recorded by Begin, if any, that has not
+// since been ended by End, ie. the run that is in progress or that was
+// interrupted.
+func InProgress(dir string) (Entry, bool, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, InProgressFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		return Entry{}, false, fmt.Errorf("%v: %v", InProgressFilename, err)
+	}
+	return entry, true, nil
+}
+
+// End records that the run recorded by Begin has completed.
+func End(dir string) error {
+	if err := os.Remove(filepath.Join(dir, InProgressFilename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
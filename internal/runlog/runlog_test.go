@@ -0,0 +1,83 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package runlog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+)
+
+func TestRunLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "runlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	entries, err := runlog.Read(tmpDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected entries or error: %v: %v", entries, err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	written := []runlog.Entry{
+		{Prefix: "/a", Start: now, Stop: now.Add(time.Minute), Files: 10, Prefixes: 2,
+			Exclusions: []runlog.ExclusionHits{{Prefix: "/a", Pattern: ".DS_Store$", Hits: 3}}},
+		{Prefix: "/a", Start: now.Add(time.Hour), Stop: now.Add(2 * time.Hour), Note: "after storage migration", Errors: 1, Err: "oops"},
+	}
+	for _, e := range written {
+		if err := runlog.Append(tmpDir, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = runlog.Read(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entries, written; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, runlog.Filename), []byte("{}\nnot json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runlog.Read(tmpDir); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "runlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, ok, err := runlog.InProgress(tmpDir); ok || err != nil {
+		t.Fatalf("unexpected in progress run or error: %v: %v", ok, err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := runlog.Begin(tmpDir, runlog.Entry{Prefix: "/a", Start: now}); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := runlog.InProgress(tmpDir)
+	if err != nil || !ok {
+		t.Fatalf("missing in progress run or error: %v: %v", ok, err)
+	}
+	if got, want := entry, (runlog.Entry{Prefix: "/a", Start: now}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if err := runlog.End(tmpDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok, err := runlog.InProgress(tmpDir); ok || err != nil {
+		t.Fatalf("unexpected in progress run or error: %v: %v", ok, err)
+	}
+}
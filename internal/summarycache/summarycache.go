@@ -0,0 +1,116 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package summarycache provides support for caching the totals and top-N
+// prefixes computed by summary within a database's local directory so that
+// repeated summaries of an unchanged database need not recompute them.
+// The cache is keyed by the time of the most recent analyze run and the
+// most recent modification of any of the database's files, and hence is
+// invalidated by any subsequent analyze run or other update.
+package summarycache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// Filename is the name of the cache within a database's directory.
+const Filename = "summary-cache.json"
+
+// Key identifies the state of the database that a cache was built from.
+type Key struct {
+	LastRun  time.Time `json:"last_run"`
+	Modified time.Time `json:"modified"`
+}
+
+// Equal returns true if k and l refer to the same state of the database.
+func (k Key) Equal(l Key) bool {
+	return k.LastRun.Equal(l.LastRun) && k.Modified.Equal(l.Modified)
+}
+
+// KeyFor returns the key for the database in dir whose most recent analyze
+// run completed at lastRun.
+func KeyFor(dir string, lastRun time.Time) (Key, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return Key{}, err
+	}
+	var modified time.Time
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == Filename || e.Name() == Filename+".tmp" {
+			continue
+		}
+		if t := e.ModTime(); t.After(modified) {
+			modified = t
+		}
+	}
+	return Key{LastRun: lastRun, Modified: modified}, nil
+}
+
+// Entry records the totals and top-N prefixes for a single summary.
+type Entry struct {
+	TopN        int               `json:"top_n"`
+	Files       int64             `json:"files"`
+	Children    int64             `json:"children"`
+	Bytes       int64             `json:"bytes"`
+	Errors      int64             `json:"errors"`
+	TopFiles    []filewalk.Metric `json:"top_files"`
+	TopChildren []filewalk.Metric `json:"top_children"`
+	TopBytes    []filewalk.Metric `json:"top_bytes"`
+}
+
+// Cache represents the cached summaries for a single state of a database.
+type Cache struct {
+	Key     Key              `json:"key"`
+	Entries map[string]Entry `json:"entries"`
+}
+
+// Read returns the cache in dir if it was built for key, or an empty cache
+// for key otherwise, including when there is no cache or it cannot be
+// parsed.
+func Read(dir string, key Key) *Cache {
+	empty := &Cache{Key: key, Entries: map[string]Entry{}}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, Filename))
+	if err != nil {
+		return empty
+	}
+	var c Cache
+	if err := json.Unmarshal(buf, &c); err != nil || !c.Key.Equal(key) || c.Entries == nil {
+		return empty
+	}
+	return &c
+}
+
+// Lookup returns the entry for name if it contains at least n top-N
+// prefixes.
+func (c *Cache) Lookup(name string, n int) (Entry, bool) {
+	e, ok := c.Entries[name]
+	if !ok || e.TopN < n {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Store records the entry for name.
+func (c *Cache) Store(name string, e Entry) {
+	c.Entries[name] = e
+}
+
+// Write atomically writes the cache to dir.
+func (c *Cache) Write(dir string) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, Filename+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, Filename))
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package summarycache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/summarycache"
+	"cloudeng.io/file/filewalk"
+)
+
+func TestCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "summarycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dbFile := filepath.Join(tmpDir, "prefix.pudge")
+	if err := ioutil.WriteFile(dbFile, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lastRun := time.Now().Truncate(time.Second)
+	key, err := summarycache.KeyFor(tmpDir, lastRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := summarycache.Read(tmpDir, key)
+	if _, ok := cache.Lookup("", 1); ok {
+		t.Fatalf("unexpected entry in an empty cache")
+	}
+	entry := summarycache.Entry{
+		TopN:     2,
+		Files:    10,
+		Bytes:    100,
+		TopFiles: []filewalk.Metric{{Prefix: "/a", Value: 6}, {Prefix: "/b", Value: 4}},
+	}
+	cache.Store("", entry)
+	if err := cache.Write(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the cache must not change its own key.
+	key, err = summarycache.KeyFor(tmpDir, lastRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = summarycache.Read(tmpDir, key)
+	got, ok := cache.Lookup("", 1)
+	if !ok {
+		t.Fatalf("missing entry")
+	}
+	if !reflect.DeepEqual(got, entry) {
+		t.Errorf("got %v, want %v", got, entry)
+	}
+	if _, ok := cache.Lookup("", 3); ok {
+		t.Errorf("unexpected entry with too few top-N prefixes")
+	}
+	if _, ok := cache.Lookup("/a", 1); ok {
+		t.Errorf("unexpected entry for /a")
+	}
+
+	// A new run, or any update to the database, invalidates the cache.
+	if _, ok := summarycache.Read(tmpDir, summarycache.Key{LastRun: lastRun.Add(time.Minute), Modified: key.Modified}).Lookup("", 1); ok {
+		t.Errorf("cache was not invalidated by a new run")
+	}
+	modified := key.Modified.Add(time.Second)
+	if err := os.Chtimes(dbFile, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	key, err = summarycache.KeyFor(tmpDir, lastRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := summarycache.Read(tmpDir, key).Lookup("", 1); ok {
+		t.Errorf("cache was not invalidated by an update")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package warnings provides support for recording the warnings, ie.
+// conditions that deserve attention but are not errors, encountered by the
+// most recent analyze run, one JSON object per line, within a database's
+// local directory.
+package warnings
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Filename is the name of the warnings log within a database's directory.
+const Filename = "warnings.json"
+
+// Categories of warning.
+const (
+	// DeepNesting is used for prefixes that are nested more deeply than
+	// a configured limit below the prefix being analyzed.
+	DeepNesting = "deep-nesting"
+	// LargeDirectory is used for prefixes that contain more than a
+	// configured number of files and children.
+	LargeDirectory = "large-directory"
+	// Permission is used for prefixes that could not be read due to a
+	// permissions error.
+	Permission = "permission"
+	// ChangedDuringScan is used for files whose size or modification time
+	// changed, or that were removed, while their prefix was being scanned.
+	ChangedDuringScan = "changed-during-scan"
+)
+
+// Warning represents a single warning.
+type Warning struct {
+	Time     time.Time `json:"time"`
+	Prefix   string    `json:"prefix"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+}
+
+// Log records warnings and may be safely used by multiple goroutines.
+type Log struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	n   int64
+}
+
+// Create creates a new, empty, warnings log in dir, replacing any
+// existing one.
+func Create(dir string) (*Log, error) {
+	f, err := os.OpenFile(filepath.Join(dir, Filename), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends w to the log.
+func (l *Log) Write(w Warning) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n++
+	return l.enc.Encode(w)
+}
+
+// Len returns the number of warnings written to the log.
+func (l *Log) Len() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Read returns all of the warnings in the log in dir, in the order in
+// which they were written. It returns no warnings, and no error, if there
+// is no log.
+func Read(dir string) ([]Warning, error) {
+	f, err := os.Open(filepath.Join(dir, Filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var warnings []Warning
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var w Warning
+		if err := json.Unmarshal(sc.Bytes(), &w); err != nil {
+			return nil, fmt.Errorf("%v: line %v: %v", Filename, line, err)
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, sc.Err()
+}
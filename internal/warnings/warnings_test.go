@@ -0,0 +1,57 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package warnings_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/warnings"
+)
+
+func TestWarnings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "warnings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	found, err := warnings.Read(tmpDir)
+	if err != nil || len(found) != 0 {
+		t.Fatalf("unexpected warnings or error: %v: %v", found, err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	written := []warnings.Warning{
+		{Time: now, Prefix: "/a/b", Category: warnings.Permission, Message: "permission denied"},
+		{Time: now, Prefix: "/a/c", Category: warnings.LargeDirectory, Message: "200000 entries"},
+	}
+	for i := 0; i < 2; i++ {
+		// The log is replaced each time that it is created.
+		log, err := warnings.Create(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range written {
+			if err := log.Write(w); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, want := log.Len(), int64(len(written)); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err = warnings.Read(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := found, written; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
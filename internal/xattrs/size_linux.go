@@ -0,0 +1,38 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package xattrs
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// Size returns the total size, in bytes, of the names and values of the
+// extended attributes of the specified file.
+func Size(path string) (int64, error) {
+	n, err := syscall.Listxattr(path, nil)
+	if err != nil || n == 0 {
+		if err == syscall.ENOTSUP {
+			return 0, nil
+		}
+		return 0, err
+	}
+	names := make([]byte, n)
+	if n, err = syscall.Listxattr(path, names); err != nil {
+		return 0, err
+	}
+	size := int64(n)
+	for _, name := range bytes.Split(names[:n], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vn, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return 0, err
+		}
+		size += int64(vn)
+	}
+	return size, nil
+}
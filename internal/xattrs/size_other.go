@@ -0,0 +1,12 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package xattrs
+
+// Size returns ErrNotSupported.
+func Size(path string) (int64, error) {
+	return 0, ErrNotSupported
+}
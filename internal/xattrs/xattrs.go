@@ -0,0 +1,104 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package xattrs provides support for determining the storage used by the
+// extended attributes of files and for recording the total used by the
+// files in each prefix. The totals are stored alongside, rather than
+// within, the database since the format of the database's per-prefix
+// information is fixed.
+package xattrs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cosnicolaou/pudge"
+)
+
+// Filename is the name of the file, within a database's directory, that
+// records the extended attribute usage of each prefix.
+const Filename = "xattrs.pudge"
+
+// ErrNotSupported is returned by Size on platforms where extended
+// attributes are not supported.
+var ErrNotSupported = errors.New("extended attributes are not supported on this platform")
+
+// DB represents the extended attribute usage for the prefixes in a
+// database.
+type DB struct {
+	db *pudge.Db
+}
+
+// Open opens the extended attribute usage stored in dir, creating it if
+// it does not exist.
+func Open(dir string) (*DB, error) {
+	db, err := pudge.Open(filepath.Join(dir, Filename), &pudge.Config{
+		FileMode:     0666,
+		DirMode:      0777,
+		SyncInterval: 60,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", filepath.Join(dir, Filename), err)
+	}
+	return &DB{db: db}, nil
+}
+
+// Set records the total size of the extended attributes of the files in
+// prefix, a size of zero deletes any existing record.
+func (db *DB) Set(prefix string, size int64) error {
+	if size == 0 {
+		if err := db.db.Delete(prefix); err != nil && err != pudge.ErrKeyNotFound {
+			return err
+		}
+		return nil
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(size))
+	return db.db.Set(prefix, buf)
+}
+
+// Get returns the total size of the extended attributes of the files in
+// prefix, zero if none have been recorded.
+func (db *DB) Get(prefix string) (int64, error) {
+	var buf []byte
+	if err := db.db.Get(prefix, &buf); err != nil {
+		if err == pudge.ErrKeyNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, fmt.Errorf("corrupt extended attribute record for %v", prefix)
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// Usage returns the recorded extended attribute usage of all prefixes
+// that start with prefix.
+func (db *DB) Usage(prefix string) (map[string]int64, error) {
+	keys, err := db.db.KeysByPrefix([]byte(prefix), 0, 0, true)
+	if err != nil {
+		if err == pudge.ErrKeyNotFound {
+			return map[string]int64{}, nil
+		}
+		return nil, err
+	}
+	usage := make(map[string]int64, len(keys))
+	for _, k := range keys {
+		size, err := db.Get(string(k))
+		if err != nil {
+			return nil, err
+		}
+		usage[string(k)] = size
+	}
+	return usage, nil
+}
+
+// Close persists the extended attribute usage and closes the underlying
+// file.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
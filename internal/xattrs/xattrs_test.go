@@ -0,0 +1,61 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package xattrs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/xattrs"
+)
+
+func TestUsage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := xattrs.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prefix, size := range map[string]int64{
+		"/a":   10,
+		"/a/b": 20,
+		"/c":   30,
+	} {
+		if err := db.Set(prefix, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = xattrs.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	usage, err := db.Usage("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := usage, map[string]int64{"/a": 10, "/a/b": 20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := db.Set("/a/b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := db.Get("/a/b"); size != 0 || err != nil {
+		t.Errorf("got %v, %v, want 0, nil", size, err)
+	}
+	usage, err = db.Usage("/x")
+	if err != nil || len(usage) != 0 {
+		t.Errorf("got %v, %v, want no usage", usage, err)
+	}
+}
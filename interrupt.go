@@ -0,0 +1,41 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptSignals are the signals that stop analyze, and watch,
+// gracefully.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// handleInterrupts calls stop when the first signal is received on ch so
+// that the scan in progress can stop listing new prefixes, commit the
+// results obtained so far and record the run as partial. A second signal
+// calls exit for when doing so is taking too long.
+func handleInterrupts(ch <-chan os.Signal, stop func(), exit func(int)) {
+	sig, ok := <-ch
+	if !ok {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "stopping on %v, waiting for the results obtained so far to be recorded, signal again to exit immediately\n", sig)
+	stop()
+	if sig, ok = <-ch; ok {
+		fmt.Fprintf(os.Stderr, "exiting on %v\n", sig)
+		exit(1)
+	}
+}
+
+// notifyInterrupts arranges for stop to be called on the first of the
+// interruptSignals and for the process to exit on the second.
+func notifyInterrupts(stop func()) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, interruptSignals...)
+	go handleInterrupts(ch, stop, os.Exit)
+}
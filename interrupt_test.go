@@ -0,0 +1,37 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestHandleInterrupts(t *testing.T) {
+	ch := make(chan os.Signal, 2)
+	stopped, exited := make(chan struct{}), make(chan int, 1)
+	done := make(chan struct{})
+	go func() {
+		handleInterrupts(ch, func() { close(stopped) }, func(code int) { exited <- code })
+		close(done)
+	}()
+	ch <- os.Interrupt
+	<-stopped
+	select {
+	case <-exited:
+		t.Fatalf("exited on the first signal")
+	default:
+	}
+	ch <- os.Interrupt
+	if got, want := <-exited, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	<-done
+
+	// No signal.
+	ch = make(chan os.Signal)
+	close(ch)
+	handleInterrupts(ch, func() { t.Errorf("unexpected stop") }, func(int) { t.Errorf("unexpected exit") })
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type largestFilesFlags struct {
+	TopN     int  `subcmd:"top,50,the number of files to display"`
+	Smallest bool `subcmd:"smallest,false,'display the smallest rather than the largest files, eg. to find zero length files'"`
+}
+
+type sizedFile struct {
+	path string
+	size int64
+}
+
+// fileHeap is a heap of files whose root is the file that would be the
+// first to be discarded, ie. the smallest file when the largest files are
+// being retained and vice versa.
+type fileHeap struct {
+	files    []sizedFile
+	smallest bool
+}
+
+func (h *fileHeap) Len() int { return len(h.files) }
+
+func (h *fileHeap) Less(i, j int) bool {
+	return h.before(h.files[j], h.files[i])
+}
+
+func (h *fileHeap) Swap(i, j int) { h.files[i], h.files[j] = h.files[j], h.files[i] }
+
+func (h *fileHeap) Push(x interface{}) { h.files = append(h.files, x.(sizedFile)) }
+
+func (h *fileHeap) Pop() interface{} {
+	last := h.files[len(h.files)-1]
+	h.files = h.files[:len(h.files)-1]
+	return last
+}
+
+// before returns true if a is to be displayed before b, ties are broken
+// by path so that the results do not depend on the order in which files
+// are added.
+func (h *fileHeap) before(a, b sizedFile) bool {
+	if a.size != b.size {
+		if h.smallest {
+			return a.size < b.size
+		}
+		return a.size > b.size
+	}
+	return a.path < b.path
+}
+
+// topFiles retains the n largest, or smallest, files added to it using an
+// amount of memory that is proportional to n rather than to the number of
+// files added.
+type topFiles struct {
+	n int
+	h fileHeap
+}
+
+func newTopFiles(n int, smallest bool) *topFiles {
+	return &topFiles{n: n, h: fileHeap{files: make([]sizedFile, 0, n), smallest: smallest}}
+}
+
+func (t *topFiles) add(path string, size int64) {
+	f := sizedFile{path: path, size: size}
+	if len(t.h.files) < t.n {
+		heap.Push(&t.h, f)
+		return
+	}
+	if t.n > 0 && t.h.before(f, t.h.files[0]) {
+		t.h.files[0] = f
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// sorted returns the retained files in the order in which they should be
+// displayed.
+func (t *topFiles) sorted() []sizedFile {
+	files := make([]sizedFile, len(t.h.files))
+	copy(files, t.h.files)
+	sort.Slice(files, func(i, j int) bool {
+		return t.h.before(files[i], files[j])
+	})
+	return files
+}
+
+// largestFiles displays the largest, or smallest, individual files stored
+// in the database for root and its descendants. Symlinks are ignored.
+func largestFiles(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*largestFilesFlags)
+	if flagValues.TopN < 1 {
+		return fmt.Errorf("--top must be greater than zero: %v", flagValues.TopN)
+	}
+	root := args[0]
+	sep := globalConfig.LayoutFor(root).Separator
+	top := newTopFiles(flagValues.TopN, flagValues.Smallest)
+	if err := forEachFile(ctx, root, func(prefix string, fi filewalk.Info) {
+		if fi.Mode&filewalk.ModeLink != 0 {
+			return
+		}
+		top.add(strings.TrimSuffix(prefix, sep)+sep+fi.Name, fi.Size)
+	}); err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	for _, f := range top.sorted() {
+		ifmt.Printf("%20v %v\n", fsize(f.size), f.path)
+	}
+	return nil
+}
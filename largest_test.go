@@ -0,0 +1,55 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopFiles(t *testing.T) {
+	var files []sizedFile
+	for i := 0; i < 100; i++ {
+		files = append(files, sizedFile{path: fmt.Sprintf("/f%03d", i), size: int64(i % 10)})
+	}
+	for _, smallest := range []bool{false, true} {
+		var want []sizedFile
+		for i := 0; i < len(files) && len(want) < 3; i++ {
+			if smallest {
+				want = append(want, files[i*10])
+			} else {
+				want = append(want, files[i*10+9])
+			}
+		}
+		for iter := 0; iter < 10; iter++ {
+			top := newTopFiles(3, smallest)
+			for _, i := range rand.Perm(len(files)) {
+				top.add(files[i].path, files[i].size)
+			}
+			if got := top.sorted(); !reflect.DeepEqual(got, want) {
+				t.Errorf("smallest: %v: got %v, want %v", smallest, got, want)
+			}
+		}
+	}
+	top := newTopFiles(0, false)
+	top.add("/a", 1)
+	if got := top.sorted(); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+}
+
+func TestLargestFilesTopN(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{0, -1} {
+		err := largestFiles(ctx, &largestFilesFlags{TopN: n}, []string{"/a"})
+		if err == nil || !strings.Contains(err.Error(), "--top must be greater than zero") {
+			t.Errorf("%v: unexpected or missing error: %v", n, err)
+		}
+	}
+}
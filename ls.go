@@ -6,19 +6,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"cloudeng.io/algo/container/heap"
+	"cloudeng.io/cmd/idu/internal/errorclass"
 	"cloudeng.io/cmdutil"
+	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/errors"
 	"cloudeng.io/file/filewalk"
 	"cloudeng.io/sync/errgroup"
 )
 
 type lsFlags struct {
+	PrefixFileFlags
+	OtherFlags
 	Limit      int    `subcmd:"limit,-1,'limit the number of items to list'"`
 	TopN       int    `subcmd:"top,10,'show the top prefixes by file/prefix counts and disk usage, set to zero to disable'"`
 	Summary    bool   `subcmd:"summary,true,show summary statistics"`
@@ -26,10 +31,83 @@ type lsFlags struct {
 	ShowFiles  bool   `subcmd:"files,false,show information on individual files"`
 	ShowErrors bool   `subcmd:"errors,false,show information on individual errors"`
 	User       string `subcmd:"user,,show information for this user only"`
+	Merge      bool   `subcmd:"merge-identical-prefixes,false,'ignore prefixes that are identical to, or contained within, other prefixes on the command line'"`
+	NDJSON     bool   `subcmd:"ndjson,false,'write a JSON object, on a line of its own, for every prefix and file as it is read from the database rather than displaying summary statistics'"`
 }
 
-func lsTree(ctx context.Context, pt *progressTracker, db filewalk.Database, root, user string, flags *lsFlags) (files, children, disk *heap.KeyedInt64, nerrors int64, err error) {
-	files, children, disk = heap.NewKeyedInt64(heap.Descending), heap.NewKeyedInt64(heap.Descending), heap.NewKeyedInt64(heap.Descending)
+// lsRecord is the ndjson representation of a prefix or file written by
+// lsr --ndjson.
+type lsRecord struct {
+	Type     string    `json:"type"` // Type is either prefix or file.
+	Key      string    `json:"key"`
+	UserID   string    `json:"user_id"`
+	GroupID  string    `json:"group_id"`
+	Files    int       `json:"files,omitempty"`
+	Children int       `json:"children,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	ModTime  time.Time `json:"modtime"`
+	Err      string    `json:"error,omitempty"`
+}
+
+// lsWriter serializes the records written by concurrent scans.
+type lsWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *lsWriter) write(recs ...lsRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, rec := range recs {
+		if err := w.enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lsNDJSON writes a record for root and each of its descendant prefixes,
+// followed by one for each of their files, as they are scanned so that
+// nothing is accumulated in memory.
+func lsNDJSON(ctx context.Context, wr *lsWriter, db filewalk.Database, root, user string, limit int) error {
+	sep := globalConfig.LayoutFor(root).Separator
+	sc := db.NewScanner(root, limit, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if len(user) > 0 && pi.UserID != user {
+			continue
+		}
+		recs := make([]lsRecord, 0, len(pi.Files)+1)
+		recs = append(recs, lsRecord{
+			Type:     "prefix",
+			Key:      prefix,
+			UserID:   pi.UserID,
+			GroupID:  pi.GroupID,
+			Files:    len(pi.Files),
+			Children: len(pi.Children),
+			Bytes:    pi.DiskUsage,
+			ModTime:  displayTime(pi.ModTime),
+			Err:      pi.Err,
+		})
+		for _, fi := range pi.Files {
+			recs = append(recs, lsRecord{
+				Type:    "file",
+				Key:     strings.TrimSuffix(prefix, sep) + sep + fi.Name,
+				UserID:  fi.UserID,
+				GroupID: fi.GroupID,
+				Bytes:   fi.Size,
+				ModTime: displayTime(fi.ModTime),
+			})
+		}
+		if err := wr.write(recs...); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func lsTree(ctx context.Context, pt *progressTracker, db filewalk.Database, root, user string, flags *lsFlags) (files, children, disk *topNRanker, nerrors int64, err error) {
+	files, children, disk = newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak)
 	if flags.ShowDirs {
 		fmt.Printf("     disk usage :  # files : # dirs : directory/prefix\n")
 	}
@@ -49,19 +127,19 @@ func lsTree(ctx context.Context, pt *progressTracker, db filewalk.Database, root
 			}
 			continue
 		}
-		files.Update(prefix, int64(len(pi.Files)))
-		children.Update(prefix, int64(len(pi.Children)))
-		disk.Update(prefix, pi.DiskUsage)
+		files.add(prefix, int64(len(pi.Files)), pi)
+		children.add(prefix, int64(len(pi.Children)), pi)
+		disk.add(prefix, pi.DiskUsage, pi)
 		if flags.ShowDirs || flags.ShowFiles {
 			fmt.Printf("% 15v : % 8v : % 6v : %s\n", fsize(pi.DiskUsage), len(pi.Files), len(pi.Children), prefix)
 			if flags.ShowDirs {
 				for _, fi := range pi.Children {
-					fmt.Printf("    % 15v : % 40v: % 10v : %v\n", fsize(fi.Size), fi.ModTime, globalUserManager.nameForUID(fi.UserID), fi.Name)
+					fmt.Printf("    % 15v : % 40v: % 10v : %v\n", fsize(fi.Size), displayTime(fi.ModTime), globalUserManager.nameForUID(fi.UserID), fi.Name)
 				}
 			}
 			if flags.ShowFiles {
 				for _, fi := range pi.Files {
-					fmt.Printf("    % 15v : % 40v: % 10v : %v\n", fsize(fi.Size), fi.ModTime, globalUserManager.nameForUID(fi.UserID), fi.Name)
+					fmt.Printf("    % 15v : % 40v: % 10v : %v\n", fsize(fi.Size), displayTime(fi.ModTime), globalUserManager.nameForUID(fi.UserID), fi.Name)
 				}
 			}
 			continue
@@ -72,19 +150,13 @@ func lsTree(ctx context.Context, pt *progressTracker, db filewalk.Database, root
 	return
 }
 
-func topNMetrics(top []struct {
-	K string
-	V int64
-}) []filewalk.Metric {
-	m := make([]filewalk.Metric, len(top))
-	for i, kv := range top {
-		m[i] = filewalk.Metric{Prefix: kv.K, Value: kv.V}
-	}
-	return m
-}
-
 func lsr(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*lsFlags)
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	args = mergePrefixes(args, flagValues.Merge)
 
 	if len(args) > 1 {
 		flagValues.ShowFiles = false
@@ -94,7 +166,7 @@ func lsr(ctx context.Context, values interface{}, args []string) error {
 
 	type results struct {
 		root                  string
-		files, children, disk *heap.KeyedInt64
+		files, children, disk *topNRanker
 		errors                int64
 		db                    filewalk.Database
 	}
@@ -108,9 +180,31 @@ func lsr(ctx context.Context, values interface{}, args []string) error {
 		key = globalUserManager.uidForName(usr)
 	}
 
+	if flagValues.NDJSON {
+		wr := &lsWriter{enc: json.NewEncoder(os.Stdout)}
+		listers := errgroup.WithConcurrency(&errgroup.T{}, len(args))
+		errs := errors.M{}
+		for _, root := range args {
+			root := root
+			db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+			if err != nil {
+				// Wait for any listings already started so that their
+				// databases can be closed.
+				errs.Append(err)
+				break
+			}
+			listers.Go(func() error {
+				return lsNDJSON(ctx, wr, db, root, key, flagValues.Limit)
+			})
+		}
+		errs.Append(listers.Wait())
+		errs.Append(globalDatabaseManager.CloseAll(ctx))
+		return errs.Err()
+	}
+
 	var pt *progressTracker
 	if !flagValues.ShowFiles && !flagValues.ShowDirs {
-		pt = newProgressTracker(ctx, time.Second)
+		pt = newProgressTracker(ctx, os.Stdout, time.Second)
 	}
 	listers := &errgroup.T{}
 	listers = errgroup.WithConcurrency(listers, len(args))
@@ -158,27 +252,78 @@ func lsr(ctx context.Context, values interface{}, args []string) error {
 		fmt.Println(strings.Repeat("=", len(heading)))
 
 		nFiles, nChildren, nBytes := files.Sum(), children.Sum(), disk.Sum()
-		topFiles, topChildren, topBytes := topNMetrics(files.TopN(flagValues.TopN)),
-			topNMetrics(children.TopN(flagValues.TopN)),
-			topNMetrics(disk.TopN(flagValues.TopN))
+		topFiles, topChildren, topBytes := files.TopN(flagValues.TopN),
+			children.TopN(flagValues.TopN),
+			disk.TopN(flagValues.TopN)
 
-		printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
+		printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, flagValues.Other, nil, topFiles, topChildren, topBytes)
 	}
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	return errs.Err()
 }
 
+type errorsFlags struct {
+	PrefixFileFlags
+	OutputFormat string `subcmd:"output-format,text,'output format, text or ndjson; ndjson writes each error as a JSON object, with time, key, category and message fields, on a line of its own'"`
+}
+
+// errorRecord is the ndjson representation of an error stored in the
+// errors database.
+type errorRecord struct {
+	Time     string `json:"time,omitempty"`
+	Key      string `json:"key"`
+	Category string `json:"category,omitempty"`
+	Message  string `json:"message"`
+}
+
+// parseStoredError splits an error, as recorded by analyze, into its
+// timestamp, category and message. Errors recorded by earlier versions may
+// not have a category or timestamp.
+func parseStoredError(key, stored string) errorRecord {
+	rec := errorRecord{Key: key, Message: stored}
+	n := len(time.StampMilli)
+	if len(stored) > n+2 && stored[n:n+2] == ": " {
+		if _, err := time.Parse(time.StampMilli, stored[:n]); err == nil {
+			rec.Time, rec.Message = stored[:n], stored[n+2:]
+		}
+	}
+	if idx := strings.Index(rec.Message, ": "); idx > 0 {
+		category := rec.Message[:idx]
+		if _, err := errorclass.ParseCategory(category); err == nil || category == "deletion" {
+			rec.Category, rec.Message = category, rec.Message[idx+2:]
+		}
+	}
+	return rec
+}
+
 func listErrors(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*errorsFlags)
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	if err := flags.OneOf(flagValues.OutputFormat).Validate("text", "text", "ndjson"); err != nil {
+		return err
+	}
+	ndjson := flagValues.OutputFormat == "ndjson"
+	enc := json.NewEncoder(os.Stdout)
 	db, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ErrorsOnly(), filewalk.ReadOnly())
 	if err != nil {
 		return err
 	}
 	sc := db.NewScanner("", 0, filewalk.ScanErrors())
+	errs := errors.M{}
 	for sc.Scan(ctx) {
 		prefix, info := sc.PrefixInfo()
-		fmt.Printf("%v: %v\n", prefix, info.Err)
+		if !ndjson {
+			fmt.Printf("%v: %v\n", prefix, info.Err)
+			continue
+		}
+		if err := enc.Encode(parseStoredError(prefix, info.Err)); err != nil {
+			errs.Append(err)
+			break
+		}
 	}
-	errs := errors.M{}
 	errs.Append(sc.Err())
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	return errs.Err()
@@ -0,0 +1,111 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/file/filewalk"
+)
+
+func TestParseStoredError(t *testing.T) {
+	for i, tc := range []struct {
+		stored string
+		want   errorRecord
+	}{
+		{"Jul  4 10:11:12.345: permission: open /a: permission denied",
+			errorRecord{Time: "Jul  4 10:11:12.345", Key: "/a", Category: "permission", Message: "open /a: permission denied"}},
+		{"Dec 25 01:02:03.000: deletion: failed",
+			errorRecord{Time: "Dec 25 01:02:03.000", Key: "/a", Category: "deletion", Message: "failed"}},
+		{"Dec 25 01:02:03.000: open /a: no such file",
+			errorRecord{Time: "Dec 25 01:02:03.000", Key: "/a", Message: "open /a: no such file"}},
+		{"open /a: permission denied",
+			errorRecord{Key: "/a", Message: "open /a: permission denied"}},
+	} {
+		if got, want := parseStoredError("/a", tc.stored), tc.want; got != want {
+			t.Errorf("%v: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestLsNDJSON(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func(cfg *config.Config) { globalConfig = cfg }(globalConfig)
+	globalConfig, err = config.ParseConfig([]byte(fmt.Sprintf("databases:\n  - prefix: /a\n    type: local\n    directory: %v\n", filepath.Join(tmpDir, "db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2021, 7, 4, 10, 11, 12, 0, time.UTC)
+	defer func(zone *time.Location) { displayZone = zone }(displayZone)
+	displayZone = time.UTC
+	db, err := globalDatabaseManager.DatabaseFor(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prefix, pi := range map[string]*filewalk.PrefixInfo{
+		"/a": {UserID: "u1", GroupID: "g1", DiskUsage: 3, ModTime: modTime,
+			Files:    []filewalk.Info{{Name: "f", Size: 3, UserID: "u1", GroupID: "g1", ModTime: modTime}},
+			Children: []filewalk.Info{{Name: "b"}}},
+		"/a/b": {UserID: "u2", GroupID: "g2", ModTime: modTime, Err: "oops"},
+	} {
+		if err := db.Set(ctx, prefix, pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ndjson := func(user string) []lsRecord {
+		out := &strings.Builder{}
+		wr := &lsWriter{enc: json.NewEncoder(out)}
+		if err := lsNDJSON(ctx, wr, db, "/a", user, -1); err != nil {
+			t.Fatal(err)
+		}
+		var recs []lsRecord
+		dec := json.NewDecoder(strings.NewReader(out.String()))
+		for dec.More() {
+			var rec lsRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+	prefixA := lsRecord{Type: "prefix", Key: "/a", UserID: "u1", GroupID: "g1", Files: 1, Children: 1, Bytes: 3, ModTime: modTime}
+	fileA := lsRecord{Type: "file", Key: "/a/f", UserID: "u1", GroupID: "g1", Bytes: 3, ModTime: modTime}
+	prefixB := lsRecord{Type: "prefix", Key: "/a/b", UserID: "u2", GroupID: "g2", ModTime: modTime, Err: "oops"}
+	if got, want := ndjson(""), []lsRecord{prefixA, fileA, prefixB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := ndjson("u2"), []lsRecord{prefixB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := globalDatabaseManager.CloseAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Databases that have been opened are closed when a subsequent prefix
+	// has no database.
+	err = lsr(ctx, &lsFlags{NDJSON: true, Limit: -1}, []string{"/a", "/nodb"})
+	if err == nil || !strings.Contains(err.Error(), "no database is configured for /nodb") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if got := len(globalDatabaseManager.dbs); got != 0 {
+		t.Errorf("got %v open databases, want none", got)
+	}
+}
@@ -7,14 +7,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/otlp"
 	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/cmdutil/profiling"
 	"cloudeng.io/cmdutil/subcmd"
@@ -29,19 +33,39 @@ var (
 	globalConfig *config.Config
 	panicBuf     = make([]byte, 1024*1024)
 	bytesPrinter func(size int64) (float64, string)
+	displayZone  = time.Local
+	// globalTelemetry is nil unless --otlp-endpoint is specified.
+	globalTelemetry *otlp.Exporter
 )
 
 type GlobalFlags struct {
-	ExitProfile profiling.ProfileFlag `subcmd:"exit-profile,,'write a profile on exit; the format is <profile-name>:<file> and the flag may be repeated to request multiple profile types, use cpu to request cpu profiling in addition to predefined profiles in runtime/pprof'"`
-	Human       bool                  `subcmd:"h,true,show sizes in human readable form"`
-	ConfigFile  string                `subcmd:"config,$HOME/.idu.yml,configuration file"`
-	Units       string                `subcmd:"units,decimal,display usage in decimal (KB) or binary (KiB) formats"`
-	Verbose     int                   `subcmd:"v,0,higher values show more debugging output"`
-	HTTP        string                `subcmd:"http,,set to a port to enable http serving of /debug/vars and profiling"`
+	ExitProfile          profiling.ProfileFlag `subcmd:"exit-profile,,'write a profile on exit; the format is <profile-name>:<file> and the flag may be repeated to request multiple profile types, use cpu to request cpu profiling in addition to predefined profiles in runtime/pprof'"`
+	Human                bool                  `subcmd:"h,true,show sizes in human readable form"`
+	ConfigFile           string                `subcmd:"config,$HOME/.idu.yml,configuration file"`
+	DBLockTimeout        time.Duration         `subcmd:"db-lock-timeout,0s,'the maximum time to wait for a database that is locked by another idu command, eg. a running analyze, zero waits indefinitely unless --db-lock-retries is set'"`
+	DBLockRetries        int                   `subcmd:"db-lock-retries,0,'the maximum number of attempts to lock a database that is locked by another idu command, zero places no limit on the number of attempts'"`
+	DBLockBackoff        time.Duration         `subcmd:"db-lock-backoff,1s,'the delay before the first retry to lock a database when --db-lock-timeout or --db-lock-retries is set, it doubles for each subsequent attempt'"`
+	Units                string                `subcmd:"units,decimal,display usage in decimal (KB) or binary (KiB) formats"`
+	Verbose              int                   `subcmd:"v,0,higher values show more debugging output"`
+	NoProgress           bool                  `subcmd:"no-progress,false,'disable the display of progress updates, final summaries are still displayed'"`
+	Progress             string                `subcmd:"progress,text,'the format of progress updates, text, or json to write each update as a JSON object on its own line for consumption by log pipelines, the final summary is also written as JSON'"`
+	HTTP                 string                `subcmd:"http,,'set to a port to enable http serving of /debug/vars, /progress/stream, /metrics and profiling'"`
+	ProgressFile         string                `subcmd:"progress-file,,'periodically write the current progress and all expvars, including memory statistics, to the specified JSON file, for use in post-mortem debugging'"`
+	ProgressFileInterval time.Duration         `subcmd:"progress-file-interval,30s,the interval at which to write the --progress-file"`
+	Snapshot             string                `subcmd:"snapshot,,'read from the specified database snapshot, as created by database snapshot, rather than the live database'"`
+	OTLPEndpoint         string                `subcmd:"otlp-endpoint,$OTEL_EXPORTER_OTLP_ENDPOINT,'export OpenTelemetry trace spans for the major phases of analyze to the OTLP/HTTP collector at the specified endpoint, eg. http://localhost:4318, tracing is disabled when empty'"`
+	ExactTies            bool                  `subcmd:"top-exact-ties,false,'scan the database to determine which of the prefixes that are tied at the end of a summary top-N listing are included, rather than choosing among those returned by the database'"`
+	TieBreak             string                `subcmd:"top-tie-break,path,'the order in which prefixes with equal values are listed in top-N listings, by path, by the number of files they contain (files) or most recently modified first (modtime); prefixes that remain tied are listed by path'"`
+	Timezone             string                `subcmd:"timezone,,'display all timestamps in the specified time zone, e.g. UTC or America/Los_Angeles, rather than local time'"`
+}
+
+// displayTime returns t in the time zone requested via --timezone.
+func displayTime(t time.Time) time.Time {
+	return t.In(displayZone)
 }
 
 func init() {
-	analyzeFlagSet := subcmd.MustRegisterFlagStruct(&analyzeFlags{}, nil, nil)
+	analyzeFlagSet := subcmd.MustRegisterFlagStruct(&AnalyzeFlags{}, nil, nil)
 	summaryFlagSet := subcmd.MustRegisterFlagStruct(&summaryFlags{}, nil, nil)
 	userFlagSet := subcmd.MustRegisterFlagStruct(&userFlags{}, nil, nil)
 	groupFlagSet := subcmd.MustRegisterFlagStruct(&groupFlags{}, nil, nil)
@@ -49,34 +73,42 @@ func init() {
 	lsFlagSet := subcmd.MustRegisterFlagStruct(&lsFlags{}, nil, nil)
 	eraseFlagSet := subcmd.MustRegisterFlagStruct(&eraseFlags{}, nil, nil)
 
-	analyzeCmd := subcmd.NewCommand("analyze", analyzeFlagSet, analyze, subcmd.ExactlyNumArguments(1))
+	analyzeCmd := subcmd.NewCommand("analyze", analyzeFlagSet, analyze, subcmd.OptionalSingleArgument())
 	analyzeCmd.Document("analyze the file system to build a database of file counts, disk usage etc", "<directory/prefix>+")
 
-	summaryCmd := subcmd.NewCommand("summary", summaryFlagSet, summary, subcmd.ExactlyNumArguments(1))
+	summaryCmd := subcmd.NewCommand("summary", summaryFlagSet, summary, subcmd.OptionalSingleArgument())
 	summaryCmd.Document("summarize file count and disk usage")
 
-	userSummaryCmd := subcmd.NewCommand("user", userFlagSet, userSummary, subcmd.AtLeastNArguments(1))
-	userSummaryCmd.Document("summarize file count and disk usage on a per user basis", "<prefix> <users>...")
+	userSummaryCmd := subcmd.NewCommand("user", userFlagSet, userSummary)
+	userSummaryCmd.Document("summarize file count and disk usage on a per user basis, the prefix may be read from --prefix-file instead", "<prefix> <users>...")
 
-	groupSummaryCmd := subcmd.NewCommand("group", groupFlagSet, groupSummary, subcmd.AtLeastNArguments(1))
-	groupSummaryCmd.Document("summarize file count and disk usage on a per group basis", "<prefix> <groups>...")
+	groupSummaryCmd := subcmd.NewCommand("group", groupFlagSet, groupSummary)
+	groupSummaryCmd.Document("summarize file count and disk usage on a per group basis, the prefix may be read from --prefix-file instead", "<prefix> <groups>...")
 
 	findCmd := subcmd.NewCommand("find", findFlagSet, find)
 	findCmd.Document("find prefixes/files in statistics database")
 
-	lsrCmd := subcmd.NewCommand("lsr", lsFlagSet, lsr, subcmd.AtLeastNArguments(1))
+	lsrCmd := subcmd.NewCommand("lsr", lsFlagSet, lsr)
 	lsrCmd.Document("list the contents of the database")
 
 	dbEraseCmd := subcmd.NewCommand("erase", eraseFlagSet, dbErase, subcmd.ExactlyNumArguments(1))
 	dbEraseCmd.Document("erase the file and statistics database")
 
+	dbExportFlagSet := subcmd.MustRegisterFlagStruct(&exportFlags{}, nil, nil)
+	dbExportCmd := subcmd.NewCommand("export", dbExportFlagSet, dbExport, subcmd.ExactlyNumArguments(1))
+	dbExportCmd.Document("export the contents of the database in a format suitable for use by other tools, eg. a nested JSON treemap for use with d3 or flamegraph visualizations or a manifest of files for use with rsync or tar", "<prefix>")
+
+	dbSnapshotFlagSet := subcmd.MustRegisterFlagStruct(&snapshotFlags{}, nil, nil)
+	dbSnapshotCmd := subcmd.NewCommand("snapshot", dbSnapshotFlagSet, dbSnapshot, subcmd.ExactlyNumArguments(1))
+	dbSnapshotCmd.Document("create a point-in-time copy of the database for the specified prefix, to be used with --snapshot", "<prefix>")
+
 	dbStatsFlagSet := subcmd.MustRegisterFlagStruct(&configFlags{}, nil, nil)
 	dbStatsCmd := subcmd.NewCommand("stats", dbStatsFlagSet, dbStats, subcmd.AtLeastNArguments(1))
 	dbStatsCmd.Document("display database stastistics")
 
-	dbCompactFlagSet := subcmd.MustRegisterFlagStruct(&configFlags{}, nil, nil)
+	dbCompactFlagSet := subcmd.MustRegisterFlagStruct(&compactFlags{}, nil, nil)
 	dbCompactCmd := subcmd.NewCommand("compact", dbCompactFlagSet, dbCompact, subcmd.AtLeastNArguments(1))
-	dbCompactCmd.Document("perform database compaction")
+	dbCompactCmd.Document("perform database compaction to reclaim unused space, or report the space that would be reclaimed with --dry-run", "<prefix>...")
 
 	dbRefreshStatsFlagSet := subcmd.NewFlagSet()
 	dbRefreshStatsCmd := subcmd.NewCommand("refresh-stats", dbRefreshStatsFlagSet, dbRefreshStats, subcmd.ExactlyNumArguments(1))
@@ -86,7 +118,31 @@ func init() {
 	dmRmPrefixesCmd := subcmd.NewCommand("rm-prefixes", dbRmPrefixesFlagSet, dbRmPrefixes)
 	dmRmPrefixesCmd.Document("delete the specified prefixes, recursively, from the database")
 
-	dbCmds := subcmd.NewCommandSet(dbCompactCmd, dbStatsCmd, dbEraseCmd, dbRefreshStatsCmd, dmRmPrefixesCmd)
+	dbListFlagSet := subcmd.NewFlagSet()
+	dbListCmd := subcmd.NewCommand("list", dbListFlagSet, dbList, subcmd.WithoutArguments())
+	dbListCmd.Document("list all configured prefixes and the status of their databases")
+
+	dbHistoryFlagSet := subcmd.MustRegisterFlagStruct(&historyFlags{}, nil, nil)
+	dbHistoryCmd := subcmd.NewCommand("history", dbHistoryFlagSet, dbHistory, subcmd.ExactlyNumArguments(1))
+	dbHistoryCmd.Document("display the log of analyze runs, including any notes supplied via analyze --note, for the database for the specified prefix", "<prefix>")
+
+	dbCompareFlagSet := subcmd.MustRegisterFlagStruct(&compareFlags{}, nil, nil)
+	dbCompareCmd := subcmd.NewCommand("compare", dbCompareFlagSet, dbCompare, subcmd.ExactlyNumArguments(2))
+	dbCompareCmd.Document("compare the prefix records and totals of two databases, each specified as either a local database directory, such as a snapshot, or a prefix with a configured database, and report any divergence", "<database> <database>")
+
+	dbDiffFlagSet := subcmd.MustRegisterFlagStruct(&diffFlags{}, nil, nil)
+	dbDiffCmd := subcmd.NewCommand("diff", dbDiffFlagSet, dbDiff, subcmd.ExactlyNumArguments(3))
+	dbDiffCmd.Document("report the prefixes beneath the specified prefix that were added, removed, grew or shrank, in files and disk usage, between two scans, each specified as either a local database directory, such as a snapshot, or a prefix with a configured database", "<prefix> <before> <after>")
+
+	dbPruneFlagSet := subcmd.MustRegisterFlagStruct(&pruneFlags{}, nil, nil)
+	dbPruneCmd := subcmd.NewCommand("prune", dbPruneFlagSet, dbPrune, subcmd.ExactlyNumArguments(1))
+	dbPruneCmd.Document("delete the prefixes, beneath the specified prefix, that have not been seen by analyze for at least --min-age, as of the most recent analyze run, or with --missing, that no longer exist", "<prefix>")
+
+	dbVerifyFlagSet := subcmd.MustRegisterFlagStruct(&dbVerifyFlags{}, nil, nil)
+	dbVerifyCmd := subcmd.NewCommand("verify", dbVerifyFlagSet, dbVerify, subcmd.ExactlyNumArguments(1))
+	dbVerifyCmd.Document("check that every prefix beneath the specified prefix can be read from its database and is internally consistent, and optionally delete those that cannot be read", "<prefix>")
+
+	dbCmds := subcmd.NewCommandSet(dbCompactCmd, dbCompareCmd, dbDiffCmd, dbStatsCmd, dbEraseCmd, dbExportCmd, dbHistoryCmd, dbListCmd, dbPruneCmd, dbRefreshStatsCmd, dmRmPrefixesCmd, dbSnapshotCmd, dbVerifyCmd)
 
 	dbCommands := subcmd.NewCommandLevel("database", dbCmds)
 	dbCommands.Document("database management commands")
@@ -95,11 +151,47 @@ func init() {
 	configCmd := subcmd.NewCommand("config", configFlagSet, configManager, subcmd.WithoutArguments())
 	configCmd.Document("describe the current configuration")
 
-	errorsFlagSet := subcmd.NewFlagSet()
-	errorsCmd := subcmd.NewCommand("errors", errorsFlagSet, listErrors, subcmd.ExactlyNumArguments(1))
+	testExcludeFlagSet := subcmd.NewFlagSet()
+	testExcludeCmd := subcmd.NewCommand("test-exclude", testExcludeFlagSet, testExclusions, subcmd.AtLeastNArguments(2))
+	testExcludeCmd.Document("test whether the specified paths, relative to prefix unless absolute, are excluded from analysis and by which exclusion", "<prefix> <path>...")
+
+	duFlagSet := subcmd.MustRegisterFlagStruct(&duFlags{}, nil, nil)
+	duCmd := subcmd.NewCommand("du", duFlagSet, du, subcmd.ExactlyNumArguments(1))
+	duCmd.Document("display the disk usage of the immediate contents of a prefix without descending into its children or updating the database, unless requested", "<prefix>")
+
+	verifyTreeFlagSet := subcmd.MustRegisterFlagStruct(&verifyTreeFlags{}, nil, nil)
+	verifyTreeCmd := subcmd.NewCommand("verify-tree", verifyTreeFlagSet, verifyTree, subcmd.ExactlyNumArguments(1))
+	verifyTreeCmd.Document("compare checksums of the prefixes stored in the database against the filesystem to report prefixes that have been added, removed or changed since they were last analyzed", "<prefix>")
+
+	dupDirsFlagSet := subcmd.MustRegisterFlagStruct(&dupDirsFlags{}, nil, nil)
+	dupDirsCmd := subcmd.NewCommand("dup-dirs", dupDirsFlagSet, dupDirs, subcmd.ExactlyNumArguments(1))
+	dupDirsCmd.Document("report groups of identical directory trees, as determined from the names and sizes of their files and children stored in the database, ordered by reclaimable disk usage", "<prefix>")
+
+	largestFilesFlagSet := subcmd.MustRegisterFlagStruct(&largestFilesFlags{}, nil, nil)
+	largestFilesCmd := subcmd.NewCommand("largest-files", largestFilesFlagSet, largestFiles, subcmd.ExactlyNumArguments(1))
+	largestFilesCmd.Document("display the largest, or smallest, individual files stored in the database for the specified prefix and its descendants", "<prefix>")
+
+	duplicatesFlagSet := subcmd.MustRegisterFlagStruct(&duplicatesFlags{}, nil, nil)
+	duplicatesCmd := subcmd.NewCommand("duplicates", duplicatesFlagSet, duplicates, subcmd.ExactlyNumArguments(1))
+	duplicatesCmd.Document("report groups of likely identical files, as determined from their names and sizes stored in the database or, optionally, by comparing checksums of their contents, ordered by reclaimable disk usage", "<prefix>")
+
+	errorsFlagSet := subcmd.MustRegisterFlagStruct(&errorsFlags{}, nil, nil)
+	errorsCmd := subcmd.NewCommand("errors", errorsFlagSet, listErrors, subcmd.OptionalSingleArgument())
 	errorsCmd.Document("list the contents of the errors database")
 
-	cmdSet = subcmd.NewCommandSet(analyzeCmd, configCmd, errorsCmd, lsrCmd, findCmd, summaryCmd, userSummaryCmd, groupSummaryCmd, dbCommands)
+	warningsFlagSet := subcmd.MustRegisterFlagStruct(&warningsFlags{}, nil, nil)
+	warningsCmd := subcmd.NewCommand("warnings", warningsFlagSet, listWarnings, subcmd.ExactlyNumArguments(1))
+	warningsCmd.Document("list the warnings, such as deeply nested or very large directories, recorded by the most recent analyze run for the database for the specified prefix", "<prefix>")
+
+	watchFlagSet := subcmd.MustRegisterFlagStruct(&watchFlags{}, nil, nil)
+	watchCmd := subcmd.NewCommand("watch", watchFlagSet, watch, subcmd.OptionalSingleArgument())
+	watchCmd.Document("analyze the file system and then continue to watch it for changes, re-analyzing incrementally only those prefixes that have changed; accepts the same flags as analyze", "<prefix>")
+
+	waitFlagSet := subcmd.MustRegisterFlagStruct(&waitFlags{}, nil, nil)
+	waitCmd := subcmd.NewCommand("wait", waitFlagSet, waitForRun, subcmd.ExactlyNumArguments(1))
+	waitCmd.Document("wait for the next successful analyze run that covers the specified prefix to complete and then display a summary of its database", "<prefix>")
+
+	cmdSet = subcmd.NewCommandSet(analyzeCmd, configCmd, testExcludeCmd, duCmd, verifyTreeCmd, dupDirsCmd, duplicatesCmd, largestFilesCmd, errorsCmd, warningsCmd, waitCmd, watchCmd, lsrCmd, findCmd, summaryCmd, userSummaryCmd, groupSummaryCmd, dbCommands)
 	cmdSet.Document(`idu: analyze file systems to create a database of per-file and aggregate size stastistics to support incremental updates and subsequent interrogation. Local and cloud based filesystems are contemplated. See https://github.com/cloudengio/blob/master/idu/README.md for full details.`)
 
 	globals := subcmd.GlobalFlagSet()
@@ -113,6 +205,18 @@ func mainWrapper(ctx context.Context, cmdRunner func() error) error {
 	if err != nil {
 		return err
 	}
+	if err := flags.OneOf(globalFlags.TieBreak).Validate(tieBreakPath, tieBreakFiles, tieBreakModTime); err != nil {
+		return err
+	}
+	if err := flags.OneOf(globalFlags.Progress).Validate("text", "json"); err != nil {
+		return err
+	}
+	if tz := globalFlags.Timezone; len(tz) > 0 {
+		displayZone, err = time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("invalid --timezone: %v", err)
+		}
+	}
 	switch globalFlags.Units {
 	case "decimal":
 		bytesPrinter = func(size int64) (float64, string) {
@@ -138,24 +242,97 @@ func mainWrapper(ctx context.Context, cmdRunner func() error) error {
 			fmt.Println(string(panicBuf))
 		}
 	}()
+	if endpoint := globalFlags.OTLPEndpoint; len(endpoint) > 0 {
+		globalTelemetry = otlp.New(endpoint, "idu", os.Getenv("TRACEPARENT"))
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := globalTelemetry.Flush(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}()
+	}
+	_, span := globalTelemetry.Start(ctx, "config-load", otlp.String("config", globalFlags.ConfigFile))
 	cfg, err := config.ReadConfig(globalFlags.ConfigFile)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		return err
 	}
 	globalConfig = cfg
+	if len(globalFlags.Snapshot) > 0 {
+		if err := useSnapshot(globalFlags.Snapshot); err != nil {
+			return err
+		}
+	}
 
 	var ln net.Listener
 	if port := globalFlags.HTTP; len(port) > 0 {
 		if ln, err = net.Listen("tcp", port); err != nil {
 			return err
 		}
+		http.HandleFunc("/metrics", serveMetrics)
 		go http.Serve(ln, nil)
 	}
 	return cmdRunner()
 }
 
+// PrefixFileFlags is embedded in the flags for commands that accept
+// their target prefix via a file as well as on the command line.
+type PrefixFileFlags struct {
+	PrefixFile string `subcmd:"prefix-file,,read the prefix to operate on from the specified file rather than the command line"`
+}
+
+// prefixArgs returns the prefixes to operate on, either as read from
+// the prefix file or as supplied on the command line, but not both.
+func prefixArgs(pf PrefixFileFlags, args []string) ([]string, error) {
+	if len(pf.PrefixFile) == 0 {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no prefix specified")
+		}
+		return args, nil
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("a prefix may be specified via either --prefix-file or as an argument, but not both: %v", strings.Join(args, ", "))
+	}
+	prefix, err := readPrefixFile(pf.PrefixFile)
+	if err != nil {
+		return nil, err
+	}
+	return []string{prefix}, nil
+}
+
+// prefixAndArgs returns the prefix to operate on and the remaining
+// arguments for commands, such as user and group, whose first argument is
+// the prefix unless it is read from the prefix file.
+func prefixAndArgs(pf PrefixFileFlags, args []string) (string, []string, error) {
+	if len(pf.PrefixFile) == 0 {
+		if len(args) == 0 {
+			return "", nil, fmt.Errorf("no prefix specified")
+		}
+		return args[0], args[1:], nil
+	}
+	prefix, err := readPrefixFile(pf.PrefixFile)
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix, args, nil
+}
+
+func readPrefixFile(filename string) (string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read prefix file: %v", err)
+	}
+	prefix := strings.TrimSpace(string(buf))
+	if len(prefix) == 0 {
+		return "", fmt.Errorf("prefix file %v is empty", filename)
+	}
+	return prefix, nil
+}
+
 func main() {
-	cmdSet.MustDispatch(context.Background())
+	exit(cmdSet.Dispatch(context.Background()))
 }
 
 func debug(ctx context.Context, level int, format string, args ...interface{}) {
@@ -163,7 +340,7 @@ func debug(ctx context.Context, level int, format string, args ...interface{}) {
 		return
 	}
 	_, file, line, _ := runtime.Caller(1)
-	fmt.Printf("%s: %s:% 4d: ", time.Now().Format(time.RFC3339), filepath.Base(file), line)
+	fmt.Printf("%s: %s:% 4d: ", displayTime(time.Now()).Format(time.RFC3339), filepath.Base(file), line)
 	fmt.Printf(format, args...)
 }
 
@@ -5,14 +5,20 @@
 package main_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"github.com/cosnicolaou/pudge"
 )
 
 var iduCommand string
@@ -71,7 +77,7 @@ func TestHelp(t *testing.T) {
 	if err := containsAnyOf(out, base...); err != nil {
 		t.Fatal(err)
 	}
-	err := containsAnyOf(out, "[--config=$HOME/.idu.yml --exit-profile= --h=true --http= --units=decimal --v=0]")
+	err := containsAnyOf(out, "[--config=$HOME/.idu.yml --db-lock-backoff=1s --db-lock-retries=0 --db-lock-timeout=0s --exit-profile= --h=true --http= --no-progress=false --otlp-endpoint=$OTEL_EXPORTER_OTLP_ENDPOINT --progress=text --progress-file= --progress-file-interval=30s --snapshot= --timezone= --top-exact-ties=false --top-tie-break=path --units=decimal --v=0]")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,3 +89,1351 @@ func TestHelp(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func writeFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// analyzeTree writes the named files beneath a tree in tmpDir, configures an
+// identity layout for it and analyzes it, returning the tree and the config
+// file.
+func analyzeTree(t *testing.T, tmpDir string, names ...string) (string, string) {
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, names...)
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	return tree, cfgFile
+}
+
+func TestReportsDirExcluded(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	reports := filepath.Join(tree, "reports")
+	writeFiles(t, tree, "a", "b", filepath.Join("reports", "someone.txt"))
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+reports_dir: %v
+`, tree, filepath.Join(tree, ".idu"), reports)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "find", "--prefix=.", tree)
+	if err != nil {
+		t.Fatalf("find: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, tree+" "); err != nil {
+		t.Fatal(err)
+	}
+	for _, excluded := range []string{reports, filepath.Join(tree, ".idu")} {
+		if strings.Contains(out, excluded) {
+			t.Errorf("%v was not excluded: %s", excluded, out)
+		}
+	}
+}
+
+func TestDeletionsBetweenScans(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a/x", "a/y", "b/z", "c/d/w")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	analyzeAndSummarize := func(expected ...string) string {
+		out, err := runIDU("--config="+cfgFile, "analyze", tree)
+		if err != nil {
+			t.Fatalf("analyze: %v: %s", err, out)
+		}
+		summary, err := runIDU("--config="+cfgFile, "summary", tree)
+		if err != nil {
+			t.Fatalf("summary: %v: %s", err, summary)
+		}
+		if err := containsAnyOf(summary, expected...); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	analyzeAndSummarize("4 : total files", "0.014 KB : total disk usage")
+	for _, name := range []string{"a/y", "b/z"} {
+		if err := os.Remove(filepath.Join(tree, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tree, "c")); err != nil {
+		t.Fatal(err)
+	}
+	out := analyzeAndSummarize("1 : total files", "0.003 KB : total disk usage")
+	if err := containsAnyOf(out, "file deletions :               2", "prefix deletions :               1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlyExtensions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a.vmdk", "b.txt", "c/d.QCOW2", "c/e.log", "c/f/g")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runIDU("--config="+cfgFile, "analyze", "--only-ext=vmdk,qcow2", tree)
+	if err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	summary, err := runIDU("--config="+cfgFile, "summary", tree)
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, summary)
+	}
+	if err := containsAnyOf(summary, "2 : total files", "0.015 KB : total disk usage"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, manifest)
+	}
+	if got, want := strings.Join(strings.Fields(manifest), " "), "a.vmdk "+filepath.Join("c", "d.QCOW2"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/c", "b/d/e", "b/d/f/g", "b/d/j/k", "b/h/i")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	usage := func() string {
+		out, err := runIDU("--config="+cfgFile, "summary", tree)
+		if err != nil {
+			t.Fatalf("summary: %v: %s", err, out)
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "total disk usage") {
+				return strings.TrimSpace(line)
+			}
+		}
+		t.Fatalf("no disk usage in: %s", out)
+		return ""
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	full := usage()
+	// The prefixes recorded by the first, unlimited, run below b must be
+	// removed so that their usage is not counted twice.
+	out, err := runIDU("--config="+cfgFile, "analyze", "--max-depth=1", "--concurrency=2", tree)
+	if err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// b/d, b/d/f, b/d/j and b/h are totaled.
+	if err := containsAnyOf(out, "totaled :               4\n"); err != nil {
+		t.Error(err)
+	}
+	if got, want := usage(), full; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	manifest, err := runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, manifest)
+	}
+	if got, want := strings.Join(strings.Fields(manifest), " "), "a "+filepath.Join("b", "c"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestForceRescan(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/c", "b/d/e")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+  - type: identity
+    prefix: %v
+    force_rescan_after: 1ns
+`, tree, filepath.Join(tmpDir, "db"), tree, filepath.Join(tree, "b"))
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	decisions := func() map[string]string {
+		traceFile := filepath.Join(tmpDir, "trace.json")
+		if out, err := runIDU("--config="+cfgFile, "analyze", "--trace="+traceFile, tree); err != nil {
+			t.Fatalf("analyze: %v: %s", err, out)
+		}
+		buf, err := ioutil.ReadFile(traceFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			var ev struct{ Event, Prefix, Decision string }
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Event == "enter" {
+				decisions[ev.Prefix] = ev.Decision
+			}
+		}
+		return decisions
+	}
+	decisions()
+	got := decisions()
+	want := map[string]string{
+		tree:                          "unchanged",
+		filepath.Join(tree, "b"):      "list",
+		filepath.Join(tree, "b", "d"): "list",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPruneMissing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/c", "b/h", "b/d/e", "b/d/f/g", "bb/x")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	for _, name := range []string{filepath.Join("b", "d"), filepath.Join("b", "c"), "bb"} {
+		if err := os.RemoveAll(filepath.Join(tree, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := filepath.Join(tree, "b")
+	out, err := runIDU("--config="+cfgFile, "database", "prune", "--missing", "--dry-run", b)
+	if err != nil {
+		t.Fatalf("prune: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, filepath.Join(b, "d", "f")+"\n", filepath.Join(b, "c")+"\n", "would prune 2 prefixes and 1 files"); err != nil {
+		t.Fatal(err)
+	}
+	// Prefixes that share a string prefix with b, but are not within it,
+	// are not pruned.
+	if strings.Contains(out, filepath.Join(tree, "bb")) {
+		t.Errorf("%v should not have been pruned: %s", filepath.Join(tree, "bb"), out)
+	}
+	for _, want := range []string{"pruned 2 prefixes and 1 files", "pruned 0 prefixes and 0 files"} {
+		out, err := runIDU("--config="+cfgFile, "database", "prune", "--missing", b)
+		if err != nil {
+			t.Fatalf("prune: %v: %s", err, out)
+		}
+		if err := containsAnyOf(out, want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err = runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, out)
+	}
+	if got, want := strings.Join(strings.Fields(out), " "), "a "+filepath.Join("b", "h")+" "+filepath.Join("bb", "x"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPruneAfterSubtreeAnalyze(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a/x", "a/y/z", "b/x", "b/y/z")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+`, tree, filepath.Join(tmpDir, "db"))
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if out, err := runIDU("--config="+cfgFile, "analyze", filepath.Join(tree, "a")); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// The sibling of the subtree that was analyzed most recently was seen
+	// by the most recent analyze run of its ancestor and is not stale.
+	out, err := runIDU("--config="+cfgFile, "database", "prune", "--min-age=1ns", filepath.Join(tree, "b"))
+	if err != nil {
+		t.Fatalf("prune: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "pruned 0 prefixes"); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runIDU("--config="+cfgFile, "lsr", filepath.Join(tree, "b"))
+	if err != nil {
+		t.Fatalf("lsr: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, filepath.Join(tree, "b", "y")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatabaseVerify(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/c", "b/d/e")
+	dbDir := filepath.Join(tmpDir, "db")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, dbDir, tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "database", "verify", tree)
+	if err != nil {
+		t.Fatalf("verify: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "3 healthy, 0 unreadable, 0 inconsistent prefixes"); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(tree, "b", "d")
+	pdb, err := pudge.Open(filepath.Join(dbDir, "prefix.pudge"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pdb.Set(corrupt, []byte("not a prefix")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runIDU("--config="+cfgFile, "database", "verify", "--list", tree)
+	if err == nil {
+		t.Fatalf("verify of a corrupt database succeeded: %s", out)
+	}
+	if err := containsAnyOf(out, "unreadable: "+corrupt+":", "2 healthy, 1 unreadable, 0 inconsistent prefixes"); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runIDU("--config="+cfgFile, "database", "verify", "--repair", tree)
+	if err != nil {
+		t.Fatalf("verify --repair: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "deleted 1 unreadable prefixes"); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runIDU("--config="+cfgFile, "database", "verify", tree)
+	if err != nil {
+		t.Fatalf("verify: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "2 healthy, 0 unreadable, 0 inconsistent prefixes"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/c")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "database", "export", "--format=csv", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := len(lines), 5; got != want {
+		t.Fatalf("got %v, want %v: %s", got, want, out)
+	}
+	if got, want := lines[0], "path,uid,gid,size,mtime,is_dir"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i, want := range []string{tree + ",", filepath.Join(tree, "a") + ",", filepath.Join(tree, "b") + ",", filepath.Join(tree, "b", "c") + ","} {
+		if !strings.HasPrefix(lines[i+1], want) {
+			t.Errorf("%v: %v does not start with %v", i, lines[i+1], want)
+		}
+	}
+	if !strings.HasSuffix(lines[1], ",true") || !strings.HasSuffix(lines[2], ",false") {
+		t.Errorf("unexpected is_dir values: %s", out)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	dbDir := filepath.Join(tmpDir, "db")
+	writeFiles(t, tree, "a", "b/c")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, dbDir, tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Minute)
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--resume", tree); err == nil || !strings.Contains(out, "no interrupted analyze run") {
+		t.Fatalf("expected an error: %v: %s", err, out)
+	}
+	// Simulate a run, that started before the previous one, having been
+	// interrupted; all of the prefixes scanned since then are skipped and
+	// hence the new file is not seen.
+	if err := runlog.Begin(dbDir, runlog.Entry{Prefix: tree, Start: start}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, tree, "d")
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--resume", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	manifest, err := runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, manifest)
+	}
+	if got, want := strings.Join(strings.Fields(manifest), " "), "a "+filepath.Join("b", "c"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok, err := runlog.InProgress(dbDir); ok || err != nil {
+		t.Errorf("the resumed run was not recorded as complete: %v: %v", ok, err)
+	}
+}
+
+func exitCode(err error) int {
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func TestExitCodes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a/x", "b/y")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+`, tree, filepath.Join(tmpDir, "db"))
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "verify-tree", tree)
+	if got, want := exitCode(err), 0; got != want {
+		t.Errorf("got %v, want %v: %s", got, want, out)
+	}
+	writeFiles(t, tree, "c/z")
+	out, err = runIDU("--config="+cfgFile, "verify-tree", tree)
+	if got, want := exitCode(err), 3; got != want {
+		t.Errorf("got %v, want %v: %s", got, want, out)
+	}
+	out, err = runIDU("--config="+cfgFile, "no-such-command")
+	if got, want := exitCode(err), 1; got != want {
+		t.Errorf("got %v, want %v: %s", got, want, out)
+	}
+}
+
+func TestVerifyTreeFilters(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a.vmdk", "b.txt", "c/d.vmdk", "c/e.log", "c/f/g.vmdk", "h/i.txt")
+	writeFiles(t, tmpDir, "outside/target.vmdk")
+	if err := ioutil.WriteFile(filepath.Join(tree, "c", ".iduignore"), []byte("*.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tmpDir, "outside", "target.vmdk"), filepath.Join(tree, "link.vmdk")); err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range [][]string{
+		nil,
+		{"--only-ext=vmdk"},
+		{"--count-symlink-targets"},
+		{"--files-only"},
+		{"--only-ext=vmdk", "--count-symlink-targets", "--files-only"},
+	} {
+		// Start afresh since prefixes recorded by previous runs with
+		// other options, eg. without --files-only, are not removed.
+		if err := os.RemoveAll(filepath.Join(tmpDir, "db")); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"--config=" + cfgFile, "analyze"}, flags...)
+		if out, err := runIDU(append(args, tree)...); err != nil {
+			t.Fatalf("analyze %v: %v: %s", flags, err, out)
+		}
+		out, err := runIDU("--config="+cfgFile, "verify-tree", tree)
+		if err != nil {
+			t.Fatalf("verify-tree %v: %v: %s", flags, err, out)
+		}
+		if err := containsAnyOf(out, "changed: 0, added: 0, removed: 0, errors: 0"); err != nil {
+			t.Errorf("%v: %v", flags, err)
+		}
+		// Verifying a subtree uses the options for the tree.
+		out, err = runIDU("--config="+cfgFile, "verify-tree", filepath.Join(tree, "c"))
+		if err != nil {
+			t.Fatalf("verify-tree %v: %v: %s", flags, err, out)
+		}
+		if err := containsAnyOf(out, "changed: 0, added: 0, removed: 0, errors: 0"); err != nil {
+			t.Errorf("%v: %v", flags, err)
+		}
+	}
+	// Changes to files that are recorded are still detected.
+	if err := ioutil.WriteFile(filepath.Join(tree, "c", "d.vmdk"), []byte("modified"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runIDU("--config="+cfgFile, "verify-tree", tree)
+	if err == nil {
+		t.Fatalf("verify-tree: expected an error: %s", out)
+	}
+	if err := containsAnyOf(out, "changed: "+filepath.Join(tree, "c")+"\n", "changed: 1,"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompactDryRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	var names []string
+	for i := 0; i < 200; i++ {
+		names = append(names, filepath.Join(fmt.Sprintf("d%03d", i), "f"))
+	}
+	writeFiles(t, tree, names...)
+	dbDir := filepath.Join(tmpDir, "db")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, dbDir, tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// Deleting most of the prefixes leaves free space to be reclaimed.
+	for i := 0; i < 190; i++ {
+		if err := os.RemoveAll(filepath.Join(tree, fmt.Sprintf("d%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := runIDU("--config="+cfgFile, "database", "prune", "--missing", tree); err != nil {
+		t.Fatalf("prune: %v: %s", err, out)
+	}
+	sizes := func() map[string]int64 {
+		sizes := map[string]int64{}
+		err := filepath.Walk(dbDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				sizes[path] = info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sizes
+	}
+	before := sizes()
+	out, err := runIDU("--config="+cfgFile, "database", "compact", "--dry-run", tree)
+	if err != nil {
+		t.Fatalf("compact: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "compaction of the database for: "+tree+": would reduce its size from"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sizes(), before; !reflect.DeepEqual(got, want) {
+		t.Errorf("database was modified by --dry-run: got %v, want %v", got, want)
+	}
+	// The database remains usable.
+	out, err = runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, out)
+	}
+	if got, want := len(strings.Fields(out)), 10; got != want {
+		t.Errorf("got %v, want %v: %s", got, want, out)
+	}
+
+	// Only local databases can be compacted via a copy.
+	if out, err := runIDU("--config="+cfgFile, "database", "compact", "--dry-run", "/not/configured"); err == nil {
+		t.Errorf("expected an error: %s", out)
+	}
+}
+
+func TestSummaryOwners(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/d/e", "b/f/g")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	tsvFile := filepath.Join(tmpDir, "summary.tsv")
+	header := func() string {
+		buf, err := ioutil.ReadFile(tsvFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.SplitN(string(buf), "\n", 2)[0]
+	}
+	out, err := runIDU("--config="+cfgFile, "summary", "--tsv="+tsvFile, tree)
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, out)
+	}
+	if strings.Contains(out, "owners:") {
+		t.Errorf("unexpected owners: %s", out)
+	}
+	if got, want := header(), "prefix\tuser\tbytes\tfiles\tdirectories\terrors\tavg_file_size"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	out, err = runIDU("--config="+cfgFile, "summary", "--owners", "--tsv="+tsvFile, tree)
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "owners: 1 users, 1 groups"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header(), "prefix\tuser\tbytes\tfiles\tdirectories\terrors\tavg_file_size\tdistinct_users\tdistinct_groups"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The prefixes with no files of their own are included since their
+	// descendants have files.
+	out, err = runIDU("--config="+cfgFile, "summary", "--most-shared", filepath.Join(tree, "b"))
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "1 groups: "+filepath.Join(tree, "b")+" ", "1 groups: "+filepath.Join(tree, "b", "d")+" "); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	for name, contents := range map[string]string{
+		"a/dup":         "identical",
+		"b/copy":        "identical",
+		"c/same-size":   "different",
+		"d/unique":      "unique contents",
+		"ignored/dup":   "identical",
+		"excluded/copy": "identical",
+	} {
+		filename := filepath.Join(tree, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	writeConfig := func(exclusions string) {
+		cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+%v`, tree, filepath.Join(tmpDir, "db"), tree, exclusions)
+		if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("")
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// Exclusions added after the database was created are still applied.
+	if err := ioutil.WriteFile(filepath.Join(tree, ".iduignore"), []byte("ignored/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(fmt.Sprintf(`exclusions:
+  - prefix: %v
+    regexps:
+      - /excluded$
+`, tree))
+	out, err := runIDU("--config="+cfgFile, "duplicates", "--hash", tree)
+	if err != nil {
+		t.Fatalf("duplicates: %v: %s", err, out)
+	}
+	want := fmt.Sprintf("2 copies of 0.009 KB\n    %v\n    %v\n1 groups of duplicate files",
+		filepath.Join(tree, "a", "dup"), filepath.Join(tree, "b", "copy"))
+	if err := containsAnyOf(out, want); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"same-size", "unique", "ignored", "excluded"} {
+		if strings.Contains(out, name) {
+			t.Errorf("%v should not have been reported: %s", name, out)
+		}
+	}
+	// Without --hash, files with the same name and size are assumed to be
+	// identical.
+	out, err = runIDU("--config="+cfgFile, "duplicates", tree)
+	if err != nil {
+		t.Fatalf("duplicates: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "0 groups of duplicate files"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindChangedSinceTime(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// A time after the first run but before the second selects the first.
+	since := time.Now().Add(time.Second).UTC()
+	time.Sleep(time.Until(since) + 100*time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(tree, "b"), []byte("modified"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--incremental=false", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "find", "--changed-since="+since.Format(time.RFC3339), tree)
+	if err != nil {
+		t.Fatalf("find: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "changed   "+filepath.Join(tree, "b")+"\n", "reporting files modified since the analyze run of "+tree); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, filepath.Join(tree, "a")+"\n") {
+		t.Errorf("%v should not have been reported: %s", filepath.Join(tree, "a"), out)
+	}
+	// There are no runs before the first.
+	out, err = runIDU("--config="+cfgFile, "find", "--changed-since=2001-01-01", tree)
+	if err == nil || !strings.Contains(out, "no analyze run of "+tree+" completed at or before") {
+		t.Errorf("missing or wrong error: %v: %s", err, out)
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a", "b/cc")
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	type row struct {
+		Prefix         string `json:"prefix"`
+		Value          int64  `json:"value"`
+		DistinctUsers  *int64 `json:"distinct_users"`
+		DistinctGroups *int64 `json:"distinct_groups"`
+	}
+	type summary struct {
+		Prefix      string `json:"prefix"`
+		Bytes       int64  `json:"bytes"`
+		Files       int64  `json:"files"`
+		Children    int64  `json:"children"`
+		TopBytes    []row  `json:"top_bytes"`
+		TopFiles    []row  `json:"top_files"`
+		TopChildren []row  `json:"top_children"`
+	}
+	decode := func(args ...string) summary {
+		out, err := runIDU(append([]string{"--config=" + cfgFile, "summary", "--json"}, args...)...)
+		if err != nil {
+			t.Fatalf("summary: %v: %s", err, out)
+		}
+		var s summary
+		if err := json.Unmarshal([]byte(out), &s); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return s
+	}
+	s := decode("--top=1", tree)
+	if got, want := s.Prefix, tree; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := []int64{s.Bytes, s.Files, s.Children}, []int64{5, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.TopBytes, []row{{Prefix: filepath.Join(tree, "b"), Value: 4}, {Prefix: "(other)", Value: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := len(s.TopFiles), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.TopChildren, []row{{Prefix: tree, Value: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	s = decode("--top=1", "--other=false", "--owners", tree)
+	if got, want := len(s.TopBytes), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if r := s.TopBytes[0]; r.DistinctUsers == nil || *r.DistinctUsers != 1 || r.DistinctGroups == nil || *r.DistinctGroups != 1 {
+		t.Errorf("unexpected owners: %+v", r)
+	}
+
+	out, err := runIDU("--config="+cfgFile, "summary", "--json", "--compact", tree)
+	if err == nil || !strings.Contains(out, "--json can only be used with --by-extension or the totals and top prefixes") {
+		t.Errorf("missing or unexpected error: %v: %s", err, out)
+	}
+	out, err = runIDU("--config="+cfgFile, "summary", "--json", "--by-extension", tree)
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, `"extensions":`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDupDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// x and y are identical, as are x/p and y/p, but the latter are not
+	// reported since their parents are. z/p has a file of a different size.
+	tree, cfgFile := analyzeTree(t, tmpDir, "x/p/f", "x/p/g", "y/p/f", "y/p/g", "z/p/ff")
+	out, err := runIDU("--config="+cfgFile, "dup-dirs", tree)
+	if err != nil {
+		t.Fatalf("dup-dirs: %v: %s", err, out)
+	}
+	want := fmt.Sprintf("2 copies of 0.010 KB (2 files)\n    %v\n    %v\n1 groups of duplicate trees",
+		filepath.Join(tree, "x"), filepath.Join(tree, "y"))
+	if err := containsAnyOf(out, want); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{filepath.Join(tree, "x", "p"), filepath.Join(tree, "z")} {
+		if strings.Contains(out, prefix) {
+			t.Errorf("%v should not have been reported: %s", prefix, out)
+		}
+	}
+	out, err = runIDU("--config="+cfgFile, "dup-dirs", "--min-size=11", tree)
+	if err != nil {
+		t.Fatalf("dup-dirs: %v: %s", err, out)
+	}
+	// Trees that use less than --min-size are not reported.
+	if err := containsAnyOf(out, "0 groups of duplicate trees"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a", "b/c")
+	snap := filepath.Join(tmpDir, "snap")
+	if out, err := runIDU("--config="+cfgFile, "database", "snapshot", "--out="+snap, tree); err != nil {
+		t.Fatalf("snapshot: %v: %s", err, out)
+	}
+	out, err := runIDU("--config="+cfgFile, "database", "compare", snap, tree)
+	if err != nil {
+		t.Fatalf("compare: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "identical prefixes: 2, divergences: 0"); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, tree, "d/e")
+	if err := ioutil.WriteFile(filepath.Join(tree, "b", "c"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--incremental=false", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err = runIDU("--config="+cfgFile, "database", "compare", snap, tree)
+	if err == nil || !strings.Contains(out, "the databases have diverged") {
+		t.Fatalf("missing or unexpected error: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out,
+		"only in b: "+filepath.Join(tree, "d")+"\n",
+		"differs: "+tree+": ",
+		"differs: "+filepath.Join(tree, "b")+": disk usage, files",
+		"total files differs: a: 2, b: 3",
+	); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = runIDU("--config="+cfgFile, "database", "compare", "--max-divergences=1", tree, snap)
+	if err := containsAnyOf(out, "differs: "+tree+": ", "... 5 more\n", "divergences: 6"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "only in a: ") {
+		t.Errorf("only one divergence should be displayed: %s", out)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a", "b/c")
+	snap := filepath.Join(tmpDir, "snap")
+	if out, err := runIDU("--config="+cfgFile, "database", "snapshot", "--out="+snap, tree); err != nil {
+		t.Fatalf("snapshot: %v: %s", err, out)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(snap, "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Prefix string   `json:"prefix"`
+		Files  []string `json:"files"`
+	}
+	if err := json.Unmarshal(buf, &info); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Prefix, tree; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(info.Files) == 0 {
+		t.Errorf("no files were copied")
+	}
+	for _, name := range info.Files {
+		if _, err := os.Stat(filepath.Join(snap, name)); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	out, err := runIDU("--config="+cfgFile, "database", "snapshot", "--out="+snap, tree)
+	if err == nil || !strings.Contains(out, snap+" already exists") {
+		t.Errorf("missing or unexpected error: %v: %s", err, out)
+	}
+
+	// Subsequent changes to the database are not visible via the snapshot.
+	writeFiles(t, tree, "d/e")
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--incremental=false", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	totalFiles := func(args ...string) string {
+		out, err := runIDU(append([]string{"--config=" + cfgFile}, args...)...)
+		if err != nil {
+			t.Fatalf("summary: %v: %s", err, out)
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasSuffix(line, ": total files") {
+				return strings.TrimSpace(strings.TrimSuffix(line, ": total files"))
+			}
+		}
+		t.Fatalf("no total files: %s", out)
+		return ""
+	}
+	if got, want := totalFiles("summary", tree), "3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := totalFiles("--snapshot="+snap, "summary", tree), "2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSummaryGrowthRate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a", "b/c")
+	out, err := runIDU("--config="+cfgFile, "summary", "--growth-rate", tree)
+	if err == nil || !strings.Contains(out, "growth rates require at least two analyze runs") {
+		t.Errorf("missing or unexpected error: %v: %s", err, out)
+	}
+	writeFiles(t, tree, "b/more")
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--incremental=false", tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	out, err = runIDU("--config="+cfgFile, "summary", "--growth-rate", tree)
+	if err != nil {
+		t.Fatalf("summary: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "ordered by growth rate between runs at ", "/day: "+filepath.Join(tree, "b")+" (0.009 KB)"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindContentType(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "notes.txt", "d/image.dat")
+	if err := ioutil.WriteFile(filepath.Join(tree, "d", "image.dat"), []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runIDU("--config="+cfgFile, "find", "--type=image", tree)
+	if err != nil {
+		t.Fatalf("find: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, filepath.Join(tree, "d", "image.dat")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "notes.txt") {
+		t.Errorf("notes.txt should not have been found: %s", out)
+	}
+	out, err = runIDU("--config="+cfgFile, "find", "--type=text,video", tree)
+	if err != nil {
+		t.Fatalf("find: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, filepath.Join(tree, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "image.dat") {
+		t.Errorf("image.dat should not have been found: %s", out)
+	}
+	out, err = runIDU("--config="+cfgFile, "find", "--type=spreadsheet", tree)
+	if err == nil || !strings.Contains(out, "unsupported content type: spreadsheet") {
+		t.Errorf("missing or unexpected error: %v: %s", err, out)
+	}
+}
+
+func TestAnalyzeExcludeFrom(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	writeFiles(t, tree, "a.txt", "b.log", "build/c.txt", "src/d.txt", "src/e.log", "src/build/f.txt")
+	patterns := filepath.Join(tmpDir, "patterns")
+	if err := ioutil.WriteFile(patterns, []byte("# comment\n\n*.log\n/build/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(tmpDir, "idu.yml")
+	cfg := fmt.Sprintf(`databases:
+  - prefix: %v
+    type: local
+    directory: %v
+layouts:
+  - type: identity
+    prefix: %v
+`, tree, filepath.Join(tmpDir, "db"), tree)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runIDU("--config="+cfgFile, "analyze", "--exclude-from="+patterns, tree); err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	// The excluded files and prefixes are never written to the database.
+	manifest, err := runIDU("--config="+cfgFile, "database", "export", "--format=manifest", "--paths-only", "--relative", tree)
+	if err != nil {
+		t.Fatalf("export: %v: %s", err, manifest)
+	}
+	if got, want := strings.Join(strings.Fields(manifest), " "), strings.Join([]string{
+		"a.txt", filepath.Join("src", "d.txt"), filepath.Join("src", "build", "f.txt")}, " "); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	out, err := runIDU("--config="+cfgFile, "lsr", tree)
+	if err != nil {
+		t.Fatalf("lsr: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "3 : total files", filepath.Join(tree, "src", "build")+" "); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, filepath.Join(tree, "build")+" ") {
+		t.Errorf("%v should not be in the database: %s", filepath.Join(tree, "build"), out)
+	}
+	missing := filepath.Join(tmpDir, "missing")
+	out, err = runIDU("--config="+cfgFile, "analyze", "--exclude-from="+missing, tree)
+	if err == nil || !strings.Contains(out, "--exclude-from: open "+missing) {
+		t.Errorf("missing or unexpected error: %v: %s", err, out)
+	}
+}
+
+func TestUserGroupPrefixFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a")
+	prefixFile := filepath.Join(tmpDir, "prefix.txt")
+	if err := ioutil.WriteFile(prefixFile, []byte(tree+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"user", "group"} {
+		withFile, err := runIDU("--config="+cfgFile, cmd, "--list-"+cmd+"s", "--prefix-file="+prefixFile)
+		if err != nil {
+			t.Fatalf("%v: %v: %s", cmd, err, withFile)
+		}
+		withArg, err := runIDU("--config="+cfgFile, cmd, "--list-"+cmd+"s", tree)
+		if err != nil {
+			t.Fatalf("%v: %v: %s", cmd, err, withArg)
+		}
+		if len(withFile) == 0 || withFile != withArg {
+			t.Errorf("%v: got %q, want %q", cmd, withFile, withArg)
+		}
+		out, err := runIDU("--config="+cfgFile, cmd)
+		if err == nil || !strings.Contains(out, "no prefix specified") {
+			t.Errorf("%v: missing or unexpected error: %v: %s", cmd, err, out)
+		}
+	}
+}
+
+func TestFindDuplicateNamesWithinPrefix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a/x", "a/c/x", "ab/x")
+	out, err := runIDU("--config="+cfgFile, "find", "--duplicate-names", filepath.Join(tree, "a"))
+	if err != nil {
+		t.Fatalf("find: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "x: 2 occurrences", filepath.Join(tree, "a", "x"), filepath.Join(tree, "a", "c", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, filepath.Join(tree, "ab")) {
+		t.Errorf("%v should not have been included: %s", filepath.Join(tree, "ab"), out)
+	}
+}
+
+func TestVerifyTreeWithinPrefix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a/x", "ab/y")
+	// Changes to a sibling that shares the prefix of the tree being
+	// verified are not reported.
+	if err := os.RemoveAll(filepath.Join(tree, "ab")); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runIDU("--config="+cfgFile, "verify-tree", filepath.Join(tree, "a"))
+	if err != nil {
+		t.Fatalf("verify-tree: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "unchanged: 1, changed: 0, added: 0, removed: 0, errors: 0"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatOnlyWithinPrefix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, cfgFile := analyzeTree(t, tmpDir, "a/x", "ab/y")
+	// Only the files within the prefix are re-statted and rewritten.
+	out, err := runIDU("--config="+cfgFile, "analyze", "--stat-only", filepath.Join(tree, "a"))
+	if err != nil {
+		t.Fatalf("analyze: %v: %s", err, out)
+	}
+	if err := containsAnyOf(out, "re-statted :               1\n"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// writeManifest writes the files stored for root and its descendants to out
+// as they are read from the database, one per line, or NUL terminated if
+// null is set. Each line contains the file's size, modification time and
+// path, tab separated, unless pathsOnly is set, in which case only the path
+// is written as required by rsync's --files-from. Paths are relative to root
+// if relative is set.
+func writeManifest(ctx context.Context, out io.Writer, db filewalk.Database, root, sep string, relative, pathsOnly, null bool) error {
+	wr := bufio.NewWriter(out)
+	terminator := byte('\n')
+	if null {
+		terminator = 0
+	}
+	parent := strings.TrimSuffix(root, sep) + sep
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if prefix != root && !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		dir := strings.TrimSuffix(prefix, sep) + sep
+		if relative {
+			dir = strings.TrimPrefix(dir, parent)
+		}
+		for _, fi := range pi.Files {
+			if !pathsOnly {
+				wr.WriteString(strconv.FormatInt(fi.Size, 10))
+				wr.WriteByte('\t')
+				wr.WriteString(displayTime(fi.ModTime).Format(time.RFC3339))
+				wr.WriteByte('\t')
+			}
+			wr.WriteString(dir)
+			wr.WriteString(fi.Name)
+			if err := wr.WriteByte(terminator); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return wr.Flush()
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestWriteManifest(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	defer func(zone *time.Location) { displayZone = zone }(displayZone)
+	displayZone = time.UTC
+	modTime := time.Date(2021, 7, 4, 10, 11, 12, 0, time.UTC)
+	file := func(name string, size int64) filewalk.Info {
+		return filewalk.Info{Name: name, Size: size, ModTime: modTime}
+	}
+	for prefix, files := range map[string][]filewalk.Info{
+		"/r":     {file("f", 1)},
+		"/r/a":   {file("g", 2), file("h h", 3)},
+		"/r/a/x": {file("i", 4)},
+		// /r/ab shares a string prefix with /r/a but is not beneath it.
+		"/r/ab": {file("j", 5)},
+		"/r/b":  nil,
+	} {
+		if err := db.Set(ctx, prefix, &filewalk.PrefixInfo{Files: files}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := "\t2021-07-04T10:11:12Z\t"
+	for i, tc := range []struct {
+		root                      string
+		relative, pathsOnly, null bool
+		want                      string
+	}{
+		{"/r/a", false, false, false, "2" + ts + "/r/a/g\n3" + ts + "/r/a/h h\n4" + ts + "/r/a/x/i\n"},
+		{"/r/a", false, true, false, "/r/a/g\n/r/a/h h\n/r/a/x/i\n"},
+		{"/r/a", true, true, false, "g\nh h\nx/i\n"},
+		{"/r/a", true, true, true, "g\x00h h\x00x/i\x00"},
+		{"/r/a", true, false, true, "2" + ts + "g\x003" + ts + "h h\x004" + ts + "x/i\x00"},
+		{"/r/a/x", true, true, false, "i\n"},
+		{"/r/b", false, false, false, ""},
+		{"/r", true, true, false, "f\na/g\na/h h\na/x/i\nab/j\n"},
+	} {
+		out := &strings.Builder{}
+		if err := writeManifest(ctx, out, db, tc.root, "/", tc.relative, tc.pathsOnly, tc.null); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.String(), tc.want; got != want {
+			t.Errorf("%v: %v: got %q, want %q", i, tc.root, got, want)
+		}
+	}
+	if err := writeManifest(ctx, failingWriter{}, db, "/r", "/", false, false, false); err == nil {
+		t.Errorf("expected an error")
+	}
+}
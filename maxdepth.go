@@ -0,0 +1,122 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cloudeng.io/cmd/idu/internal/warnings"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/sync/errgroup"
+)
+
+// atMaxDepth returns true if prefix is at, or below, the --max-depth
+// limit, in which case its descendants are totaled rather than being
+// recorded individually.
+func (sc *scanState) atMaxDepth(prefix string) bool {
+	return sc.maxDepth > 0 && sc.depth(prefix) >= sc.maxDepth
+}
+
+// subtreeDir is a prefix beneath the --max-depth limit and its children.
+type subtreeDir struct {
+	prefix   string
+	children []filewalk.Info
+}
+
+// subtreeUsage returns the disk usage of the files within the supplied
+// children of prefix and all of their descendants, along with the number
+// of prefixes listed to obtain it. None of these prefixes are recorded in
+// the database. Exclusions, ignore files and --only-ext are applied just
+// as they are when walking the tree. The prefixes at each level of the
+// subtree are listed concurrently, up to --concurrency at a time, and every
+// prefix listed is reported as totaled to the progress tracker.
+func (sc *scanState) subtreeUsage(ctx context.Context, prefix string, children []filewalk.Info) (int64, int) {
+	concurrency := sc.concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(-1)
+	}
+	var usage, listed int64
+	level := []subtreeDir{{prefix: prefix, children: children}}
+	for len(level) > 0 {
+		var mu sync.Mutex
+		var next []subtreeDir
+		listers := errgroup.WithConcurrency(&errgroup.T{}, concurrency)
+		for _, parent := range level {
+			for _, child := range parent.children {
+				if err := globalPauser.wait(ctx); err != nil {
+					listers.Wait()
+					return usage, int(listed)
+				}
+				dir := sc.fs.Join(parent.prefix, child.Name)
+				if sc.exclusions.Exclude(dir) || sc.ignores.Exclude(dir, true) || sc.devices.skip(dir, &child) {
+					continue
+				}
+				listers.GoContext(ctx, func() error {
+					u, grandchildren := sc.dirUsage(ctx, dir)
+					atomic.AddInt64(&usage, u)
+					atomic.AddInt64(&listed, 1)
+					sc.pt.send(ctx, progressUpdate{totaled: 1})
+					mu.Lock()
+					next = append(next, subtreeDir{prefix: dir, children: grandchildren})
+					mu.Unlock()
+					return nil
+				})
+			}
+		}
+		if err := listers.Wait(); err != nil {
+			return usage, int(listed)
+		}
+		level = next
+	}
+	return usage, int(listed)
+}
+
+// dirUsage lists dir, which lies beneath the --max-depth limit, and returns
+// the disk usage of its files and its children.
+func (sc *scanState) dirUsage(ctx context.Context, dir string) (int64, []filewalk.Info) {
+	sc.readIgnoreFile(ctx, dir)
+	files, children, err := listPrefix(ctx, sc.fs, dir)
+	if err != nil {
+		if sc.fs.IsPermissionError(err) {
+			sc.warn(ctx, dir, warnings.Permission, "%v", err)
+		} else {
+			debug(ctx, 1, "error: %v: %v\n", dir, err)
+		}
+	}
+	var usage int64
+	layout := globalConfig.LayoutFor(dir)
+	for _, file := range files {
+		if !sc.onlyExt.include(file.Name) {
+			continue
+		}
+		if sc.ignores.Exclude(strings.TrimSuffix(dir, layout.Separator)+layout.Separator+file.Name, false) {
+			continue
+		}
+		file = sc.symlinks.attribute(ctx, dir, file)
+		usage += calculatorFor(layout, dir, file.Name).Calculate(file.Size)
+	}
+	return usage, children
+}
+
+// deleteDescendants removes the records for the supplied children of
+// prefix, and their descendants, that were stored by a previous run that
+// was not limited by --max-depth, since their usage is now included in
+// that of prefix.
+func deleteDescendants(ctx context.Context, separator, prefix string, children []filewalk.Info) error {
+	if len(children) == 0 {
+		return nil
+	}
+	parent := strings.TrimSuffix(prefix, separator) + separator
+	paths := make([]string, len(children))
+	for i, child := range children {
+		paths[i] = parent + child.Name
+	}
+	_, err := globalDatabaseManager.Delete(ctx, separator, prefix, paths)
+	return err
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// serveMetrics serves the metrics written by writeMetrics, it is registered
+// for /metrics only when --http is set.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// metricName returns a valid prometheus metric name for name.
+func metricName(name string) string {
+	return "idu_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func writeMetric(out io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(out, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, kind, name, value)
+}
+
+// writeMetrics writes the analyze progress counters recorded in
+// progressMap, the pause and concurrency gauges and a subset of the
+// runtime's memory statistics in the prometheus text format.
+func writeMetrics(out io.Writer) {
+	var progress []expvar.KeyValue
+	progressMap.Do(func(kv expvar.KeyValue) {
+		progress = append(progress, kv)
+	})
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Key < progress[j].Key
+	})
+	for _, kv := range progress {
+		writeMetric(out, metricName("progress_"+kv.Key+"_total"), "counter",
+			"the number of "+strings.Replace(kv.Key, "-", " ", -1)+" reported by analyze", kv.Value.String())
+	}
+	writeMetric(out, metricName("paused"), "gauge", "1 if analyze is paused", pausedVar.String())
+	writeMetric(out, metricName("concurrency"), "gauge", "the current concurrency limit of a ramped analyze", concurrencyVar.String())
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for _, m := range []struct {
+		name, kind, help string
+		value            uint64
+	}{
+		{"memstats_alloc_bytes", "gauge", "bytes of allocated heap objects", ms.Alloc},
+		{"memstats_sys_bytes", "gauge", "bytes of memory obtained from the OS", ms.Sys},
+		{"memstats_heap_inuse_bytes", "gauge", "bytes in in-use heap spans", ms.HeapInuse},
+		{"memstats_heap_objects", "gauge", "number of allocated heap objects", ms.HeapObjects},
+		{"memstats_gc_total", "counter", "number of completed GC cycles", uint64(ms.NumGC)},
+	} {
+		writeMetric(out, metricName(m.name), m.kind, m.help, m.value)
+	}
+	writeMetric(out, metricName("goroutines"), "gauge", "the number of goroutines", runtime.NumGoroutine())
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// deviceFilter identifies prefixes that are on a filesystem other than the
+// one containing the root of a scan, as per --one-file-system, and records
+// them so that they can be noted in the run log. A nil deviceFilter skips
+// nothing.
+type deviceFilter struct {
+	device  uint64
+	mu      sync.Mutex
+	skipped []string
+}
+
+func newDeviceFilter(ctx context.Context, fs filewalk.Filesystem, root string) (*deviceFilter, error) {
+	info, err := fs.Stat(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	dev, ok := deviceID(info)
+	if !ok {
+		return nil, fmt.Errorf("--one-file-system is not supported on this system")
+	}
+	return &deviceFilter{device: dev}, nil
+}
+
+// skip returns true if prefix is on a different filesystem to the root. The
+// prefix is assumed to be on the same filesystem if its device cannot be
+// determined.
+func (df *deviceFilter) skip(prefix string, info *filewalk.Info) bool {
+	if df == nil || info == nil {
+		return false
+	}
+	dev, ok := deviceID(*info)
+	if !ok || dev == df.device {
+		return false
+	}
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.skipped = append(df.skipped, prefix)
+	return true
+}
+
+// mounts returns the prefixes that were skipped in lexicographic order.
+func (df *deviceFilter) mounts() []string {
+	if df == nil {
+		return nil
+	}
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	skipped := append([]string{}, df.skipped...)
+	sort.Strings(skipped)
+	return skipped
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// deviceID returns the id of the device, ie. st_dev, that contains the
+// file or prefix described by info.
+func deviceID(info filewalk.Info) (uint64, bool) {
+	fi, ok := info.Sys().(os.FileInfo)
+	if !ok {
+		return 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true //nolint:unconvert
+}
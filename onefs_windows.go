@@ -0,0 +1,14 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package main
+
+import "cloudeng.io/file/filewalk"
+
+// deviceID is not supported on windows.
+func deviceID(info filewalk.Info) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cloudeng.io/path/cloudpath"
+)
+
+// isObjectStore returns true if the supplied path refers to an object
+// store rather than the local filesystem.
+func isObjectStore(path string) bool {
+	switch cloudpath.Scheme(path) {
+	case cloudpath.AWSS3, cloudpath.GoogleCloudStorage:
+		return true
+	}
+	return false
+}
+
+// createOutput creates the named local file for writing. Object store URLs
+// (eg. s3://bucket/object) are rejected since this module does not depend
+// on any object store client libraries.
+func createOutput(name string) (io.WriteCloser, error) {
+	if isObjectStore(name) {
+		return nil, fmt.Errorf("writing to object stores is not supported, use a local file and copy it: %v", name)
+	}
+	return os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+}
+
+// joinOutput joins a directory and a filename.
+func joinOutput(dir, name string) string {
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateOutput(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	name := joinOutput(tmpDir, "report.txt")
+	if got, want := name, filepath.Join(tmpDir, "report.txt"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, contents := range []string{"a longer first report\n", "second\n"} {
+		out, err := createOutput(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := out.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf), contents; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	for _, url := range []string{"s3://bucket/report.tsv", "gs://bucket/report.tsv"} {
+		if !isObjectStore(url) {
+			t.Errorf("%v: not recognised as an object store", url)
+		}
+		out, err := createOutput(url)
+		if err == nil || !strings.Contains(err.Error(), "object stores is not supported") {
+			t.Errorf("%v: missing or wrong error: %v", url, err)
+		}
+		if out != nil {
+			t.Errorf("%v: unexpected output", url)
+		}
+		if err := createReportsDirIfNeeded(url); err == nil {
+			t.Errorf("%v: expected an error", url)
+		}
+	}
+	if isObjectStore(tmpDir) {
+		t.Errorf("%v: recognised as an object store", tmpDir)
+	}
+}
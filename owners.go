@@ -0,0 +1,234 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// ownerCounts records the number of distinct users and groups that own
+// the files within a prefix and its descendants.
+type ownerCounts struct {
+	users, groups int64
+}
+
+// ownerSets records the distinct users and groups that own a set of files.
+type ownerSets struct {
+	uids, gids map[string]struct{}
+}
+
+func newOwnerSets() *ownerSets {
+	return &ownerSets{uids: map[string]struct{}{}, gids: map[string]struct{}{}}
+}
+
+func (o *ownerSets) add(files []filewalk.Info) {
+	for _, fi := range files {
+		o.uids[fi.UserID] = struct{}{}
+		o.gids[fi.GroupID] = struct{}{}
+	}
+}
+
+func (o *ownerSets) counts() ownerCounts {
+	return ownerCounts{users: int64(len(o.uids)), groups: int64(len(o.gids))}
+}
+
+// prefixAndAncestors calls fn for prefix and each of its ancestors up to,
+// and including, root.
+func prefixAndAncestors(root, prefix, sep string, fn func(string)) {
+	root = strings.TrimSuffix(root, sep)
+	for p := prefix; ; {
+		fn(p)
+		if strings.TrimSuffix(p, sep) == root || len(p) <= len(root) {
+			return
+		}
+		idx := strings.LastIndex(strings.TrimSuffix(p, sep), sep)
+		switch {
+		case idx < 0:
+			return
+		case idx == 0:
+			p = sep
+		default:
+			p = p[:idx]
+		}
+	}
+}
+
+// subtreeOwners scans root and returns the number of distinct users and
+// groups that own the files within each prefix, for which include returns
+// true, and its descendants.
+func subtreeOwners(ctx context.Context, db filewalk.Database, root, sep string, include func(string) bool) (map[string]ownerCounts, error) {
+	sets := map[string]*ownerSets{}
+	within := withinPrefix(root, sep)
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		if len(pi.Files) == 0 {
+			continue
+		}
+		prefixAndAncestors(root, prefix, sep, func(p string) {
+			if !include(p) {
+				return
+			}
+			o := sets[p]
+			if o == nil {
+				o = newOwnerSets()
+				sets[p] = o
+			}
+			o.add(pi.Files)
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]ownerCounts, len(sets))
+	for p, o := range sets {
+		counts[p] = o.counts()
+	}
+	return counts, nil
+}
+
+// topOwners returns the number of distinct owners of root and of each
+// of the prefixes in the supplied top-N listings, including those of
+// their descendants.
+func topOwners(ctx context.Context, db filewalk.Database, root string, listings ...[]filewalk.Metric) (map[string]ownerCounts, error) {
+	prefixes := map[string]bool{root: true}
+	for _, metrics := range listings {
+		for _, m := range metrics {
+			prefixes[m.Prefix] = true
+		}
+	}
+	return subtreeOwners(ctx, db, root, globalConfig.LayoutFor(root).Separator, func(p string) bool {
+		return prefixes[p]
+	})
+}
+
+// setOwners sets the number of distinct owners for each of the merged
+// stats that has them.
+func setOwners(merged []mergedStats, owners map[string]ownerCounts) {
+	for i, m := range merged {
+		if c, ok := owners[m.prefix]; ok {
+			merged[i].users, merged[i].groups = c.users, c.groups
+		}
+	}
+}
+
+// mergedOwners returns the number of distinct owners of each of the
+// merged stats for root.
+func mergedOwners(ctx context.Context, db filewalk.Database, root string, merged []mergedStats) (map[string]ownerCounts, error) {
+	prefixes := make([]filewalk.Metric, len(merged))
+	for i, m := range merged {
+		prefixes[i].Prefix = m.prefix
+	}
+	return topOwners(ctx, db, root, prefixes)
+}
+
+// ownerFields are the tsv fields that report the number of distinct owners.
+var ownerFields = []string{"distinct_users", "distinct_groups"}
+
+// includesOwnerFields returns true if fields includes any of ownerFields.
+func includesOwnerFields(fields []string) bool {
+	for _, f := range fields {
+		for _, o := range ownerFields {
+			if f == o {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownersKey combines the number of distinct users and groups so that
+// prefixes are ordered by users and then by groups.
+func ownersKey(users, groups int64) int64 {
+	return users<<32 | groups
+}
+
+// mostShared lists the prefixes, beneath and including root, whose files,
+// including those of their descendants, are owned by the most distinct
+// users, and then groups, and optionally writes them to a tsv file.
+func mostShared(ctx context.Context, out io.Writer, root string, topN int, tsvOut string) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	errs := errors.M{}
+	errs.Append(writeMostShared(ctx, out, db, root, topN, tsvOut))
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
+
+func writeMostShared(ctx context.Context, out io.Writer, db filewalk.Database, root string, topN int, tsvOut string) error {
+	sep := globalConfig.LayoutFor(root).Separator
+	owners, err := subtreeOwners(ctx, db, root, sep, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	// Scan again to rank the prefixes so that ties are broken using
+	// their files and modification times.
+	shared := newTopNRanker(globalFlags.TieBreak)
+	within := withinPrefix(root, sep)
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		if c, ok := owners[prefix]; ok {
+			shared.add(prefix, ownersKey(c.users, c.groups), pi)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	fmt.Fprintf(out, "Top %v prefixes by distinct owners\n", topN)
+	var merged []mergedStats
+	for _, m := range shared.TopN(topN) {
+		users, groups := m.Value>>32, m.Value&(1<<32-1)
+		name := globalUserManager.nameForPrefix(ctx, db, m.Prefix)
+		ifmt.Fprintf(out, "%10v users, %10v groups: %v (%v)\n", users, groups, m.Prefix, name)
+		var pi filewalk.PrefixInfo
+		if ok, err := db.Get(ctx, m.Prefix, &pi); err != nil || !ok {
+			continue
+		}
+		merged = append(merged, mergedStats{
+			prefix:    m.Prefix,
+			user:      name,
+			nBytes:    pi.DiskUsage,
+			nFiles:    int64(len(pi.Files)),
+			nChildren: int64(len(pi.Children)),
+			users:     users,
+			groups:    groups,
+		})
+	}
+	if len(tsvOut) == 0 {
+		return nil
+	}
+	tfile, err := createOutput(tsvOut)
+	if err != nil {
+		return err
+	}
+	errs := errors.M{}
+	errs.Append(writeTSVSummary(ctx, tfile, append(defaultTSVFields[:len(defaultTSVFields):len(defaultTSVFields)], ownerFields...), merged))
+	errs.Append(tfile.Close())
+	return errs.Err()
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestPrefixAndAncestors(t *testing.T) {
+	for _, tc := range []struct {
+		root, prefix string
+		want         []string
+	}{
+		{"/a", "/a", []string{"/a"}},
+		{"/a", "/a/b/c", []string{"/a/b/c", "/a/b", "/a"}},
+		{"/a/", "/a/b", []string{"/a/b", "/a"}},
+		{"/", "/a/b", []string{"/a/b", "/a", "/"}},
+	} {
+		var got []string
+		prefixAndAncestors(tc.root, tc.prefix, "/", func(p string) {
+			got = append(got, p)
+		})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: %v: got %v, want %v", tc.root, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestSubtreeOwners(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	files := func(owners ...string) []filewalk.Info {
+		var fi []filewalk.Info
+		for i := 0; i < len(owners); i += 2 {
+			fi = append(fi, filewalk.Info{Name: owners[i], UserID: owners[i], GroupID: owners[i+1]})
+		}
+		return fi
+	}
+	for prefix, fi := range map[string][]filewalk.Info{
+		"/a":     files("u1", "g1"),
+		"/a/b":   files("u2", "g1", "u3", "g2"),
+		"/a/b/c": files("u4", "g1"),
+		"/a/d":   files("u1", "g1"),
+		"/a/e":   nil,
+		"/ab":    files("u5", "g5"),
+	} {
+		if err := db.Set(ctx, prefix, &filewalk.PrefixInfo{Files: fi}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owners, err := subtreeOwners(ctx, db, "/a", "/", func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prefixes without files within them or their descendants, such as /a/e,
+	// and those outside of /a, such as /ab, are not included.
+	want := map[string]ownerCounts{
+		"/a":     {users: 4, groups: 2},
+		"/a/b":   {users: 3, groups: 2},
+		"/a/b/c": {users: 1, groups: 1},
+		"/a/d":   {users: 1, groups: 1},
+	}
+	if !reflect.DeepEqual(owners, want) {
+		t.Errorf("got %v, want %v", owners, want)
+	}
+	owners, err = subtreeOwners(ctx, db, "/a", "/", func(p string) bool { return p == "/a/b" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := owners, (map[string]ownerCounts{"/a/b": {users: 3, groups: 2}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+)
+
+// pauser allows a running scan to be paused and resumed. Scanning
+// goroutines call wait before starting any new work and will block
+// whilst the scan is paused; work already in progress is allowed to
+// complete and is written to the database as usual.
+type pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+var pausedVar = expvar.NewInt("cloudeng.io/idu.paused")
+
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+	pausedVar.Set(1)
+}
+
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	close(p.resumed)
+	pausedVar.Set(0)
+}
+
+func (p *pauser) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// wait blocks whilst paused, or until the context is canceled.
+func (p *pauser) wait(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.paused {
+		p.mu.Unlock()
+		return nil
+	}
+	ch := p.resumed
+	p.mu.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var globalPauser = &pauser{}
@@ -0,0 +1,40 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses the scan on receipt of SIGUSR1 and resumes it
+// on receipt of SIGUSR2.
+func handlePauseSignals(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case sig := <-sigCh:
+				switch sig {
+				case syscall.SIGUSR1:
+					fmt.Fprintf(os.Stderr, "\npausing, send SIGUSR2 to pid %v to resume\n", os.Getpid())
+					globalPauser.pause()
+				case syscall.SIGUSR2:
+					fmt.Fprintf(os.Stderr, "\nresuming\n")
+					globalPauser.resume()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
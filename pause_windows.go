@@ -0,0 +1,12 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package main
+
+import "context"
+
+// handlePauseSignals is a no-op on windows since it lacks SIGUSR1/SIGUSR2.
+func handlePauseSignals(ctx context.Context) {}
@@ -0,0 +1,94 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrefixArgs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	prefixFile := filepath.Join(tmpDir, "prefix")
+	if err := ioutil.WriteFile(prefixFile, []byte("  /a/b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(tmpDir, "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missingFile := filepath.Join(tmpDir, "missing")
+
+	for i, tc := range []struct {
+		file string
+		args []string
+		want []string
+		err  string
+	}{
+		{"", []string{"/a"}, []string{"/a"}, ""},
+		{"", []string{"/a", "/b"}, []string{"/a", "/b"}, ""},
+		{prefixFile, nil, []string{"/a/b"}, ""},
+		{prefixFile, []string{"/a"}, nil, "but not both: /a"},
+		{"", nil, nil, "no prefix specified"},
+		{emptyFile, nil, nil, "prefix file " + emptyFile + " is empty"},
+		{missingFile, nil, nil, "failed to read prefix file"},
+	} {
+		got, err := prefixArgs(PrefixFileFlags{PrefixFile: tc.file}, tc.args)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: missing or unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+
+	for i, tc := range []struct {
+		file   string
+		args   []string
+		prefix string
+		rest   []string
+		err    string
+	}{
+		{"", []string{"/a"}, "/a", []string{}, ""},
+		{"", []string{"/a", "u1", "u2"}, "/a", []string{"u1", "u2"}, ""},
+		{prefixFile, nil, "/a/b", nil, ""},
+		// All of the arguments are users or groups when the prefix is
+		// read from the prefix file.
+		{prefixFile, []string{"u1", "u2"}, "/a/b", []string{"u1", "u2"}, ""},
+		{"", nil, "", nil, "no prefix specified"},
+		{emptyFile, []string{"u1"}, "", nil, "prefix file " + emptyFile + " is empty"},
+		{missingFile, nil, "", nil, "failed to read prefix file"},
+	} {
+		prefix, rest, err := prefixAndArgs(PrefixFileFlags{PrefixFile: tc.file}, tc.args)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: missing or unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if prefix != tc.prefix || !reflect.DeepEqual(rest, tc.rest) {
+			t.Errorf("%v: got %v, %v, want %v, %v", i, prefix, rest, tc.prefix, tc.rest)
+		}
+	}
+}
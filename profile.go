@@ -0,0 +1,142 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// profileOutput returns the output for a report profile, stdout is used
+// if no output is configured.
+func profileOutput(name string) (io.WriteCloser, error) {
+	if len(name) == 0 {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return createOutput(name)
+}
+
+// reportOwners returns the ids and names of the users or groups that
+// a profile's report is to be grouped by, or a single, unnamed, entry
+// for global reports.
+func reportOwners(ctx context.Context, db filewalk.Database, groupBy string) (ids, names []string, opts []filewalk.MetricOption, err error) {
+	switch groupBy {
+	case "user":
+		ids, err = db.UserIDs(ctx)
+		for _, id := range ids {
+			names = append(names, globalUserManager.nameForUID(id))
+			opts = append(opts, filewalk.UserID(id))
+		}
+	case "group":
+		ids, err = db.GroupIDs(ctx)
+		for _, id := range ids {
+			names = append(names, globalUserManager.nameForGID(id))
+			opts = append(opts, filewalk.GroupID(id))
+		}
+	default:
+		ids, names, opts = []string{""}, []string{""}, []filewalk.MetricOption{filewalk.Global()}
+	}
+	return
+}
+
+// reportProfile generates the report described by profile for prefix.
+func reportProfile(ctx context.Context, profile config.ReportProfile, prefix string) error {
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	ids, names, opts, err := reportOwners(ctx, db, profile.GroupBy)
+	if err != nil {
+		return err
+	}
+	errs := errors.M{}
+	switch {
+	case profile.Format == "tsv":
+		errs.Append(tsvReportProfile(ctx, db, profile, prefix, names, opts))
+	case profile.GroupBy == "global":
+		errs.Append(textReportProfile(ctx, db, profile, profile.Output, prefix, "", "", opts[0]))
+	default:
+		dir := reportsDir(profile.Output)
+		if err := createReportsDirIfNeeded(dir); err != nil {
+			errs.Append(err)
+			break
+		}
+		for i := range ids {
+			output := ""
+			if len(dir) > 0 {
+				output = joinOutput(dir, names[i]+".txt")
+			}
+			errs.Append(textReportProfile(ctx, db, profile, output, prefix, ids[i], names[i], opts[i]))
+		}
+	}
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	return errs.Err()
+}
+
+func textReportProfile(ctx context.Context, db filewalk.Database, profile config.ReportProfile, output, prefix, id, name string, opt filewalk.MetricOption) error {
+	out, err := profileOutput(output)
+	if err != nil {
+		return err
+	}
+	nFiles, nChildren, nBytes, nErrors, topFiles, topChildren, topBytes, err := getAllStats(ctx, db, prefix, profile.TopN, opt)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if len(id) > 0 {
+		fmt.Fprintf(out, "\nSummary for %v (%v)\n", name, id)
+	}
+	printSummaryStats(ctx, out, nFiles, nChildren, nBytes, nErrors, profile.TopN, !profile.OmitOther, nil, topFiles, topChildren, topBytes)
+	return out.Close()
+}
+
+func tsvReportProfile(ctx context.Context, db filewalk.Database, profile config.ReportProfile, prefix string, names []string, opts []filewalk.MetricOption) error {
+	out, err := profileOutput(profile.Output)
+	if err != nil {
+		return err
+	}
+	errs := errors.M{}
+	wr := csv.NewWriter(out)
+	wr.Comma = '\t'
+	wr.Write(profile.Fields)
+	for i, opt := range opts {
+		nFiles, nChildren, nBytes, nErrors, topFiles, topChildren, topBytes, err := getAllStats(ctx, db, prefix, profile.TopN, opt)
+		if err != nil {
+			errs.Append(err)
+			continue
+		}
+		merged := mergeStats(ctx, db, prefix, nFiles, nChildren, nBytes, nErrors, profile.TopN, topFiles, topChildren, topBytes)
+		if includesOwnerFields(profile.Fields) {
+			owners, err := mergedOwners(ctx, db, prefix, merged)
+			if err != nil {
+				errs.Append(err)
+				continue
+			}
+			setOwners(merged, owners)
+		}
+		for _, m := range merged {
+			wr.Write(tsvFields(profile.Fields, names[i], m))
+		}
+	}
+	wr.Flush()
+	errs.Append(wr.Error())
+	errs.Append(out.Close())
+	return errs.Err()
+}
@@ -6,11 +6,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"cloudeng.io/cmd/idu/internal/otlp"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 )
@@ -22,22 +29,84 @@ type progressUpdate struct {
 	deletions   int
 	errors      int
 	reused      int
+	restats     int
+	// fileDeletions is the number of files that have been deleted
+	// since the prefix was last analyzed.
+	fileDeletions int
+	warnings      int
+	// changed is the number of files that changed while their prefix
+	// was being scanned.
+	changed int
+	// totaled is the number of prefixes beneath the --max-depth limit
+	// that were listed to total their usage but not recorded.
+	totaled int
 }
 
 type progressTracker struct {
+	out                                     io.Writer
 	ch                                      chan progressUpdate
 	numPrefixesStarted, numPrefixesFinished int64
 	numFiles, numReused                     int64
 	numDeletions, numErrors, lastFiles      int64
+	numRestats, numFileDeletions            int64
+	numWarnings, numChanged                 int64
+	numTotaled                              int64
 	interval                                time.Duration
 	start                                   time.Time
+	quiet                                   bool
+	asJSON                                  bool
+	ramp                                    *ramp
+	// estimatedPrefixes is the number of prefixes expected to be
+	// scanned, as recorded by the previous run, or zero if unknown.
+	estimatedPrefixes int64
 }
 
-func newProgressTracker(ctx context.Context, interval time.Duration) *progressTracker {
+// tooManyErrors returns true if max is greater than zero and at least max
+// errors have been encountered.
+func (pt *progressTracker) tooManyErrors(max int) bool {
+	return max > 0 && atomic.LoadInt64(&pt.numErrors) >= int64(max)
+}
+
+// eta returns the percentage of the estimated number of prefixes that
+// have been scanned and the estimated time remaining, based on the rate
+// at which prefixes have been scanned so far.
+func (pt *progressTracker) eta(finished int64, elapsed time.Duration) string {
+	estimated := atomic.LoadInt64(&pt.estimatedPrefixes)
+	if estimated <= 0 || finished <= 0 || elapsed <= 0 {
+		return "ETA unknown"
+	}
+	if finished >= estimated {
+		// More prefixes than were previously scanned.
+		return "100% ETA unknown"
+	}
+	rate := float64(finished) / elapsed.Seconds()
+	remaining := time.Duration(float64(estimated-finished) / rate * float64(time.Second))
+	pct := float64(finished) * 100 / float64(estimated)
+	return fmt.Sprintf("%.0f%% ETA %v", pct, remaining.Truncate(time.Second))
+}
+
+// endSpan records the progress made as attributes of span and ends it.
+func (pt *progressTracker) endSpan(span *otlp.Span, err error) {
+	span.SetAttributes(
+		otlp.Int("prefixes", atomic.LoadInt64(&pt.numPrefixesFinished)),
+		otlp.Int("files", atomic.LoadInt64(&pt.numFiles)),
+		otlp.Int("errors", atomic.LoadInt64(&pt.numErrors)),
+		otlp.Int("duration_ms", time.Since(pt.start).Milliseconds()),
+	)
+	span.SetError(err)
+	span.End()
+}
+
+// newProgressTracker returns a progressTracker that writes progress updates,
+// and its final summary, to out.
+func newProgressTracker(ctx context.Context, out io.Writer, interval time.Duration) *progressTracker {
 	pt := &progressTracker{
+		out:      out,
 		ch:       make(chan progressUpdate, 10),
 		interval: interval,
 		start:    time.Now(),
+		quiet:    globalFlags.NoProgress,
+		asJSON:   globalFlags.Progress == "json",
 	}
 	go pt.display(ctx)
 	return pt
@@ -55,18 +124,89 @@ func (pt *progressTracker) send(ctx context.Context, u progressUpdate) {
 }
 
 func (pt *progressTracker) summary() {
+	if pt.asJSON {
+		json.NewEncoder(pt.out).Encode(pt.current(0))
+		pt.writeProgressFile()
+		return
+	}
 	ifmt := message.NewPrinter(language.English)
-	ifmt.Printf("\n")
-	ifmt.Printf("        prefixes : % 15v\n", atomic.LoadInt64(&pt.numPrefixesFinished))
-	ifmt.Printf("           files : % 15v\n", atomic.LoadInt64(&pt.numFiles))
-	ifmt.Printf("prefix deletions : % 15v\n", atomic.LoadInt64(&pt.numDeletions))
-	ifmt.Printf("          reused : % 15v\n", atomic.LoadInt64(&pt.numReused))
-	ifmt.Printf("          errors : % 15v\n", atomic.LoadInt64(&pt.numErrors))
-	ifmt.Printf("        run time : % 15v\n", time.Since(pt.start))
+	ifmt.Fprintf(pt.out, "\n")
+	ifmt.Fprintf(pt.out, "        prefixes : % 15v\n", atomic.LoadInt64(&pt.numPrefixesFinished))
+	ifmt.Fprintf(pt.out, "           files : % 15v\n", atomic.LoadInt64(&pt.numFiles))
+	ifmt.Fprintf(pt.out, "prefix deletions : % 15v\n", atomic.LoadInt64(&pt.numDeletions))
+	ifmt.Fprintf(pt.out, "  file deletions : % 15v\n", atomic.LoadInt64(&pt.numFileDeletions))
+	ifmt.Fprintf(pt.out, "          reused : % 15v\n", atomic.LoadInt64(&pt.numReused))
+	if n := atomic.LoadInt64(&pt.numRestats); n > 0 {
+		ifmt.Fprintf(pt.out, "      re-statted : % 15v\n", n)
+	}
+	ifmt.Fprintf(pt.out, "          errors : % 15v\n", atomic.LoadInt64(&pt.numErrors))
+	ifmt.Fprintf(pt.out, "        warnings : % 15v\n", atomic.LoadInt64(&pt.numWarnings))
+	if n := atomic.LoadInt64(&pt.numChanged); n > 0 {
+		ifmt.Fprintf(pt.out, "changed mid-scan : % 15v\n", n)
+	}
+	if n := atomic.LoadInt64(&pt.numTotaled); n > 0 {
+		ifmt.Fprintf(pt.out, "         totaled : % 15v\n", n)
+	}
+	ifmt.Fprintf(pt.out, "        run time : % 15v\n", time.Since(pt.start))
+	pt.writeProgressFile()
+}
+
+func (pt *progressTracker) writeProgressFile() {
+	if filename := globalFlags.ProgressFile; len(filename) > 0 {
+		if err := writeProgressFile(filename, pt.current(0)); err != nil {
+			fmt.Fprintf(pt.out, "failed to write progress file: %v: %v\n", filename, err)
+		}
+	}
+}
+
+// progressSummary is a snapshot of the progress made so far.
+type progressSummary struct {
+	Time          time.Time     `json:"time"`
+	Started       int64         `json:"prefixes_started"`
+	Finished      int64         `json:"prefixes_finished"`
+	Files         int64         `json:"files"`
+	Reused        int64         `json:"reused"`
+	Restats       int64         `json:"restats"`
+	Deletions     int64         `json:"deletions"`
+	FileDeletions int64         `json:"file_deletions"`
+	Errors        int64         `json:"errors"`
+	Warnings      int64         `json:"warnings"`
+	Changed       int64         `json:"changed_during_scan"`
+	Totaled       int64         `json:"totaled"`
+	StatsPerSec   float64       `json:"stats_per_second"`
+	RunTime       time.Duration `json:"run_time"`
+	Concurrency   int64         `json:"concurrency,omitempty"`
+	Estimated     int64         `json:"estimated_prefixes,omitempty"`
+}
+
+func (pt *progressTracker) current(rate float64) progressSummary {
+	return progressSummary{
+		Time:          displayTime(time.Now()),
+		Started:       atomic.LoadInt64(&pt.numPrefixesStarted),
+		Finished:      atomic.LoadInt64(&pt.numPrefixesFinished),
+		Files:         atomic.LoadInt64(&pt.numFiles),
+		Reused:        atomic.LoadInt64(&pt.numReused),
+		Restats:       atomic.LoadInt64(&pt.numRestats),
+		Deletions:     atomic.LoadInt64(&pt.numDeletions),
+		FileDeletions: atomic.LoadInt64(&pt.numFileDeletions),
+		Errors:        atomic.LoadInt64(&pt.numErrors),
+		Warnings:      atomic.LoadInt64(&pt.numWarnings),
+		Changed:       atomic.LoadInt64(&pt.numChanged),
+		Totaled:       atomic.LoadInt64(&pt.numTotaled),
+		StatsPerSec:   rate,
+		RunTime:       time.Since(pt.start),
+		Concurrency:   pt.ramp.concurrency(),
+		Estimated:     atomic.LoadInt64(&pt.estimatedPrefixes),
+	}
 }
 
-func isInteractive() bool {
-	info, err := os.Stdout.Stat()
+// isInteractive returns true if out is a terminal.
+func isInteractive(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
 	if err != nil {
 		return false
 	}
@@ -75,16 +215,79 @@ func isInteractive() bool {
 
 var progressMap = expvar.NewMap("cloudeng.io/idu.progress")
 
+// progressFileContents is written to the file specified by --progress-file.
+// Vars contains every published expvar, including memstats.
+type progressFileContents struct {
+	Progress progressSummary            `json:"progress"`
+	Vars     map[string]json.RawMessage `json:"vars"`
+}
+
+// progressFileMu serializes writes to the --progress-file, which may be
+// written by both the final summary and the display goroutine.
+var progressFileMu sync.Mutex
+
+// writeProgressFile atomically writes the current progress, and all
+// published expvars, to filename so that they survive the process
+// being killed. A uniquely named temporary file in the same directory is
+// written and then renamed so that concurrent writers never rename one
+// another's partially written files.
+func writeProgressFile(filename string, cs progressSummary) error {
+	contents := progressFileContents{
+		Progress: cs,
+		Vars:     map[string]json.RawMessage{},
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		contents.Vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	buf, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	progressFileMu.Lock()
+	defer progressFileMu.Unlock()
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
 func (pt *progressTracker) display(ctx context.Context) {
 	ifmt := message.NewPrinter(language.English)
 	cr := "\r"
-	if !isInteractive() {
+	if !isInteractive(pt.out) {
 		pt.interval = time.Second * 30
 		cr = "\n"
 	}
-	lastReport := time.Now()
+	enc := json.NewEncoder(pt.out)
+	lastReport, lastWrite := time.Now(), time.Now()
+	progressFile := globalFlags.ProgressFile
+	writeProgress := func(cs progressSummary) {
+		if err := writeProgressFile(progressFile, cs); err != nil {
+			debug(ctx, 1, "failed to write progress file: %v: %v\n", progressFile, err)
+		}
+		lastWrite = time.Now()
+	}
+	// Make sure that the progress line is updated periodically even if
+	// no updates are received, eg. when the scan is paused.
+	ticker := time.NewTicker(pt.interval)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ticker.C:
 		case update := <-pt.ch:
 			atomic.AddInt64(&pt.numPrefixesStarted, int64(update.prefixStart))
 			atomic.AddInt64(&pt.numPrefixesFinished, int64(update.prefixDone))
@@ -92,6 +295,11 @@ func (pt *progressTracker) display(ctx context.Context) {
 			atomic.AddInt64(&pt.numDeletions, int64(update.deletions))
 			atomic.AddInt64(&pt.numReused, int64(update.reused))
 			atomic.AddInt64(&pt.numErrors, int64(update.errors))
+			atomic.AddInt64(&pt.numRestats, int64(update.restats))
+			atomic.AddInt64(&pt.numFileDeletions, int64(update.fileDeletions))
+			atomic.AddInt64(&pt.numWarnings, int64(update.warnings))
+			atomic.AddInt64(&pt.numChanged, int64(update.changed))
+			atomic.AddInt64(&pt.numTotaled, int64(update.totaled))
 
 			progressMap.Add("started", int64(update.prefixStart))
 			progressMap.Add("finished", int64(update.prefixDone))
@@ -99,25 +307,55 @@ func (pt *progressTracker) display(ctx context.Context) {
 			progressMap.Add("deletions", int64(update.deletions))
 			progressMap.Add("reused", int64(update.reused))
 			progressMap.Add("errors", int64(update.errors))
+			progressMap.Add("restats", int64(update.restats))
+			progressMap.Add("file-deletions", int64(update.fileDeletions))
+			progressMap.Add("warnings", int64(update.warnings))
+			progressMap.Add("changed", int64(update.changed))
+			progressMap.Add("totaled", int64(update.totaled))
 
 		case <-ctx.Done():
+			if len(progressFile) > 0 {
+				writeProgress(pt.current(0))
+			}
 			return
 		}
+		if len(progressFile) > 0 && time.Since(lastWrite) > globalFlags.ProgressFileInterval {
+			writeProgress(pt.current(0))
+		}
 		if since := time.Since(lastReport); since > pt.interval {
 			last := atomic.SwapInt64(&pt.lastFiles, atomic.LoadInt64(&pt.numFiles))
 			rate := float64(pt.numFiles-last) / since.Seconds()
-			started, finished := atomic.LoadInt64(&pt.numPrefixesStarted), atomic.LoadInt64(&pt.numPrefixesFinished)
-			ifmt.Printf("% 8v(%3v) prefixes, % 8v files, % 8v reused, % 6v errors, % 9.2f stats/second  % 8v, (%s)  %s",
-				finished,
-				started-finished,
-				atomic.LoadInt64(&pt.numFiles),
-				atomic.LoadInt64(&pt.numReused),
-				atomic.LoadInt64(&pt.numErrors),
+			cs := pt.current(rate)
+			globalProgressStream.publish(cs)
+			lastReport = time.Now()
+			if pt.quiet {
+				continue
+			}
+			if pt.asJSON {
+				if err := enc.Encode(cs); err != nil {
+					debug(ctx, 1, "failed to write progress: %v\n", err)
+				}
+				continue
+			}
+			paused := ""
+			if globalPauser.isPaused() {
+				paused = "(paused) "
+			}
+			if pt.ramp.ramping() {
+				paused += ifmt.Sprintf("(concurrency %v/%v) ", cs.Concurrency, pt.ramp.max)
+			}
+			ifmt.Fprintf(pt.out, "%s% 8v(%3v) prefixes, % 8v files, % 8v reused, % 6v errors, % 9.2f stats/second, %s  % 8v, (%s)  %s",
+				paused,
+				cs.Finished,
+				cs.Started-cs.Finished,
+				cs.Files,
+				cs.Reused,
+				cs.Errors,
 				rate,
-				time.Since(pt.start).Truncate(time.Second),
-				time.Now().Format("15:04:05"),
+				pt.eta(cs.Finished, cs.RunTime),
+				cs.RunTime.Truncate(time.Second),
+				cs.Time.Format("15:04:05"),
 				cr)
-			lastReport = time.Now()
 		}
 	}
 }
@@ -0,0 +1,165 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProgressSummary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &bytes.Buffer{}
+	defer func(noProgress bool) { globalFlags.NoProgress = noProgress }(globalFlags.NoProgress)
+	globalFlags.NoProgress = true
+	pt := newProgressTracker(ctx, out, time.Millisecond)
+	pt.send(ctx, progressUpdate{prefixStart: 2, prefixDone: 2, files: 1234, errors: 1})
+	pt.send(ctx, progressUpdate{files: 1, fileDeletions: 3})
+	for atomic.LoadInt64(&pt.numFileDeletions) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	pt.summary()
+	for _, want := range []string{
+		"        prefixes :               2\n",
+		"           files :           1,235\n",
+		"  file deletions :               3\n",
+		"          errors :               1\n",
+	} {
+		if got := out.String(); !strings.Contains(got, want) {
+			t.Errorf("%q does not contain %q", got, want)
+		}
+	}
+	if got := out.String(); strings.Contains(got, "re-statted") {
+		t.Errorf("%q unexpectedly contains re-statted", got)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	pt := &progressTracker{}
+	if got, want := pt.eta(10, time.Minute), "ETA unknown"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	pt.estimatedPrefixes = 100
+	for _, tc := range []struct {
+		finished int64
+		elapsed  time.Duration
+		want     string
+	}{
+		{0, time.Minute, "ETA unknown"},
+		{25, time.Minute, "25% ETA 3m0s"},
+		{50, 10 * time.Second, "50% ETA 10s"},
+		{120, time.Minute, "100% ETA unknown"},
+	} {
+		if got := pt.eta(tc.finished, tc.elapsed); got != tc.want {
+			t.Errorf("%v/%v: got %q, want %q", tc.finished, tc.elapsed, got, tc.want)
+		}
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &bytes.Buffer{}
+	defer func(noProgress bool, progress string) {
+		globalFlags.NoProgress, globalFlags.Progress = noProgress, progress
+	}(globalFlags.NoProgress, globalFlags.Progress)
+	globalFlags.NoProgress = true
+	globalFlags.Progress = "json"
+	pt := newProgressTracker(ctx, out, time.Millisecond)
+	pt.send(ctx, progressUpdate{prefixStart: 3, prefixDone: 3, files: 42})
+	for atomic.LoadInt64(&pt.numFiles) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	pt.summary()
+	var ps progressSummary
+	if err := json.Unmarshal(out.Bytes(), &ps); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if got, want := ps.Finished, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ps.Files, int64(42); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProgressFileConcurrentWrites(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "idu-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "progress.json")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- writeProgressFile(filename, progressSummary{Files: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents progressFileContents
+	if err := json.Unmarshal(buf, &contents); err != nil {
+		t.Fatalf("%v: %s", err, buf)
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Errorf("got %v, want %v: temporary files were left behind", got, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	progressMap.Add("files", 0)
+	progressMap.Add("file-deletions", 0)
+	out := &bytes.Buffer{}
+	writeMetrics(out)
+	for _, want := range []string{
+		"# TYPE idu_progress_files_total counter\nidu_progress_files_total ",
+		"# TYPE idu_progress_file_deletions_total counter\n",
+		"# TYPE idu_paused gauge\nidu_paused 0\n",
+		"# TYPE idu_memstats_alloc_bytes gauge\n",
+	} {
+		if got := out.String(); !strings.Contains(got, want) {
+			t.Errorf("%q does not contain %q", got, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rec.Body.String(), "# TYPE idu_paused gauge\n"; !strings.Contains(got, want) {
+		t.Errorf("%q does not contain %q", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxProgressStreamClients bounds the number of clients that may be
+// simultaneously connected to the progress stream.
+const maxProgressStreamClients = 16
+
+// progressStream publishes progress summaries to http clients as
+// server sent events.
+type progressStream struct {
+	sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+var globalProgressStream = &progressStream{
+	clients: map[chan []byte]struct{}{},
+}
+
+func init() {
+	http.Handle("/progress/stream", globalProgressStream)
+}
+
+func (ps *progressStream) register() (chan []byte, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+	if len(ps.clients) >= maxProgressStreamClients {
+		return nil, false
+	}
+	ch := make(chan []byte, 10)
+	ps.clients[ch] = struct{}{}
+	return ch, true
+}
+
+func (ps *progressStream) unregister(ch chan []byte) {
+	ps.Lock()
+	defer ps.Unlock()
+	delete(ps.clients, ch)
+}
+
+// publish sends the supplied summary to all connected clients, clients
+// that are not keeping up will miss updates rather than block the caller.
+func (ps *progressStream) publish(summary progressSummary) {
+	ps.Lock()
+	defer ps.Unlock()
+	if len(ps.clients) == 0 {
+		return
+	}
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+	for ch := range ps.clients {
+		select {
+		case ch <- buf:
+		default:
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (ps *progressStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, ok := ps.register()
+	if !ok {
+		http.Error(w, "too many progress stream clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer ps.unregister(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	for {
+		select {
+		case buf := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", buf); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
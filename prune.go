@@ -0,0 +1,268 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/lastseen"
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type pruneFlags struct {
+	MinAge  time.Duration `subcmd:"min-age,720h,'delete only prefixes that had not been seen by analyze for at least this long as of the most recent analyze run of the prefix or of one of its ancestors'"`
+	Missing bool          `subcmd:"missing,false,'delete the prefixes and files that no longer exist on the filesystem, as determined by stat-ing each one, instead of those that have not been seen recently'"`
+	DryRun  bool          `subcmd:"dry-run,false,'display the prefixes that would be deleted, and their total disk usage, without deleting them'"`
+}
+
+// withinPrefix returns a function that reports whether a prefix returned
+// by a scanner started at prefix lies within it, and whether the scan can
+// be stopped since all subsequent prefixes will lie outside of it.
+func withinPrefix(prefix, sep string) func(sp string) (within, done bool) {
+	parent := strings.TrimSuffix(prefix, sep) + sep
+	return func(sp string) (bool, bool) {
+		if sp != prefix && !strings.HasPrefix(sp, parent) {
+			return false, sp > parent
+		}
+		return true, false
+	}
+}
+
+// stalePrefixes returns the prefixes beneath prefix whose last seen time
+// is before cutoff, along with their total disk usage. Prefixes with no
+// last seen time, eg. those stored before last seen times were recorded,
+// are never considered stale.
+func stalePrefixes(ctx context.Context, db filewalk.Database, ls *lastseen.DB, prefix, sep string, cutoff time.Time) ([]string, int64, error) {
+	var stale []string
+	var size int64
+	within := withinPrefix(prefix, sep)
+	sc := db.NewScanner(prefix, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		sp, pi := sc.PrefixInfo()
+		if ok, done := within(sp); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		rec, ok, err := ls.Get(sp)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok || !rec.Seen.Before(cutoff) {
+			continue
+		}
+		debug(ctx, 2, "stale: %v: last seen %v\n", sp, rec.Seen)
+		stale = append(stale, sp)
+		size += pi.DiskUsage
+	}
+	return stale, size, sc.Err()
+}
+
+// missingFiles records the files stored for a prefix that still exists
+// which no longer exist; current is the prefix's information with them
+// removed.
+type missingFiles struct {
+	prefix            string
+	names             []string
+	existing, current filewalk.PrefixInfo
+}
+
+// missingPrefixes returns the prefixes beneath prefix that no longer exist
+// on the filesystem, the files that no longer exist within the prefixes
+// that do, and the total disk usage of both.
+func missingPrefixes(ctx context.Context, db filewalk.Database, fs filewalk.Filesystem, prefix, sep string) ([]string, []missingFiles, int64, error) {
+	var missing []string
+	var files []missingFiles
+	var size int64
+	within := withinPrefix(prefix, sep)
+	sc := db.NewScanner(prefix, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		sp, pi := sc.PrefixInfo()
+		if ok, done := within(sp); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		_, err := fs.Stat(ctx, sp)
+		if err == nil {
+			if mf, ok := missingFilesIn(ctx, fs, sp, pi); ok {
+				files = append(files, mf)
+				size += mf.existing.DiskUsage - mf.current.DiskUsage
+			}
+			continue
+		}
+		if !fs.IsNotExist(err) {
+			debug(ctx, 1, "stat error: %v: %v\n", sp, err)
+			continue
+		}
+		debug(ctx, 2, "missing: %v\n", sp)
+		missing = append(missing, sp)
+		size += pi.DiskUsage
+	}
+	return missing, files, size, sc.Err()
+}
+
+// missingFilesIn returns the files stored for prefix that no longer exist.
+func missingFilesIn(ctx context.Context, fs filewalk.Filesystem, prefix string, pi *filewalk.PrefixInfo) (missingFiles, bool) {
+	layout := globalConfig.LayoutFor(prefix)
+	mf := missingFiles{prefix: prefix, existing: *pi, current: *pi}
+	mf.current.Files = make([]filewalk.Info, 0, len(pi.Files))
+	mf.current.DiskUsage = 0
+	for _, file := range pi.Files {
+		_, err := fs.Stat(ctx, fs.Join(prefix, file.Name))
+		if err != nil && fs.IsNotExist(err) {
+			debug(ctx, 2, "missing: %v/%v\n", prefix, file.Name)
+			mf.names = append(mf.names, file.Name)
+			continue
+		}
+		mf.current.DiskUsage += calculatorFor(layout, prefix, file.Name).Calculate(file.Size)
+		mf.current.Files = append(mf.current.Files, file)
+	}
+	return mf, len(mf.names) > 0
+}
+
+// removeMissingFiles removes the files that no longer exist from the
+// database and returns the number removed.
+func removeMissingFiles(ctx context.Context, db filewalk.Database, files []missingFiles) (int, error) {
+	removed := 0
+	for i := range files {
+		mf := &files[i]
+		if _, err := removeStaleStats(ctx, globalConfig.LayoutFor(mf.prefix), mf.prefix, &mf.existing, &mf.current); err != nil {
+			return removed, err
+		}
+		if err := db.Set(ctx, mf.prefix, &mf.current); err != nil {
+			return removed, err
+		}
+		removed += len(mf.names)
+	}
+	return removed, nil
+}
+
+// pruneCutoff returns the time before which prefixes that have not been
+// seen are considered stale. It is measured from the most recent analyze
+// run of prefix, or of one of its ancestors, since runs of other subtrees
+// do not update the last seen times of the prefixes beneath prefix.
+func pruneCutoff(location, prefix, sep string, minAge time.Duration) (time.Time, error) {
+	entries, err := runlog.Read(location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Prefix == prefix || strings.HasPrefix(prefix, strings.TrimSuffix(e.Prefix, sep)+sep) {
+			// Measuring from the start of the run ensures that no
+			// prefix seen by that run is ever considered stale.
+			return e.Start.Add(-minAge), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no analyze runs have been recorded for %v", prefix)
+}
+
+// dbPrune deletes prefixes that have not been seen by analyze for at
+// least --min-age, or with --missing, those that no longer exist. The age
+// is measured relative to the most recent analyze run rather than the
+// current time so that a database that has not been analyzed recently is
+// not emptied.
+func dbPrune(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*pruneFlags)
+	if !flagValues.Missing && flagValues.MinAge <= 0 {
+		return fmt.Errorf("--min-age must be positive: %v", flagValues.MinAge)
+	}
+	prefix := args[0]
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", prefix)
+	}
+	if len(cfg.Location) == 0 {
+		return fmt.Errorf("database location is unknown: %v", cfg.Description)
+	}
+	var cutoff time.Time
+	if !flagValues.Missing {
+		var err error
+		if cutoff, err = pruneCutoff(cfg.Location, prefix, globalConfig.LayoutFor(prefix).Separator, flagValues.MinAge); err != nil {
+			return err
+		}
+	}
+	var opts []filewalk.DatabaseOption
+	if flagValues.DryRun {
+		opts = append(opts, filewalk.ReadOnly())
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, opts...)
+	if err != nil {
+		return err
+	}
+	ls, err := lastseen.Open(cfg.Location)
+	if err != nil {
+		globalDatabaseManager.CloseAll(ctx)
+		return err
+	}
+	var errs errors.M
+	var stale []string
+	var files []missingFiles
+	var size int64
+	sep := globalConfig.LayoutFor(prefix).Separator
+	if flagValues.Missing {
+		stale, files, size, err = missingPrefixes(ctx, db, filewalk.LocalFilesystem(1000), prefix, sep)
+	} else {
+		stale, size, err = stalePrefixes(ctx, db, ls, prefix, sep, cutoff)
+	}
+	errs.Append(err)
+	ifmt := message.NewPrinter(language.English)
+	deleted, removed := 0, 0
+	switch {
+	case err != nil || len(stale)+len(files) == 0:
+	case flagValues.DryRun:
+		sort.Strings(stale)
+		for _, sp := range stale {
+			ifmt.Printf("%v\n", sp)
+		}
+		for _, mf := range files {
+			for _, name := range mf.names {
+				ifmt.Printf("%v%v%v\n", strings.TrimSuffix(mf.prefix, sep), sep, name)
+			}
+			removed += len(mf.names)
+		}
+		deleted = len(stale)
+	default:
+		sort.Slice(stale, func(i, j int) bool {
+			return stale[i] > stale[j]
+		})
+		if len(stale) > 0 {
+			deleted, err = db.Delete(ctx, sep, stale, false)
+			errs.Append(err)
+			if err == nil {
+				for _, sp := range stale {
+					errs.Append(ls.Delete(sp))
+				}
+			}
+		}
+		if err == nil {
+			removed, err = removeMissingFiles(ctx, db, files)
+			errs.Append(err)
+		}
+	}
+	errs.Append(ls.Close())
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	action := "pruned"
+	if flagValues.DryRun {
+		action = "would prune"
+	}
+	if flagValues.Missing {
+		ifmt.Printf("%v %v prefixes and %v files, %v, that no longer exist\n", action, deleted, removed, fsize(size))
+	} else {
+		ifmt.Printf("%v %v prefixes, %v, not seen since %v\n", action, deleted, fsize(size), displayTime(cutoff).Format(time.RFC3339))
+	}
+	return errs.Err()
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/mounts"
+)
+
+// pseudoFilesystemExclusions returns exclusions for the pseudo filesystems,
+// eg. tmpfs or overlay, that are mounted beneath prefix. Filesystems mounted
+// on prefix itself, or any of its ancestors, are not excluded since doing so
+// would exclude the entire scan, eg. for / within a container.
+func pseudoFilesystemExclusions(ctx context.Context, out io.Writer, prefix string) []config.Exclusions {
+	all, err := mounts.List()
+	if err != nil {
+		fmt.Fprintf(out, "warning: pseudo filesystems will not be skipped: %v\n", err)
+		return nil
+	}
+	return mountExclusions(ctx, prefix, mounts.Filter(all, globalConfig.PseudoFilesystems))
+}
+
+// mountExclusions returns exclusions for those of the supplied mounts that
+// are beneath prefix.
+func mountExclusions(ctx context.Context, prefix string, mounted []mounts.Mount) []config.Exclusions {
+	root := strings.TrimSuffix(filepath.Clean(prefix), string(filepath.Separator)) + string(filepath.Separator)
+	var excl []config.Exclusions
+	seen := map[string]bool{}
+	for _, m := range mounted {
+		// The same mount point may appear more than once when filesystems
+		// are mounted over one another. A root of / is itself a mount point.
+		if !strings.HasPrefix(m.Point, root) || m.Point == root || seen[m.Point] {
+			continue
+		}
+		seen[m.Point] = true
+		debug(ctx, 1, "skipping %v filesystem mounted on %v\n", m.Type, m.Point)
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(m.Point) + "(" + regexp.QuoteMeta(string(filepath.Separator)) + "|$)")
+		excl = append(excl, config.Exclusions{Prefix: m.Point, Regexps: []*regexp.Regexp{re}})
+	}
+	return excl
+}
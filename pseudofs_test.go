@@ -0,0 +1,57 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/cmd/idu/internal/mounts"
+)
+
+func TestMountExclusions(t *testing.T) {
+	ctx := context.Background()
+	mounted := []mounts.Mount{
+		{Point: "/", Type: "overlay"},
+		{Point: "/proc", Type: "proc"},
+		{Point: "/data", Type: "tmpfs"},
+		{Point: "/data/tmp", Type: "tmpfs"},
+		{Point: "/data/tmp", Type: "tmpfs"},
+		{Point: "/database", Type: "tmpfs"},
+	}
+	for i, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		// Filesystems mounted on the prefix, or its ancestors, are not
+		// excluded.
+		{"/", []string{"/proc", "/data", "/data/tmp", "/database"}},
+		{"/data", []string{"/data/tmp"}},
+		{"/data/", []string{"/data/tmp"}},
+		{"/data/tmp", nil},
+		{"/data/tmp/x", nil},
+		{"/home", nil},
+	} {
+		var got []string
+		for _, excl := range mountExclusions(ctx, tc.prefix, mounted) {
+			got = append(got, excl.Prefix)
+			for _, path := range []string{excl.Prefix, excl.Prefix + "/a"} {
+				if !excl.Regexps[0].MatchString(path) {
+					t.Errorf("%v: %v: %v should be excluded", i, tc.prefix, path)
+				}
+			}
+			// Siblings that share a string prefix are not excluded.
+			if excl.Regexps[0].MatchString(excl.Prefix + "x") {
+				t.Errorf("%v: %v: %vx should not be excluded", i, tc.prefix, excl.Prefix)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.prefix, got, tc.want)
+		}
+	}
+}
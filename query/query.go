@@ -0,0 +1,194 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package query provides support for querying the statistics and
+// per-prefix information stored in an idu database independently of the
+// idu command line tool, eg. from within a long running service.
+//
+// A Querier may be used concurrently by multiple goroutines provided
+// that the database it wraps supports concurrent readers, as does
+// cloudeng.io/file/filewalk/localdb. Note however that TopN, and hence
+// Stats, consume the per-metric heaps maintained by the database and
+// consequently the top-N prefixes for a given metric and metric option
+// can be obtained only once per database handle; the database must be
+// closed and reopened to obtain them again. Walk reads the database
+// directly and may be called any number of times.
+package query
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+// Querier provides read-only access to the statistics and prefixes
+// stored in a database.
+type Querier struct {
+	db  filewalk.Database
+	sep string
+}
+
+// New returns a Querier for db, which should be opened with
+// filewalk.ReadOnly unless it is concurrently being written to by the
+// caller. separator is the separator used by the filesystem whose
+// prefixes are stored in db, eg. "/".
+func New(db filewalk.Database, separator string) *Querier {
+	return &Querier{db: db, sep: separator}
+}
+
+// Total returns the total value of the specified metric, eg.
+// filewalk.TotalDiskUsage, for the database or for the user or group
+// selected by opts.
+func (q *Querier) Total(ctx context.Context, metric filewalk.MetricName, opts ...filewalk.MetricOption) (int64, error) {
+	return q.db.Total(ctx, metric, opts...)
+}
+
+// TopN returns the n prefixes with the largest values for the specified
+// metric, for the database or for the user or group selected by opts.
+// Prefixes with the same value are returned in an unspecified order.
+func (q *Querier) TopN(ctx context.Context, metric filewalk.MetricName, n int, opts ...filewalk.MetricOption) ([]filewalk.Metric, error) {
+	return q.db.TopN(ctx, metric, n, opts...)
+}
+
+// UserIDs returns the ids of the users that own files in the database.
+func (q *Querier) UserIDs(ctx context.Context) ([]string, error) {
+	return q.db.UserIDs(ctx)
+}
+
+// GroupIDs returns the ids of the groups that own files in the database.
+func (q *Querier) GroupIDs(ctx context.Context) ([]string, error) {
+	return q.db.GroupIDs(ctx)
+}
+
+// Stats represents the totals and top-N prefixes for a database, or for
+// a user or group within it.
+type Stats struct {
+	Files, Prefixes, Bytes, Errors int64
+	TopFiles                       []filewalk.Metric // Top prefixes by file count.
+	TopPrefixes                    []filewalk.Metric // Top prefixes by the number of prefixes they contain.
+	TopBytes                       []filewalk.Metric // Top prefixes by disk usage.
+}
+
+// Stats returns the totals and top-n prefixes for the database, or for the
+// user or group selected by opts. Neither the totals nor the top-N
+// prefixes require scanning the database; both are served from the
+// per-metric statistics that the database maintains as prefixes are
+// written.
+func (q *Querier) Stats(ctx context.Context, n int, opts ...filewalk.MetricOption) (Stats, error) {
+	var st Stats
+	var err error
+	errs := errors.M{}
+	st.Files, err = q.db.Total(ctx, filewalk.TotalFileCount, opts...)
+	errs.Append(err)
+	st.Prefixes, err = q.db.Total(ctx, filewalk.TotalPrefixCount, opts...)
+	errs.Append(err)
+	st.Bytes, err = q.db.Total(ctx, filewalk.TotalDiskUsage, opts...)
+	errs.Append(err)
+	st.Errors, err = q.db.Total(ctx, filewalk.TotalErrorCount, opts...)
+	errs.Append(err)
+	st.TopFiles, err = q.db.TopN(ctx, filewalk.TotalFileCount, n, opts...)
+	errs.Append(err)
+	st.TopPrefixes, err = q.db.TopN(ctx, filewalk.TotalPrefixCount, n, opts...)
+	errs.Append(err)
+	st.TopBytes, err = q.db.TopN(ctx, filewalk.TotalDiskUsage, n, opts...)
+	errs.Append(err)
+	return st, errs.Err()
+}
+
+// PrefixStats represents the statistics for a single prefix as merged
+// from the totals and top-N lists returned by Stats.
+type PrefixStats struct {
+	Prefix                         string
+	Files, Prefixes, Bytes, Errors int64
+}
+
+// Merge merges the totals and top-N prefixes in st, as returned by Stats,
+// into a single entry per prefix, sorted by prefix. The entry for root
+// records the totals in st. A prefix may appear in only some of the top-N
+// lists and hence its missing values are read from the database so that
+// derived values, such as the average file size, are meaningful.
+func (q *Querier) Merge(ctx context.Context, root string, st Stats) []PrefixStats {
+	existing := map[string]PrefixStats{}
+	existing[root] = PrefixStats{
+		Prefix:   root,
+		Files:    st.Files,
+		Prefixes: st.Prefixes,
+		Bytes:    st.Bytes,
+		Errors:   st.Errors,
+	}
+	setv := func(m filewalk.Metric, set func(*PrefixStats, int64)) {
+		if m.Prefix == root {
+			// The entry for root records the totals.
+			return
+		}
+		e := existing[m.Prefix]
+		e.Prefix = m.Prefix
+		set(&e, m.Value)
+		existing[m.Prefix] = e
+	}
+	for _, m := range st.TopFiles {
+		setv(m, func(e *PrefixStats, v int64) { e.Files = v })
+	}
+	for _, m := range st.TopPrefixes {
+		setv(m, func(e *PrefixStats, v int64) { e.Prefixes = v })
+	}
+	for _, m := range st.TopBytes {
+		setv(m, func(e *PrefixStats, v int64) { e.Bytes = v })
+	}
+	merged := make([]PrefixStats, 0, len(existing))
+	for _, v := range existing {
+		if v.Prefix != root {
+			var pi filewalk.PrefixInfo
+			if ok, err := q.db.Get(ctx, v.Prefix, &pi); err == nil && ok {
+				if v.Files == 0 {
+					v.Files = int64(len(pi.Files))
+				}
+				if v.Bytes == 0 {
+					v.Bytes = pi.DiskUsage
+				}
+				if v.Prefixes == 0 {
+					v.Prefixes = int64(len(pi.Children))
+				}
+			}
+		}
+		merged = append(merged, v)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Prefix < merged[j].Prefix
+	})
+	return merged
+}
+
+// WalkFunc is called by Walk for every prefix visited. The PrefixInfo is
+// only valid for the duration of the call. Returning an error stops the
+// walk and that error is returned by Walk.
+type WalkFunc func(prefix string, pi *filewalk.PrefixInfo) error
+
+// Walk calls fn, in lexical order, for root and every one of its
+// descendants stored in the database. Prefixes are read from the database
+// in batches as the walk progresses so that memory usage is independent
+// of the size of the database.
+func (q *Querier) Walk(ctx context.Context, root string, fn WalkFunc) error {
+	parent := strings.TrimSuffix(root, q.sep) + q.sep
+	sc := q.db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if prefix != root && !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		if err := fn(prefix, pi); err != nil {
+			// Err is called so that the scanner can release any resources
+			// that it holds when a scan is stopped early.
+			sc.Err()
+			return err
+		}
+	}
+	return sc.Err()
+}
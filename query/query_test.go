@@ -0,0 +1,171 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package query_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"cloudeng.io/cmd/idu/query"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func createDB(ctx context.Context, t *testing.T, dir string) {
+	db, err := localdb.Open(ctx, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, prefix := range []string{"/a", "/a/b", "/a/b/c", "/ab", "/z"} {
+		pi := &filewalk.PrefixInfo{UserID: "u1", GroupID: "g1"}
+		for j := 0; j <= i; j++ {
+			pi.Files = append(pi.Files, filewalk.Info{Name: fmt.Sprintf("f%v", j), Size: 10, UserID: "u1", GroupID: "g1"})
+		}
+		pi.DiskUsage = int64(len(pi.Files)) * 10
+		if err := db.Set(ctx, prefix, pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuerier(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	createDB(ctx, t, tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, []filewalk.DatabaseOption{filewalk.ReadOnly()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	q := query.New(db, "/")
+
+	st, err := q.Stats(ctx, 2, filewalk.Global())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Files, int64(15); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := st.Bytes, int64(150); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(st.TopBytes), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := st.TopBytes[0].Prefix, "/z"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	users, err := q.UserIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := users, []string{"u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	n, err := q.Total(ctx, filewalk.TotalFileCount, filewalk.UserID("u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(15); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var walked []string
+	if err := q.Walk(ctx, "/a", func(prefix string, pi *filewalk.PrefixInfo) error {
+		walked = append(walked, prefix)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := walked, []string{"/a", "/a/b", "/a/b/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	stop := fmt.Errorf("stop")
+	walked = nil
+	if err := q.Walk(ctx, "/a", func(prefix string, pi *filewalk.PrefixInfo) error {
+		walked = append(walked, prefix)
+		return stop
+	}); err != stop {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+	if got, want := len(walked), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Walks that are stopped early release their scanner.
+	rs := &releaseScanner{Database: db}
+	rq := query.New(rs, "/")
+	if err := rq.Walk(ctx, "/a", func(prefix string, pi *filewalk.PrefixInfo) error {
+		return stop
+	}); err != stop {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+	if got, want := rs.errCalls, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type releaseScanner struct {
+	filewalk.Database
+	errCalls int
+}
+
+func (rs *releaseScanner) NewScanner(prefix string, limit int, opts ...filewalk.ScannerOption) filewalk.DatabaseScanner {
+	return &countingScanner{DatabaseScanner: rs.Database.NewScanner(prefix, limit, opts...), rs: rs}
+}
+
+type countingScanner struct {
+	filewalk.DatabaseScanner
+	rs *releaseScanner
+}
+
+func (cs *countingScanner) Err() error {
+	cs.rs.errCalls++
+	return cs.DatabaseScanner.Err()
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	createDB(ctx, t, tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, []filewalk.DatabaseOption{filewalk.ReadOnly()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	q := query.New(db, "/")
+	st := query.Stats{
+		Files: 15, Prefixes: 5, Bytes: 150, Errors: 1,
+		TopFiles: []filewalk.Metric{{Prefix: "/z", Value: 5}, {Prefix: "/ab", Value: 4}},
+		TopBytes: []filewalk.Metric{{Prefix: "/z", Value: 50}, {Prefix: "/", Value: 150}},
+	}
+	merged := q.Merge(ctx, "/", st)
+	want := []query.PrefixStats{
+		{Prefix: "/", Files: 15, Prefixes: 5, Bytes: 150, Errors: 1},
+		// The disk usage of /ab is read from the database.
+		{Prefix: "/ab", Files: 4, Bytes: 40},
+		{Prefix: "/z", Files: 5, Bytes: 50},
+	}
+	if got := merged; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// rampInterval is the interval at which the concurrency of a ramp is
+// increased.
+const rampInterval = 100 * time.Millisecond
+
+var concurrencyVar = expvar.NewInt("cloudeng.io/idu.concurrency")
+
+// ramp gradually increases the number of concurrent filesystem operations
+// from one to max over the specified duration to avoid overwhelming cold
+// caches, eg. on NFS servers or spinning disks, at the start of a scan.
+type ramp struct {
+	tokens   chan struct{}
+	max      int64
+	current  int64
+	duration time.Duration
+	shape    string
+}
+
+// newRamp returns a ramp that increases to max over duration, following
+// the specified shape, either linear or exponential. A max of zero or less
+// implies the walker's default concurrency of GOMAXPROCS.
+func newRamp(ctx context.Context, max int, duration time.Duration, shape string) *ramp {
+	if max <= 0 {
+		max = runtime.GOMAXPROCS(-1)
+	}
+	r := &ramp{
+		tokens:   make(chan struct{}, max),
+		max:      int64(max),
+		duration: duration,
+		shape:    shape,
+	}
+	r.grow(1)
+	go r.run(ctx)
+	return r
+}
+
+// target returns the concurrency to be allowed once elapsed has passed.
+func (r *ramp) target(elapsed time.Duration) int64 {
+	frac := float64(elapsed) / float64(r.duration)
+	if frac >= 1 {
+		return r.max
+	}
+	var n float64
+	switch r.shape {
+	case "exponential":
+		n = math.Pow(float64(r.max), frac)
+	default:
+		n = 1 + float64(r.max-1)*frac
+	}
+	if t := int64(n); t > 1 {
+		return t
+	}
+	return 1
+}
+
+// grow adds tokens until n operations may run concurrently, it must only
+// be called by a single goroutine.
+func (r *ramp) grow(n int64) {
+	current := atomic.LoadInt64(&r.current)
+	for ; current < n; current++ {
+		r.tokens <- struct{}{}
+	}
+	atomic.StoreInt64(&r.current, current)
+	concurrencyVar.Set(current)
+}
+
+func (r *ramp) run(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(rampInterval)
+	defer ticker.Stop()
+	for r.concurrency() < r.max {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.grow(r.target(time.Since(start)))
+	}
+}
+
+// concurrency returns the current effective concurrency and is nil-safe.
+func (r *ramp) concurrency() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.current)
+}
+
+// ramping returns true if the ramp has yet to reach its maximum.
+func (r *ramp) ramping() bool {
+	return r != nil && r.concurrency() < r.max
+}
+
+func (r *ramp) acquire(ctx context.Context) error {
+	select {
+	case <-r.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *ramp) release() {
+	r.tokens <- struct{}{}
+}
+
+// rampedFilesystem limits the concurrency of the Stat and List operations
+// performed by the walker according to a ramp.
+type rampedFilesystem struct {
+	filewalk.Filesystem
+	ramp *ramp
+}
+
+func (fs *rampedFilesystem) Stat(ctx context.Context, path string) (filewalk.Info, error) {
+	if err := fs.ramp.acquire(ctx); err != nil {
+		return filewalk.Info{}, err
+	}
+	defer fs.ramp.release()
+	return fs.Filesystem.Stat(ctx, path)
+}
+
+func (fs *rampedFilesystem) List(ctx context.Context, path string, ch chan<- filewalk.Contents) {
+	if err := fs.ramp.acquire(ctx); err != nil {
+		ch <- filewalk.Contents{Path: path, Err: err}
+		return
+	}
+	defer fs.ramp.release()
+	fs.Filesystem.List(ctx, path, ch)
+}
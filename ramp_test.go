@@ -0,0 +1,84 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRampTarget(t *testing.T) {
+	for i, tc := range []struct {
+		shape   string
+		max     int64
+		elapsed time.Duration
+		want    int64
+	}{
+		{"linear", 9, 0, 1},
+		{"linear", 9, 250 * time.Millisecond, 3},
+		{"linear", 9, 500 * time.Millisecond, 5},
+		{"linear", 9, time.Second, 9},
+		{"linear", 9, time.Hour, 9},
+		{"linear", 1, 500 * time.Millisecond, 1},
+		{"", 9, 500 * time.Millisecond, 5},
+		{"exponential", 16, 0, 1},
+		{"exponential", 16, 250 * time.Millisecond, 2},
+		{"exponential", 16, 500 * time.Millisecond, 4},
+		{"exponential", 16, 750 * time.Millisecond, 8},
+		{"exponential", 16, time.Second, 16},
+		{"exponential", 16, 2 * time.Second, 16},
+	} {
+		r := &ramp{max: tc.max, duration: time.Second, shape: tc.shape}
+		if got, want := r.target(tc.elapsed), tc.want; got != want {
+			t.Errorf("%v: %v: %v: got %v, want %v", i, tc.shape, tc.elapsed, got, want)
+		}
+	}
+}
+
+func TestRampConcurrency(t *testing.T) {
+	var nilRamp *ramp
+	if nilRamp.concurrency() != 0 || nilRamp.ramping() {
+		t.Errorf("a nil ramp should have no concurrency")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &ramp{tokens: make(chan struct{}, 3), max: 3, duration: time.Second}
+	r.grow(1)
+	if got, want := r.concurrency(), int64(1); got != want || !r.ramping() {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := r.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// No more operations may be started until the ramp grows or the
+	// operation in progress completes.
+	acquired := make(chan error, 1)
+	go func() { acquired <- r.acquire(ctx) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("unexpected acquisition: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.release()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	// Growing never reduces the concurrency.
+	r.grow(3)
+	r.grow(2)
+	if got, want := r.concurrency(), int64(3); got != want || r.ramping() {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if err := r.acquire(ctx); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+// localDBLockFilename is the lock file used by cloudeng.io/file/filewalk/localdb.
+const localDBLockFilename = "db.lock"
+
+// snapshotInfoFilename is the file, within a snapshot, that describes it.
+const snapshotInfoFilename = "snapshot.json"
+
+type snapshotFlags struct {
+	Out string `subcmd:"out,,the directory to write the snapshot to; it must not already exist"`
+}
+
+// snapshotInfo describes a snapshot.
+type snapshotInfo struct {
+	Prefix  string    `json:"prefix"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+	Files   []string  `json:"files"`
+}
+
+func copyFile(to, from string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// dbSnapshot creates a point-in-time copy of the database for a prefix.
+// The database is opened read-only for the duration of the copy, which
+// waits for, and then excludes, any writers.
+func dbSnapshot(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*snapshotFlags)
+	if len(flagValues.Out) == 0 {
+		return fmt.Errorf("--out must be specified")
+	}
+	dbCfg, ok := globalConfig.DatabaseFor(args[0])
+	if !ok {
+		return fmt.Errorf("no database found for %v", args[0])
+	}
+	if len(dbCfg.Location) == 0 {
+		return fmt.Errorf("snapshots are not supported for: %v", dbCfg.Description)
+	}
+	if _, err := os.Stat(flagValues.Out); err == nil {
+		return fmt.Errorf("%v already exists", flagValues.Out)
+	}
+	if _, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ReadOnly()); err != nil {
+		return err
+	}
+	errs := errors.M{}
+	errs.Append(writeSnapshot(flagValues.Out, dbCfg.Prefix, dbCfg.Description, dbCfg.Location))
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("snapshot of %v written to %v\n", dbCfg.Description, flagValues.Out)
+	return nil
+}
+
+func writeSnapshot(out, prefix, description, location string) error {
+	entries, err := ioutil.ReadDir(location)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return err
+	}
+	info := snapshotInfo{
+		Prefix:  prefix,
+		Source:  description,
+		Created: time.Now(),
+	}
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir(), entry.Name() == localDBLockFilename, entry.Name() == localDBLockInfoFilename:
+			continue
+		}
+		if err := copyFile(filepath.Join(out, entry.Name()), filepath.Join(location, entry.Name())); err != nil {
+			return err
+		}
+		info.Files = append(info.Files, entry.Name())
+	}
+	// Readers require the lock file to exist.
+	if err := ioutil.WriteFile(filepath.Join(out, localDBLockFilename), nil, 0600); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(out, snapshotInfoFilename), buf, 0600)
+}
+
+// useSnapshot configures the database for the prefix that the snapshot
+// in dir was created for to use that snapshot.
+func useSnapshot(dir string) error {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, snapshotInfoFilename))
+	if err != nil {
+		return fmt.Errorf("%v does not appear to be a snapshot: %v", dir, err)
+	}
+	var info snapshotInfo
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return fmt.Errorf("failed to parse %v: %v", filepath.Join(dir, snapshotInfoFilename), err)
+	}
+	return globalConfig.UseSnapshot(info.Prefix, dir)
+}
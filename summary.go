@@ -7,13 +7,17 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/cmd/idu/query"
+	"cloudeng.io/cmdutil/flags"
 	"cloudeng.io/errors"
 	"cloudeng.io/file/filewalk"
 	"golang.org/x/text/language"
@@ -21,36 +25,131 @@ import (
 )
 
 type summaryFlags struct {
-	TopN    int    `subcmd:"top,20,show the top prefixes by file count and disk usage"`
-	TSVTopN int    `subcmd:"tsv-top,200,'include the top prefixes by file count and disk usage in the tsv output, if any'"`
-	TSVOut  string `subcmd:"tsv,,write a tsv file with the summary information"`
+	PrefixFileFlags
+	TopN          int             `subcmd:"top,20,show the top prefixes by file count and disk usage"`
+	TSVTopN       int             `subcmd:"tsv-top,200,'include the top prefixes by file count and disk usage in the tsv output, if any'"`
+	TSVOut        string          `subcmd:"tsv,,'write a tsv file with the summary information'"`
+	Profile       string          `subcmd:"profile,,'generate the named report profile from the config file, other flags are ignored'"`
+	Under         string          `subcmd:"under,,'restrict the totals and top prefixes to the specified subpath of the prefix being summarized'"`
+	Other         bool            `subcmd:"other,true,'include an (other) row, in both the text and tsv output, for the usage of all of the prefixes not in the top prefixes so that the listings sum to the totals'"`
+	Growth        bool            `subcmd:"growth-rate,false,'show the growth rate, in bytes per day, of the top prefixes by disk usage between the two most recent analyze runs'"`
+	XAttrs        bool            `subcmd:"xattrs,false,'show the total size of the extended attributes of files and the top prefixes by extended attribute usage, as recorded by analyze for layouts with xattrs enabled'"`
+	AsOf          string          `subcmd:"as-of,,'show the totals and top prefixes by disk usage recorded by the most recent analyze run at or before the specified time, in RFC3339 or YYYY-MM-DD format, rather than the current contents of the database'"`
+	MostShared    bool            `subcmd:"most-shared,false,'list the prefixes whose files, including those of their descendants, are owned by the most distinct users, and then groups, as an indication of those that are shared and that could perhaps be split per-user'"`
+	Owners        bool            `subcmd:"owners,false,'show the number of distinct users and groups that own the files within each of the top prefixes and their descendants, and include them in the tsv output, if any, as the distinct_users and distinct_groups fields; this requires scanning the prefix in the database'"`
+	SizeHistogram bool            `subcmd:"size-histogram,false,'show the number and total size of files in each of the size ranges delimited by --size-buckets, the histogram rather than the summary is written to the --tsv file, if any'"`
+	SizeBuckets   string          `subcmd:"size-buckets,'1KB,1MB,1GB','comma separated, increasing, boundaries of the ranges used by --size-histogram, sizes may use decimal (KB, MB, ...) or binary (KiB, MiB, ...) units'"`
+	AgeHistogram  bool            `subcmd:"age-histogram,false,'show the number and total size of files whose modification times fall within each of the age ranges delimited by --age-bucket, the histogram rather than the summary is written to the --tsv file, if any'"`
+	AgeBuckets    flags.Repeating `subcmd:"age-bucket,,'an increasing boundary of the ranges used by --age-histogram, as a duration or number of days (d), weeks (w) or years (y), eg. 36h or 7d, may be repeated; defaults to 1d, 7d, 30d and 1y'"`
+	Cost          bool            `subcmd:"cost,false,'show the estimated monthly cost of storing the files in cloud storage, by storage tier, as determined from their sizes and modification times by the cloud layouts configured for them, the estimate rather than the summary is written to the --tsv file, if any'"`
+	ByExtension   bool            `subcmd:"by-extension,false,'show the number and total size of files grouped by filename extension, ie. everything after the last dot, for the top extensions by total size'"`
+	JSON          bool            `subcmd:"json,false,'write the totals and top prefixes, or with --by-extension the usage of every extension, as a single JSON object rather than text'"`
+	NoCache       bool            `subcmd:"no-cache,false,'recompute the totals and top prefixes rather than reusing those cached by a previous summary of the same, unchanged, database'"`
+	Compact       bool            `subcmd:"compact,false,'print a single tab separated line, path bytes files dirs, for the prefix being summarized and each of its top prefixes rather than the totals and top prefix listings'"`
+
+	Tenants     string `subcmd:"tenants,,'report the usage of each immediate child of the specified prefix, eg. /home, as a separate tenant and flag those that are over quota'"`
+	TenantQuota int64  `subcmd:"tenant-quota,0,'the default quota, in bytes, for each tenant, overrides that in the tenants section of the config file'"`
+	TenantSort  string `subcmd:"tenant-sort,bytes,'sort tenants by bytes, files, quota (the fraction of their quota used) or name'"`
 }
 
 type userFlags struct {
-	TopN       int    `subcmd:"top,20,show the top prefixes by file count and disk usage"`
-	ListUsers  bool   `subcmd:"list-users,false,list available users"`
-	AllUsers   bool   `subcmd:"all-users,false,summarize usage for all users"`
-	WriteFiles string `subcmd:"reports-dir,,write per-user statistics to the specified directory"`
+	PrefixFileFlags
+	TopN        int    `subcmd:"top,20,show the top prefixes by file count and disk usage"`
+	ListUsers   bool   `subcmd:"list-users,false,list available users"`
+	AllUsers    bool   `subcmd:"all-users,false,summarize usage for all users"`
+	DefaultUser string `subcmd:"default-user,,'the user to summarize when no users are specified on the command line, defaults to the USER environment variable'"`
+	Force       bool   `subcmd:"force,false,'regenerate reports that are newer than the most recent analyze run, such reports are otherwise skipped'"`
+	WriteFiles  string `subcmd:"reports-dir,,'write per-user statistics to the specified directory, defaults to reports_dir from the config file'"`
+	UsageThresholdFlags
+	OtherFlags
 }
 
 type groupFlags struct {
+	PrefixFileFlags
 	TopN       int    `subcmd:"top,20,show the top prefixes by file count and disk usage"`
 	ListGroups bool   `subcmd:"list-groups,false,list available groups"`
 	AllGroups  bool   `subcmd:"all-groups,false,summarize usage for all groups"`
-	WriteFiles string `subcmd:"reports-dir,,write per-group statistics to the specified directory"`
+	Force      bool   `subcmd:"force,false,'regenerate reports that are newer than the most recent analyze run, such reports are otherwise skipped'"`
+	WriteFiles string `subcmd:"reports-dir,,'write per-group statistics to the specified directory, defaults to reports_dir from the config file'"`
+	UsageThresholdFlags
+	OtherFlags
+}
+
+// OtherFlags control whether each top-N listing is followed by an (other)
+// row.
+type OtherFlags struct {
+	Other bool `subcmd:"other,true,'include an (other) row in each top-N listing for the usage of all of the prefixes not included in it so that the listing sums to the total'"`
+}
+
+// UsageThresholdFlags are used to restrict reports to those users or groups
+// whose usage meets the specified thresholds.
+type UsageThresholdFlags struct {
+	MinBytes int64 `subcmd:"min-bytes,0,'only report on users or groups whose disk usage is at least this many bytes'"`
+	MinFiles int64 `subcmd:"min-files,0,'only report on users or groups that own at least this many files'"`
+}
+
+// belowThreshold returns true if the totals for the user or group selected
+// by opt do not meet the thresholds. Only the totals are read so that the
+// top-N statistics are not needlessly computed for those that are skipped.
+func belowThreshold(ctx context.Context, db filewalk.Database, thresholds UsageThresholdFlags, opt filewalk.MetricOption) (bool, error) {
+	if thresholds.MinBytes > 0 {
+		n, err := db.Total(ctx, filewalk.TotalDiskUsage, opt)
+		if err != nil || n < thresholds.MinBytes {
+			return true, err
+		}
+	}
+	if thresholds.MinFiles > 0 {
+		n, err := db.Total(ctx, filewalk.TotalFileCount, opt)
+		if err != nil || n < thresholds.MinFiles {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// otherMetric is the name used for the row that accounts for the usage
+// of all of the prefixes not in a top-N listing.
+const otherMetric = "(other)"
+
+// residual returns the portion of total not accounted for by metrics.
+func residual(total int64, metrics []filewalk.Metric) int64 {
+	for _, m := range metrics {
+		total -= m.Value
+	}
+	return total
 }
 
-func printSummaryStats(ctx context.Context, out io.Writer, nFiles, nChildren, nBytes, nErrors int64, topN int, topFiles, topChildren, topBytes []filewalk.Metric) {
+// printSummaryStats prints the totals and top-N prefixes. If other is
+// true, each top-N listing is followed by an (other) row for the usage of
+// the prefixes not included in it, so that the listing sums to the total.
+// The number of distinct owners of each prefix is shown if owners is not
+// nil.
+func printSummaryStats(ctx context.Context, out io.Writer, nFiles, nChildren, nBytes, nErrors int64, topN int, other bool, owners map[string]ownerCounts, topFiles, topChildren, topBytes []filewalk.Metric) {
 	ifmt := message.NewPrinter(language.English)
 
-	printMetric := func(metric []filewalk.Metric, bytes bool) {
+	printMetric := func(metric []filewalk.Metric, bytes bool, total int64) {
+		defer func() {
+			if r := residual(total, metric); other && r > 0 {
+				if bytes {
+					ifmt.Fprintf(out, "%20v: %v\n", fsize(r), otherMetric)
+				} else {
+					ifmt.Fprintf(out, "%20v: %v\n", r, otherMetric)
+				}
+			}
+		}()
 		for _, m := range metric {
 			db, _ := globalDatabaseManager.DatabaseFor(ctx, m.Prefix, filewalk.ReadOnly())
 			name := globalUserManager.nameForPrefix(ctx, db, m.Prefix)
+			avg := fsize(prefixAverageFileSize(ctx, db, m.Prefix))
+			shared := ""
+			if owners != nil {
+				c := owners[m.Prefix]
+				shared = ifmt.Sprintf(", owners: %v users, %v groups", c.users, c.groups)
+			}
 			if bytes {
-				ifmt.Fprintf(out, "%20v: %v (%v)\n", fsize(m.Value), m.Prefix, name)
+				ifmt.Fprintf(out, "%20v: %v (%v, avg file size: %v%v)\n", fsize(m.Value), m.Prefix, name, avg, shared)
 			} else {
-				ifmt.Fprintf(out, "%20v: %v (%v)\n", m.Value, m.Prefix, name)
+				ifmt.Fprintf(out, "%20v: %v (%v, avg file size: %v%v)\n", m.Value, m.Prefix, name, avg, shared)
 			}
 		}
 	}
@@ -60,13 +159,93 @@ func printSummaryStats(ctx context.Context, out io.Writer, nFiles, nChildren, nB
 	ifmt.Fprintf(out, "% 20v : total errors\n", nErrors)
 
 	fmt.Fprintf(out, "Top %v prefixes by disk usage\n", topN)
-	printMetric(topBytes, true)
+	printMetric(topBytes, true, nBytes)
 
 	fmt.Fprintf(out, "Top %v prefixes by file count\n", topN)
-	printMetric(topFiles, false)
+	printMetric(topFiles, false, nFiles)
 
 	fmt.Fprintf(out, "Top %v prefixes by child count\n", topN)
-	printMetric(topChildren, false)
+	printMetric(topChildren, false, nChildren)
+}
+
+// topPrefix is the JSON representation of a single row of a top-N listing.
+type topPrefix struct {
+	Prefix         string `json:"prefix"`
+	User           string `json:"user,omitempty"`
+	Value          int64  `json:"value"`
+	AvgFileSize    int64  `json:"avg_file_size"`
+	DistinctUsers  *int64 `json:"distinct_users,omitempty"`
+	DistinctGroups *int64 `json:"distinct_groups,omitempty"`
+}
+
+// prefixSummary is the JSON representation of summary --json.
+type prefixSummary struct {
+	Prefix      string      `json:"prefix"`
+	Bytes       int64       `json:"bytes"`
+	Files       int64       `json:"files"`
+	Children    int64       `json:"children"`
+	Errors      int64       `json:"errors"`
+	TopBytes    []topPrefix `json:"top_bytes"`
+	TopFiles    []topPrefix `json:"top_files"`
+	TopChildren []topPrefix `json:"top_children"`
+}
+
+// writeSummaryJSON writes the same totals and top-N prefixes as
+// printSummaryStats as a single JSON object.
+func writeSummaryJSON(ctx context.Context, out io.Writer, root string, nFiles, nChildren, nBytes, nErrors int64, other bool, owners map[string]ownerCounts, topFiles, topChildren, topBytes []filewalk.Metric) error {
+	listing := func(metrics []filewalk.Metric, total int64) []topPrefix {
+		rows := make([]topPrefix, 0, len(metrics)+1)
+		for _, m := range metrics {
+			db, _ := globalDatabaseManager.DatabaseFor(ctx, m.Prefix, filewalk.ReadOnly())
+			row := topPrefix{
+				Prefix:      m.Prefix,
+				User:        globalUserManager.nameForPrefix(ctx, db, m.Prefix),
+				Value:       m.Value,
+				AvgFileSize: prefixAverageFileSize(ctx, db, m.Prefix),
+			}
+			if owners != nil {
+				c := owners[m.Prefix]
+				row.DistinctUsers, row.DistinctGroups = &c.users, &c.groups
+			}
+			rows = append(rows, row)
+		}
+		if r := residual(total, metrics); other && r > 0 {
+			rows = append(rows, topPrefix{Prefix: otherMetric, Value: r})
+		}
+		return rows
+	}
+	return json.NewEncoder(out).Encode(prefixSummary{
+		Prefix:      root,
+		Bytes:       nBytes,
+		Files:       nFiles,
+		Children:    nChildren,
+		Errors:      nErrors,
+		TopBytes:    listing(topBytes, nBytes),
+		TopFiles:    listing(topFiles, nFiles),
+		TopChildren: listing(topChildren, nChildren),
+	})
+}
+
+// averageFileSize returns the average file size, or zero if there are
+// no files.
+func averageFileSize(nBytes, nFiles int64) int64 {
+	if nFiles == 0 {
+		return 0
+	}
+	return nBytes / nFiles
+}
+
+// prefixAverageFileSize returns the average disk usage of the files
+// stored for prefix itself.
+func prefixAverageFileSize(ctx context.Context, db filewalk.Database, prefix string) int64 {
+	var pi filewalk.PrefixInfo
+	if db == nil {
+		return 0
+	}
+	if ok, err := db.Get(ctx, prefix, &pi); err != nil || !ok {
+		return 0
+	}
+	return averageFileSize(pi.DiskUsage, int64(len(pi.Files)))
 }
 
 type mergedStats struct {
@@ -76,121 +255,466 @@ type mergedStats struct {
 	nBytes    int64
 	nFiles    int64
 	nChildren int64
+	users     int64 // users is the number of distinct users that own files.
+	groups    int64 // groups is the number of distinct groups that own files.
+	growth    string
 }
 
+// mergeStats merges the totals and top-N prefixes for root, see
+// query.Querier.Merge, and adds the name of the owner of each prefix.
 func mergeStats(ctx context.Context, db filewalk.Database, root string, nFiles, nChildren, nBytes, nErrors int64, topN int, topFiles, topChildren, topBytes []filewalk.Metric) []mergedStats {
-	existing := map[string]mergedStats{}
-	existing[root] = mergedStats{
-		prefix:    root,
-		nErrors:   nErrors,
-		nBytes:    nBytes,
-		nFiles:    nFiles,
-		nChildren: nChildren,
+	st := query.Stats{
+		Files:       nFiles,
+		Prefixes:    nChildren,
+		Bytes:       nBytes,
+		Errors:      nErrors,
+		TopFiles:    topFiles,
+		TopPrefixes: topChildren,
+		TopBytes:    topBytes,
 	}
-
-	setv := func(m filewalk.Metric, which int) {
-		e := existing[m.Prefix]
-		e.prefix = m.Prefix
-		switch which {
-		case 0:
-			e.nFiles = m.Value
-		case 1:
-			e.nChildren = m.Value
-		case 2:
-			e.nBytes = m.Value
+	ps := query.New(db, globalConfig.LayoutFor(root).Separator).Merge(ctx, root, st)
+	merged := make([]mergedStats, len(ps))
+	for i, p := range ps {
+		merged[i] = mergedStats{
+			prefix:    p.Prefix,
+			user:      globalUserManager.nameForPrefix(ctx, db, p.Prefix),
+			nErrors:   p.Errors,
+			nBytes:    p.Bytes,
+			nFiles:    p.Files,
+			nChildren: p.Prefixes,
 		}
-		existing[m.Prefix] = e
 	}
-	for _, m := range topFiles {
-		setv(m, 0)
+	return merged
+}
+
+// otherStats returns the usage not accounted for by the non-root entries
+// in merged, given that the entry for root records the totals.
+func otherStats(root string, merged []mergedStats) mergedStats {
+	other := mergedStats{prefix: otherMetric}
+	for _, m := range merged {
+		if m.prefix == root {
+			other.nBytes += m.nBytes
+			other.nFiles += m.nFiles
+			other.nChildren += m.nChildren
+			other.nErrors += m.nErrors
+			continue
+		}
+		other.nBytes -= m.nBytes
+		other.nFiles -= m.nFiles
+		other.nChildren -= m.nChildren
 	}
-	for _, m := range topChildren {
-		setv(m, 1)
+	clamp := func(v *int64) {
+		if *v < 0 {
+			*v = 0
+		}
 	}
-	for _, m := range topBytes {
-		setv(m, 2)
+	clamp(&other.nBytes)
+	clamp(&other.nFiles)
+	clamp(&other.nChildren)
+	return other
+}
 
+// tsvFields returns the values of the requested fields for a tsv row.
+func tsvFields(fields []string, owner string, m mergedStats) []string {
+	row := make([]string, len(fields))
+	for i, f := range fields {
+		switch f {
+		case "owner":
+			row[i] = owner
+		case "prefix":
+			row[i] = m.prefix
+		case "user":
+			row[i] = m.user
+		case "bytes":
+			row[i] = strconv.FormatInt(m.nBytes, 10)
+		case "files":
+			row[i] = strconv.FormatInt(m.nFiles, 10)
+		case "directories":
+			row[i] = strconv.FormatInt(m.nChildren, 10)
+		case "errors":
+			row[i] = strconv.FormatInt(m.nErrors, 10)
+		case "avg_file_size":
+			row[i] = strconv.FormatInt(averageFileSize(m.nBytes, m.nFiles), 10)
+		case "distinct_users":
+			row[i] = strconv.FormatInt(m.users, 10)
+		case "distinct_groups":
+			row[i] = strconv.FormatInt(m.groups, 10)
+		case "growth_per_day":
+			row[i] = m.growth
+		}
 	}
-	merged := make([]mergedStats, 0, len(existing))
-	for _, v := range existing {
-		v.user = globalUserManager.nameForPrefix(ctx, db, v.prefix)
-		merged = append(merged, v)
+	return row
+}
+
+// defaultTSVFields are the fields written by summary --tsv.
+var defaultTSVFields = []string{"prefix", "user", "bytes", "files", "directories", "errors", "avg_file_size"}
+
+// setGrowthRates sets the growth rate, in bytes per day, for each of the
+// merged stats that has one.
+func setGrowthRates(merged []mergedStats, rates map[string]float64) {
+	for i, m := range merged {
+		if rate, ok := rates[m.prefix]; ok {
+			merged[i].growth = strconv.FormatInt(int64(rate), 10)
+		}
 	}
-	sort.Slice(merged, func(i, j int) bool {
-		return merged[i].prefix < merged[j].prefix
-	})
-	return merged
 }
 
-func writeTSVSummary(ctx context.Context, out *os.File, merged []mergedStats) error {
+func writeTSVSummary(ctx context.Context, out io.Writer, fields []string, merged []mergedStats) error {
 	wr := csv.NewWriter(out)
 	wr.Comma = '\t'
-	wr.Write([]string{"prefix", "user", "bytes", "files", "directories", "errors"})
+	wr.Write(fields)
 	for _, m := range merged {
-		wr.Write([]string{
-			m.prefix,
-			m.user,
-			strconv.FormatInt(m.nBytes, 10),
-			strconv.FormatInt(m.nFiles, 10),
-			strconv.FormatInt(m.nChildren, 10),
-			strconv.FormatInt(m.nErrors, 10),
-		})
+		wr.Write(tsvFields(fields, "", m))
 	}
 	wr.Flush()
 	return wr.Error()
 }
 
-func getAllStats(ctx context.Context, db filewalk.Database, n int, opts ...filewalk.MetricOption) (
+// getAllStats returns the totals and top-N prefixes for the database
+// that stores prefix, see query.Querier.Stats. Note that TopN consumes the underlying heap,
+// hence the top-N metrics can only be obtained once per database handle.
+func getAllStats(ctx context.Context, db filewalk.Database, prefix string, n int, opts ...filewalk.MetricOption) (
 	nFiles, nChildren, nBytes, nErrors int64,
 	topFiles, topChildren, topBytes []filewalk.Metric,
 	err error) {
-	errs := errors.M{}
-	nFiles, err = db.Total(ctx, filewalk.TotalFileCount, opts...)
-	errs.Append(err)
-	nChildren, err = db.Total(ctx, filewalk.TotalPrefixCount, opts...)
-	errs.Append(err)
-	nBytes, err = db.Total(ctx, filewalk.TotalDiskUsage, opts...)
-	errs.Append(err)
-	nErrors, err = db.Total(ctx, filewalk.TotalErrorCount, opts...)
-	errs.Append(err)
-	topFiles, err = db.TopN(ctx, filewalk.TotalFileCount, n, opts...)
-	errs.Append(err)
-	topChildren, err = db.TopN(ctx, filewalk.TotalPrefixCount, n, opts...)
-	errs.Append(err)
-	topBytes, err = db.TopN(ctx, filewalk.TotalDiskUsage, n, opts...)
-	errs.Append(err)
-	err = errs.Err()
+	st, err := query.New(db, globalConfig.LayoutFor(prefix).Separator).Stats(ctx, n, opts...)
+	if err != nil {
+		return
+	}
+	nFiles, nChildren, nBytes, nErrors = st.Files, st.Prefixes, st.Bytes, st.Errors
+	topFiles = rankMetrics(ctx, db, globalFlags.TieBreak, st.TopFiles)
+	topChildren = rankMetrics(ctx, db, globalFlags.TieBreak, st.TopPrefixes)
+	topBytes = rankMetrics(ctx, db, globalFlags.TieBreak, st.TopBytes)
+	return
+}
+
+// getGlobalStats returns the totals and top-N prefixes for the database for
+// prefix. One more than n top-N prefixes are read so that ties at the
+// cutoff can be detected. Such ties are broken by --top-tie-break among the
+// prefixes returned by the database unless --top-exact-ties is set, in
+// which case the top-N prefixes are determined by scanning the database so
+// that they do not depend on which of the tied prefixes the database
+// returns.
+func getGlobalStats(ctx context.Context, db filewalk.Database, prefix string, n int) (
+	nFiles, nChildren, nBytes, nErrors int64,
+	topFiles, topChildren, topBytes []filewalk.Metric,
+	err error) {
+	nFiles, nChildren, nBytes, nErrors,
+		topFiles, topChildren, topBytes, err =
+		getAllStats(ctx, db, prefix, n+1, filewalk.Global())
+	if err != nil {
+		return
+	}
+	if !scanForTies(globalFlags.ExactTies, n, topFiles, topChildren, topBytes) {
+		topFiles, topChildren, topBytes = firstNMetrics(topFiles, n), firstNMetrics(topChildren, n), firstNMetrics(topBytes, n)
+		return
+	}
+	root := prefix
+	if cfg, ok := globalConfig.DatabaseFor(prefix); ok {
+		root = cfg.Prefix
+	}
+	debug(ctx, 1, "top-N prefixes tied at the cutoff, scanning: %v\n", root)
+	_, _, _, _, topFiles, topChildren, topBytes, err =
+		getStatsUnder(ctx, db, root, globalConfig.LayoutFor(root).Separator, n)
 	return
 }
 
+// validateUnder returns an error if under is not prefix or one of its
+// descendants.
+func validateUnder(prefix, under string) error {
+	sep := globalConfig.LayoutFor(prefix).Separator
+	if under == prefix || strings.HasPrefix(under, strings.TrimSuffix(prefix, sep)+sep) {
+		return nil
+	}
+	return fmt.Errorf("--under %v is not within %v", under, prefix)
+}
+
+// getStatsUnder returns the totals and top-N prefixes for root and its
+// descendants only, by scanning the portion of the database that stores
+// them.
+func getStatsUnder(ctx context.Context, db filewalk.Database, root, sep string, n int) (
+	nFiles, nChildren, nBytes, nErrors int64,
+	topFiles, topChildren, topBytes []filewalk.Metric,
+	err error) {
+	files, children, disk := newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak), newTopNRanker(globalFlags.TieBreak)
+	if root != sep {
+		// The database stores prefixes without a trailing separator.
+		root = strings.TrimSuffix(root, sep)
+	}
+	parent := strings.TrimSuffix(root, sep) + sep
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if prefix != root && !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		if len(pi.Err) > 0 {
+			nErrors++
+		}
+		files.add(prefix, int64(len(pi.Files)), pi)
+		children.add(prefix, int64(len(pi.Children)), pi)
+		disk.add(prefix, pi.DiskUsage, pi)
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+	nFiles, nChildren, nBytes = files.Sum(), children.Sum(), disk.Sum()
+	topFiles = files.TopN(n)
+	topChildren = children.TopN(n)
+	topBytes = disk.TopN(n)
+	return
+}
+
+// compactSize formats size for summary --compact, omitting the digit
+// separators used elsewhere so that the output is easily parsed.
+func compactSize(size int64) string {
+	if globalFlags.Human {
+		return fsize(size)
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// writeCompactSummary writes a single line per prefix, path bytes files
+// dirs, separated by tabs.
+func writeCompactSummary(out io.Writer, merged []mergedStats) error {
+	for _, m := range merged {
+		if _, err := fmt.Fprintf(out, "%v\t%v\t%v\t%v\n", m.prefix, compactSize(m.nBytes), m.nFiles, m.nChildren); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func firstNMetrics(metrics []filewalk.Metric, n int) []filewalk.Metric {
+	if n < len(metrics) {
+		return metrics[:n]
+	}
+	return metrics
+}
+
+// summaryMode is one of the mutually exclusive modes of summary, each of
+// which replaces the default totals and top prefixes.
+type summaryMode struct {
+	flag    string
+	enabled bool
+}
+
+// summaryOption is a flag that modifies the output of summary and that
+// can be used with the default totals and top prefixes and the listed
+// modes only, and not with the listed conflicting options.
+type summaryOption struct {
+	flag      string
+	enabled   bool
+	modes     []string
+	conflicts []string
+}
+
+// validateSummaryFlags returns the flag for the mode selected by
+// flagValues, or an empty string for the default totals and top prefixes,
+// or an error if incompatible modes or options are specified.
+func validateSummaryFlags(flagValues *summaryFlags) (string, error) {
+	modes := []summaryMode{
+		{"--most-shared", flagValues.MostShared},
+		{"--by-extension", flagValues.ByExtension},
+		{"--cost", flagValues.Cost},
+		{"--age-histogram", flagValues.AgeHistogram},
+		{"--size-histogram", flagValues.SizeHistogram},
+		{"--profile", len(flagValues.Profile) > 0},
+		{"--xattrs", flagValues.XAttrs},
+		{"--as-of", len(flagValues.AsOf) > 0},
+	}
+	options := []summaryOption{
+		{flag: "--json", enabled: flagValues.JSON,
+			modes:     []string{"--by-extension"},
+			conflicts: []string{"--compact", "--growth-rate"}},
+		{flag: "--compact", enabled: flagValues.Compact,
+			conflicts: []string{"--growth-rate"}},
+		{flag: "--growth-rate", enabled: flagValues.Growth},
+		{flag: "--tsv", enabled: len(flagValues.TSVOut) > 0,
+			modes: []string{"--most-shared", "--cost", "--age-histogram", "--size-histogram"}},
+		{flag: "--under", enabled: len(flagValues.Under) > 0,
+			modes: []string{"--most-shared", "--by-extension", "--cost", "--age-histogram", "--size-histogram"}},
+	}
+	mode := ""
+	for _, m := range modes {
+		if !m.enabled {
+			continue
+		}
+		if len(mode) > 0 {
+			return "", fmt.Errorf("%v cannot be used with %v", mode, m.flag)
+		}
+		mode = m.flag
+	}
+	enabled := map[string]bool{}
+	for _, o := range options {
+		enabled[o.flag] = o.enabled
+	}
+	for _, o := range options {
+		if !o.enabled {
+			continue
+		}
+		conflict := ""
+		for _, c := range o.conflicts {
+			if enabled[c] {
+				conflict = c
+				break
+			}
+		}
+		if len(conflict) == 0 && len(mode) > 0 && !containsString(o.modes, mode) {
+			conflict = mode
+		}
+		if len(conflict) == 0 {
+			continue
+		}
+		allowed := ""
+		if len(o.modes) > 0 {
+			allowed = strings.Join(o.modes, ", ") + " or "
+		}
+		return "", fmt.Errorf("%v can only be used with %vthe totals and top prefixes, not with %v", o.flag, allowed, conflict)
+	}
+	return mode, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func summary(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*summaryFlags)
+	if len(flagValues.Tenants) > 0 {
+		if len(args) > 0 || len(flagValues.PrefixFile) > 0 {
+			return fmt.Errorf("--tenants specifies the prefix to summarize and cannot be used with a prefix argument or --prefix-file")
+		}
+		return tenantSummary(ctx, flagValues, flagValues.Tenants)
+	}
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	warnNestedDatabases(args[0])
+	mode, err := validateSummaryFlags(flagValues)
+	if err != nil {
+		return err
+	}
+	root := args[0]
+	if len(flagValues.Under) > 0 {
+		if err := validateUnder(args[0], flagValues.Under); err != nil {
+			return err
+		}
+		root = flagValues.Under
+	}
+	switch mode {
+	case "--most-shared":
+		return mostShared(ctx, os.Stdout, root, flagValues.TopN, flagValues.TSVOut)
+	case "--by-extension":
+		return summaryByExtension(ctx, os.Stdout, root, flagValues.TopN, flagValues.JSON)
+	case "--cost":
+		return summaryCost(ctx, os.Stdout, root, flagValues.TSVOut)
+	case "--age-histogram":
+		return summaryAgeHistogram(ctx, os.Stdout, root, flagValues.AgeBuckets.Values, flagValues.TSVOut)
+	case "--size-histogram":
+		return summarySizeHistogram(ctx, os.Stdout, root, flagValues.SizeBuckets, flagValues.TSVOut)
+	case "--profile":
+		profile, ok := globalConfig.ReportProfileFor(flagValues.Profile)
+		if !ok {
+			return fmt.Errorf("no such report profile: %v", flagValues.Profile)
+		}
+		return reportProfile(ctx, profile, args[0])
+	case "--xattrs":
+		return xattrSummary(ctx, os.Stdout, args[0], flagValues.TopN)
+	case "--as-of":
+		return summaryAsOf(os.Stdout, args[0], flagValues.AsOf, flagValues.TopN)
+	}
 	db, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ReadOnly())
 	if err != nil {
 		return err
 	}
 	defer globalDatabaseManager.CloseAll(ctx)
+	// The top-N metrics can only be read once per database handle, so
+	// read as many as are required for both the text and tsv output.
+	n := flagValues.TopN
+	if len(flagValues.TSVOut) > 0 && flagValues.TSVTopN > n {
+		n = flagValues.TSVTopN
+	}
+	var rates map[string]float64
+	var from, to usageSnapshot
+	if flagValues.Growth {
+		if rates, from, to, err = growthRatesFor(args[0]); err != nil {
+			return err
+		}
+	}
 	nFiles, nChildren, nBytes, nErrors,
 		topFiles, topChildren, topBytes, err :=
-		getAllStats(ctx, db, flagValues.TopN, filewalk.Global())
+		cachedStats(ctx, db, args[0], flagValues.Under, n, flagValues.NoCache)
 	if err != nil {
 		return err
 	}
-	printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
-
-	nFiles, nChildren, nBytes, nErrors,
-		topFiles, topChildren, topBytes, err =
-		getAllStats(ctx, db, flagValues.TSVTopN, filewalk.Global())
-	if err != nil {
-		return err
+	var owners map[string]ownerCounts
+	if flagValues.Owners {
+		if owners, err = topOwners(ctx, db, root, topFiles, topChildren, topBytes); err != nil {
+			return err
+		}
+	}
+	switch {
+	case flagValues.JSON:
+		if err := writeSummaryJSON(ctx, os.Stdout, root, nFiles, nChildren, nBytes, nErrors, flagValues.Other, owners,
+			firstNMetrics(topFiles, flagValues.TopN),
+			firstNMetrics(topChildren, flagValues.TopN),
+			firstNMetrics(topBytes, flagValues.TopN)); err != nil {
+			return err
+		}
+	case flagValues.Compact:
+		merged := mergeStats(ctx, db, root, nFiles, nChildren, nBytes, nErrors, flagValues.TopN,
+			firstNMetrics(topFiles, flagValues.TopN),
+			firstNMetrics(topChildren, flagValues.TopN),
+			firstNMetrics(topBytes, flagValues.TopN))
+		if err := writeCompactSummary(os.Stdout, merged); err != nil {
+			return err
+		}
+	default:
+		printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, flagValues.Other, owners,
+			firstNMetrics(topFiles, flagValues.TopN),
+			firstNMetrics(topChildren, flagValues.TopN),
+			firstNMetrics(topBytes, flagValues.TopN))
+	}
+	if flagValues.Growth {
+		printGrowthRates(os.Stdout, flagValues.TopN, firstNMetrics(topBytes, flagValues.TopN), rates, from, to)
 	}
+
+	topFiles = firstNMetrics(topFiles, flagValues.TSVTopN)
+	topChildren = firstNMetrics(topChildren, flagValues.TSVTopN)
+	topBytes = firstNMetrics(topBytes, flagValues.TSVTopN)
 	if tsvFile := flagValues.TSVOut; len(flagValues.TSVOut) > 0 {
-		tfile, err := os.OpenFile(tsvFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		tfile, err := createOutput(tsvFile)
 		if err != nil {
 			return err
 		}
-		merged := mergeStats(ctx, db, args[0], nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
-		if err := writeTSVSummary(ctx, tfile, merged); err != nil {
+		merged := mergeStats(ctx, db, root, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
+		if flagValues.Other {
+			merged = append(merged, otherStats(root, merged))
+		}
+		fields := defaultTSVFields
+		if flagValues.Owners {
+			setOwners(merged, owners)
+			fields = append(fields[:len(fields):len(fields)], ownerFields...)
+		}
+		if flagValues.Growth {
+			setGrowthRates(merged, rates)
+			fields = append(fields[:len(fields):len(fields)], "growth_per_day")
+		}
+		if err := writeTSVSummary(ctx, tfile, fields, merged); err != nil {
+			tfile.Close()
+			return err
+		}
+		if err := tfile.Close(); err != nil {
 			return err
 		}
 	}
@@ -231,7 +755,19 @@ func printGroups(ctx context.Context, db filewalk.Database) error {
 	return nil
 }
 
+// reportsDir returns the directory to write reports to, the command line
+// flag takes precedence over the configuration file.
+func reportsDir(dir string) string {
+	if len(dir) > 0 {
+		return dir
+	}
+	return globalConfig.ReportsDir
+}
+
 func createReportsDirIfNeeded(dir string) error {
+	if isObjectStore(dir) {
+		return fmt.Errorf("writing reports to object stores is not supported: %v", dir)
+	}
 	if len(dir) > 0 {
 		if err := os.MkdirAll(dir, 0777); err != nil {
 			fmt.Printf("failed to create directory %v for statistics: %v", dir, err)
@@ -241,61 +777,153 @@ func createReportsDirIfNeeded(dir string) error {
 	return nil
 }
 
+// reportForUserOrGroup returns the output for the named user or group's
+// report. Local reports are written to a temporary file that is renamed
+// when closed so that an interrupted run never leaves a partial report that
+// would be mistaken for a current one.
 func reportForUserOrGroup(dir, name string) (io.Writer, func() error, error) {
 	if len(dir) == 0 {
 		return os.Stdout, func() error { return nil }, nil
 	}
-	name = filepath.Join(dir, name+".txt")
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	filename := joinOutput(dir, name+".txt")
+	f, err := createOutput(filename + ".tmp")
 	if err != nil {
 		return os.Stdout, func() error { return nil }, err
 	}
-	return f, f.Close, nil
+	return f, func() error {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(filename+".tmp", filename)
+	}, nil
+}
+
+// lastRunTime returns the time at which the most recent complete and
+// successful analyze run of prefix, or of a prefix that contains it,
+// finished, as recorded in its run log, or the zero time if that is not
+// known. Runs of other prefixes in the same database, and partial or
+// failed runs, are ignored since they may not have updated prefix.
+func lastRunTime(prefix string) time.Time {
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return time.Time{}
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil {
+		return time.Time{}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if e := entries[i]; isNestedPrefix(e.Prefix, prefix) && len(e.Err) == 0 && !e.Partial {
+			return e.Stop
+		}
+	}
+	return time.Time{}
+}
+
+// reportIsCurrent returns true if the named user or group's report in dir
+// was written after the most recent analyze run.
+func reportIsCurrent(dir, name string, lastRun time.Time) bool {
+	if len(dir) == 0 || lastRun.IsZero() {
+		return false
+	}
+	fi, err := os.Stat(joinOutput(dir, name+".txt"))
+	return err == nil && fi.ModTime().After(lastRun)
+}
+
+func printReportCounts(generated, current, below int) {
+	if current == 0 && below == 0 {
+		return
+	}
+	fmt.Printf("generated %v reports, skipped %v that are up to date and %v with usage below the thresholds\n", generated, current, below)
+}
+
+// defaultUser returns the user to summarize when none are specified on
+// the command line: --default-user takes precedence over the USER
+// environment variable, which must be set if --default-user is not.
+func defaultUser(flagValue string) (string, error) {
+	if len(flagValue) > 0 {
+		return flagValue, nil
+	}
+	if usr := os.Getenv("USER"); len(usr) > 0 {
+		return usr, nil
+	}
+	return "", fmt.Errorf("no user was specified and the USER environment variable is not set: specify one or more users, --default-user or --all-users")
 }
 
 func userSummary(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*userFlags)
-	db, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ReadOnly())
+	prefix, args, err := prefixAndArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	warnNestedDatabases(prefix)
+	dir := reportsDir(flagValues.WriteFiles)
+	if err := createReportsDirIfNeeded(dir); err != nil {
+		return err
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
 	if err != nil {
 		return err
 	}
 	if flagValues.ListUsers {
 		return printUsers(ctx, db)
 	}
-	args = args[1:]
-	if len(args) == 0 {
-		args = []string{os.Getenv("USER")}
-	}
-	if flagValues.AllUsers {
+	switch {
+	case flagValues.AllUsers:
 		args, err = db.UserIDs(ctx)
-		if err != nil {
-			return err
-		}
+	case len(args) == 0:
+		var usr string
+		usr, err = defaultUser(flagValues.DefaultUser)
+		args = []string{usr}
+	}
+	if err != nil {
+		return err
 	}
 	errs := errors.M{}
-	errs.Append(createReportsDirIfNeeded(flagValues.WriteFiles))
+	lastRun := lastRunTime(prefix)
+	generated, current, below := 0, 0, 0
 	for _, usr := range args {
 		name := globalUserManager.nameForUID(usr)
 		key := globalUserManager.uidForName(name)
-		out, close, err := reportForUserOrGroup(flagValues.WriteFiles, name)
+		if !flagValues.Force && reportIsCurrent(dir, name, lastRun) {
+			current++
+			continue
+		}
+		skip, err := belowThreshold(ctx, db, flagValues.UsageThresholdFlags, filewalk.UserID(key))
+		errs.Append(err)
+		if skip {
+			below++
+			continue
+		}
+		generated++
+		out, close, err := reportForUserOrGroup(dir, name)
 		errs.Append(err)
-		nFiles, nChildren, nBytes, nErrors, topFiles, topChildren, topBytes, err := getAllStats(ctx, db, flagValues.TopN, filewalk.UserID(key))
+		nFiles, nChildren, nBytes, nErrors, topFiles, topChildren, topBytes, err := getAllStats(ctx, db, prefix, flagValues.TopN, filewalk.UserID(key))
 		errs.Append(err)
 		fmt.Fprintf(out, "\nSummary for %v (%v)\n", name, usr)
-		printSummaryStats(ctx, out, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
+		printSummaryStats(ctx, out, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, flagValues.Other, nil, topFiles, topChildren, topBytes)
 		errs.Append(close())
 	}
+	printReportCounts(generated, current, below)
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	return errs.Err()
 }
 
 func groupSummary(ctx context.Context, values interface{}, args []string) error {
 	flagValues := values.(*groupFlags)
-	db, err := globalDatabaseManager.DatabaseFor(ctx, args[0], filewalk.ReadOnly())
+	prefix, args, err := prefixAndArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	warnNestedDatabases(prefix)
+	dir := reportsDir(flagValues.WriteFiles)
+	if err := createReportsDirIfNeeded(dir); err != nil {
+		return err
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
 	if err != nil {
 		return err
 	}
-	args = args[1:]
 	if flagValues.ListGroups {
 		return printGroups(ctx, db)
 	}
@@ -310,19 +938,32 @@ func groupSummary(ctx context.Context, values interface{}, args []string) error
 	}
 
 	errs := errors.M{}
-	errs.Append(createReportsDirIfNeeded(flagValues.WriteFiles))
+	lastRun := lastRunTime(prefix)
+	generated, current, below := 0, 0, 0
 	for _, grp := range args {
 		name := globalUserManager.nameForGID(grp)
 		key := globalUserManager.gidForName(grp)
-		out, close, err := reportForUserOrGroup(flagValues.WriteFiles, name)
+		if !flagValues.Force && reportIsCurrent(dir, name, lastRun) {
+			current++
+			continue
+		}
+		skip, err := belowThreshold(ctx, db, flagValues.UsageThresholdFlags, filewalk.GroupID(key))
+		errs.Append(err)
+		if skip {
+			below++
+			continue
+		}
+		generated++
+		out, close, err := reportForUserOrGroup(dir, name)
 		errs.Append(err)
 		nFiles, nChildren, nBytes, nErrors,
-			topFiles, topChildren, topBytes, err := getAllStats(ctx, db, flagValues.TopN, filewalk.GroupID(key))
+			topFiles, topChildren, topBytes, err := getAllStats(ctx, db, prefix, flagValues.TopN, filewalk.GroupID(key))
 		errs.Append(err)
 		fmt.Fprintf(out, "\nSummary for %v (%v)\n", name, grp)
-		printSummaryStats(ctx, out, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, topFiles, topChildren, topBytes)
+		printSummaryStats(ctx, out, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, flagValues.Other, nil, topFiles, topChildren, topBytes)
 		errs.Append(close())
 	}
+	printReportCounts(generated, current, below)
 	errs.Append(globalDatabaseManager.CloseAll(ctx))
 	return errs.Err()
 }
@@ -0,0 +1,325 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/file/diskusage"
+	"cloudeng.io/file/filewalk"
+	"cloudeng.io/file/filewalk/localdb"
+)
+
+func TestResidual(t *testing.T) {
+	metrics := func(values ...int64) []filewalk.Metric {
+		var m []filewalk.Metric
+		for _, v := range values {
+			m = append(m, filewalk.Metric{Prefix: "/a", Value: v})
+		}
+		return m
+	}
+	for i, tc := range []struct {
+		total   int64
+		metrics []filewalk.Metric
+		want    int64
+	}{
+		{0, nil, 0},
+		{10, nil, 10},
+		{10, metrics(3, 2), 5},
+		{10, metrics(6, 4), 0},
+		{10, metrics(8, 4), -2},
+	} {
+		if got, want := residual(tc.total, tc.metrics), tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestOtherStats(t *testing.T) {
+	for i, tc := range []struct {
+		merged []mergedStats
+		want   mergedStats
+	}{
+		{nil, mergedStats{prefix: otherMetric}},
+		{[]mergedStats{
+			{prefix: "/r", nBytes: 100, nFiles: 10, nChildren: 5, nErrors: 2},
+			{prefix: "/r/a", nBytes: 60, nFiles: 4, nChildren: 1, nErrors: 1},
+			{prefix: "/r/b", nBytes: 30, nFiles: 4, nChildren: 1},
+		}, mergedStats{prefix: otherMetric, nBytes: 10, nFiles: 2, nChildren: 3, nErrors: 2}},
+		// The listed prefixes may overlap and hence exceed the totals.
+		{[]mergedStats{
+			{prefix: "/r", nBytes: 100, nFiles: 10, nChildren: 5},
+			{prefix: "/r/a", nBytes: 80, nFiles: 8, nChildren: 4},
+			{prefix: "/r/a/b", nBytes: 70, nFiles: 7, nChildren: 3},
+		}, mergedStats{prefix: otherMetric}},
+		// The root is not included in the listing.
+		{[]mergedStats{
+			{prefix: "/r/a", nBytes: 80, nFiles: 8, nChildren: 4},
+		}, mergedStats{prefix: otherMetric}},
+	} {
+		if got, want := otherStats("/r", tc.merged), tc.want; got != want {
+			t.Errorf("%v: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestPrintSummaryOther(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func(cfg *config.Config) { globalConfig = cfg }(globalConfig)
+	globalConfig, err = config.ParseConfig([]byte(fmt.Sprintf("databases:\n  - prefix: /r\n    type: local\n    directory: %v\n", filepath.Join(tmpDir, "db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer globalDatabaseManager.CloseAll(ctx)
+	db, err := globalDatabaseManager.DatabaseFor(ctx, "/r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/r/a", "/r/b"} {
+		if err := db.Set(ctx, p, &filewalk.PrefixInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(human bool) { globalFlags.Human = human }(globalFlags.Human)
+	globalFlags.Human = false
+	top := []filewalk.Metric{{Prefix: "/r/a", Value: 6}, {Prefix: "/r/b", Value: 3}}
+	all := []filewalk.Metric{{Prefix: "/r/a", Value: 6}, {Prefix: "/r/b", Value: 4}}
+	for _, tc := range []struct {
+		other   bool
+		metrics []filewalk.Metric
+		want    int
+	}{
+		{true, top, 3},
+		{false, top, 0},
+		{true, all, 0},
+	} {
+		out := &bytes.Buffer{}
+		printSummaryStats(ctx, out, 10, 10, 10, 0, 2, tc.other, nil, tc.metrics, tc.metrics, tc.metrics)
+		if got, want := strings.Count(out.String(), otherMetric), tc.want; got != want {
+			t.Errorf("other: %v, %v: got %v (other) rows, want %v: %s", tc.other, tc.metrics, got, want, out.String())
+		}
+	}
+}
+
+func TestValidateUnder(t *testing.T) {
+	defer func(cfg *config.Config) { globalConfig = cfg }(globalConfig)
+	var err error
+	globalConfig, err = config.ParseConfig([]byte("databases:\n  - prefix: /r\n    type: local\n    directory: ./db\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		prefix, under string
+		ok            bool
+	}{
+		{"/r", "/r", true},
+		{"/r", "/r/a", true},
+		{"/r", "/r/a/b", true},
+		{"/r/", "/r/a", true},
+		{"/r", "/ra", false},
+		{"/r", "/", false},
+		{"/r/a", "/r", false},
+		{"/r", "", false},
+	} {
+		err := validateUnder(tc.prefix, tc.under)
+		if got, want := err == nil, tc.ok; got != want {
+			t.Errorf("%v: %v: %v: got %v, want %v", i, tc.prefix, tc.under, err, want)
+		}
+	}
+}
+
+func TestGetStatsUnder(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := localdb.Open(ctx, tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	for prefix, pi := range map[string]*filewalk.PrefixInfo{
+		"/r":     {DiskUsage: 1, Files: make([]filewalk.Info, 1), Children: make([]filewalk.Info, 3)},
+		"/r/a":   {DiskUsage: 10, Files: make([]filewalk.Info, 2), Children: make([]filewalk.Info, 1)},
+		"/r/a/x": {DiskUsage: 20, Files: make([]filewalk.Info, 1), Err: "oops"},
+		// /r/ab shares a string prefix with /r/a but is not beneath it.
+		"/r/ab": {DiskUsage: 100, Files: make([]filewalk.Info, 5)},
+		"/r/b":  {DiskUsage: 1000, Files: make([]filewalk.Info, 1)},
+	} {
+		if err := db.Set(ctx, prefix, pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type stats struct {
+		nFiles, nChildren, nBytes, nErrors int64
+		topBytes                           []filewalk.Metric
+	}
+	for i, tc := range []struct {
+		root string
+		n    int
+		want stats
+	}{
+		{"/r/a", 5, stats{3, 1, 30, 1, []filewalk.Metric{{Prefix: "/r/a/x", Value: 20}, {Prefix: "/r/a", Value: 10}}}},
+		{"/r/a/", 5, stats{3, 1, 30, 1, []filewalk.Metric{{Prefix: "/r/a/x", Value: 20}, {Prefix: "/r/a", Value: 10}}}},
+		{"/r/a", 1, stats{3, 1, 30, 1, []filewalk.Metric{{Prefix: "/r/a/x", Value: 20}}}},
+		{"/r/a/x", 5, stats{1, 0, 20, 1, []filewalk.Metric{{Prefix: "/r/a/x", Value: 20}}}},
+		{"/r/b", 5, stats{1, 0, 1000, 0, []filewalk.Metric{{Prefix: "/r/b", Value: 1000}}}},
+		{"/r", 2, stats{10, 4, 1131, 1, []filewalk.Metric{{Prefix: "/r/b", Value: 1000}, {Prefix: "/r/ab", Value: 100}}}},
+	} {
+		nFiles, nChildren, nBytes, nErrors, _, _, topBytes, err := getStatsUnder(ctx, db, tc.root, "/", tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := stats{nFiles, nChildren, nBytes, nErrors, topBytes}
+		if want := tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v: got %+v, want %+v", i, tc.root, got, want)
+		}
+	}
+	if _, _, _, _, _, _, _, err := getStatsUnder(ctx, db, "/r/c", "/", 5); err == nil {
+		t.Errorf("expected an error for a prefix that is not in the database")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteCompactSummary(t *testing.T) {
+	defer func(human bool, printer func(int64) (float64, string)) {
+		globalFlags.Human, bytesPrinter = human, printer
+	}(globalFlags.Human, bytesPrinter)
+	bytesPrinter = func(size int64) (float64, string) {
+		return diskusage.DecimalBytes(size).Standardize()
+	}
+	merged := []mergedStats{
+		{prefix: "/r", nBytes: 1234567, nFiles: 1000, nChildren: 2},
+		{prefix: "/r/a b", nBytes: 0, nFiles: 0, nChildren: 0},
+		{prefix: otherMetric, nBytes: 999, nFiles: 12345, nChildren: 1},
+	}
+	for i, tc := range []struct {
+		human  bool
+		merged []mergedStats
+		want   string
+	}{
+		{false, nil, ""},
+		// Sizes and counts are written without digit separators.
+		{false, merged, "/r\t1234567\t1000\t2\n/r/a b\t0\t0\t0\n(other)\t999\t12345\t1\n"},
+		{true, merged[:1], "/r\t1.235 MB\t1000\t2\n"},
+	} {
+		globalFlags.Human = tc.human
+		out := &strings.Builder{}
+		if err := writeCompactSummary(out, tc.merged); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.String(), tc.want; got != want {
+			t.Errorf("%v: got %q, want %q", i, got, want)
+		}
+	}
+	if err := writeCompactSummary(failingWriter{}, merged); err == nil || err.Error() != "write failed" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestLastRunTime(t *testing.T) {
+	defer func(cfg *config.Config) { globalConfig = cfg }(globalConfig)
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	globalConfig, err = config.ParseConfig([]byte(fmt.Sprintf("databases:\n  - prefix: /r\n    type: local\n    directory: %v\n", tmpDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lastRunTime("/r/a"); !got.IsZero() {
+		t.Errorf("got %v, want the zero time", got)
+	}
+	at := func(h int) time.Time {
+		return time.Date(2021, 7, 4, h, 0, 0, 0, time.UTC)
+	}
+	for _, e := range []runlog.Entry{
+		{Prefix: "/r", Stop: at(1)},
+		{Prefix: "/r/a", Stop: at(2)},
+		{Prefix: "/r/ab", Stop: at(3)},
+		{Prefix: "/r/a/b", Stop: at(4)},
+		{Prefix: "/r/a", Stop: at(5), Partial: true},
+		{Prefix: "/r/a", Stop: at(6), Err: "oops"},
+	} {
+		if err := runlog.Append(tmpDir, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		prefix string
+		want   time.Time
+	}{
+		{"/r/a", at(2)},
+		{"/r/ab", at(3)},
+		{"/r/a/b", at(4)},
+		{"/r/c", at(1)},
+		{"/r", at(1)},
+	} {
+		if got := lastRunTime(tc.prefix); !got.Equal(tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSummaryFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags summaryFlags
+		mode  string
+		err   string
+	}{
+		{summaryFlags{}, "", ""},
+		{summaryFlags{Growth: true, TSVOut: "x", Under: "/a"}, "", ""},
+		{summaryFlags{Cost: true, TSVOut: "x", Under: "/a"}, "--cost", ""},
+		{summaryFlags{ByExtension: true, JSON: true}, "--by-extension", ""},
+		{summaryFlags{MostShared: true, ByExtension: true}, "", "--most-shared cannot be used with --by-extension"},
+		{summaryFlags{SizeHistogram: true, AsOf: "1d"}, "", "--size-histogram cannot be used with --as-of"},
+		{summaryFlags{JSON: true, Compact: true}, "", "--json can only be used with --by-extension or the totals and top prefixes, not with --compact"},
+		{summaryFlags{JSON: true, Cost: true}, "", "--json can only be used with --by-extension or the totals and top prefixes, not with --cost"},
+		{summaryFlags{Compact: true, XAttrs: true}, "", "--compact can only be used with the totals and top prefixes, not with --xattrs"},
+		{summaryFlags{Growth: true, AsOf: "1d"}, "", "--growth-rate can only be used with the totals and top prefixes, not with --as-of"},
+		{summaryFlags{ByExtension: true, TSVOut: "x"}, "", "--tsv can only be used with --most-shared, --cost, --age-histogram, --size-histogram or the totals and top prefixes, not with --by-extension"},
+		{summaryFlags{Profile: "p", Under: "/a"}, "", "--under can only be used with --most-shared, --by-extension, --cost, --age-histogram, --size-histogram or the totals and top prefixes, not with --profile"},
+	} {
+		flags := tc.flags
+		mode, err := validateSummaryFlags(&flags)
+		if len(tc.err) > 0 {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%+v: got %v, want %v", tc.flags, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tc.flags, err)
+		}
+		if got, want := mode, tc.mode; got != want {
+			t.Errorf("%+v: got %v, want %v", tc.flags, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/cmd/idu/internal/summarycache"
+	"cloudeng.io/file/filewalk"
+)
+
+// openSummaryCache returns the summary cache for the database for prefix
+// and the directory that it is stored in. It returns nil if the database
+// is not local or if a snapshot is being read, since snapshots are never
+// modified.
+func openSummaryCache(ctx context.Context, prefix string) (*summarycache.Cache, string) {
+	if len(globalFlags.Snapshot) > 0 {
+		return nil, ""
+	}
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		return nil, ""
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil || len(entries) == 0 {
+		debug(ctx, 1, "summary cache disabled: no run log: %v: %v\n", prefix, err)
+		return nil, ""
+	}
+	key, err := summarycache.KeyFor(cfg.Location, entries[len(entries)-1].Stop)
+	if err != nil {
+		debug(ctx, 1, "summary cache disabled: %v: %v\n", prefix, err)
+		return nil, ""
+	}
+	return summarycache.Read(cfg.Location, key), cfg.Location
+}
+
+// cachedStats returns the totals and top-N prefixes for the database for
+// prefix, or for its subpath under if specified, from the summary cache
+// if it is valid and contains at least n top-N prefixes, computing and
+// caching them otherwise, or if noCache is true.
+func cachedStats(ctx context.Context, db filewalk.Database, prefix, under string, n int, noCache bool) (
+	nFiles, nChildren, nBytes, nErrors int64,
+	topFiles, topChildren, topBytes []filewalk.Metric,
+	err error) {
+	cache, dir := openSummaryCache(ctx, prefix)
+	if cache != nil && !noCache {
+		if e, ok := cache.Lookup(under, n); ok {
+			debug(ctx, 1, "using cached summary: %v %v\n", prefix, under)
+			return e.Files, e.Children, e.Bytes, e.Errors, e.TopFiles, e.TopChildren, e.TopBytes, nil
+		}
+	}
+	if len(under) > 0 {
+		nFiles, nChildren, nBytes, nErrors,
+			topFiles, topChildren, topBytes, err =
+			getStatsUnder(ctx, db, under, globalConfig.LayoutFor(under).Separator, n)
+	} else {
+		nFiles, nChildren, nBytes, nErrors,
+			topFiles, topChildren, topBytes, err =
+			getGlobalStats(ctx, db, prefix, n)
+	}
+	if err != nil || cache == nil {
+		return
+	}
+	cache.Store(under, summarycache.Entry{
+		TopN:        n,
+		Files:       nFiles,
+		Children:    nChildren,
+		Bytes:       nBytes,
+		Errors:      nErrors,
+		TopFiles:    topFiles,
+		TopChildren: topChildren,
+		TopBytes:    topBytes,
+	})
+	if werr := cache.Write(dir); werr != nil {
+		debug(ctx, 1, "failed to write summary cache: %v: %v\n", dir, werr)
+	}
+	return
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// symlinkTargets attributes the size of the files that symlinks refer to
+// to the symlinks themselves, for those symlinks whose targets lie outside
+// of the tree being analyzed. Targets within the tree are already counted
+// at their own location by the scan and so are never attributed to a
+// symlink. Each target, as identified by its device and inode where
+// available, is attributed to at most one symlink so that multiple links
+// to the same file do not inflate usage.
+type symlinkTargets struct {
+	root string
+	sync.Mutex
+	seen                               map[targetID]bool
+	attributed, inTree, dangling, dirs int64
+	duplicates                         int64
+}
+
+// targetID identifies a symlink target by its device and inode, or by
+// its path if these are not available.
+type targetID struct {
+	dev, ino uint64
+	path     string
+}
+
+func newSymlinkTargets(root string) *symlinkTargets {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	return &symlinkTargets{root: filepath.Clean(root), seen: map[targetID]bool{}}
+}
+
+func (st *symlinkTargets) within(path string) bool {
+	return path == st.root || strings.HasPrefix(path, st.root+string(filepath.Separator))
+}
+
+// attribute returns the file, with its size replaced by that of its
+// target if file is a symlink whose target is a file outside of the tree
+// that has not already been attributed to another symlink. Symlinks to
+// targets within the tree, to directories or that are dangling are
+// returned unchanged and hence counted by their own size.
+func (st *symlinkTargets) attribute(ctx context.Context, prefix string, file filewalk.Info) filewalk.Info {
+	if st == nil || file.Mode&filewalk.ModeLink == 0 {
+		return file
+	}
+	link := filepath.Join(prefix, file.Name)
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		debug(ctx, 2, "dangling symlink: %v: %v\n", link, err)
+		st.count(&st.dangling)
+		return file
+	}
+	if st.within(target) {
+		debug(ctx, 2, "symlink target is within %v and counted there: %v -> %v\n", st.root, link, target)
+		st.count(&st.inTree)
+		return file
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		debug(ctx, 2, "dangling symlink: %v: %v\n", link, err)
+		st.count(&st.dangling)
+		return file
+	}
+	if info.IsDir() {
+		st.count(&st.dirs)
+		return file
+	}
+	id := targetID{path: target}
+	if dev, ino, ok := inodeFor(info); ok {
+		id = targetID{dev: dev, ino: ino}
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.seen[id] {
+		st.duplicates++
+		return file
+	}
+	st.seen[id] = true
+	st.attributed++
+	file.Size = info.Size()
+	return file
+}
+
+func (st *symlinkTargets) count(n *int64) {
+	st.Lock()
+	*n++
+	st.Unlock()
+}
+
+func (st *symlinkTargets) summary(out io.Writer) {
+	if st == nil {
+		return
+	}
+	st.Lock()
+	defer st.Unlock()
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "symlinks counted by target size: %v, by their own size: %v (already counted: %v, directories: %v, within %v: %v, dangling: %v)\n",
+		st.attributed,
+		st.duplicates+st.dirs+st.inTree+st.dangling,
+		st.duplicates, st.dirs, st.root, st.inTree, st.dangling)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloudeng.io/file/filewalk"
+)
+
+func TestSymlinkTargets(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := ioutil.TempDir("", "idu-symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree, outside := filepath.Join(tmpDir, "tree"), filepath.Join(tmpDir, "outside")
+	for _, dir := range []string{tree, outside} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, size := range map[string]int{
+		filepath.Join(tree, "in-tree"):   100,
+		filepath.Join(outside, "target"): 200,
+	} {
+		if err := ioutil.WriteFile(name, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"to-in-tree":       filepath.Join(tree, "in-tree"),
+		"to-outside":       filepath.Join(outside, "target"),
+		"to-outside-again": filepath.Join(outside, "target"),
+		"to-dir":           outside,
+		"dangling":         filepath.Join(tree, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(tree, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := newSymlinkTargets(tree)
+	sizes := map[string]int64{}
+	for _, name := range []string{"in-tree", "to-in-tree", "to-outside", "to-outside-again", "to-dir", "dangling"} {
+		file := filewalk.Info{Name: name, Size: 1}
+		if name != "in-tree" {
+			file.Mode = filewalk.ModeLink
+		}
+		sizes[name] = st.attribute(ctx, tree, file).Size
+	}
+	for name, want := range map[string]int64{
+		"in-tree":          1,
+		"to-in-tree":       1,
+		"to-outside":       200,
+		"to-outside-again": 1,
+		"to-dir":           1,
+		"dangling":         1,
+	} {
+		if got := sizes[name]; got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+	out := &bytes.Buffer{}
+	st.summary(out)
+	if got, want := out.String(), "symlinks counted by target size: 1, by their own size: 4 (already counted: 1, directories: 1, within "; !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want prefix %v", got, want)
+	}
+	if got, want := out.String(), ": 1, dangling: 1)\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %v, want suffix %v", got, want)
+	}
+}
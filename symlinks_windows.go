@@ -0,0 +1,14 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package main
+
+import "os"
+
+// inodeFor is not supported on windows.
+func inodeFor(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
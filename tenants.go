@@ -0,0 +1,203 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloudeng.io/cmdutil/flags"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// tenantUsage is the usage of a single tenant, ie. an immediate child of
+// the prefix specified via --tenants, and all of its descendants.
+type tenantUsage struct {
+	name            string
+	owner           string
+	bytes, quota    int64
+	files, prefixes int64
+	errors          int64
+}
+
+func (t tenantUsage) overQuota() bool {
+	return t.quota > 0 && t.bytes > t.quota
+}
+
+// used returns the fraction of its quota that the tenant is using, or -1
+// if it has no quota.
+func (t tenantUsage) used() float64 {
+	if t.quota <= 0 {
+		return -1
+	}
+	return float64(t.bytes) / float64(t.quota)
+}
+
+// scanTenants computes the usage of every tenant beneath root by scanning
+// all of the prefixes stored for root.
+func scanTenants(ctx context.Context, db filewalk.Database, root, sep string) (map[string]*tenantUsage, error) {
+	tenants := map[string]*tenantUsage{}
+	parent := strings.TrimSuffix(root, sep) + sep
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if !strings.HasPrefix(prefix, parent) {
+			if prefix > parent {
+				break
+			}
+			continue
+		}
+		name := strings.TrimPrefix(prefix, parent)
+		if idx := strings.Index(name, sep); idx >= 0 {
+			name = name[:idx]
+		}
+		t := tenants[name]
+		if t == nil {
+			t = &tenantUsage{name: name}
+			tenants[name] = t
+		}
+		if prefix == parent+name {
+			t.owner = globalUserManager.nameForUID(pi.UserID)
+		}
+		t.bytes += pi.DiskUsage
+		t.files += int64(len(pi.Files))
+		t.prefixes++
+		if len(pi.Err) > 0 {
+			t.errors++
+		}
+	}
+	return tenants, sc.Err()
+}
+
+func sortTenants(tenants []tenantUsage, by string) {
+	sort.SliceStable(tenants, func(i, j int) bool {
+		a, b := tenants[i], tenants[j]
+		switch by {
+		case "files":
+			if a.files != b.files {
+				return a.files > b.files
+			}
+		case "quota":
+			if ua, ub := a.used(), b.used(); ua != ub {
+				return ua > ub
+			}
+		case "name":
+		default:
+			if a.bytes != b.bytes {
+				return a.bytes > b.bytes
+			}
+		}
+		return a.name < b.name
+	})
+}
+
+var tenantTSVFields = []string{"tenant", "owner", "bytes", "files", "prefixes", "errors", "quota", "over_quota"}
+
+func writeTenantsTSV(out io.Writer, tenants []tenantUsage) error {
+	wr := csv.NewWriter(out)
+	wr.Comma = '\t'
+	if err := wr.Write(tenantTSVFields); err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		err := wr.Write([]string{
+			t.name,
+			t.owner,
+			strconv.FormatInt(t.bytes, 10),
+			strconv.FormatInt(t.files, 10),
+			strconv.FormatInt(t.prefixes, 10),
+			strconv.FormatInt(t.errors, 10),
+			strconv.FormatInt(t.quota, 10),
+			strconv.FormatBool(t.overQuota()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	wr.Flush()
+	return wr.Error()
+}
+
+func printTenants(out io.Writer, root string, tenants []tenantUsage) {
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "Usage by tenant for %v\n", root)
+	ifmt.Fprintf(out, "     disk usage :          quota :  used : # files : owner : tenant\n")
+	for _, t := range tenants {
+		quota, used, over := "-", "-", ""
+		if t.quota > 0 {
+			quota = fsize(t.quota)
+			used = fmt.Sprintf("%.0f%%", t.used()*100)
+		}
+		if t.overQuota() {
+			over = " (over quota)"
+		}
+		ifmt.Fprintf(out, "% 15v : % 14v : % 5v : % 7v : %v : %v%v\n", fsize(t.bytes), quota, used, t.files, t.owner, t.name, over)
+	}
+}
+
+// tenantSummary reports the usage of each immediate child of root as a
+// separate tenant, flagging those that exceed their quota. Quotas are
+// taken from the tenants section of the config file, with the default
+// quota for all tenants being overridden by --tenant-quota.
+func tenantSummary(ctx context.Context, flagValues *summaryFlags, root string) error {
+	if err := flags.OneOf(flagValues.TenantSort).Validate("bytes", "files", "quota", "name"); err != nil {
+		return err
+	}
+	if flagValues.TenantQuota < 0 {
+		return fmt.Errorf("--tenant-quota must not be negative: %v", flagValues.TenantQuota)
+	}
+	cfg, _ := globalConfig.TenantsFor(root)
+	if flagValues.TenantQuota > 0 {
+		cfg.Quota = flagValues.TenantQuota
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	usage, err := scanTenants(ctx, db, root, globalConfig.LayoutFor(root).Separator)
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	tenants := make([]tenantUsage, 0, len(usage))
+	over := 0
+	for name, t := range usage {
+		t.quota = cfg.QuotaFor(name)
+		if t.overQuota() {
+			over++
+		}
+		tenants = append(tenants, *t)
+	}
+	sortTenants(tenants, flagValues.TenantSort)
+	printTenants(os.Stdout, root, tenants)
+	if tsvFile := flagValues.TSVOut; len(tsvFile) > 0 {
+		tfile, err := createOutput(tsvFile)
+		if err != nil {
+			return err
+		}
+		if err := writeTenantsTSV(tfile, tenants); err != nil {
+			tfile.Close()
+			return err
+		}
+		if err := tfile.Close(); err != nil {
+			return err
+		}
+	}
+	if over > 0 {
+		return withExitCode(exitThreshold, fmt.Errorf("%v of %v tenants are over quota", over, len(tenants)))
+	}
+	return nil
+}
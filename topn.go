@@ -0,0 +1,135 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+// The orders, specified via --top-tie-break, in which prefixes with equal
+// values are listed in top-N listings. Prefixes that are still tied are
+// always ordered by path so that listings are deterministic.
+const (
+	tieBreakPath    = "path"    // Lexicographically by path.
+	tieBreakFiles   = "files"   // Most files first.
+	tieBreakModTime = "modtime" // Most recently modified first.
+)
+
+// rankedMetric is a candidate for inclusion in a top-N listing.
+type rankedMetric struct {
+	filewalk.Metric
+	files   int64
+	modTime time.Time
+}
+
+// rankedBefore returns true if a is to be listed before b.
+func rankedBefore(order string, a, b rankedMetric) bool {
+	if a.Value != b.Value {
+		return a.Value > b.Value
+	}
+	switch order {
+	case tieBreakFiles:
+		if a.files != b.files {
+			return a.files > b.files
+		}
+	case tieBreakModTime:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.After(b.modTime)
+		}
+	}
+	return a.Prefix < b.Prefix
+}
+
+func sortRanked(order string, candidates []rankedMetric) {
+	sort.Slice(candidates, func(i, j int) bool {
+		return rankedBefore(order, candidates[i], candidates[j])
+	})
+}
+
+// topNRanker collects the candidates for a top-N listing.
+type topNRanker struct {
+	order      string
+	candidates []rankedMetric
+	total      int64
+}
+
+func newTopNRanker(order string) *topNRanker {
+	return &topNRanker{order: order}
+}
+
+func (r *topNRanker) add(prefix string, value int64, pi *filewalk.PrefixInfo) {
+	r.total += value
+	r.candidates = append(r.candidates, rankedMetric{
+		Metric:  filewalk.Metric{Prefix: prefix, Value: value},
+		files:   int64(len(pi.Files)),
+		modTime: pi.ModTime,
+	})
+}
+
+// Sum returns the sum of the values of all of the candidates.
+func (r *topNRanker) Sum() int64 {
+	return r.total
+}
+
+// TopN returns the top n candidates.
+func (r *topNRanker) TopN(n int) []filewalk.Metric {
+	sortRanked(r.order, r.candidates)
+	if n > len(r.candidates) {
+		n = len(r.candidates)
+	}
+	top := make([]filewalk.Metric, n)
+	for i := range top {
+		top[i] = r.candidates[i].Metric
+	}
+	return top
+}
+
+// rankMetrics orders the top-N metrics returned by a database according to
+// order, reading the prefixes' files and modification times as required.
+func rankMetrics(ctx context.Context, db filewalk.Database, order string, metrics []filewalk.Metric) []filewalk.Metric {
+	candidates := make([]rankedMetric, len(metrics))
+	for i, m := range metrics {
+		candidates[i].Metric = m
+		if order == tieBreakPath {
+			continue
+		}
+		var pi filewalk.PrefixInfo
+		if ok, err := db.Get(ctx, m.Prefix, &pi); err == nil && ok {
+			candidates[i].files, candidates[i].modTime = int64(len(pi.Files)), pi.ModTime
+		}
+	}
+	sortRanked(order, candidates)
+	for i := range candidates {
+		metrics[i] = candidates[i].Metric
+	}
+	return metrics
+}
+
+// tiedAtCutoff returns true if metrics, ordered by value, contains more
+// than n entries and the n'th and n+1'th have the same value, in which case
+// the prefixes to be included in the top n cannot be determined from
+// metrics alone.
+func tiedAtCutoff(metrics []filewalk.Metric, n int) bool {
+	return n > 0 && len(metrics) > n && metrics[n-1].Value == metrics[n].Value
+}
+
+// scanForTies returns true if exact is set and any of the listings is tied
+// at the cutoff, in which case the database must be scanned to determine
+// the top n prefixes.
+func scanForTies(exact bool, n int, listings ...[]filewalk.Metric) bool {
+	if !exact {
+		return false
+	}
+	for _, metrics := range listings {
+		if tiedAtCutoff(metrics, n) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+func TestTopNTieBreak(t *testing.T) {
+	now := time.Now()
+	prefixes := make([]string, 100)
+	infos := map[string]*filewalk.PrefixInfo{}
+	for i := range prefixes {
+		p := fmt.Sprintf("/a/%03d", i)
+		prefixes[i] = p
+		// The number of files and modification times vary so that each
+		// order produces a different listing.
+		infos[p] = &filewalk.PrefixInfo{
+			Files:   make([]filewalk.Info, i%3),
+			ModTime: now.Add(time.Duration(i) * time.Second),
+		}
+	}
+	ranked := func(order string, seed int64) []filewalk.Metric {
+		shuffled := append([]string{}, prefixes...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		r := newTopNRanker(order)
+		r.add("/a/big", 2, &filewalk.PrefixInfo{})
+		for _, p := range shuffled {
+			r.add(p, 1, infos[p])
+		}
+		if got, want := r.Sum(), int64(102); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return r.TopN(5)
+	}
+	metrics := func(prefixes ...string) []filewalk.Metric {
+		m := []filewalk.Metric{{Prefix: "/a/big", Value: 2}}
+		for _, p := range prefixes {
+			m = append(m, filewalk.Metric{Prefix: p, Value: 1})
+		}
+		return m
+	}
+	for _, tc := range []struct {
+		order string
+		want  []filewalk.Metric
+	}{
+		{tieBreakPath, metrics("/a/000", "/a/001", "/a/002", "/a/003")},
+		{tieBreakFiles, metrics("/a/002", "/a/005", "/a/008", "/a/011")},
+		{tieBreakModTime, metrics("/a/099", "/a/098", "/a/097", "/a/096")},
+	} {
+		for seed := int64(0); seed < 10; seed++ {
+			if got := ranked(tc.order, seed); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%v: seed %v: got %v, want %v", tc.order, seed, got, tc.want)
+			}
+		}
+	}
+
+	if !tiedAtCutoff(metrics("/a/000", "/a/001"), 2) {
+		t.Errorf("expected a tie at the cutoff")
+	}
+	if tiedAtCutoff(metrics("/a/000", "/a/001"), 1) || tiedAtCutoff(metrics("/a/000"), 2) {
+		t.Errorf("unexpected tie at the cutoff")
+	}
+}
+
+func TestTopNTiesAtCutoff(t *testing.T) {
+	// The database returns one more than n prefixes, in an arbitrary order
+	// for those that are tied.
+	returned := []filewalk.Metric{
+		{Prefix: "/a/big", Value: 2},
+		{Prefix: "/a/003", Value: 1},
+		{Prefix: "/a/001", Value: 1},
+		{Prefix: "/a/002", Value: 1},
+	}
+	n := 3
+	ranked := rankMetrics(context.Background(), nil, tieBreakPath, append([]filewalk.Metric{}, returned...))
+	if got, want := firstNMetrics(ranked, n), returned[:1]; len(got) != n || got[0] != want[0] {
+		t.Fatalf("got %v, want %v first", got, want)
+	}
+	if got, want := firstNMetrics(ranked, n)[1:], []filewalk.Metric{{Prefix: "/a/001", Value: 1}, {Prefix: "/a/002", Value: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	untied := []filewalk.Metric{{Prefix: "/a/x", Value: 3}, {Prefix: "/a/y", Value: 2}}
+	for _, tc := range []struct {
+		exact    bool
+		listings [][]filewalk.Metric
+		scan     bool
+	}{
+		{false, [][]filewalk.Metric{returned}, false},
+		{true, [][]filewalk.Metric{returned}, true},
+		{true, [][]filewalk.Metric{untied, returned}, true},
+		{true, [][]filewalk.Metric{untied}, false},
+		{true, nil, false},
+	} {
+		if got, want := scanForTies(tc.exact, n, tc.listings...), tc.scan; got != want {
+			t.Errorf("%v: %v: got %v, want %v", tc.exact, tc.listings, got, want)
+		}
+	}
+}
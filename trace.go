@@ -0,0 +1,151 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+)
+
+// traceEvent is a single record in the trace written by analyze --trace.
+// Durations are in nanoseconds.
+type traceEvent struct {
+	Time     time.Time     `json:"time"`
+	Event    string        `json:"event"` // One of enter, stat, list or exit.
+	Prefix   string        `json:"prefix"`
+	Decision string        `json:"decision,omitempty"` // Decision is recorded for enter events.
+	Duration time.Duration `json:"duration,omitempty"`
+	Stats    int           `json:"stats,omitempty"` // Stats is the number of entries stat'ed by a listing.
+	Batches  int           `json:"batches,omitempty"`
+	Files    int           `json:"files,omitempty"`
+	Children int           `json:"children,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// tracer writes trace events, as JSON Lines, and may be safely used by
+// multiple goroutines. A nil tracer discards all events.
+type tracer struct {
+	mu  sync.Mutex
+	f   *os.File
+	wr  *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+func newTracer(filename string) (*tracer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	wr := bufio.NewWriter(f)
+	return &tracer{f: f, wr: wr, enc: json.NewEncoder(wr)}, nil
+}
+
+func (t *tracer) record(ev traceEvent) {
+	if t == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(ev); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *tracer) enter(prefix, decision string, err error) {
+	if t == nil {
+		return
+	}
+	ev := traceEvent{Event: "enter", Prefix: prefix, Decision: decision}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	t.record(ev)
+}
+
+func (t *tracer) exit(prefix string, start time.Time, pi *filewalk.PrefixInfo) {
+	if t == nil {
+		return
+	}
+	t.record(traceEvent{
+		Event:    "exit",
+		Prefix:   prefix,
+		Duration: time.Since(start),
+		Files:    len(pi.Files),
+		Children: len(pi.Children),
+		Bytes:    pi.DiskUsage,
+		Err:      pi.Err,
+	})
+}
+
+func (t *tracer) close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	errs := errors.M{}
+	errs.Append(t.err)
+	errs.Append(t.wr.Flush())
+	errs.Append(t.f.Close())
+	return errs.Err()
+}
+
+// tracedFilesystem records a trace event for every Stat and List operation
+// performed by the walker.
+type tracedFilesystem struct {
+	filewalk.Filesystem
+	tracer *tracer
+}
+
+func (fs *tracedFilesystem) Stat(ctx context.Context, path string) (filewalk.Info, error) {
+	start := time.Now()
+	info, err := fs.Filesystem.Stat(ctx, path)
+	ev := traceEvent{Time: start, Event: "stat", Prefix: path, Duration: time.Since(start)}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	fs.tracer.record(ev)
+	return info, err
+}
+
+// List forwards the results of the underlying List so that they may be
+// counted; the duration recorded includes any time spent waiting for the
+// results to be consumed.
+func (fs *tracedFilesystem) List(ctx context.Context, path string, ch chan<- filewalk.Contents) {
+	start := time.Now()
+	ev := traceEvent{Time: start, Event: "list", Prefix: path}
+	fwd := make(chan filewalk.Contents, 1)
+	done := make(chan struct{})
+	go func() {
+		for contents := range fwd {
+			ev.Batches++
+			ev.Files += len(contents.Files)
+			ev.Children += len(contents.Children)
+			if contents.Err != nil {
+				ev.Err = contents.Err.Error()
+			}
+			ch <- contents
+		}
+		close(done)
+	}()
+	fs.Filesystem.List(ctx, path, fwd)
+	close(fwd)
+	<-done
+	ev.Stats = ev.Files + ev.Children
+	ev.Duration = time.Since(start)
+	fs.tracer.record(ev)
+}
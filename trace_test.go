@@ -0,0 +1,125 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloudeng.io/file/filewalk"
+)
+
+func readTrace(t *testing.T, filename string) []traceEvent {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []traceEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ev traceEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("%q: %v", sc.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	var nilTracer *tracer
+	nilTracer.enter("/a", "scan", nil)
+	nilTracer.exit("/a", time.Now(), &filewalk.PrefixInfo{})
+	if err := nilTracer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "idu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tree := filepath.Join(tmpDir, "tree")
+	for _, name := range []string{"a", "b", "d/c"} {
+		filename := filepath.Join(tree, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	traceFile := filepath.Join(tmpDir, "trace.json")
+	tr, err := newTracer(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &tracedFilesystem{Filesystem: filewalk.LocalFilesystem(100), tracer: tr}
+	tr.enter(tree, "scan", nil)
+	tr.enter(filepath.Join(tree, "x"), "skip", fmt.Errorf("oops"))
+	if _, err := fs.Stat(ctx, filepath.Join(tree, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(ctx, filepath.Join(tree, "missing")); err == nil {
+		t.Fatal("expected an error")
+	}
+	ch := make(chan filewalk.Contents, 10)
+	fs.List(ctx, tree, ch)
+	close(ch)
+	var listed int
+	for contents := range ch {
+		listed += len(contents.Files) + len(contents.Children)
+	}
+	if got, want := listed, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	tr.exit(tree, time.Now(), &filewalk.PrefixInfo{Files: make([]filewalk.Info, 2), Children: make([]filewalk.Info, 1), DiskUsage: 2})
+	if err := tr.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := readTrace(t, traceFile)
+	if got, want := len(events), 6; got != want {
+		t.Fatalf("got %v, want %v: %+v", got, want, events)
+	}
+	for i, tc := range []struct {
+		event, prefix, decision string
+		files, children, stats  int
+		bytes                   int64
+		err                     bool
+	}{
+		{"enter", tree, "scan", 0, 0, 0, 0, false},
+		{"enter", filepath.Join(tree, "x"), "skip", 0, 0, 0, 0, true},
+		{"stat", filepath.Join(tree, "a"), "", 0, 0, 0, 0, false},
+		{"stat", filepath.Join(tree, "missing"), "", 0, 0, 0, 0, true},
+		{"list", tree, "", 2, 1, 3, 0, false},
+		{"exit", tree, "", 2, 1, 0, 2, false},
+	} {
+		ev := events[i]
+		if ev.Event != tc.event || ev.Prefix != tc.prefix || ev.Decision != tc.decision ||
+			ev.Files != tc.files || ev.Children != tc.children || ev.Stats != tc.stats || ev.Bytes != tc.bytes ||
+			(len(ev.Err) > 0) != tc.err {
+			t.Errorf("%v: unexpected event: %+v", i, ev)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("%v: missing time: %+v", i, ev)
+		}
+	}
+	if ev := events[4]; ev.Batches == 0 || ev.Duration <= 0 {
+		t.Errorf("unexpected batches or duration: %+v", ev)
+	}
+}
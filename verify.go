@@ -0,0 +1,262 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type verifyTreeFlags struct {
+	ScanSize int  `subcmd:"scan-size,10000,control the number of items to fetch from the filesystem in a single operation"`
+	Verbose  bool `subcmd:"checksums,false,display the stored and current checksums for changed prefixes"`
+}
+
+// prefixChecksum returns a checksum over the names, sizes, modification
+// times and modes of the supplied files and children.
+func prefixChecksum(files, children []filewalk.Info) []byte {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for _, infos := range [][]filewalk.Info{files, children} {
+		sorted := make([]filewalk.Info, len(infos))
+		copy(sorted, infos)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Name < sorted[j].Name
+		})
+		for _, info := range sorted {
+			h.Write([]byte(info.Name))
+			binary.LittleEndian.PutUint64(buf, uint64(info.Size))
+			h.Write(buf)
+			binary.LittleEndian.PutUint64(buf, uint64(info.ModTime.UnixNano()))
+			h.Write(buf)
+			binary.LittleEndian.PutUint64(buf, uint64(info.Mode))
+			h.Write(buf)
+		}
+		// Separate files from children.
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// verifyFilter applies the options that the database was created with, as
+// recorded in the run log, to the current contents of each prefix so that
+// they may be compared with those stored in the database.
+type verifyFilter struct {
+	opts    runlog.ScanOptions
+	onlyExt extensionFilter
+	ignores *exclusions.Ignores
+	sep     string
+}
+
+// analyzeOptions returns the options used by the most recent analyze run
+// of root, or of one of its ancestors, that listed prefixes and the prefix
+// it analyzed.
+func analyzeOptions(root, sep string) (runlog.ScanOptions, string) {
+	cfg, ok := globalConfig.DatabaseFor(root)
+	if !ok || len(cfg.Location) == 0 {
+		return runlog.ScanOptions{}, root
+	}
+	entries, err := runlog.Read(cfg.Location)
+	if err != nil {
+		return runlog.ScanOptions{}, root
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Options == nil {
+			continue
+		}
+		if e.Prefix == root || strings.HasPrefix(root, strings.TrimSuffix(e.Prefix, sep)+sep) {
+			return *e.Options, e.Prefix
+		}
+	}
+	return runlog.ScanOptions{}, root
+}
+
+func newVerifyFilter(ctx context.Context, fs filewalk.Filesystem, root, sep string) (*verifyFilter, error) {
+	opts, analyzed := analyzeOptions(root, sep)
+	ignores, err := analyzeIgnores(ctx, fs, root, sep, opts, analyzed)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyFilter{
+		opts:    opts,
+		onlyExt: newExtensionFilter(opts.OnlyExt),
+		ignores: ignores,
+		sep:     sep,
+	}, nil
+}
+
+// analyzeIgnores returns the ignore patterns that applied to root when
+// analyzed was analyzed with opts: those in the --exclude-from file, if
+// any, and in the ignore files between analyzed and root. Those in root
+// and below must be read as each prefix is visited.
+func analyzeIgnores(ctx context.Context, fs filewalk.Filesystem, root, sep string, opts runlog.ScanOptions, analyzed string) (*exclusions.Ignores, error) {
+	ignores := exclusions.NewIgnores(sep)
+	if len(opts.ExcludeFrom) > 0 {
+		if err := addExcludeFrom(ignores, analyzed, opts.ExcludeFrom); err != nil {
+			return nil, err
+		}
+	}
+	for dir := root; dir != analyzed && strings.HasPrefix(dir, analyzed); {
+		parent := dir[:strings.LastIndex(dir, sep)]
+		if len(parent) == 0 {
+			parent = sep
+		}
+		readIgnoreFile(ctx, fs, ignores, parent)
+		dir = parent
+	}
+	return ignores, nil
+}
+
+// apply returns the files and children of prefix as they would have been
+// recorded by analyze.
+func (vf *verifyFilter) apply(ctx context.Context, fs filewalk.Filesystem, prefix string, files, children []filewalk.Info) ([]filewalk.Info, []filewalk.Info) {
+	readIgnoreFile(ctx, fs, vf.ignores, prefix)
+	filtered := make([]filewalk.Info, 0, len(files))
+	for _, file := range files {
+		if !vf.onlyExt.include(file.Name) {
+			continue
+		}
+		if vf.ignores.Exclude(strings.TrimSuffix(prefix, vf.sep)+vf.sep+file.Name, false) {
+			continue
+		}
+		filtered = append(filtered, file)
+	}
+	return vf.comparable(filtered, children)
+}
+
+// comparable returns the files and children with the fields that
+// cannot be recomputed from the current filesystem removed: symlinks may
+// have been recorded with the size of their targets and children are not
+// recorded by analyze --files-only.
+func (vf *verifyFilter) comparable(files, children []filewalk.Info) ([]filewalk.Info, []filewalk.Info) {
+	if vf.opts.FilesOnly {
+		children = nil
+	}
+	if !vf.opts.Symlinks {
+		return files, children
+	}
+	cpy := make([]filewalk.Info, len(files))
+	for i, file := range files {
+		if file.Mode&filewalk.ModeLink != 0 {
+			file.Size = 0
+		}
+		cpy[i] = file
+	}
+	return cpy, children
+}
+
+// listPrefix returns the current contents of prefix.
+func listPrefix(ctx context.Context, fs filewalk.Filesystem, prefix string) (files, children []filewalk.Info, err error) {
+	ch := make(chan filewalk.Contents, 10)
+	go func() {
+		fs.List(ctx, prefix, ch)
+		close(ch)
+	}()
+	for contents := range ch {
+		if contents.Err != nil && err == nil {
+			err = contents.Err
+		}
+		files = append(files, contents.Files...)
+		children = append(children, contents.Children...)
+	}
+	return
+}
+
+func verifyTree(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*verifyTreeFlags)
+	root := args[0]
+	fs := filewalk.LocalFilesystem(flagValues.ScanSize)
+	vf, err := newVerifyFilter(ctx, fs, root, globalConfig.LayoutFor(root).Separator)
+	if err != nil {
+		return err
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	var nUnchanged, nChanged, nRemoved, nAdded, nErrors int
+	stored := map[string]bool{}
+	var candidates []string
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(1000))
+	within := withinPrefix(root, globalConfig.LayoutFor(root).Separator)
+	for sc.Scan(ctx) {
+		prefix, pi := sc.PrefixInfo()
+		if ok, done := within(prefix); !ok {
+			if done {
+				break
+			}
+			continue
+		}
+		stored[prefix] = true
+		files, children, err := listPrefix(ctx, fs, prefix)
+		if err != nil {
+			if fs.IsNotExist(err) {
+				ifmt.Printf("removed: %v\n", prefix)
+				nRemoved++
+				continue
+			}
+			ifmt.Printf("error: %v: %v\n", prefix, err)
+			nErrors++
+			continue
+		}
+		files, children = vf.apply(ctx, fs, prefix, files, children)
+		previous, current := prefixChecksum(vf.comparable(pi.Files, pi.Children)), prefixChecksum(files, children)
+		if bytes.Equal(previous, current) {
+			nUnchanged++
+		} else {
+			ifmt.Printf("changed: %v\n", prefix)
+			if flagValues.Verbose {
+				ifmt.Printf("  stored: %x\n  current: %x\n", previous, current)
+			}
+			nChanged++
+		}
+		if vf.opts.FilesOnly {
+			// Prefixes without files are not recorded and hence cannot
+			// be distinguished from added ones.
+			continue
+		}
+		previousChildren := map[string]bool{}
+		for _, child := range pi.Children {
+			previousChildren[child.Name] = true
+		}
+		for _, child := range children {
+			if !previousChildren[child.Name] {
+				candidates = append(candidates, fs.Join(prefix, child.Name))
+			}
+		}
+	}
+	for _, prefix := range candidates {
+		if !stored[prefix] {
+			ifmt.Printf("added: %v\n", prefix)
+			nAdded++
+		}
+	}
+	ifmt.Printf("unchanged: %v, changed: %v, added: %v, removed: %v, errors: %v\n",
+		nUnchanged, nChanged, nAdded, nRemoved, nErrors)
+	errs := errors.M{}
+	errs.Append(sc.Err())
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	if nChanged+nAdded+nRemoved > 0 {
+		return withExitCode(exitStale, fmt.Errorf("%v prefixes have changed since they were last analyzed", nChanged+nAdded+nRemoved))
+	}
+	return nil
+}
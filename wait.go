@@ -0,0 +1,107 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/runlog"
+	"cloudeng.io/cmdutil"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type waitFlags struct {
+	Interval time.Duration `subcmd:"interval,10s,the interval at which to poll the run log for a newly completed analyze run"`
+	Timeout  time.Duration `subcmd:"timeout,0s,'the maximum time to wait, zero waits indefinitely'"`
+	TopN     int           `subcmd:"top,20,show the top prefixes by file count and disk usage once the run has completed"`
+	OtherFlags
+}
+
+// completedRun returns the first successful analyze run in entries, that
+// covers prefix, which completed after since.
+func completedRun(entries []runlog.Entry, prefix, sep string, since time.Time) (runlog.Entry, bool) {
+	for _, e := range entries {
+		if len(e.Err) > 0 || !e.Stop.After(since) {
+			continue
+		}
+		if e.Prefix == prefix || strings.HasPrefix(prefix, strings.TrimSuffix(e.Prefix, sep)+sep) {
+			return e, true
+		}
+	}
+	return runlog.Entry{}, false
+}
+
+// waitForRun blocks until the next successful analyze run that covers the
+// specified prefix completes, as recorded in the run log, and then displays
+// a summary of the database.
+func waitForRun(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*waitFlags)
+	prefix := args[0]
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", prefix)
+	}
+	if len(cfg.Location) == 0 {
+		return fmt.Errorf("database location is unknown: %v", cfg.Description)
+	}
+	if flagValues.Interval <= 0 {
+		return fmt.Errorf("--interval must be greater than zero")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmdutil.HandleSignals(cancel, os.Interrupt)
+	if flagValues.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, flagValues.Timeout)
+		defer cancel()
+	}
+	sep := globalConfig.LayoutFor(prefix).Separator
+	since := time.Now()
+	ticker := time.NewTicker(flagValues.Interval)
+	defer ticker.Stop()
+	var run runlog.Entry
+	for {
+		entries, err := runlog.Read(cfg.Location)
+		if err != nil {
+			return err
+		}
+		if run, ok = completedRun(entries, prefix, sep, since); ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %v waiting for an analyze run of %v to complete", flagValues.Timeout, prefix)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Printf("analyze of %v completed at %v, taking %v: %v prefixes, %v files, %v errors\n",
+		run.Prefix, displayTime(run.Stop).Format(time.RFC3339), run.Stop.Sub(run.Start).Truncate(time.Second),
+		run.Prefixes, run.Files, run.Errors)
+	db, err := globalDatabaseManager.DatabaseFor(ctx, prefix, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	defer globalDatabaseManager.CloseAll(ctx)
+	nFiles, nChildren, nBytes, nErrors,
+		topFiles, topChildren, topBytes, err :=
+		cachedStats(ctx, db, prefix, "", flagValues.TopN, false)
+	if err != nil {
+		return err
+	}
+	printSummaryStats(ctx, os.Stdout, nFiles, nChildren, nBytes, nErrors, flagValues.TopN, flagValues.Other, nil,
+		firstNMetrics(topFiles, flagValues.TopN),
+		firstNMetrics(topChildren, flagValues.TopN),
+		firstNMetrics(topBytes, flagValues.TopN))
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/warnings"
+	"cloudeng.io/cmdutil/flags"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+type warningsFlags struct {
+	Categories flags.Commas `subcmd:"category,,'comma separated list of the categories of warning to display (deep-nesting, large-directory, permission or changed-during-scan), all categories are displayed by default'"`
+	Summary    bool         `subcmd:"summary,false,display only the number of warnings in each category"`
+}
+
+var warningCategories = []string{warnings.DeepNesting, warnings.LargeDirectory, warnings.Permission, warnings.ChangedDuringScan}
+
+// listWarnings displays the warnings recorded by the most recent analyze
+// run for the database for a prefix.
+func listWarnings(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*warningsFlags)
+	var categories map[string]bool
+	for _, c := range flagValues.Categories.Values {
+		if err := flags.OneOf(c).Validate(warningCategories[0], warningCategories[1:]...); err != nil {
+			return err
+		}
+		if categories == nil {
+			categories = map[string]bool{}
+		}
+		categories[c] = true
+	}
+	cfg, ok := globalConfig.DatabaseFor(args[0])
+	if !ok {
+		return fmt.Errorf("no database is configured for %v", args[0])
+	}
+	if len(cfg.Location) == 0 {
+		return fmt.Errorf("database location is unknown: %v", cfg.Description)
+	}
+	found, err := warnings.Read(cfg.Location)
+	if err != nil {
+		return err
+	}
+	ifmt := message.NewPrinter(language.English)
+	counts := map[string]int{}
+	for _, w := range found {
+		if categories != nil && !categories[w.Category] {
+			continue
+		}
+		counts[w.Category]++
+		if !flagValues.Summary {
+			ifmt.Printf("%v %v: %v: %v\n", displayTime(w.Time).Format(time.RFC3339), w.Category, w.Prefix, w.Message)
+		}
+	}
+	if flagValues.Summary {
+		names := make([]string, 0, len(counts))
+		for c := range counts {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+		for _, c := range names {
+			ifmt.Printf("% 12v : %v\n", counts[c], c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+)
+
+type watchFlags struct {
+	AnalyzeFlags
+	Debounce time.Duration `subcmd:"debounce,5s,'the period of inactivity to wait for, once a change has been noticed, before re-analyzing so that bursts of changes are handled by a single scan'"`
+	MaxWait  time.Duration `subcmd:"max-wait,1m,'the maximum time to wait, once a change has been noticed, before re-analyzing even if changes continue to be reported, zero waits indefinitely'"`
+}
+
+// dirChange is a change to the contents of a directory as reported by a
+// dirWatcher. Overflow is set when changes have been lost, in which case
+// dir is empty.
+type dirChange struct {
+	dir      string
+	overflow bool
+}
+
+// dirWatcher reports changes to the contents of the directories in a tree,
+// including those created after it is started. The channel returned by
+// Changes is closed if the watcher fails, Close returns the reason and
+// may be called more than once.
+type dirWatcher interface {
+	Changes() <-chan dirChange
+	Close() error
+}
+
+// watch analyzes prefix and then re-analyzes it, incrementally, whenever
+// the filesystem reports that it has changed. Only the prefixes that
+// have changed are re-listed, unless changes have been lost, in which
+// case the entire prefix is re-listed.
+func watch(ctx context.Context, values interface{}, args []string) error {
+	flagValues := values.(*watchFlags)
+	if flagValues.StatOnly || flagValues.FilesOnly || len(flagValues.OnlyExt.Values) > 0 || len(flagValues.Trace) > 0 {
+		return fmt.Errorf("watch cannot be used with --stat-only, --files-only, --only-ext or --trace")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args, err := prefixArgs(flagValues.PrefixFileFlags, args)
+	if err != nil {
+		return err
+	}
+	prefix := args[0]
+	notifyInterrupts(cancel)
+	handlePauseSignals(ctx)
+	// Changes to idu's own directories, as well as any excluded ones, are
+	// not watched so that updating the database does not trigger another
+	// scan.
+	ex := exclusions.New(append(globalConfig.InternalExclusions(), globalConfig.Exclusions...))
+	watcher, err := newDirWatcher(prefix, ex)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := analyzePrefix(ctx, &flagValues.AnalyzeFlags, prefix, nil); err != nil {
+		return err
+	}
+	return watchChanges(ctx, watcher, flagValues.Debounce, flagValues.MaxWait, func(changed map[string]bool, overflow bool) {
+		rescan := flagValues.AnalyzeFlags
+		if overflow {
+			fmt.Fprintf(os.Stderr, "watch: changes were lost, re-analyzing all of %v\n", prefix)
+			rescan.Incremental = false
+		} else {
+			fmt.Fprintf(os.Stderr, "watch: %v prefixes changed, re-analyzing %v\n", len(changed), prefix)
+		}
+		if err := analyzePrefix(ctx, &rescan, prefix, changed); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "watch: %v\n", err)
+		}
+	})
+}
+
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// watchChanges collects the changes reported by watcher and calls rescan
+// with them once no further changes have been reported for debounce, or
+// once maxWait has elapsed since the first of them was reported, so that a
+// continuous stream of changes cannot postpone re-analysis indefinitely.
+// It returns when ctx is canceled or watcher fails.
+func watchChanges(ctx context.Context, watcher dirWatcher, debounce, maxWait time.Duration, rescan func(changed map[string]bool, overflow bool)) error {
+	changed := map[string]bool{}
+	overflow, pending := false, false
+	quiet := time.NewTimer(debounce)
+	stopTimer(quiet)
+	deadline := time.NewTimer(maxWait)
+	stopTimer(deadline)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ch, ok := <-watcher.Changes():
+			if !ok {
+				return fmt.Errorf("watch: no longer receiving changes: %v", watcher.Close())
+			}
+			if ch.overflow {
+				overflow = true
+			} else {
+				changed[ch.dir] = true
+			}
+			stopTimer(quiet)
+			quiet.Reset(debounce)
+			if !pending && maxWait > 0 {
+				deadline.Reset(maxWait)
+			}
+			pending = true
+			continue
+		case <-quiet.C:
+		case <-deadline.C:
+		}
+		stopTimer(quiet)
+		stopTimer(deadline)
+		rescan(changed, overflow)
+		changed = map[string]bool{}
+		overflow, pending = false, false
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyWatcher implements dirWatcher using inotify, with one watch per
+// directory. inotify is used directly, rather than via a portable package
+// such as fsnotify, since no such package is among idu's dependencies and
+// watch only needs to know which directories have changed, which inotify
+// reports without any translation.
+type inotifyWatcher struct {
+	ex      *exclusions.T
+	fd      int
+	f       *os.File
+	changes chan dirChange
+	done    chan struct{}
+
+	mu     sync.Mutex
+	dirs   map[int32]string
+	err    error
+	closed bool
+}
+
+func newDirWatcher(root string, ex *exclusions.T) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		ex: ex,
+		fd: fd,
+		// A non-blocking descriptor is managed by the runtime poller so
+		// that Close will interrupt a pending Read.
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan dirChange, 1000),
+		done:    make(chan struct{}),
+		dirs:    map[int32]string{},
+	}
+	if err := w.addTree(root); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addTree adds a watch for dir and every directory beneath it that is
+// not excluded.
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if w.ex.Exclude(path) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if err == syscall.ENOENT || err == syscall.EACCES {
+				return nil
+			}
+			return os.NewSyscallError("inotify_add_watch: "+path, err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) dirFor(wd int32) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir, ok := w.dirs[wd]
+	return dir, ok
+}
+
+func (w *inotifyWatcher) send(ch dirChange) bool {
+	select {
+	case w.changes <- ch:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.changes)
+	buf := make([]byte, syscall.SizeofInotifyEvent*4096)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			w.mu.Lock()
+			if !w.closed {
+				w.err = err
+			}
+			w.mu.Unlock()
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !w.send(dirChange{overflow: true}) {
+					return
+				}
+				continue
+			}
+			dir, ok := w.dirFor(ev.Wd)
+			if !ok {
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				w.mu.Lock()
+				delete(w.dirs, ev.Wd)
+				w.mu.Unlock()
+				continue
+			}
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// New directories must be watched and scanned.
+				child := filepath.Join(dir, name)
+				if err := w.addTree(child); err != nil {
+					debug(context.Background(), 1, "failed to watch: %v: %v\n", child, err)
+				}
+				if !w.send(dirChange{dir: child}) {
+					return
+				}
+			}
+			if !w.send(dirChange{dir: dir}) {
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) Changes() <-chan dirChange {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	close(w.done)
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
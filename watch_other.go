@@ -0,0 +1,17 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"cloudeng.io/cmd/idu/internal/exclusions"
+)
+
+func newDirWatcher(root string, ex *exclusions.T) (dirWatcher, error) {
+	return nil, fmt.Errorf("watch is currently only supported on linux")
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWatcher struct {
+	changes chan dirChange
+}
+
+func (w *fakeWatcher) Changes() <-chan dirChange {
+	return w.changes
+}
+
+func (w *fakeWatcher) Close() error {
+	return fmt.Errorf("closed")
+}
+
+type rescans struct {
+	sync.Mutex
+	changed  []map[string]bool
+	overflow []bool
+}
+
+func (r *rescans) rescan(changed map[string]bool, overflow bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.changed = append(r.changed, changed)
+	r.overflow = append(r.overflow, overflow)
+}
+
+func (r *rescans) get() ([]map[string]bool, []bool) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]map[string]bool{}, r.changed...), append([]bool{}, r.overflow...)
+}
+
+func runWatchChanges(ctx context.Context, debounce, maxWait time.Duration) (*fakeWatcher, *rescans, chan error) {
+	w := &fakeWatcher{changes: make(chan dirChange)}
+	r := &rescans{}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- watchChanges(ctx, w, debounce, maxWait, r.rescan)
+	}()
+	return w, r, errCh
+}
+
+func TestWatchDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, r, errCh := runWatchChanges(ctx, 100*time.Millisecond, 0)
+
+	// A burst of changes results in a single rescan.
+	for _, dir := range []string{"/a", "/b", "/a"} {
+		w.changes <- dirChange{dir: dir}
+	}
+	time.Sleep(500 * time.Millisecond)
+	changed, overflow := r.get()
+	if got, want := changed, []map[string]bool{{"/a": true, "/b": true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := overflow, []bool{false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Lost changes are reported as such.
+	w.changes <- dirChange{overflow: true}
+	time.Sleep(500 * time.Millisecond)
+	changed, overflow = r.get()
+	if got, want := len(changed), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := overflow[1], true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := changed[1]; len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+
+	// A watcher that fails causes an error to be returned.
+	close(w.changes)
+	if err := <-errCh; err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestWatchMaxWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w, r, errCh := runWatchChanges(ctx, 200*time.Millisecond, 300*time.Millisecond)
+
+	// Changes reported more frequently than the debounce period would
+	// postpone the rescan indefinitely without the maximum wait.
+	start := time.Now()
+	for time.Since(start) < time.Second {
+		w.changes <- dirChange{dir: "/a"}
+		time.Sleep(20 * time.Millisecond)
+	}
+	changed, _ := r.get()
+	if got := len(changed); got < 2 {
+		t.Errorf("got %v rescans, want at least 2", got)
+	}
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w, r, _ = runWatchChanges(ctx, 200*time.Millisecond, 0)
+	start = time.Now()
+	for time.Since(start) < time.Second {
+		w.changes <- dirChange{dir: "/a"}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if changed, _ := r.get(); len(changed) != 0 {
+		t.Errorf("got %v rescans, want none", len(changed))
+	}
+}
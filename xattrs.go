@@ -0,0 +1,123 @@
+// Copyright 2020 cloudeng llc. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cloudeng.io/cmd/idu/internal/config"
+	"cloudeng.io/cmd/idu/internal/xattrs"
+	"cloudeng.io/errors"
+	"cloudeng.io/file/filewalk"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// openXAttrs opens the extended attribute usage for the database for
+// prefix if its layout requests that extended attributes be counted. It
+// returns nil if they are not to be counted or are not supported.
+func openXAttrs(out io.Writer, prefix string) (*xattrs.DB, error) {
+	if !globalConfig.LayoutFor(prefix).XAttrs {
+		return nil, nil
+	}
+	cfg, ok := globalConfig.DatabaseFor(prefix)
+	if !ok || len(cfg.Location) == 0 {
+		fmt.Fprintf(out, "warning: extended attributes can only be counted for local databases: %v\n", prefix)
+		return nil, nil
+	}
+	if _, err := xattrs.Size(prefix); err == xattrs.ErrNotSupported {
+		fmt.Fprintf(out, "warning: %v, they will not be counted\n", err)
+		return nil, nil
+	}
+	return xattrs.Open(cfg.Location)
+}
+
+// xattrUsage returns the total size of the extended attributes of files in
+// prefix and records it. Symlinks are skipped since the size of their
+// targets' extended attributes would otherwise be returned.
+func (sc *scanState) xattrUsage(ctx context.Context, layout config.Layout, prefix string, files []filewalk.Info) int64 {
+	if sc.xattrs == nil {
+		return 0
+	}
+	var total int64
+	for _, file := range files {
+		if file.Mode&filewalk.ModeLink != 0 {
+			continue
+		}
+		path := strings.TrimSuffix(prefix, layout.Separator) + layout.Separator + file.Name
+		size, err := xattrs.Size(path)
+		if err != nil {
+			debug(ctx, 1, "failed to read extended attributes: %v: %v\n", path, err)
+			continue
+		}
+		total += size
+	}
+	if err := sc.xattrs.Set(prefix, total); err != nil {
+		debug(ctx, 1, "failed to record extended attribute usage: %v: %v\n", prefix, err)
+	}
+	return total
+}
+
+// xattrSummary reports the total size of the extended attributes of the
+// files beneath root and the prefixes that use the most. Only prefixes
+// that are still stored in the database are included.
+func xattrSummary(ctx context.Context, out io.Writer, root string, topN int) error {
+	cfg, ok := globalConfig.DatabaseFor(root)
+	if !ok || len(cfg.Location) == 0 {
+		return fmt.Errorf("extended attribute usage is only available for local databases: %v", root)
+	}
+	if _, err := os.Stat(cfg.Location); err != nil {
+		return err
+	}
+	xdb, err := xattrs.Open(cfg.Location)
+	if err != nil {
+		return err
+	}
+	usage, err := xdb.Usage(root)
+	errs := errors.M{}
+	errs.Append(err)
+	errs.Append(xdb.Close())
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	db, err := globalDatabaseManager.DatabaseFor(ctx, root, filewalk.ReadOnly())
+	if err != nil {
+		return err
+	}
+	var total int64
+	top := make([]filewalk.Metric, 0, len(usage))
+	sc := db.NewScanner(root, 0, filewalk.ScanLimit(10000))
+	for sc.Scan(ctx) {
+		prefix, _ := sc.PrefixInfo()
+		if size, ok := usage[prefix]; ok {
+			total += size
+			top = append(top, filewalk.Metric{Prefix: prefix, Value: size})
+		}
+	}
+	errs.Append(sc.Err())
+	errs.Append(globalDatabaseManager.CloseAll(ctx))
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Value != top[j].Value {
+			return top[i].Value > top[j].Value
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+	ifmt := message.NewPrinter(language.English)
+	ifmt.Fprintf(out, "% 20v : total extended attribute usage\n", fsize(total))
+	ifmt.Fprintf(out, "% 20v : prefixes with extended attributes\n", len(top))
+	fmt.Fprintf(out, "Top %v prefixes by extended attribute usage\n", topN)
+	for _, m := range firstNMetrics(top, topN) {
+		ifmt.Fprintf(out, "%20v: %v\n", fsize(m.Value), m.Prefix)
+	}
+	return nil
+}